@@ -0,0 +1,398 @@
+package admission
+
+import (
+	"errors"
+	"math"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/clock"
+	loggingclient "code.cloudfoundry.org/diego-logging-client"
+	"code.cloudfoundry.org/lager"
+)
+
+var (
+	ErrDenied      = errors.New("source address is not allowed")
+	ErrRateLimited = errors.New("too many attempts from source address")
+	ErrBanned      = errors.New("source address is temporarily banned")
+)
+
+const (
+	DefaultBanWindow   = 10 * time.Minute
+	DefaultBanDuration = 10 * time.Minute
+
+	connectionsDeniedMetric          = "ssh-connections-denied"
+	connectionsRateLimitedMetric     = "ssh-connections-rate-limited"
+	connectionsBannedMetric          = "ssh-connections-banned"
+	authenticationsRateLimitedMetric = "ssh-authentications-rate-limited"
+	sourceBansMetric                 = "ssh-source-bans"
+
+	pruneInterval = time.Minute
+)
+
+// IsRejected returns whether err is one of the errors that the controller
+// rejects attempts with.
+func IsRejected(err error) bool {
+	return err == ErrDenied || err == ErrRateLimited || err == ErrBanned
+}
+
+// Rate is a token bucket: PerSecond tokens are added every second, up to
+// Burst tokens, and every attempt takes one. A zero PerSecond disables the
+// limit. Burst defaults to PerSecond rounded up.
+type Rate struct {
+	PerSecond float64
+	Burst     int
+}
+
+func (r Rate) enabled() bool {
+	return r.PerSecond > 0
+}
+
+func (r Rate) burst() float64 {
+	if r.Burst > 0 {
+		return float64(r.Burst)
+	}
+	return math.Max(1, math.Ceil(r.PerSecond))
+}
+
+// refillTime is how long an empty bucket takes to fill up again.
+func (r Rate) refillTime() time.Duration {
+	if !r.enabled() {
+		return 0
+	}
+	return time.Duration(r.burst() / r.PerSecond * float64(time.Second))
+}
+
+// Config describes which source addresses may connect and how often.
+type Config struct {
+	// Allow lists the networks that may connect. When it is empty, every
+	// network that is not denied may connect.
+	Allow []*net.IPNet
+
+	// Deny lists the networks that may not connect. It takes precedence over
+	// Allow.
+	Deny []*net.IPNet
+
+	// Connections limits the new connections of each source address.
+	Connections Rate
+
+	// Authentications limits the authentication attempts of each source
+	// address.
+	Authentications Rate
+
+	// BanThreshold is the number of failed authentications within BanWindow
+	// after which a source address is banned for BanDuration. Zero disables
+	// bans.
+	BanThreshold int
+	BanWindow    time.Duration
+	BanDuration  time.Duration
+}
+
+// ParseCIDRs parses networks in CIDR notation. Plain addresses are taken as
+// networks of a single address.
+func ParseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, &net.ParseError{Type: "IP address", Text: cidr}
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func (b *bucket) take(rate Rate, now time.Time) bool {
+	if b.updated.IsZero() {
+		b.tokens = rate.burst()
+	} else {
+		b.tokens = math.Min(rate.burst(), b.tokens+now.Sub(b.updated).Seconds()*rate.PerSecond)
+	}
+	b.updated = now
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+type source struct {
+	connections     bucket
+	authentications bucket
+	failures        []time.Time
+	bannedUntil     time.Time
+	lastSeen        time.Time
+}
+
+// Controller decides whether connections and authentication attempts from a
+// source address are admitted. Run prunes the state of sources that have not
+// been seen for a while.
+type Controller struct {
+	logger       lager.Logger
+	metronClient loggingclient.IngressClient
+	clock        clock.Clock
+	config       Config
+
+	// forgetAfter is how long a source has to be idle before its state no
+	// longer matters.
+	forgetAfter time.Duration
+
+	lock    *sync.Mutex
+	sources map[string]*source
+}
+
+func NewController(logger lager.Logger, metronClient loggingclient.IngressClient, clock clock.Clock, config Config) *Controller {
+	if config.BanWindow <= 0 {
+		config.BanWindow = DefaultBanWindow
+	}
+	if config.BanDuration <= 0 {
+		config.BanDuration = DefaultBanDuration
+	}
+
+	forgetAfter := config.BanWindow
+	if refill := config.Connections.refillTime(); refill > forgetAfter {
+		forgetAfter = refill
+	}
+	if refill := config.Authentications.refillTime(); refill > forgetAfter {
+		forgetAfter = refill
+	}
+
+	return &Controller{
+		logger:       logger.Session("admission"),
+		metronClient: metronClient,
+		clock:        clock,
+		config:       config,
+		forgetAfter:  forgetAfter,
+		lock:         &sync.Mutex{},
+		sources:      map[string]*source{},
+	}
+}
+
+// AdmitConnection returns an error when a new connection from addr has to be
+// rejected.
+func (c *Controller) AdmitConnection(logger lager.Logger, addr net.Addr) error {
+	ip := sourceIP(addr)
+	if ip == nil {
+		return nil
+	}
+
+	var err error
+	var metric string
+
+	if !c.allowed(ip) {
+		err, metric = ErrDenied, connectionsDeniedMetric
+	} else {
+		c.lock.Lock()
+		now := c.clock.Now()
+		src := c.source(ip, now)
+		if now.Before(src.bannedUntil) {
+			err, metric = ErrBanned, connectionsBannedMetric
+		} else if c.config.Connections.enabled() && !src.connections.take(c.config.Connections, now) {
+			err, metric = ErrRateLimited, connectionsRateLimitedMetric
+		}
+		c.lock.Unlock()
+	}
+
+	if err != nil {
+		logger.Info("rejected-connection", lager.Data{"source": ip.String(), "reason": err.Error()})
+		c.incrementCounter(logger, metric)
+	}
+
+	return err
+}
+
+// AdmitAuthentication returns an error when an authentication attempt from
+// addr has to be rejected without checking the credentials.
+func (c *Controller) AdmitAuthentication(logger lager.Logger, addr net.Addr) error {
+	ip := sourceIP(addr)
+	if ip == nil {
+		return nil
+	}
+
+	var err error
+
+	c.lock.Lock()
+	now := c.clock.Now()
+	src := c.source(ip, now)
+	if now.Before(src.bannedUntil) {
+		err = ErrBanned
+	} else if c.config.Authentications.enabled() && !src.authentications.take(c.config.Authentications, now) {
+		err = ErrRateLimited
+	}
+	c.lock.Unlock()
+
+	if err != nil {
+		logger.Info("rejected-authentication", lager.Data{"source": ip.String(), "reason": err.Error()})
+		if err == ErrRateLimited {
+			c.incrementCounter(logger, authenticationsRateLimitedMetric)
+		}
+	}
+
+	return err
+}
+
+// AuthenticationFailed records a failed authentication from addr and bans the
+// source once it has failed too often.
+func (c *Controller) AuthenticationFailed(logger lager.Logger, addr net.Addr) {
+	ip := sourceIP(addr)
+	if ip == nil || c.config.BanThreshold <= 0 {
+		return
+	}
+
+	c.lock.Lock()
+	now := c.clock.Now()
+	src := c.source(ip, now)
+	if now.Before(src.bannedUntil) {
+		c.lock.Unlock()
+		return
+	}
+
+	failures := src.failures[:0]
+	for _, failure := range src.failures {
+		if now.Sub(failure) < c.config.BanWindow {
+			failures = append(failures, failure)
+		}
+	}
+	src.failures = append(failures, now)
+
+	banned := len(src.failures) >= c.config.BanThreshold
+	if banned {
+		src.bannedUntil = now.Add(c.config.BanDuration)
+		src.failures = nil
+	}
+	c.lock.Unlock()
+
+	if banned {
+		logger.Info("banned-source", lager.Data{
+			"source":   ip.String(),
+			"failures": c.config.BanThreshold,
+			"duration": c.config.BanDuration.String(),
+		})
+		c.incrementCounter(logger, sourceBansMetric)
+	}
+}
+
+func (c *Controller) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	ticker := c.clock.NewTicker(pruneInterval)
+	defer ticker.Stop()
+
+	close(ready)
+
+	for {
+		select {
+		case <-ticker.C():
+			pruned := c.prune()
+			if pruned > 0 {
+				c.logger.Debug("pruned-sources", lager.Data{"sources": pruned})
+			}
+		case <-signals:
+			return nil
+		}
+	}
+}
+
+// Sources returns the number of source addresses that the controller keeps
+// state for.
+func (c *Controller) Sources() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return len(c.sources)
+}
+
+func (c *Controller) prune() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	pruned := 0
+	now := c.clock.Now()
+	for key, src := range c.sources {
+		if now.Before(src.bannedUntil) || now.Sub(src.lastSeen) < c.forgetAfter {
+			continue
+		}
+		delete(c.sources, key)
+		pruned++
+	}
+	return pruned
+}
+
+func (c *Controller) allowed(ip net.IP) bool {
+	for _, network := range c.config.Deny {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+
+	if len(c.config.Allow) == 0 {
+		return true
+	}
+
+	for _, network := range c.config.Allow {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// source returns the state of ip. It must be called with the lock held.
+func (c *Controller) source(ip net.IP, now time.Time) *source {
+	key := ip.String()
+
+	src, ok := c.sources[key]
+	if !ok {
+		src = &source{}
+		c.sources[key] = src
+	}
+	src.lastSeen = now
+
+	return src
+}
+
+func (c *Controller) incrementCounter(logger lager.Logger, metric string) {
+	err := c.metronClient.IncrementCounter(metric)
+	if err != nil {
+		logger.Error("failed-to-send-metric", err, lager.Data{"metric": metric})
+	}
+}
+
+func sourceIP(addr net.Addr) net.IP {
+	if addr == nil {
+		return nil
+	}
+
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
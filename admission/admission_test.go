@@ -0,0 +1,244 @@
+package admission_test
+
+import (
+	"net"
+	"os"
+	"time"
+
+	"code.cloudfoundry.org/clock/fakeclock"
+	mfakes "code.cloudfoundry.org/diego-logging-client/testhelpers"
+	"code.cloudfoundry.org/diego-ssh/admission"
+	"code.cloudfoundry.org/lager/lagertest"
+	"github.com/tedsuo/ifrit"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+)
+
+var _ = Describe("Controller", func() {
+	var (
+		logger           *lagertest.TestLogger
+		fakeClock        *fakeclock.FakeClock
+		fakeMetronClient *mfakes.FakeIngressClient
+		config           admission.Config
+		controller       *admission.Controller
+
+		source      net.Addr
+		otherSource net.Addr
+	)
+
+	mustParseCIDRs := func(cidrs ...string) []*net.IPNet {
+		networks, err := admission.ParseCIDRs(cidrs)
+		Expect(err).NotTo(HaveOccurred())
+		return networks
+	}
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test")
+		fakeClock = fakeclock.NewFakeClock(time.Now())
+		fakeMetronClient = &mfakes.FakeIngressClient{}
+		config = admission.Config{}
+
+		source = &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 50000}
+		otherSource = &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 50000}
+	})
+
+	JustBeforeEach(func() {
+		controller = admission.NewController(logger, fakeMetronClient, fakeClock, config)
+	})
+
+	Describe("ParseCIDRs", func() {
+		It("parses networks and single addresses", func() {
+			networks, err := admission.ParseCIDRs([]string{"10.0.0.0/8", "192.168.1.1", "fd00::/8"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(networks).To(HaveLen(3))
+			Expect(networks[0].String()).To(Equal("10.0.0.0/8"))
+			Expect(networks[1].String()).To(Equal("192.168.1.1/32"))
+			Expect(networks[2].String()).To(Equal("fd00::/8"))
+		})
+
+		It("fails on invalid entries", func() {
+			_, err := admission.ParseCIDRs([]string{"10.0.0.0/33"})
+			Expect(err).To(HaveOccurred())
+
+			_, err = admission.ParseCIDRs([]string{"not-an-address"})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("AdmitConnection", func() {
+		It("admits every source by default", func() {
+			for i := 0; i < 100; i++ {
+				Expect(controller.AdmitConnection(logger, source)).To(Succeed())
+			}
+		})
+
+		It("admits addresses that are not IP addresses", func() {
+			Expect(controller.AdmitConnection(logger, &net.UnixAddr{Name: "/some/socket", Net: "unix"})).To(Succeed())
+		})
+
+		Context("when networks are allowed", func() {
+			BeforeEach(func() {
+				config.Allow = mustParseCIDRs("10.0.0.0/31")
+			})
+
+			It("only admits sources from them", func() {
+				Expect(controller.AdmitConnection(logger, source)).To(Succeed())
+				Expect(controller.AdmitConnection(logger, otherSource)).To(Equal(admission.ErrDenied))
+			})
+
+			It("logs and counts the denied connections", func() {
+				controller.AdmitConnection(logger, otherSource)
+
+				Expect(logger).To(gbytes.Say(`rejected-connection.*"reason":"source address is not allowed","source":"10.0.0.2"`))
+				Expect(fakeMetronClient.IncrementCounterCallCount()).To(Equal(1))
+				Expect(fakeMetronClient.IncrementCounterArgsForCall(0)).To(Equal("ssh-connections-denied"))
+			})
+		})
+
+		Context("when networks are denied", func() {
+			BeforeEach(func() {
+				config.Allow = mustParseCIDRs("10.0.0.0/8")
+				config.Deny = mustParseCIDRs("10.0.0.1")
+			})
+
+			It("rejects sources from them even when they are allowed", func() {
+				Expect(controller.AdmitConnection(logger, source)).To(Equal(admission.ErrDenied))
+				Expect(controller.AdmitConnection(logger, otherSource)).To(Succeed())
+			})
+		})
+
+		Context("when connections are rate limited", func() {
+			BeforeEach(func() {
+				config.Connections = admission.Rate{PerSecond: 1, Burst: 3}
+			})
+
+			It("admits a burst of connections per source", func() {
+				for i := 0; i < 3; i++ {
+					Expect(controller.AdmitConnection(logger, source)).To(Succeed())
+				}
+				Expect(controller.AdmitConnection(logger, source)).To(Equal(admission.ErrRateLimited))
+
+				Expect(controller.AdmitConnection(logger, otherSource)).To(Succeed())
+
+				Expect(fakeMetronClient.IncrementCounterCallCount()).To(Equal(1))
+				Expect(fakeMetronClient.IncrementCounterArgsForCall(0)).To(Equal("ssh-connections-rate-limited"))
+			})
+
+			It("admits connections again as the bucket refills", func() {
+				for i := 0; i < 3; i++ {
+					Expect(controller.AdmitConnection(logger, source)).To(Succeed())
+				}
+				Expect(controller.AdmitConnection(logger, source)).To(Equal(admission.ErrRateLimited))
+
+				fakeClock.Increment(time.Second)
+				Expect(controller.AdmitConnection(logger, source)).To(Succeed())
+				Expect(controller.AdmitConnection(logger, source)).To(Equal(admission.ErrRateLimited))
+			})
+		})
+	})
+
+	Describe("AdmitAuthentication", func() {
+		BeforeEach(func() {
+			config.Authentications = admission.Rate{PerSecond: 0.5}
+		})
+
+		It("rate limits authentication attempts per source", func() {
+			Expect(controller.AdmitAuthentication(logger, source)).To(Succeed())
+			Expect(controller.AdmitAuthentication(logger, source)).To(Equal(admission.ErrRateLimited))
+			Expect(controller.AdmitAuthentication(logger, otherSource)).To(Succeed())
+
+			fakeClock.Increment(2 * time.Second)
+			Expect(controller.AdmitAuthentication(logger, source)).To(Succeed())
+
+			Expect(logger).To(gbytes.Say("rejected-authentication"))
+			Expect(fakeMetronClient.IncrementCounterArgsForCall(0)).To(Equal("ssh-authentications-rate-limited"))
+		})
+	})
+
+	Describe("AuthenticationFailed", func() {
+		BeforeEach(func() {
+			config.BanThreshold = 3
+			config.BanWindow = time.Minute
+			config.BanDuration = 10 * time.Minute
+		})
+
+		It("bans a source after repeated failures within the window", func() {
+			controller.AuthenticationFailed(logger, source)
+			controller.AuthenticationFailed(logger, source)
+			Expect(controller.AdmitConnection(logger, source)).To(Succeed())
+
+			controller.AuthenticationFailed(logger, source)
+			Expect(controller.AdmitConnection(logger, source)).To(Equal(admission.ErrBanned))
+			Expect(controller.AdmitAuthentication(logger, source)).To(Equal(admission.ErrBanned))
+			Expect(controller.AdmitConnection(logger, otherSource)).To(Succeed())
+
+			Expect(logger).To(gbytes.Say(`banned-source.*"duration":"10m0s","failures":3,"source":"10.0.0.1"`))
+			Expect(fakeMetronClient.IncrementCounterArgsForCall(0)).To(Equal("ssh-source-bans"))
+			Expect(fakeMetronClient.IncrementCounterArgsForCall(1)).To(Equal("ssh-connections-banned"))
+		})
+
+		It("lifts the ban after the ban duration", func() {
+			for i := 0; i < 3; i++ {
+				controller.AuthenticationFailed(logger, source)
+			}
+			Expect(controller.AdmitConnection(logger, source)).To(Equal(admission.ErrBanned))
+
+			fakeClock.Increment(10 * time.Minute)
+			Expect(controller.AdmitConnection(logger, source)).To(Succeed())
+		})
+
+		It("forgets failures outside of the window", func() {
+			controller.AuthenticationFailed(logger, source)
+			controller.AuthenticationFailed(logger, source)
+
+			fakeClock.Increment(time.Minute)
+			controller.AuthenticationFailed(logger, source)
+			Expect(controller.AdmitConnection(logger, source)).To(Succeed())
+		})
+
+		Context("when bans are disabled", func() {
+			BeforeEach(func() {
+				config.BanThreshold = 0
+			})
+
+			It("never bans", func() {
+				for i := 0; i < 100; i++ {
+					controller.AuthenticationFailed(logger, source)
+				}
+				Expect(controller.AdmitConnection(logger, source)).To(Succeed())
+			})
+		})
+	})
+
+	Describe("Run", func() {
+		var process ifrit.Process
+
+		BeforeEach(func() {
+			config.BanThreshold = 1
+			config.BanWindow = time.Minute
+			config.BanDuration = time.Hour
+		})
+
+		JustBeforeEach(func() {
+			process = ifrit.Invoke(controller)
+		})
+
+		AfterEach(func() {
+			process.Signal(os.Interrupt)
+			Eventually(process.Wait()).Should(Receive())
+		})
+
+		It("forgets idle sources that are not banned", func() {
+			controller.AdmitConnection(logger, source)
+			controller.AuthenticationFailed(logger, otherSource)
+			Expect(controller.Sources()).To(Equal(2))
+
+			fakeClock.WaitForWatcherAndIncrement(2 * time.Minute)
+			Eventually(controller.Sources).Should(Equal(1))
+
+			Expect(controller.AdmitConnection(logger, otherSource)).To(Equal(admission.ErrBanned))
+		})
+	})
+})
@@ -9,6 +9,8 @@ import (
 	"strconv"
 	"strings"
 
+	"code.cloudfoundry.org/diego-ssh/cfuser"
+	"code.cloudfoundry.org/diego-ssh/proxy"
 	"code.cloudfoundry.org/lager"
 	"github.com/dgrijalva/jwt-go"
 	"golang.org/x/crypto/ssh"
@@ -22,6 +24,7 @@ type CFAuthenticator struct {
 	uaaPassword        string
 	uaaUsername        string
 	permissionsBuilder PermissionsBuilder
+	accessGrants       *proxy.AccessGrants
 }
 
 type AppSSHResponse struct {
@@ -29,11 +32,24 @@ type AppSSHResponse struct {
 }
 
 type UAAAuthTokenResponse struct {
-	AccessToken string `json:"access_token"`
-	TokenType   string `json:"token_type"`
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	RefreshToken string `json:"refresh_token,omitempty"`
 }
 
-var CFUserRegex *regexp.Regexp = regexp.MustCompile(`cf:([0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12})/(\d+)`)
+// cfAccessGrant records what a connection was authorized for, so that access
+// can be checked again while the connection is open. It holds the tokens of
+// the user and is only handed to the proxy, never put in the permissions.
+type cfAccessGrant struct {
+	AppGuid      string
+	Index        int
+	Token        string
+	RefreshToken string
+}
+
+// CFUserRegex matches cf:<app-guid>/<index>. An index of * selects all
+// running instances of the app.
+var CFUserRegex *regexp.Regexp = cfuser.Regex
 
 func NewCFAuthenticator(
 	logger lager.Logger,
@@ -43,6 +59,7 @@ func NewCFAuthenticator(
 	uaaUsername string,
 	uaaPassword string,
 	permissionsBuilder PermissionsBuilder,
+	accessGrants *proxy.AccessGrants,
 ) *CFAuthenticator {
 	return &CFAuthenticator{
 		logger:             logger,
@@ -52,6 +69,7 @@ func NewCFAuthenticator(
 		uaaUsername:        uaaUsername,
 		uaaPassword:        uaaPassword,
 		permissionsBuilder: permissionsBuilder,
+		accessGrants:       accessGrants,
 	}
 }
 
@@ -73,16 +91,21 @@ func (cfa *CFAuthenticator) Authenticate(metadata ssh.ConnMetadata, password []b
 
 	appGuid := guidAndIndex[1]
 
-	index, err := strconv.Atoi(guidAndIndex[2])
-	if err != nil {
-		logger.Error("atoi-failed", err)
-		return nil, InvalidCredentialsErr
+	index := AllInstances
+	if guidAndIndex[2] != "*" {
+		var err error
+		index, err = strconv.Atoi(guidAndIndex[2])
+		if err != nil {
+			logger.Error("atoi-failed", err)
+			return nil, InvalidCredentialsErr
+		}
 	}
 
-	cred, err := cfa.exchangeAccessCodeForToken(logger, string(password))
+	tokenResponse, err := cfa.exchangeAccessCodeForToken(logger, string(password))
 	if err != nil {
 		return nil, err
 	}
+	cred := fmt.Sprintf("%s %s", tokenResponse.TokenType, tokenResponse.AccessToken)
 
 	parts := strings.Split(cred, " ")
 	if len(parts) != 2 {
@@ -105,12 +128,19 @@ func (cfa *CFAuthenticator) Authenticate(metadata ssh.ConnMetadata, password []b
 	}
 
 	logger = logger.WithData(lager.Data{
-		"app":       fmt.Sprintf("%s/%d", appGuid, index),
+		"app":       fmt.Sprintf("%s/%s", appGuid, guidAndIndex[2]),
 		"principal": principal,
 		"username":  username,
 	})
 
-	processGuid, err := cfa.checkAccess(logger, appGuid, index, string(cred))
+	// Access is granted per app, so any index will do when all instances
+	// are requested.
+	accessIndex := index
+	if accessIndex == AllInstances {
+		accessIndex = 0
+	}
+
+	processGuid, err := cfa.checkAccess(logger, appGuid, accessIndex, string(cred))
 	if err != nil {
 		return nil, err
 	}
@@ -120,21 +150,113 @@ func (cfa *CFAuthenticator) Authenticate(metadata ssh.ConnMetadata, password []b
 		logger.Error("building-ssh-permissions-failed", err)
 	}
 
+	if permissions != nil && cfa.accessGrants != nil {
+		cfa.accessGrants.Put(metadata.SessionID(), &cfAccessGrant{
+			AppGuid:      appGuid,
+			Index:        accessIndex,
+			Token:        cred,
+			RefreshToken: tokenResponse.RefreshToken,
+		})
+	}
+
 	logger.Info("app-access-success")
 
 	return permissions, err
 }
 
-func (cfa *CFAuthenticator) exchangeAccessCodeForToken(logger lager.Logger, code string) (string, error) {
+// CheckAccess asks the Cloud Controller again whether the user that opened a
+// connection may still access the app. Expired tokens are refreshed when UAA
+// handed out a refresh token.
+func (cfa *CFAuthenticator) CheckAccess(logger lager.Logger, accessGrant proxy.AccessGrant) error {
+	grant, ok := accessGrant.(*cfAccessGrant)
+	if !ok {
+		return nil
+	}
+
+	logger = logger.Session("cf-check-access")
+	logger = logger.WithData(lager.Data{"app": grant.AppGuid})
+
+	resp, err := cfa.fetchSSHAccess(logger, grant.AppGuid, grant.Index, grant.Token)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized && grant.RefreshToken != "" {
+		tokenResponse, err := cfa.refreshToken(logger, grant.RefreshToken)
+		if err != nil {
+			return err
+		}
+
+		grant.Token = fmt.Sprintf("%s %s", tokenResponse.TokenType, tokenResponse.AccessToken)
+		if tokenResponse.RefreshToken != "" {
+			grant.RefreshToken = tokenResponse.RefreshToken
+		}
+
+		resp, err = cfa.fetchSSHAccess(logger, grant.AppGuid, grant.Index, grant.Token)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+	}
+
+	status := resp.StatusCode
+	switch status {
+	case http.StatusOK:
+		return nil
+	case http.StatusForbidden, http.StatusNotFound:
+		logger.Info("app-access-revoked", lager.Data{"status-code": status})
+		return proxy.ErrAccessRevoked
+	default:
+		return fmt.Errorf("unexpected ssh_access status: %d", status)
+	}
+}
+
+// fetchSSHAccess asks the Cloud Controller whether token grants SSH access to
+// the instance of the app. The caller closes the body of the response.
+func (cfa *CFAuthenticator) fetchSSHAccess(logger lager.Logger, appGuid string, index int, token string) (*http.Response, error) {
+	path := fmt.Sprintf("%s/internal/apps/%s/ssh_access/%d", cfa.ccURL, appGuid, index)
+
+	req, err := http.NewRequest("GET", path, nil)
+	if err != nil {
+		logger.Error("creating-request-failed", InvalidRequestErr)
+		return nil, InvalidRequestErr
+	}
+	req.Header.Add("Authorization", token)
+
+	resp, err := cfa.httpClient.Do(req)
+	if err != nil {
+		logger.Error("fetching-app-failed", err)
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+func (cfa *CFAuthenticator) exchangeAccessCodeForToken(logger lager.Logger, code string) (*UAAAuthTokenResponse, error) {
 	logger = logger.Session("exchange-access-code-for-token")
 
 	formValues := make(url.Values)
 	formValues.Set("grant_type", "authorization_code")
 	formValues.Set("code", code)
 
+	return cfa.requestToken(logger, formValues)
+}
+
+func (cfa *CFAuthenticator) refreshToken(logger lager.Logger, refreshToken string) (*UAAAuthTokenResponse, error) {
+	logger = logger.Session("refresh-token")
+
+	formValues := make(url.Values)
+	formValues.Set("grant_type", "refresh_token")
+	formValues.Set("refresh_token", refreshToken)
+
+	return cfa.requestToken(logger, formValues)
+}
+
+func (cfa *CFAuthenticator) requestToken(logger lager.Logger, formValues url.Values) (*UAAAuthTokenResponse, error) {
 	req, err := http.NewRequest("POST", cfa.uaaTokenURL, strings.NewReader(formValues.Encode()))
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	req.SetBasicAuth(cfa.uaaUsername, cfa.uaaPassword)
@@ -143,7 +265,7 @@ func (cfa *CFAuthenticator) exchangeAccessCodeForToken(logger lager.Logger, code
 	resp, err := cfa.httpClient.Do(req)
 	if err != nil {
 		logger.Error("request-failed", err)
-		return "", AuthenticationFailedErr
+		return nil, AuthenticationFailedErr
 	}
 	defer resp.Body.Close()
 
@@ -151,32 +273,22 @@ func (cfa *CFAuthenticator) exchangeAccessCodeForToken(logger lager.Logger, code
 		logger.Error("response-status-not-ok", AuthenticationFailedErr, lager.Data{
 			"status-code": resp.StatusCode,
 		})
-		return "", AuthenticationFailedErr
+		return nil, AuthenticationFailedErr
 	}
 
 	var tokenResponse UAAAuthTokenResponse
 	err = json.NewDecoder(resp.Body).Decode(&tokenResponse)
 	if err != nil {
 		logger.Error("decode-token-response-failed", err)
-		return "", AuthenticationFailedErr
+		return nil, AuthenticationFailedErr
 	}
 
-	return fmt.Sprintf("%s %s", tokenResponse.TokenType, tokenResponse.AccessToken), nil
+	return &tokenResponse, nil
 }
 
 func (cfa *CFAuthenticator) checkAccess(logger lager.Logger, appGuid string, index int, token string) (string, error) {
-	path := fmt.Sprintf("%s/internal/apps/%s/ssh_access/%d", cfa.ccURL, appGuid, index)
-
-	req, err := http.NewRequest("GET", path, nil)
+	resp, err := cfa.fetchSSHAccess(logger, appGuid, index, token)
 	if err != nil {
-		logger.Error("creating-request-failed", InvalidRequestErr)
-		return "", InvalidRequestErr
-	}
-	req.Header.Add("Authorization", token)
-
-	resp, err := cfa.httpClient.Do(req)
-	if err != nil {
-		logger.Error("fetching-app-failed", err)
 		return "", err
 	}
 	defer resp.Body.Close()
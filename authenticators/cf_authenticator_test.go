@@ -10,6 +10,7 @@ import (
 
 	"code.cloudfoundry.org/diego-ssh/authenticators"
 	"code.cloudfoundry.org/diego-ssh/authenticators/fake_authenticators"
+	"code.cloudfoundry.org/diego-ssh/proxy"
 	"code.cloudfoundry.org/diego-ssh/test_helpers/fake_ssh"
 	"code.cloudfoundry.org/lager/lagertest"
 	. "github.com/onsi/ginkgo"
@@ -26,8 +27,10 @@ var _ = Describe("CFAuthenticator", func() {
 		httpClient         *http.Client
 		httpClientTimeout  time.Duration
 		permissionsBuilder *fake_authenticators.FakePermissionsBuilder
+		accessGrants       *proxy.AccessGrants
 
-		authenErr error
+		permissions *ssh.Permissions
+		authenErr   error
 
 		metadata *fake_ssh.FakeConnMetadata
 		password []byte
@@ -49,7 +52,10 @@ var _ = Describe("CFAuthenticator", func() {
 		permissionsBuilder = &fake_authenticators.FakePermissionsBuilder{}
 		permissionsBuilder.BuildReturns(&ssh.Permissions{}, nil)
 
+		accessGrants = proxy.NewAccessGrants()
+
 		metadata = &fake_ssh.FakeConnMetadata{}
+		metadata.SessionIDReturns([]byte("some-session-id"))
 
 		fakeCC = ghttp.NewServer()
 		ccURL = fakeCC.URL()
@@ -65,8 +71,8 @@ var _ = Describe("CFAuthenticator", func() {
 	})
 
 	JustBeforeEach(func() {
-		authenticator = authenticators.NewCFAuthenticator(logger, httpClient, ccURL, uaaTokenURL, uaaUsername, uaaPassword, permissionsBuilder)
-		_, authenErr = authenticator.Authenticate(metadata, password)
+		authenticator = authenticators.NewCFAuthenticator(logger, httpClient, ccURL, uaaTokenURL, uaaUsername, uaaPassword, permissionsBuilder, accessGrants)
+		permissions, authenErr = authenticator.Authenticate(metadata, password)
 	})
 
 	Describe("UserRegexp", func() {
@@ -81,6 +87,10 @@ var _ = Describe("CFAuthenticator", func() {
 			Expect(regexp.MatchString("cf:986FEDF8-6B74-45AF-827C-A4464E6AA05C/00")).To(BeTrue())
 		})
 
+		It("matches cf:<app-guid>/* patterns", func() {
+			Expect(regexp.MatchString("cf:986fedf8-6b74-45af-827c-a4464e6aa05c/*")).To(BeTrue())
+		})
+
 		It("does not match other patterns", func() {
 			Expect(regexp.MatchString("cf:hhhhhhhh-6b74-45af-827c-a4464e6aa05c/00")).To(BeFalse())
 			Expect(regexp.MatchString("cf:986fedf81-6b74-45af-827c-a4464e6aa05c/00")).To(BeFalse())
@@ -228,6 +238,31 @@ var _ = Describe("CFAuthenticator", func() {
 			})
 		})
 
+		Context("when the user asks for all instances", func() {
+			BeforeEach(func() {
+				metadata.UserReturns("cf:1e051b88-a210-40b7-bcca-df645b24b634/*")
+
+				fakeCC.SetHandler(0, ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/internal/apps/1e051b88-a210-40b7-bcca-df645b24b634/ssh_access/0"),
+					ghttp.RespondWithJSONEncodedPtr(&sshAccessResponseCode, sshAccessResponse),
+				))
+			})
+
+			It("checks access to the app and builds permissions for all instances", func() {
+				Expect(authenErr).NotTo(HaveOccurred())
+				Expect(fakeCC.ReceivedRequests()).To(HaveLen(1))
+
+				Expect(permissionsBuilder.BuildCallCount()).To(Equal(1))
+				_, guid, index, _ := permissionsBuilder.BuildArgsForCall(0)
+				Expect(guid).To(Equal("app-guid-app-version"))
+				Expect(index).To(Equal(authenticators.AllInstances))
+			})
+
+			It("logs the access to the app by the user", func() {
+				Eventually(logger).Should(gbytes.Say("test.cf-authenticate.app-access-success.*\"app\":\"1e051b88-a210-40b7-bcca-df645b24b634/\\*\""))
+			})
+		})
+
 		Context("when the username is missing an index", func() {
 			BeforeEach(func() {
 				metadata.UserReturns("cf:1e051b88-a210-40b7-bcca-df645b24b634")
@@ -305,5 +340,118 @@ var _ = Describe("CFAuthenticator", func() {
 				Expect(fakeCC.ReceivedRequests()).To(HaveLen(0))
 			})
 		})
+
+		Describe("CheckAccess", func() {
+			var (
+				accessStatusCode int
+				accessGrant      proxy.AccessGrant
+				checkErr         error
+			)
+
+			BeforeEach(func() {
+				permissionsBuilder.BuildReturns(&ssh.Permissions{CriticalOptions: map[string]string{}}, nil)
+				uaaTokenResponse.RefreshToken = "some-refresh-token"
+
+				accessStatusCode = http.StatusOK
+				fakeCC.AppendHandlers(
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest("GET", "/internal/apps/1e051b88-a210-40b7-bcca-df645b24b634/ssh_access/1"),
+						ghttp.RespondWithPtr(&accessStatusCode, nil),
+					),
+				)
+			})
+
+			JustBeforeEach(func() {
+				Expect(authenErr).NotTo(HaveOccurred())
+				accessGrant = accessGrants.Take([]byte("some-session-id"))
+				Expect(accessGrant).NotTo(BeNil())
+				checkErr = authenticator.CheckAccess(logger, accessGrant)
+			})
+
+			It("keeps the tokens of the user out of the permissions", func() {
+				Expect(permissions.CriticalOptions).To(BeEmpty())
+			})
+
+			It("checks the access of the user with the cloud controller again", func() {
+				Expect(checkErr).NotTo(HaveOccurred())
+				Expect(fakeCC.ReceivedRequests()).To(HaveLen(2))
+				Expect(fakeCC.ReceivedRequests()[1].Header.Get("Authorization")).To(HavePrefix("bearer eyJhbGci"))
+			})
+
+			Context("when the cloud controller denies access", func() {
+				BeforeEach(func() {
+					accessStatusCode = http.StatusForbidden
+				})
+
+				It("reports that access has been revoked", func() {
+					Expect(checkErr).To(Equal(proxy.ErrAccessRevoked))
+				})
+			})
+
+			Context("when the cloud controller fails", func() {
+				BeforeEach(func() {
+					accessStatusCode = http.StatusInternalServerError
+				})
+
+				It("returns an error without revoking access", func() {
+					Expect(checkErr).To(HaveOccurred())
+					Expect(checkErr).NotTo(Equal(proxy.ErrAccessRevoked))
+				})
+			})
+
+			Context("when the token has expired", func() {
+				BeforeEach(func() {
+					accessStatusCode = http.StatusUnauthorized
+
+					fakeUAA.AppendHandlers(
+						ghttp.CombineHandlers(
+							ghttp.VerifyRequest("POST", "/oauth/token"),
+							ghttp.VerifyBasicAuth("diego-ssh", "fake-diego-ssh-secret-$\"^&'"),
+							ghttp.VerifyFormKV("grant_type", "refresh_token"),
+							ghttp.VerifyFormKV("refresh_token", "some-refresh-token"),
+							ghttp.RespondWithJSONEncoded(http.StatusOK, authenticators.UAAAuthTokenResponse{
+								AccessToken: "new-token",
+								TokenType:   "bearer",
+							}),
+						),
+					)
+
+					fakeCC.AppendHandlers(
+						ghttp.CombineHandlers(
+							ghttp.VerifyRequest("GET", "/internal/apps/1e051b88-a210-40b7-bcca-df645b24b634/ssh_access/1"),
+							ghttp.VerifyHeader(http.Header{"Authorization": []string{"bearer new-token"}}),
+							ghttp.RespondWith(http.StatusOK, nil),
+						),
+					)
+				})
+
+				It("refreshes the token and checks again", func() {
+					Expect(checkErr).NotTo(HaveOccurred())
+					Expect(fakeUAA.ReceivedRequests()).To(HaveLen(2))
+					Expect(fakeCC.ReceivedRequests()).To(HaveLen(3))
+				})
+
+				It("checks with the refreshed token the next time", func() {
+					fakeCC.AppendHandlers(
+						ghttp.CombineHandlers(
+							ghttp.VerifyRequest("GET", "/internal/apps/1e051b88-a210-40b7-bcca-df645b24b634/ssh_access/1"),
+							ghttp.VerifyHeader(http.Header{"Authorization": []string{"bearer new-token"}}),
+							ghttp.RespondWith(http.StatusOK, nil),
+						),
+					)
+
+					Expect(authenticator.CheckAccess(logger, accessGrant)).To(Succeed())
+					Expect(fakeUAA.ReceivedRequests()).To(HaveLen(2))
+					Expect(fakeCC.ReceivedRequests()).To(HaveLen(4))
+				})
+			})
+
+			Context("when the connection was not authenticated by the cloud controller", func() {
+				It("does not check access", func() {
+					Expect(authenticator.CheckAccess(logger, "some-other-grant")).To(Succeed())
+					Expect(fakeCC.ReceivedRequests()).To(HaveLen(2))
+				})
+			})
+		})
 	})
 })
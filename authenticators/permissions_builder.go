@@ -3,9 +3,12 @@ package authenticators
 import (
 	"encoding/json"
 	"fmt"
+	"sort"
+	"time"
 
 	"code.cloudfoundry.org/bbs"
 	"code.cloudfoundry.org/bbs/models"
+	"code.cloudfoundry.org/diego-ssh/cfuser"
 	"code.cloudfoundry.org/diego-ssh/proxy"
 	"code.cloudfoundry.org/diego-ssh/routes"
 	"code.cloudfoundry.org/lager"
@@ -24,7 +27,15 @@ func NewPermissionsBuilder(bbsClient bbs.InternalClient, useDirectInstanceAddr b
 	}
 }
 
+// AllInstances is the index that selects every running instance of a
+// process instead of a single one.
+const AllInstances = cfuser.AllInstances
+
 func (pb *permissionsBuilder) Build(logger lager.Logger, processGuid string, index int, metadata ssh.ConnMetadata) (*ssh.Permissions, error) {
+	if index == AllInstances {
+		return pb.buildAllInstances(logger, processGuid, metadata)
+	}
+
 	ind := int32(index)
 	filter := models.ActualLRPFilter{
 		ProcessGuid: processGuid,
@@ -54,14 +65,153 @@ func (pb *permissionsBuilder) Build(logger lager.Logger, processGuid string, ind
 	return pb.createPermissions(sshRoute, actualLRPs[0], desired, logMessage)
 }
 
+// buildAllInstances creates permissions that make the proxy fan out to every
+// running instance of the process. Instances that are being evacuated are
+// only used when their replacement is not running yet.
+func (pb *permissionsBuilder) buildAllInstances(logger lager.Logger, processGuid string, metadata ssh.ConnMetadata) (*ssh.Permissions, error) {
+	actualLRPs, err := pb.bbsClient.ActualLRPs(logger, models.ActualLRPFilter{ProcessGuid: processGuid})
+	if err != nil {
+		return nil, err
+	}
+
+	running := map[int32]*models.ActualLRP{}
+	for _, actual := range actualLRPs {
+		if actual.State != models.ActualLRPStateRunning {
+			continue
+		}
+		if existing, ok := running[actual.Index]; ok && existing.Presence != models.ActualLRP_Evacuating {
+			continue
+		}
+		running[actual.Index] = actual
+	}
+
+	if len(running) == 0 {
+		return nil, fmt.Errorf("no running ActualLRP for ProcessGuid: %s", processGuid)
+	}
+
+	desired, err := pb.bbsClient.DesiredLRPByProcessGuid(logger, processGuid)
+	if err != nil {
+		return nil, err
+	}
+
+	sshRoute, err := getRoutingInfo(desired)
+	if err != nil {
+		return nil, err
+	}
+
+	logMessage := fmt.Sprintf("Successful remote access to all instances by %s", metadata.RemoteAddr().String())
+
+	indices := make([]int, 0, len(running))
+	for index := range running {
+		indices = append(indices, int(index))
+	}
+	sort.Ints(indices)
+
+	targets := []proxy.InstanceTarget{}
+	for _, index := range indices {
+		actual := running[int32(index)]
+
+		targetConfig := pb.targetConfig(sshRoute, actual)
+		if targetConfig == nil {
+			continue
+		}
+
+		instanceLogMessage, err := createLogMessage(actual, desired, logMessage)
+		if err != nil {
+			return nil, err
+		}
+
+		targets = append(targets, proxy.InstanceTarget{
+			Index:        index,
+			TargetConfig: *targetConfig,
+			LogMessage:   instanceLogMessage,
+		})
+	}
+
+	if len(targets) == 0 {
+		return &ssh.Permissions{}, nil
+	}
+
+	targetsJson, err := json.Marshal(targets)
+	if err != nil {
+		return nil, err
+	}
+
+	permissions := &ssh.Permissions{
+		CriticalOptions: map[string]string{
+			"proxy-instance-targets": string(targetsJson),
+		},
+	}
+
+	err = addSessionLimits(permissions, sshRoute)
+	if err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
+
 func (pb *permissionsBuilder) createPermissions(
 	sshRoute *routes.SSHRoute,
 	actual *models.ActualLRP,
 	desired *models.DesiredLRP,
 	logMessage string,
 ) (*ssh.Permissions, error) {
-	var targetConfig *proxy.TargetConfig
+	targetConfig := pb.targetConfig(sshRoute, actual)
+	if targetConfig == nil {
+		return &ssh.Permissions{}, nil
+	}
+
+	targetConfigJson, err := json.Marshal(targetConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	message, err := createLogMessage(actual, desired, logMessage)
+	if err != nil {
+		return nil, err
+	}
+
+	logMessageJson, err := json.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+
+	permissions := &ssh.Permissions{
+		CriticalOptions: map[string]string{
+			"proxy-target-config": string(targetConfigJson),
+			"log-message":         string(logMessageJson),
+			"instance-guid":       actual.ActualLRPInstanceKey.InstanceGuid,
+		},
+	}
+
+	err = addSessionLimits(permissions, sshRoute)
+	if err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
 
+// addSessionLimits passes the session limits of the route on to the proxy.
+func addSessionLimits(permissions *ssh.Permissions, sshRoute *routes.SSHRoute) error {
+	if sshRoute.MaxSessionDurationSeconds <= 0 && sshRoute.IdleTimeoutSeconds <= 0 {
+		return nil
+	}
+
+	limitsJson, err := json.Marshal(proxy.SessionLimits{
+		MaxDuration: time.Duration(sshRoute.MaxSessionDurationSeconds) * time.Second,
+		IdleTimeout: time.Duration(sshRoute.IdleTimeoutSeconds) * time.Second,
+	})
+	if err != nil {
+		return err
+	}
+
+	permissions.CriticalOptions["session-limits"] = string(limitsJson)
+	return nil
+}
+
+func (pb *permissionsBuilder) targetConfig(sshRoute *routes.SSHRoute, actual *models.ActualLRP) *proxy.TargetConfig {
 	for _, mapping := range actual.Ports {
 		if mapping.ContainerPort == sshRoute.ContainerPort {
 			address := actual.Address
@@ -89,7 +239,7 @@ func (pb *permissionsBuilder) createPermissions(
 				tlsAddress = fmt.Sprintf("%s:%d", actual.InstanceAddress, mapping.ContainerTlsProxyPort)
 			}
 
-			targetConfig = &proxy.TargetConfig{
+			return &proxy.TargetConfig{
 				Address:             fmt.Sprintf("%s:%d", address, port),
 				TLSAddress:          tlsAddress,
 				ServerCertDomainSAN: actual.ActualLRPInstanceKey.InstanceGuid,
@@ -98,30 +248,25 @@ func (pb *permissionsBuilder) createPermissions(
 				Password:            sshRoute.Password,
 				PrivateKey:          sshRoute.PrivateKey,
 			}
-			break
 		}
 	}
 
-	if targetConfig == nil {
-		return &ssh.Permissions{}, nil
-	}
-
-	targetConfigJson, err := json.Marshal(targetConfig)
-	if err != nil {
-		return nil, err
-	}
+	return nil
+}
 
-	if len(desired.MetricTags) == 0 {
-		desired.MetricTags = map[string]*models.MetricTagValue{}
+func createLogMessage(actual *models.ActualLRP, desired *models.DesiredLRP, logMessage string) (*proxy.LogMessage, error) {
+	metricTags := map[string]*models.MetricTagValue{}
+	for key, value := range desired.MetricTags {
+		metricTags[key] = value
 	}
-	if _, ok := desired.MetricTags["source_id"]; !ok {
-		desired.MetricTags["source_id"] = &models.MetricTagValue{Static: desired.LogGuid}
+	if _, ok := metricTags["source_id"]; !ok {
+		metricTags["source_id"] = &models.MetricTagValue{Static: desired.LogGuid}
 	}
-	if _, ok := desired.MetricTags["instance_id"]; !ok {
-		desired.MetricTags["instance_id"] = &models.MetricTagValue{Dynamic: models.MetricTagDynamicValueIndex}
+	if _, ok := metricTags["instance_id"]; !ok {
+		metricTags["instance_id"] = &models.MetricTagValue{Dynamic: models.MetricTagDynamicValueIndex}
 	}
 
-	tags, err := models.ConvertMetricTags(desired.MetricTags, map[models.MetricTagValue_DynamicValue]interface{}{
+	tags, err := models.ConvertMetricTags(metricTags, map[models.MetricTagValue_DynamicValue]interface{}{
 		models.MetricTagDynamicValueIndex:        int32(actual.Index),
 		models.MetricTagDynamicValueInstanceGuid: actual.ActualLRPInstanceKey.InstanceGuid,
 	})
@@ -129,19 +274,9 @@ func (pb *permissionsBuilder) createPermissions(
 		return nil, err
 	}
 
-	logMessageJson, err := json.Marshal(proxy.LogMessage{
+	return &proxy.LogMessage{
 		Message: logMessage,
 		Tags:    tags,
-	})
-	if err != nil {
-		return nil, err
-	}
-
-	return &ssh.Permissions{
-		CriticalOptions: map[string]string{
-			"proxy-target-config": string(targetConfigJson),
-			"log-message":         string(logMessageJson),
-		},
 	}, nil
 }
 
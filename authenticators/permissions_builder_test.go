@@ -3,10 +3,12 @@ package authenticators_test
 import (
 	"encoding/json"
 	"net"
+	"time"
 
 	"code.cloudfoundry.org/bbs/fake_bbs"
 	"code.cloudfoundry.org/bbs/models"
 	"code.cloudfoundry.org/diego-ssh/authenticators"
+	"code.cloudfoundry.org/diego-ssh/proxy"
 	"code.cloudfoundry.org/diego-ssh/routes"
 	"code.cloudfoundry.org/diego-ssh/test_helpers/fake_ssh"
 	"code.cloudfoundry.org/lager/lagertest"
@@ -243,6 +245,10 @@ var _ = Describe("PermissionsBuilder", func() {
 			Expect(permissions.CriticalOptions["proxy-target-config"]).To(MatchJSON(expectedConfig))
 		})
 
+		It("saves the instance guid in the critical options of the permissions", func() {
+			Expect(permissions.CriticalOptions["instance-guid"]).To(Equal("some-instance-guid"))
+		})
+
 		It("saves log message information in the critical options of the permissions", func() {
 			expectedConfig := `{
 				"tags": {
@@ -260,6 +266,104 @@ var _ = Describe("PermissionsBuilder", func() {
 			Expect(permissions.CriticalOptions["log-message"]).To(MatchJSON(expectedConfig))
 		})
 
+		It("does not set session limits when the route has none", func() {
+			Expect(permissions.CriticalOptions).NotTo(HaveKey("session-limits"))
+		})
+
+		Context("when the route sets session limits", func() {
+			BeforeEach(func() {
+				expectedRoute.MaxSessionDurationSeconds = 3600
+				expectedRoute.IdleTimeoutSeconds = 600
+
+				diegoSSHRoutePayload, err := json.Marshal(expectedRoute)
+				Expect(err).NotTo(HaveOccurred())
+
+				diegoSSHRouteMessage := json.RawMessage(diegoSSHRoutePayload)
+				(*desiredLRP.Routes)[routes.DIEGO_SSH] = &diegoSSHRouteMessage
+			})
+
+			It("saves them in the critical options of the permissions", func() {
+				var limits proxy.SessionLimits
+				err := json.Unmarshal([]byte(permissions.CriticalOptions["session-limits"]), &limits)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(limits.MaxDuration).To(Equal(time.Hour))
+				Expect(limits.IdleTimeout).To(Equal(10 * time.Minute))
+			})
+		})
+
+		Context("when all instances are requested", func() {
+			var otherLRP, crashedLRP, evacuatingLRP *models.ActualLRP
+
+			BeforeEach(func() {
+				index = authenticators.AllInstances
+
+				actualLRP.State = models.ActualLRPStateRunning
+
+				otherLRP = &models.ActualLRP{
+					ActualLRPKey:         models.NewActualLRPKey("some-guid", 0, "some-domain"),
+					ActualLRPInstanceKey: models.NewActualLRPInstanceKey("other-instance-guid", "some-cell-id"),
+					ActualLRPNetInfo:     models.NewActualLRPNetInfo("5.6.7.8", "6.6.6.6", models.ActualLRPNetInfo_PreferredAddressUnknown, models.NewPortMapping(5555, 1111)),
+					State:                models.ActualLRPStateRunning,
+				}
+
+				evacuatingLRP = &models.ActualLRP{
+					ActualLRPKey:         models.NewActualLRPKey("some-guid", 0, "some-domain"),
+					ActualLRPInstanceKey: models.NewActualLRPInstanceKey("evacuating-instance-guid", "old-cell-id"),
+					ActualLRPNetInfo:     models.NewActualLRPNetInfo("9.9.9.9", "7.7.7.7", models.ActualLRPNetInfo_PreferredAddressUnknown, models.NewPortMapping(9999, 1111)),
+					State:                models.ActualLRPStateRunning,
+					Presence:             models.ActualLRP_Evacuating,
+				}
+
+				crashedLRP = &models.ActualLRP{
+					ActualLRPKey: models.NewActualLRPKey("some-guid", 2, "some-domain"),
+					State:        models.ActualLRPStateCrashed,
+				}
+
+				bbsClient.ActualLRPsReturns([]*models.ActualLRP{actualLRP, evacuatingLRP, crashedLRP, otherLRP}, nil)
+			})
+
+			It("gets all actual lrps of the process", func() {
+				Expect(bbsClient.ActualLRPsCallCount()).To(Equal(1))
+
+				_, filter := bbsClient.ActualLRPsArgsForCall(0)
+				Expect(filter.ProcessGuid).To(Equal("some-guid"))
+				Expect(filter.Index).To(BeNil())
+			})
+
+			It("saves a target for every running instance in the critical options of the permissions", func() {
+				Expect(buildErr).NotTo(HaveOccurred())
+				Expect(permissions.CriticalOptions).NotTo(HaveKey("proxy-target-config"))
+
+				var targets []proxy.InstanceTarget
+				err := json.Unmarshal([]byte(permissions.CriticalOptions["proxy-instance-targets"]), &targets)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(targets).To(HaveLen(2))
+
+				Expect(targets[0].Index).To(Equal(0))
+				Expect(targets[0].TargetConfig.Address).To(Equal("5.6.7.8:5555"))
+				Expect(targets[0].TargetConfig.ServerCertDomainSAN).To(Equal("other-instance-guid"))
+				Expect(targets[0].LogMessage.Tags["instance_id"]).To(Equal("0"))
+
+				Expect(targets[1].Index).To(Equal(1))
+				Expect(targets[1].TargetConfig.Address).To(Equal("1.2.3.4:3333"))
+				Expect(targets[1].TargetConfig.User).To(Equal("user"))
+				Expect(targets[1].LogMessage.Tags["instance_id"]).To(Equal("1"))
+				Expect(targets[1].LogMessage.Message).To(Equal("Successful remote access to all instances by 1.1.1.1"))
+			})
+
+			Context("when no instance is running", func() {
+				BeforeEach(func() {
+					bbsClient.ActualLRPsReturns([]*models.ActualLRP{crashedLRP}, nil)
+				})
+
+				It("fails", func() {
+					Expect(buildErr).To(MatchError("no running ActualLRP for ProcessGuid: some-guid"))
+				})
+			})
+		})
+
 		Context("when getting the desired LRP information fails", func() {
 			BeforeEach(func() {
 				bbsClient.DesiredLRPByProcessGuidReturns(nil, &models.Error{})
@@ -0,0 +1,184 @@
+// +build !windows
+
+package builtins
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"code.cloudfoundry.org/diego-ssh/termcodes"
+)
+
+// Stdio describes the environment a built-in command runs in.
+type Stdio struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// Env holds the session environment in KEY=value form.
+	Env []string
+
+	// Dir is the directory relative paths are resolved against. The working
+	// directory of the daemon is used when empty.
+	Dir string
+}
+
+func (stdio Stdio) path(name string) string {
+	if stdio.Dir == "" || filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(stdio.Dir, name)
+}
+
+func (stdio Stdio) getenv(key string) string {
+	for i := len(stdio.Env) - 1; i >= 0; i-- {
+		if strings.HasPrefix(stdio.Env[i], key+"=") {
+			return strings.TrimPrefix(stdio.Env[i], key+"=")
+		}
+	}
+	return ""
+}
+
+// Command is a built-in command. args[0] is the name of the command.
+type Command func(stdio Stdio, args []string) error
+
+// ExitError reports that a command finished with a non-zero exit status.
+// Commands print their own diagnostics before returning one.
+type ExitError struct {
+	Status int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Status)
+}
+
+var commands = map[string]Command{
+	"cat":     Cat,
+	"env":     Env,
+	"kill":    Kill,
+	"ls":      List,
+	"netstat": Netstat,
+	"ps":      Ps,
+	"tar":     Tar,
+}
+
+func Lookup(name string) (Command, bool) {
+	command, ok := commands[name]
+	return command, ok
+}
+
+func Names() []string {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Run runs the built-in command named by args[0]. Errors are reported on
+// stderr and turned into an *ExitError.
+func Run(stdio Stdio, args []string) error {
+	command, ok := Lookup(args[0])
+	if !ok {
+		fmt.Fprintf(stdio.Stderr, "%s: command not found\n", args[0])
+		return &ExitError{Status: 127}
+	}
+
+	err := command(stdio, args)
+	if err == nil {
+		return nil
+	}
+
+	if _, ok := err.(*ExitError); ok {
+		return err
+	}
+
+	fmt.Fprintf(stdio.Stderr, "%s: %s\n", args[0], err)
+	return &ExitError{Status: 1}
+}
+
+// Exec runs args as a built-in command when one exists and as a program
+// found on the PATH of the environment otherwise. No shell is involved.
+func Exec(stdio Stdio, args []string) error {
+	if _, ok := Lookup(args[0]); ok {
+		return Run(stdio, args)
+	}
+
+	path, err := LookPath(args[0], stdio.Env)
+	if err != nil {
+		fmt.Fprintf(stdio.Stderr, "%s: command not found\n", args[0])
+		return &ExitError{Status: 127}
+	}
+
+	cmd := exec.Command(path, args[1:]...)
+	cmd.Env = stdio.Env
+	cmd.Dir = stdio.Dir
+	cmd.Stdout = stdio.Stdout
+	cmd.Stderr = stdio.Stderr
+
+	// Only hand over stdin when it can be shared. Copying from any other
+	// reader would consume input past the end of the program.
+	if file, ok := stdio.Stdin.(*os.File); ok {
+		cmd.Stdin = file
+
+		// make the program the foreground of the terminal so that it
+		// receives the signals generated by the line discipline
+		if _, err := termcodes.GetAttr(file); err == nil {
+			cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+		}
+	}
+
+	err = cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return &ExitError{Status: 128 + int(status.Signal())}
+		}
+		return &ExitError{Status: exitErr.ExitCode()}
+	}
+	if err != nil {
+		fmt.Fprintf(stdio.Stderr, "%s: %s\n", args[0], err)
+		return &ExitError{Status: 126}
+	}
+
+	return nil
+}
+
+// LookPath searches for file in the directories named by the PATH variable
+// of env rather than the environment of the daemon.
+func LookPath(file string, env []string) (string, error) {
+	if strings.Contains(file, "/") {
+		if isExecutable(file) {
+			return file, nil
+		}
+		return "", &exec.Error{Name: file, Err: exec.ErrNotFound}
+	}
+
+	path := Stdio{Env: env}.getenv("PATH")
+	for _, dir := range filepath.SplitList(path) {
+		if dir == "" {
+			continue
+		}
+
+		candidate := filepath.Join(dir, file)
+		if isExecutable(candidate) {
+			return candidate, nil
+		}
+	}
+
+	return "", &exec.Error{Name: file, Err: exec.ErrNotFound}
+}
+
+func isExecutable(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	return !info.IsDir() && info.Mode()&0111 != 0
+}
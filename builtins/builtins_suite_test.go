@@ -0,0 +1,20 @@
+package builtins_test
+
+import (
+	"runtime"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestBuiltins(t *testing.T) {
+	RegisterFailHandler(Fail)
+	BeforeEach(func() {
+		if runtime.GOOS == "windows" {
+			Skip("built-in commands aren't supported on windows")
+		}
+	})
+	RunSpecs(t, "Builtins Suite")
+}
@@ -0,0 +1,185 @@
+// +build !windows
+
+package builtins_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"code.cloudfoundry.org/diego-ssh/builtins"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+)
+
+var _ = Describe("Builtins", func() {
+	var (
+		stdout, stderr *gbytes.Buffer
+		stdio          builtins.Stdio
+	)
+
+	BeforeEach(func() {
+		stdout = gbytes.NewBuffer()
+		stderr = gbytes.NewBuffer()
+
+		stdio = builtins.Stdio{
+			Stdin:  strings.NewReader(""),
+			Stdout: stdout,
+			Stderr: stderr,
+			Env:    []string{"PATH=/bin:/usr/bin", "FOO=bar"},
+		}
+	})
+
+	Describe("Names", func() {
+		It("lists the built-in commands in order", func() {
+			Expect(builtins.Names()).To(Equal([]string{"cat", "env", "kill", "ls", "netstat", "ps", "tar"}))
+		})
+	})
+
+	Describe("Run", func() {
+		It("runs the named command", func() {
+			Expect(builtins.Run(stdio, []string{"env"})).To(Succeed())
+			Expect(stdout).To(gbytes.Say("FOO=bar"))
+		})
+
+		Context("when the command does not exist", func() {
+			It("exits with status 127", func() {
+				err := builtins.Run(stdio, []string{"bogus"})
+				Expect(err).To(Equal(&builtins.ExitError{Status: 127}))
+				Expect(stderr).To(gbytes.Say("bogus: command not found"))
+			})
+		})
+
+		Context("when the command fails", func() {
+			It("reports the error and exits with status 1", func() {
+				err := builtins.Run(stdio, []string{"env", "extra"})
+				Expect(err).To(Equal(&builtins.ExitError{Status: 1}))
+				Expect(stderr).To(gbytes.Say("env: usage: env"))
+			})
+		})
+	})
+
+	Describe("Exec", func() {
+		It("runs programs from the PATH of the environment without a shell", func() {
+			err := builtins.Exec(stdio, []string{"echo", "-n", "$FOO", "a b"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(stdout.Contents())).To(Equal("$FOO a b"))
+		})
+
+		It("preserves the exit status of the program", func() {
+			err := builtins.Exec(stdio, []string{"false"})
+			Expect(err).To(Equal(&builtins.ExitError{Status: 1}))
+		})
+
+		It("exits with status 127 when the program is not found", func() {
+			stdio.Env = []string{"PATH=/nonexistent"}
+
+			err := builtins.Exec(stdio, []string{"echo"})
+			Expect(err).To(Equal(&builtins.ExitError{Status: 127}))
+			Expect(stderr).To(gbytes.Say("echo: command not found"))
+		})
+	})
+
+	Describe("LookPath", func() {
+		It("searches the PATH of the environment", func() {
+			path, err := builtins.LookPath("true", []string{"PATH=/nonexistent:/bin"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(path).To(Equal("/bin/true"))
+		})
+
+		It("uses the last PATH in the environment", func() {
+			_, err := builtins.LookPath("true", []string{"PATH=/bin", "PATH=/nonexistent"})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("Cat", func() {
+		var dir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "builtins")
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(ioutil.WriteFile(filepath.Join(dir, "a"), []byte("hello "), 0644)).To(Succeed())
+			stdio.Dir = dir
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		It("concatenates files relative to the directory and stdin", func() {
+			stdio.Stdin = strings.NewReader("world")
+
+			Expect(builtins.Cat(stdio, []string{"cat", "a", "-"})).To(Succeed())
+			Expect(string(stdout.Contents())).To(Equal("hello world"))
+		})
+
+		It("continues past missing files and fails", func() {
+			err := builtins.Cat(stdio, []string{"cat", "missing", "a"})
+			Expect(err).To(Equal(&builtins.ExitError{Status: 1}))
+			Expect(stderr).To(gbytes.Say("cat: .*missing"))
+			Expect(string(stdout.Contents())).To(Equal("hello "))
+		})
+	})
+
+	Describe("List", func() {
+		var dir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "builtins")
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(ioutil.WriteFile(filepath.Join(dir, "file"), []byte("12345"), 0644)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(dir, ".hidden"), nil, 0644)).To(Succeed())
+			Expect(os.Symlink("file", filepath.Join(dir, "link"))).To(Succeed())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		It("lists the visible entries of a directory", func() {
+			Expect(builtins.List(stdio, []string{"ls", dir})).To(Succeed())
+			Expect(string(stdout.Contents())).To(Equal("file\nlink\n"))
+		})
+
+		It("includes hidden entries with -a", func() {
+			Expect(builtins.List(stdio, []string{"ls", "-a", dir})).To(Succeed())
+			Expect(string(stdout.Contents())).To(Equal(".hidden\nfile\nlink\n"))
+		})
+
+		It("shows mode, size and link targets with -l", func() {
+			Expect(builtins.List(stdio, []string{"ls", "-l", dir})).To(Succeed())
+			Expect(stdout).To(gbytes.Say(`-rw-r--r-- +5 .* file\n`))
+			Expect(stdout).To(gbytes.Say(`L.* link -> file\n`))
+		})
+
+		It("fails with status 2 for missing paths", func() {
+			err := builtins.List(stdio, []string{"ls", filepath.Join(dir, "missing")})
+			Expect(err).To(Equal(&builtins.ExitError{Status: 2}))
+			Expect(stderr).To(gbytes.Say("ls: "))
+		})
+	})
+
+	Describe("Env", func() {
+		It("prints the environment", func() {
+			Expect(builtins.Env(stdio, []string{"env"})).To(Succeed())
+			Expect(string(stdout.Contents())).To(Equal("PATH=/bin:/usr/bin\nFOO=bar\n"))
+		})
+	})
+
+	Describe("Ps", func() {
+		It("lists the running processes", func() {
+			Expect(builtins.Ps(stdio, []string{"ps"})).To(Succeed())
+
+			lines := strings.Split(string(stdout.Contents()), "\n")
+			Expect(lines[0]).To(MatchRegexp(`PID +PPID +S +COMMAND`))
+			Expect(stdout.Contents()).To(ContainSubstring(filepath.Base(os.Args[0])))
+		})
+	})
+})
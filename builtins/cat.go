@@ -0,0 +1,49 @@
+// +build !windows
+
+package builtins
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// Cat copies the named files, or stdin when none are given, to stdout.
+func Cat(stdio Stdio, args []string) error {
+	files := args[1:]
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+
+	status := 0
+	for _, name := range files {
+		if name == "-" {
+			if _, err := io.Copy(stdio.Stdout, stdio.Stdin); err != nil {
+				return err
+			}
+			continue
+		}
+
+		err := catFile(stdio, name)
+		if err != nil {
+			fmt.Fprintf(stdio.Stderr, "cat: %s\n", err)
+			status = 1
+		}
+	}
+
+	if status != 0 {
+		return &ExitError{Status: status}
+	}
+	return nil
+}
+
+func catFile(stdio Stdio, name string) error {
+	file, err := os.Open(stdio.path(name))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(stdio.Stdout, file)
+	return err
+}
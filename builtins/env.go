@@ -0,0 +1,20 @@
+// +build !windows
+
+package builtins
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Env prints the session environment.
+func Env(stdio Stdio, args []string) error {
+	if len(args) > 1 {
+		return errors.New("usage: env")
+	}
+
+	for _, variable := range stdio.Env {
+		fmt.Fprintln(stdio.Stdout, variable)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+// +build !windows
+
+package builtins
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"code.cloudfoundry.org/diego-ssh/signals"
+	"golang.org/x/crypto/ssh"
+)
+
+var errKillUsage = errors.New("usage: kill [-s SIGNAL | -SIGNAL] PID... or kill -l")
+
+// Kill sends a signal, TERM by default, to the given processes.
+func Kill(stdio Stdio, args []string) error {
+	args = args[1:]
+	signal := syscall.SIGTERM
+
+	if len(args) > 0 && args[0] == "-l" {
+		names := []string{}
+		for name := range signals.SyscallSignals {
+			names = append(names, string(name))
+		}
+		sort.Strings(names)
+		fmt.Fprintln(stdio.Stdout, strings.Join(names, " "))
+		return nil
+	}
+
+	if len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		name := strings.TrimPrefix(args[0], "-")
+		args = args[1:]
+
+		if name == "s" {
+			if len(args) == 0 {
+				return errKillUsage
+			}
+			name, args = args[0], args[1:]
+		}
+
+		var err error
+		signal, err = parseSignal(name)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(args) == 0 {
+		return errKillUsage
+	}
+
+	status := 0
+	for _, arg := range args {
+		pid, err := strconv.Atoi(arg)
+		if err != nil {
+			fmt.Fprintf(stdio.Stderr, "kill: invalid process id: %s\n", arg)
+			status = 1
+			continue
+		}
+
+		err = syscall.Kill(pid, signal)
+		if err != nil {
+			fmt.Fprintf(stdio.Stderr, "kill: (%d): %s\n", pid, err)
+			status = 1
+		}
+	}
+
+	if status != 0 {
+		return &ExitError{Status: status}
+	}
+	return nil
+}
+
+func parseSignal(name string) (syscall.Signal, error) {
+	if number, err := strconv.Atoi(name); err == nil {
+		return syscall.Signal(number), nil
+	}
+
+	name = strings.TrimPrefix(strings.ToUpper(name), "SIG")
+	signal, ok := signals.SyscallSignals[ssh.Signal(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown signal: %s", name)
+	}
+	return signal, nil
+}
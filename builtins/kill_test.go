@@ -0,0 +1,72 @@
+// +build !windows
+
+package builtins_test
+
+import (
+	"os/exec"
+	"strconv"
+	"syscall"
+
+	"code.cloudfoundry.org/diego-ssh/builtins"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+)
+
+var _ = Describe("Kill", func() {
+	var (
+		stdout, stderr *gbytes.Buffer
+		stdio          builtins.Stdio
+		cmd            *exec.Cmd
+	)
+
+	BeforeEach(func() {
+		stdout = gbytes.NewBuffer()
+		stderr = gbytes.NewBuffer()
+		stdio = builtins.Stdio{Stdout: stdout, Stderr: stderr}
+
+		cmd = exec.Command("sleep", "10")
+		Expect(cmd.Start()).To(Succeed())
+	})
+
+	AfterEach(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	waitStatus := func() syscall.WaitStatus {
+		cmd.Wait()
+		return cmd.ProcessState.Sys().(syscall.WaitStatus)
+	}
+
+	It("sends TERM by default", func() {
+		Expect(builtins.Kill(stdio, []string{"kill", strconv.Itoa(cmd.Process.Pid)})).To(Succeed())
+		Expect(waitStatus().Signal()).To(Equal(syscall.SIGTERM))
+	})
+
+	It("accepts signal names and numbers", func() {
+		Expect(builtins.Kill(stdio, []string{"kill", "-SIGUSR1", strconv.Itoa(cmd.Process.Pid)})).To(Succeed())
+		Expect(waitStatus().Signal()).To(Equal(syscall.SIGUSR1))
+	})
+
+	It("accepts -s", func() {
+		Expect(builtins.Kill(stdio, []string{"kill", "-s", "9", strconv.Itoa(cmd.Process.Pid)})).To(Succeed())
+		Expect(waitStatus().Signal()).To(Equal(syscall.SIGKILL))
+	})
+
+	It("lists the known signals", func() {
+		Expect(builtins.Kill(stdio, []string{"kill", "-l"})).To(Succeed())
+		Expect(stdout).To(gbytes.Say("ABRT ALRM"))
+	})
+
+	It("rejects unknown signals", func() {
+		err := builtins.Kill(stdio, []string{"kill", "-BOGUS", strconv.Itoa(cmd.Process.Pid)})
+		Expect(err).To(MatchError("unknown signal: BOGUS"))
+	})
+
+	It("reports invalid process ids", func() {
+		err := builtins.Kill(stdio, []string{"kill", "nope"})
+		Expect(err).To(Equal(&builtins.ExitError{Status: 1}))
+		Expect(stderr).To(gbytes.Say("kill: invalid process id: nope"))
+	})
+})
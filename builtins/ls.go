@@ -0,0 +1,96 @@
+// +build !windows
+
+package builtins
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pborman/getopt"
+)
+
+// List lists directory contents. It understands -l for the long format and
+// -a to include entries whose names start with a dot.
+func List(stdio Stdio, args []string) error {
+	opts := getopt.New()
+	long := opts.Bool('l', "", "use a long listing format")
+	all := opts.Bool('a', "", "do not ignore entries starting with .")
+
+	err := opts.Getopt(args, nil)
+	if err != nil {
+		return err
+	}
+
+	paths := opts.Args()
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+
+	writer := tabwriter.NewWriter(stdio.Stdout, 0, 8, 1, ' ', 0)
+	defer writer.Flush()
+
+	status := 0
+	for i, name := range paths {
+		path := stdio.path(name)
+
+		info, err := os.Lstat(path)
+		if err != nil {
+			writer.Flush()
+			fmt.Fprintf(stdio.Stderr, "ls: %s\n", err)
+			status = 2
+			continue
+		}
+
+		if !info.IsDir() {
+			listEntry(writer, path, name, info, *long)
+			continue
+		}
+
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			writer.Flush()
+			fmt.Fprintf(stdio.Stderr, "ls: %s\n", err)
+			status = 2
+			continue
+		}
+
+		if len(paths) > 1 {
+			if i > 0 {
+				fmt.Fprintln(writer)
+			}
+			fmt.Fprintf(writer, "%s:\n", name)
+		}
+
+		for _, entry := range entries {
+			if !*all && strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			listEntry(writer, filepath.Join(path, entry.Name()), entry.Name(), entry, *long)
+		}
+	}
+
+	if status != 0 {
+		return &ExitError{Status: status}
+	}
+	return nil
+}
+
+func listEntry(w io.Writer, path, name string, info os.FileInfo, long bool) {
+	if !long {
+		fmt.Fprintln(w, name)
+		return
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		if target, err := os.Readlink(path); err == nil {
+			name = name + " -> " + target
+		}
+	}
+
+	fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", info.Mode(), info.Size(), info.ModTime().Format("Jan _2 15:04"), name)
+}
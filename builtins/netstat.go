@@ -0,0 +1,145 @@
+// +build !windows
+
+package builtins
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pborman/getopt"
+)
+
+var tcpStates = map[string]string{
+	"01": "ESTABLISHED",
+	"02": "SYN_SENT",
+	"03": "SYN_RECV",
+	"04": "FIN_WAIT1",
+	"05": "FIN_WAIT2",
+	"06": "TIME_WAIT",
+	"07": "CLOSE",
+	"08": "CLOSE_WAIT",
+	"09": "LAST_ACK",
+	"0A": "LISTEN",
+	"0B": "CLOSING",
+}
+
+// Netstat lists the TCP and UDP sockets of the container from /proc/net.
+// -t and -u restrict the output to one protocol and -l to listening sockets.
+func Netstat(stdio Stdio, args []string) error {
+	opts := getopt.New()
+	tcp := opts.Bool('t', "", "show tcp sockets")
+	udp := opts.Bool('u', "", "show udp sockets")
+	listening := opts.Bool('l', "", "show only listening sockets")
+
+	err := opts.Getopt(args, nil)
+	if err != nil {
+		return err
+	}
+
+	if !*tcp && !*udp {
+		*tcp, *udp = true, true
+	}
+
+	tables := []string{}
+	if *tcp {
+		tables = append(tables, "tcp", "tcp6")
+	}
+	if *udp {
+		tables = append(tables, "udp", "udp6")
+	}
+
+	writer := tabwriter.NewWriter(stdio.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, "Proto\tLocal Address\tForeign Address\tState")
+
+	for _, proto := range tables {
+		err := writeSockets(writer, proto, *listening)
+		if err != nil && !os.IsNotExist(err) {
+			writer.Flush()
+			return err
+		}
+	}
+
+	return writer.Flush()
+}
+
+func writeSockets(writer *tabwriter.Writer, proto string, listeningOnly bool) error {
+	file, err := os.Open(filepath.Join(procDir, "net", proto))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+
+	// skip the header
+	scanner.Scan()
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+
+		state := ""
+		if strings.HasPrefix(proto, "tcp") {
+			state = tcpStates[fields[3]]
+		}
+
+		listening := state == "LISTEN" || (strings.HasPrefix(proto, "udp") && isUnconnected(fields[2]))
+		if listeningOnly && !listening {
+			continue
+		}
+
+		local, err := parseSocketAddress(fields[1])
+		if err != nil {
+			return err
+		}
+
+		remote, err := parseSocketAddress(fields[2])
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\n", proto, local, remote, state)
+	}
+
+	return scanner.Err()
+}
+
+func isUnconnected(address string) bool {
+	return strings.Trim(address, "0:") == ""
+}
+
+// parseSocketAddress decodes an address like 0100007F:1F90. The IP address
+// is stored as a sequence of 32 bit words in host byte order, which is
+// little endian on the platforms the daemon runs on.
+func parseSocketAddress(address string) (string, error) {
+	parts := strings.Split(address, ":")
+	if len(parts) != 2 {
+		return "", fmt.Errorf("malformed address: %s", address)
+	}
+
+	raw, err := hex.DecodeString(parts[0])
+	if err != nil || (len(raw) != net.IPv4len && len(raw) != net.IPv6len) {
+		return "", fmt.Errorf("malformed address: %s", address)
+	}
+
+	ip := make(net.IP, len(raw))
+	for i := 0; i < len(raw); i += 4 {
+		ip[i], ip[i+1], ip[i+2], ip[i+3] = raw[i+3], raw[i+2], raw[i+1], raw[i]
+	}
+
+	port, err := strconv.ParseUint(parts[1], 16, 16)
+	if err != nil {
+		return "", fmt.Errorf("malformed address: %s", address)
+	}
+
+	return net.JoinHostPort(ip.String(), strconv.FormatUint(port, 10)), nil
+}
@@ -0,0 +1,56 @@
+// +build linux
+
+package builtins_test
+
+import (
+	"net"
+	"strconv"
+
+	"code.cloudfoundry.org/diego-ssh/builtins"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+)
+
+var _ = Describe("Netstat", func() {
+	var (
+		stdout   *gbytes.Buffer
+		stdio    builtins.Stdio
+		listener net.Listener
+		port     string
+	)
+
+	BeforeEach(func() {
+		stdout = gbytes.NewBuffer()
+		stdio = builtins.Stdio{Stdout: stdout, Stderr: gbytes.NewBuffer()}
+
+		var err error
+		listener, err = net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		port = strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+	})
+
+	AfterEach(func() {
+		listener.Close()
+	})
+
+	It("lists listening tcp sockets", func() {
+		Expect(builtins.Netstat(stdio, []string{"netstat", "-tl"})).To(Succeed())
+		Expect(stdout).To(gbytes.Say(`Proto +Local Address +Foreign Address +State`))
+		Expect(stdout).To(gbytes.Say(`tcp +127\.0\.0\.1:` + port + ` +0\.0\.0\.0:0 +LISTEN`))
+	})
+
+	It("lists established connections", func() {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+
+		Expect(builtins.Netstat(stdio, []string{"netstat", "-t"})).To(Succeed())
+		Expect(stdout).To(gbytes.Say(`127\.0\.0\.1:` + port + ` +ESTABLISHED`))
+	})
+
+	It("leaves out tcp sockets when only udp is requested", func() {
+		Expect(builtins.Netstat(stdio, []string{"netstat", "-u"})).To(Succeed())
+		Expect(stdout.Contents()).NotTo(ContainSubstring(":" + port + " "))
+	})
+})
@@ -0,0 +1 @@
+package builtins // import "code.cloudfoundry.org/diego-ssh/builtins"
@@ -0,0 +1,98 @@
+// +build !windows
+
+package builtins
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+const procDir = "/proc"
+
+type process struct {
+	pid     int
+	ppid    int
+	state   string
+	command string
+}
+
+// Ps lists the processes of the container from /proc.
+func Ps(stdio Stdio, args []string) error {
+	if len(args) > 1 {
+		return errors.New("usage: ps")
+	}
+
+	entries, err := ioutil.ReadDir(procDir)
+	if err != nil {
+		return err
+	}
+
+	processes := []process{}
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+
+		proc, err := readProcess(pid)
+		if err != nil {
+			// the process exited while we were looking
+			continue
+		}
+		processes = append(processes, proc)
+	}
+
+	sort.Slice(processes, func(i, j int) bool { return processes[i].pid < processes[j].pid })
+
+	writer := tabwriter.NewWriter(stdio.Stdout, 0, 8, 1, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(writer, "PID\tPPID\tS\t COMMAND")
+	for _, proc := range processes {
+		fmt.Fprintf(writer, "%d\t%d\t%s\t %s\n", proc.pid, proc.ppid, proc.state, proc.command)
+	}
+	return writer.Flush()
+}
+
+func readProcess(pid int) (process, error) {
+	dir := filepath.Join(procDir, strconv.Itoa(pid))
+
+	stat, err := ioutil.ReadFile(filepath.Join(dir, "stat"))
+	if err != nil {
+		return process{}, err
+	}
+
+	// the command name is enclosed in parentheses and may contain spaces
+	open := bytes.IndexByte(stat, '(')
+	end := bytes.LastIndexByte(stat, ')')
+	if open < 0 || end < open {
+		return process{}, fmt.Errorf("malformed stat for process %d", pid)
+	}
+
+	fields := strings.Fields(string(stat[end+1:]))
+	if len(fields) < 2 {
+		return process{}, fmt.Errorf("malformed stat for process %d", pid)
+	}
+
+	ppid, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return process{}, err
+	}
+
+	command := "[" + string(stat[open+1:end]) + "]"
+	if cmdline, err := ioutil.ReadFile(filepath.Join(dir, "cmdline")); err == nil && len(cmdline) > 0 {
+		command = strings.Join(strings.Split(strings.TrimRight(string(cmdline), "\x00"), "\x00"), " ")
+	}
+
+	return process{
+		pid:     pid,
+		ppid:    ppid,
+		state:   fields[0],
+		command: command,
+	}, nil
+}
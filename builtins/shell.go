@@ -0,0 +1,95 @@
+// +build !windows
+
+package builtins
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/google/shlex"
+)
+
+// Shell is a minimal interactive shell for containers that do not have one.
+// It reads one command per line, splits it like a POSIX shell would split
+// words, and runs it with Exec. Pipes, redirections and variable expansion
+// are not supported.
+func Shell(stdio Stdio) error {
+	status := 0
+
+	for {
+		fmt.Fprint(stdio.Stdout, "$ ")
+
+		line, err := readLine(stdio.Stdin)
+		if err != nil && line == "" {
+			if err == io.EOF {
+				fmt.Fprintln(stdio.Stdout)
+				return exitStatus(status)
+			}
+			return err
+		}
+
+		args, err := shlex.Split(line)
+		if err != nil {
+			fmt.Fprintf(stdio.Stderr, "sh: %s\n", err)
+			status = 2
+			continue
+		}
+
+		if len(args) == 0 {
+			continue
+		}
+
+		switch args[0] {
+		case "exit":
+			if len(args) > 1 {
+				status, err = strconv.Atoi(args[1])
+				if err != nil {
+					fmt.Fprintf(stdio.Stderr, "sh: exit: %s: numeric argument required\n", args[1])
+					status = 2
+				}
+			}
+			return exitStatus(status)
+		case "help":
+			fmt.Fprintf(stdio.Stdout, "built-in commands: exit help %s\n", strings.Join(Names(), " "))
+			status = 0
+			continue
+		}
+
+		status = 0
+		if err := Exec(stdio, args); err != nil {
+			status = 1
+			if exitErr, ok := err.(*ExitError); ok {
+				status = exitErr.Status
+			}
+		}
+	}
+}
+
+// readLine reads up to and including the next newline one byte at a time,
+// so that no input is consumed beyond the line.
+func readLine(r io.Reader) (string, error) {
+	line := []byte{}
+	buf := make([]byte, 1)
+
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			line = append(line, buf[0])
+			if buf[0] == '\n' {
+				return string(line), nil
+			}
+		}
+		if err != nil {
+			return string(line), err
+		}
+	}
+}
+
+func exitStatus(status int) error {
+	if status == 0 {
+		return nil
+	}
+	return &ExitError{Status: status}
+}
@@ -0,0 +1,60 @@
+// +build !windows
+
+package builtins_test
+
+import (
+	"strings"
+
+	"code.cloudfoundry.org/diego-ssh/builtins"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+)
+
+var _ = Describe("Shell", func() {
+	var (
+		stdout, stderr *gbytes.Buffer
+		stdio          builtins.Stdio
+	)
+
+	BeforeEach(func() {
+		stdout = gbytes.NewBuffer()
+		stderr = gbytes.NewBuffer()
+		stdio = builtins.Stdio{
+			Stdout: stdout,
+			Stderr: stderr,
+			Env:    []string{"PATH=/bin:/usr/bin", "FOO=bar"},
+		}
+	})
+
+	It("runs built-in commands and programs line by line", func() {
+		stdio.Stdin = strings.NewReader("env\necho 'two words'\n")
+
+		Expect(builtins.Shell(stdio)).To(Succeed())
+		Expect(stdout).To(gbytes.Say(`\$ PATH=/bin:/usr/bin\nFOO=bar\n`))
+		Expect(stdout).To(gbytes.Say(`\$ two words\n\$ \n`))
+	})
+
+	It("exits with the status of the last command at end of input", func() {
+		stdio.Stdin = strings.NewReader("false\n")
+		Expect(builtins.Shell(stdio)).To(Equal(&builtins.ExitError{Status: 1}))
+	})
+
+	It("exits with the requested status", func() {
+		stdio.Stdin = strings.NewReader("exit 4\nenv\n")
+		Expect(builtins.Shell(stdio)).To(Equal(&builtins.ExitError{Status: 4}))
+		Expect(stdout.Contents()).NotTo(ContainSubstring("FOO=bar"))
+	})
+
+	It("lists the available commands", func() {
+		stdio.Stdin = strings.NewReader("help")
+		Expect(builtins.Shell(stdio)).To(Succeed())
+		Expect(stdout).To(gbytes.Say("built-in commands: exit help cat env kill ls netstat ps tar"))
+	})
+
+	It("reports lines it cannot split", func() {
+		stdio.Stdin = strings.NewReader("echo 'unterminated\n")
+		Expect(builtins.Shell(stdio)).To(Equal(&builtins.ExitError{Status: 2}))
+		Expect(stderr).To(gbytes.Say("sh: "))
+	})
+})
@@ -0,0 +1,253 @@
+// +build !windows
+
+package builtins
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/pborman/getopt"
+)
+
+var errTarUsage = errors.New("usage: tar -c [-v] [-C DIR] [-f -] PATH... or tar -x [-v] [-C DIR] [-f -]")
+
+// Tar creates an archive of the given paths on stdout (-c) or extracts an
+// archive read from stdin (-x). Archives are never read from or written to
+// files.
+func Tar(stdio Stdio, args []string) error {
+	opts := getopt.New()
+	create := opts.Bool('c', "", "create an archive")
+	extract := opts.Bool('x', "", "extract an archive")
+	verbose := opts.Bool('v', "", "list the files processed")
+	dir := opts.String('C', ".", "change to DIR first")
+	file := opts.String('f', "-", "archive file, only - is supported")
+
+	err := opts.Getopt(args, nil)
+	if err != nil {
+		return err
+	}
+
+	if *create == *extract || *file != "-" {
+		return errTarUsage
+	}
+
+	root := stdio.path(*dir)
+
+	var listing io.Writer
+	if *verbose {
+		// the archive itself goes to stdout
+		listing = stdio.Stderr
+	}
+
+	if *create {
+		if len(opts.Args()) == 0 {
+			return errTarUsage
+		}
+		return createArchive(stdio.Stdout, listing, root, opts.Args())
+	}
+
+	if len(opts.Args()) != 0 {
+		return errTarUsage
+	}
+	return extractArchive(stdio.Stdin, listing, root)
+}
+
+func createArchive(w io.Writer, listing io.Writer, root string, paths []string) error {
+	writer := tar.NewWriter(w)
+
+	for _, path := range paths {
+		err := filepath.Walk(filepath.Join(root, path), func(fullPath string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			name, err := filepath.Rel(root, fullPath)
+			if err != nil {
+				return err
+			}
+
+			link := ""
+			if info.Mode()&os.ModeSymlink != 0 {
+				link, err = os.Readlink(fullPath)
+				if err != nil {
+					return err
+				}
+			}
+
+			header, err := tar.FileInfoHeader(info, link)
+			if err != nil {
+				return err
+			}
+
+			header.Name = filepath.ToSlash(name)
+			if info.IsDir() {
+				header.Name += "/"
+			}
+
+			if listing != nil {
+				fmt.Fprintln(listing, header.Name)
+			}
+
+			err = writer.WriteHeader(header)
+			if err != nil {
+				return err
+			}
+
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+
+			file, err := os.Open(fullPath)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+
+			_, err = io.Copy(writer, file)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return writer.Close()
+}
+
+func extractArchive(r io.Reader, listing io.Writer, root string) error {
+	reader := tar.NewReader(r)
+
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// entries may not escape the target directory, neither by name nor
+		// through a symlink extracted earlier, and like tar itself, symlinks
+		// are replaced instead of written through
+		target := filepath.Join(root, filepath.Clean("/"+header.Name))
+		if target != root {
+			err = checkWithin(root, filepath.Dir(target))
+			if err != nil {
+				return err
+			}
+
+			err = removeSymlink(target)
+			if err != nil {
+				return err
+			}
+		}
+
+		if listing != nil {
+			fmt.Fprintln(listing, header.Name)
+		}
+
+		mode := os.FileMode(header.Mode).Perm()
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, mode)
+		case tar.TypeReg, tar.TypeRegA:
+			err = extractFile(reader, target, mode)
+		case tar.TypeSymlink:
+			err = extractSymlink(root, target, header.Linkname)
+		default:
+			err = fmt.Errorf("unsupported entry type %q for %s", header.Typeflag, header.Name)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func extractFile(r io.Reader, target string, mode os.FileMode) error {
+	err := os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|syscall.O_NOFOLLOW, mode)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(file, r)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// extractSymlink creates a symlink to linkname, which may not point outside
+// of root.
+func extractSymlink(root, target, linkname string) error {
+	destination := linkname
+	if !filepath.IsAbs(destination) {
+		destination = filepath.Join(filepath.Dir(target), destination)
+	}
+
+	err := checkWithin(root, destination)
+	if err != nil {
+		return err
+	}
+
+	return os.Symlink(linkname, target)
+}
+
+func removeSymlink(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	if info.Mode()&os.ModeSymlink == 0 {
+		return nil
+	}
+	return os.Remove(path)
+}
+
+func checkWithin(root, path string) error {
+	resolvedRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return err
+	}
+
+	// walk up to the closest ancestor that already exists
+	existing := path
+	for {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			break
+		}
+		existing = parent
+	}
+
+	resolved, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return err
+	}
+
+	if resolved != resolvedRoot && !strings.HasPrefix(resolved, resolvedRoot+string(filepath.Separator)) {
+		return fmt.Errorf("refusing to extract outside of %s: %s", root, path)
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+// +build !windows
+
+package builtins_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/diego-ssh/builtins"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+)
+
+var _ = Describe("Tar", func() {
+	var (
+		sourceDir, targetDir string
+		stderr               *gbytes.Buffer
+	)
+
+	BeforeEach(func() {
+		var err error
+		sourceDir, err = ioutil.TempDir("", "tar-source")
+		Expect(err).NotTo(HaveOccurred())
+
+		targetDir, err = ioutil.TempDir("", "tar-target")
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(os.MkdirAll(filepath.Join(sourceDir, "app", "sub"), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(sourceDir, "app", "sub", "file"), []byte("contents"), 0640)).To(Succeed())
+		Expect(os.Symlink("sub/file", filepath.Join(sourceDir, "app", "link"))).To(Succeed())
+
+		stderr = gbytes.NewBuffer()
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(sourceDir)
+		os.RemoveAll(targetDir)
+	})
+
+	It("round trips a directory through stdout and stdin", func() {
+		archive := &bytes.Buffer{}
+
+		err := builtins.Tar(builtins.Stdio{Stdout: archive, Stderr: stderr}, []string{"tar", "-cv", "-C", sourceDir, "-f", "-", "app"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stderr).To(gbytes.Say("app/\n"))
+
+		err = builtins.Tar(builtins.Stdio{Stdin: archive, Stderr: stderr, Dir: targetDir}, []string{"tar", "-x"})
+		Expect(err).NotTo(HaveOccurred())
+
+		contents, err := ioutil.ReadFile(filepath.Join(targetDir, "app", "sub", "file"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(contents)).To(Equal("contents"))
+
+		info, err := os.Stat(filepath.Join(targetDir, "app", "sub", "file"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.Mode().Perm()).To(Equal(os.FileMode(0640)))
+
+		link, err := os.Readlink(filepath.Join(targetDir, "app", "link"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(link).To(Equal("sub/file"))
+	})
+
+	It("requires exactly one of -c and -x", func() {
+		err := builtins.Tar(builtins.Stdio{}, []string{"tar", "-cx", "app"})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("does not read or write archive files", func() {
+		err := builtins.Tar(builtins.Stdio{}, []string{"tar", "-c", "-f", "out.tar", "app"})
+		Expect(err).To(HaveOccurred())
+	})
+
+	Context("when an entry tries to escape the target directory", func() {
+		var archive *bytes.Buffer
+
+		BeforeEach(func() {
+			archive = &bytes.Buffer{}
+			writer := tar.NewWriter(archive)
+
+			Expect(writer.WriteHeader(&tar.Header{Name: "escape", Typeflag: tar.TypeSymlink, Linkname: sourceDir})).To(Succeed())
+			Expect(writer.WriteHeader(&tar.Header{Name: "escape/owned", Typeflag: tar.TypeReg, Mode: 0644, Size: 1})).To(Succeed())
+			_, err := writer.Write([]byte("x"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(writer.Close()).To(Succeed())
+		})
+
+		It("refuses to extract it", func() {
+			err := builtins.Tar(builtins.Stdio{Stdin: archive, Dir: targetDir}, []string{"tar", "-x"})
+			Expect(err).To(MatchError(ContainSubstring("refusing to extract outside of")))
+
+			_, err = os.Stat(filepath.Join(sourceDir, "owned"))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+
+		It("refuses symlinks that point outside of the target directory", func() {
+			archive.Reset()
+			writer := tar.NewWriter(archive)
+			Expect(writer.WriteHeader(&tar.Header{Name: "x", Typeflag: tar.TypeSymlink, Linkname: filepath.Join(sourceDir, "app", "sub", "file")})).To(Succeed())
+			Expect(writer.WriteHeader(&tar.Header{Name: "x", Typeflag: tar.TypeReg, Mode: 0644, Size: 1})).To(Succeed())
+			_, err := writer.Write([]byte("x"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(writer.Close()).To(Succeed())
+
+			err = builtins.Tar(builtins.Stdio{Stdin: archive, Dir: targetDir}, []string{"tar", "-x"})
+			Expect(err).To(MatchError(ContainSubstring("refusing to extract outside of")))
+
+			contents, err := ioutil.ReadFile(filepath.Join(sourceDir, "app", "sub", "file"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(contents)).To(Equal("contents"))
+		})
+
+		It("replaces existing symlinks instead of writing through them", func() {
+			Expect(os.Symlink(filepath.Join(sourceDir, "app", "sub", "file"), filepath.Join(targetDir, "x"))).To(Succeed())
+
+			archive.Reset()
+			writer := tar.NewWriter(archive)
+			Expect(writer.WriteHeader(&tar.Header{Name: "x", Typeflag: tar.TypeReg, Mode: 0644, Size: 1})).To(Succeed())
+			_, err := writer.Write([]byte("x"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(writer.Close()).To(Succeed())
+
+			err = builtins.Tar(builtins.Stdio{Stdin: archive, Dir: targetDir}, []string{"tar", "-x"})
+			Expect(err).NotTo(HaveOccurred())
+
+			contents, err := ioutil.ReadFile(filepath.Join(sourceDir, "app", "sub", "file"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(contents)).To(Equal("contents"))
+
+			info, err := os.Lstat(filepath.Join(targetDir, "x"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Mode().IsRegular()).To(BeTrue())
+		})
+
+		It("strips leading parent references from names", func() {
+			archive.Reset()
+			writer := tar.NewWriter(archive)
+			Expect(writer.WriteHeader(&tar.Header{Name: "../../outside", Typeflag: tar.TypeReg, Mode: 0644})).To(Succeed())
+			Expect(writer.Close()).To(Succeed())
+
+			err := builtins.Tar(builtins.Stdio{Stdin: archive, Dir: targetDir}, []string{"tar", "-x"})
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = os.Stat(filepath.Join(targetDir, "outside"))
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+})
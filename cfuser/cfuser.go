@@ -0,0 +1,11 @@
+package cfuser
+
+import "regexp"
+
+// Regex matches cf:<app-guid>/<index>. An index of * selects all running
+// instances of the app.
+var Regex *regexp.Regexp = regexp.MustCompile(`cf:([0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12})/(\d+|\*)`)
+
+// AllInstances is the index that selects every running instance of a
+// process instead of a single one.
+const AllInstances = -1
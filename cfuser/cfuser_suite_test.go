@@ -0,0 +1,13 @@
+package cfuser_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestCFUser(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "CF User Suite")
+}
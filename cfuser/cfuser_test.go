@@ -0,0 +1,25 @@
+package cfuser_test
+
+import (
+	"code.cloudfoundry.org/diego-ssh/cfuser"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Regex", func() {
+	It("matches a single instance of an app", func() {
+		match := cfuser.Regex.FindStringSubmatch("cf:60f0f26e-86b3-4487-8f19-9e94f848f3d2/1")
+		Expect(match).To(Equal([]string{"cf:60f0f26e-86b3-4487-8f19-9e94f848f3d2/1", "60f0f26e-86b3-4487-8f19-9e94f848f3d2", "1"}))
+	})
+
+	It("matches all instances of an app", func() {
+		match := cfuser.Regex.FindStringSubmatch("cf:60f0f26e-86b3-4487-8f19-9e94f848f3d2/*")
+		Expect(match).To(Equal([]string{"cf:60f0f26e-86b3-4487-8f19-9e94f848f3d2/*", "60f0f26e-86b3-4487-8f19-9e94f848f3d2", "*"}))
+	})
+
+	It("does not match other users", func() {
+		Expect(cfuser.Regex.MatchString("cf:not-a-guid/1")).To(BeFalse())
+		Expect(cfuser.Regex.MatchString("diego:some-process-guid/0")).To(BeFalse())
+	})
+})
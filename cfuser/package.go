@@ -0,0 +1 @@
+package cfuser // import "code.cloudfoundry.org/diego-ssh/cfuser"
@@ -0,0 +1,118 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"code.cloudfoundry.org/diego-ssh/cfuser"
+	"code.cloudfoundry.org/diego-ssh/helpers"
+	"code.cloudfoundry.org/lager"
+	"golang.org/x/crypto/ssh"
+)
+
+const DefaultTimeout = 30 * time.Second
+
+var ErrHostKeyMismatch = errors.New("host key fingerprint mismatch")
+
+// Config describes an app instance and the ssh-proxy that it is reached
+// through.
+type Config struct {
+	// ProxyAddress is the host and port of the ssh-proxy.
+	ProxyAddress string
+
+	// HostKeyFingerprint is the MD5, SHA1 or SHA256 fingerprint of the host
+	// key of the proxy, as published in the Cloud Controller info.
+	HostKeyFingerprint string
+
+	// SkipHostKeyValidation accepts any host key. It should only be used in
+	// tests.
+	SkipHostKeyValidation bool
+
+	AppGuid string
+
+	// InstanceIndex selects the instance. AllInstances connects to every
+	// running instance, which only supports running commands.
+	InstanceIndex int
+
+	// Codes provides the one-time codes that authenticate the connection.
+	Codes CodeSource
+
+	// Timeout limits establishing the connection. DefaultTimeout is used
+	// when it is zero.
+	Timeout time.Duration
+}
+
+// AllInstances is the InstanceIndex that selects all instances of the app.
+const AllInstances = cfuser.AllInstances
+
+// User returns the user name that the proxy maps to the app instance.
+func (c Config) User() string {
+	if c.InstanceIndex == AllInstances {
+		return fmt.Sprintf("cf:%s/*", c.AppGuid)
+	}
+	return fmt.Sprintf("cf:%s/%d", c.AppGuid, c.InstanceIndex)
+}
+
+// Dial connects to the app instance through the proxy.
+func Dial(logger lager.Logger, config Config) (*ssh.Client, error) {
+	logger = logger.Session("dial", lager.Data{"proxy": config.ProxyAddress, "user": config.User()})
+
+	clientConfig, err := config.clientConfig()
+	if err != nil {
+		logger.Error("invalid-config", err)
+		return nil, err
+	}
+
+	client, err := ssh.Dial("tcp", config.ProxyAddress, clientConfig)
+	if err != nil {
+		logger.Error("failed-to-dial", err)
+		return nil, err
+	}
+
+	logger.Info("connected")
+	return client, nil
+}
+
+func (c Config) clientConfig() (*ssh.ClientConfig, error) {
+	user := c.User()
+	if !cfuser.Regex.MatchString(user) {
+		return nil, fmt.Errorf("invalid app guid or instance index: %q", user)
+	}
+
+	if c.Codes == nil {
+		return nil, errors.New("no source for one-time codes")
+	}
+
+	if c.HostKeyFingerprint == "" && !c.SkipHostKeyValidation {
+		return nil, errors.New("no host key fingerprint")
+	}
+
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+
+	return &ssh.ClientConfig{
+		User: user,
+		Auth: []ssh.AuthMethod{
+			ssh.PasswordCallback(c.Codes.Code),
+		},
+		HostKeyCallback: c.hostKeyCallback,
+		Timeout:         timeout,
+	}, nil
+}
+
+func (c Config) hostKeyCallback(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	if c.SkipHostKeyValidation {
+		return nil
+	}
+
+	switch c.HostKeyFingerprint {
+	case helpers.MD5Fingerprint(key), helpers.SHA1Fingerprint(key), ssh.FingerprintSHA256(key):
+		return nil
+	default:
+		return ErrHostKeyMismatch
+	}
+}
@@ -0,0 +1,384 @@
+package client_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/diego-ssh/client"
+	"code.cloudfoundry.org/diego-ssh/daemon"
+	"code.cloudfoundry.org/diego-ssh/handlers"
+	"code.cloudfoundry.org/diego-ssh/helpers"
+	"code.cloudfoundry.org/lager/lagertest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/crypto/ssh"
+)
+
+const appGuid = "5a6b1a6c-5d52-4b2b-bd3d-d2a4b5a6c7d8"
+
+var _ = Describe("Client", func() {
+	var (
+		logger   *lagertest.TestLogger
+		listener net.Listener
+		config   client.Config
+
+		authenticatedUsers chan string
+		codes              []string
+	)
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test")
+		authenticatedUsers = make(chan string, 10)
+		codes = []string{}
+
+		serverConfig := &ssh.ServerConfig{
+			PasswordCallback: func(metadata ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+				if string(password) != "one-time-code" {
+					return nil, errors.New("bad code")
+				}
+				authenticatedUsers <- metadata.User()
+				return &ssh.Permissions{}, nil
+			},
+		}
+		serverConfig.AddHostKey(TestHostKey)
+
+		sessionHandler := handlers.NewSessionChannelHandler(
+			handlers.NewCommandRunner(),
+			handlers.NewShellLocator(),
+			map[string]string{},
+			time.Second,
+			handlers.SessionOptions{},
+		)
+		sshd := daemon.New(logger, serverConfig, nil, map[string]handlers.NewChannelHandler{
+			"session":      sessionHandler,
+			"direct-tcpip": handlers.NewDirectTcpipChannelHandler(&net.Dialer{}),
+		})
+
+		var err error
+		listener, err = net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				go sshd.HandleConnection(conn)
+			}
+		}()
+
+		config = client.Config{
+			ProxyAddress:       listener.Addr().String(),
+			HostKeyFingerprint: helpers.SHA1Fingerprint(TestHostKey.PublicKey()),
+			AppGuid:            appGuid,
+			InstanceIndex:      2,
+			Codes: client.CodeSourceFunc(func() (string, error) {
+				codes = append(codes, "one-time-code")
+				return "one-time-code", nil
+			}),
+		}
+	})
+
+	AfterEach(func() {
+		listener.Close()
+	})
+
+	Describe("Dial", func() {
+		It("authenticates as the app instance with a one-time code", func() {
+			sshClient, err := client.Dial(logger, config)
+			Expect(err).NotTo(HaveOccurred())
+			defer sshClient.Close()
+
+			Expect(authenticatedUsers).To(Receive(Equal("cf:" + appGuid + "/2")))
+			Expect(codes).To(HaveLen(1))
+		})
+
+		It("accepts MD5 and SHA256 fingerprints", func() {
+			config.HostKeyFingerprint = helpers.MD5Fingerprint(TestHostKey.PublicKey())
+			sshClient, err := client.Dial(logger, config)
+			Expect(err).NotTo(HaveOccurred())
+			sshClient.Close()
+
+			config.HostKeyFingerprint = ssh.FingerprintSHA256(TestHostKey.PublicKey())
+			sshClient, err = client.Dial(logger, config)
+			Expect(err).NotTo(HaveOccurred())
+			sshClient.Close()
+		})
+
+		Context("when the host key does not match the fingerprint", func() {
+			BeforeEach(func() {
+				config.HostKeyFingerprint = "00:11:22:33:44:55:66:77:88:99:aa:bb:cc:dd:ee:ff"
+			})
+
+			It("fails", func() {
+				_, err := client.Dial(logger, config)
+				Expect(err).To(MatchError(ContainSubstring(client.ErrHostKeyMismatch.Error())))
+				Expect(authenticatedUsers).NotTo(Receive())
+			})
+		})
+
+		Context("when no fingerprint is configured", func() {
+			BeforeEach(func() {
+				config.HostKeyFingerprint = ""
+			})
+
+			It("fails unless host key validation is skipped", func() {
+				_, err := client.Dial(logger, config)
+				Expect(err).To(MatchError("no host key fingerprint"))
+
+				config.SkipHostKeyValidation = true
+				sshClient, err := client.Dial(logger, config)
+				Expect(err).NotTo(HaveOccurred())
+				sshClient.Close()
+			})
+		})
+
+		Context("when the app guid is invalid", func() {
+			BeforeEach(func() {
+				config.AppGuid = "not-a-guid"
+			})
+
+			It("fails without connecting", func() {
+				_, err := client.Dial(logger, config)
+				Expect(err).To(MatchError(ContainSubstring("invalid app guid")))
+				Expect(codes).To(BeEmpty())
+			})
+		})
+
+		Context("when no code can be obtained", func() {
+			BeforeEach(func() {
+				config.Codes = client.CodeSourceFunc(func() (string, error) {
+					return "", errors.New("uaa is down")
+				})
+			})
+
+			It("fails to authenticate", func() {
+				_, err := client.Dial(logger, config)
+				Expect(err).To(HaveOccurred())
+			})
+		})
+	})
+
+	Context("when connected", func() {
+		var sshClient *ssh.Client
+
+		BeforeEach(func() {
+			var err error
+			sshClient, err = client.Dial(logger, config)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			sshClient.Close()
+		})
+
+		Describe("Run", func() {
+			It("returns the output and the exit status of the command", func() {
+				stdout := &bytes.Buffer{}
+				stderr := &bytes.Buffer{}
+
+				status, err := client.Run(sshClient, "echo -n out; echo -n err >&2; exit 3", nil, stdout, stderr)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(status).To(Equal(3))
+				Expect(stdout.String()).To(Equal("out"))
+				Expect(stderr.String()).To(Equal("err"))
+			})
+		})
+
+		Describe("Interactive", func() {
+			It("runs the command with a terminal and forwards window changes", func() {
+				resize := make(chan client.WindowSize, 1)
+				stdin, stdinWriter := net.Pipe()
+				stdout := &bytes.Buffer{}
+
+				done := make(chan int)
+				go func() {
+					defer GinkgoRecover()
+					status, err := client.Interactive(sshClient, client.TerminalOptions{
+						Size:    client.WindowSize{Columns: 80, Rows: 24},
+						Resize:  resize,
+						Command: "stty size; read line; stty size",
+					}, stdin, stdout, ioutil.Discard)
+					Expect(err).NotTo(HaveOccurred())
+					done <- status
+				}()
+
+				Eventually(func() string { return stdout.String() }).Should(ContainSubstring("24 80"))
+
+				resize <- client.WindowSize{Columns: 100, Rows: 40}
+				time.Sleep(100 * time.Millisecond)
+				stdinWriter.Write([]byte("\n"))
+
+				Eventually(done, 5).Should(Receive(Equal(0)))
+				Expect(stdout.String()).To(ContainSubstring("40 100"))
+			})
+		})
+
+		Describe("NewSFTPClient", func() {
+			It("starts the sftp subsystem", func() {
+				tempDir, err := ioutil.TempDir("", "client-sftp")
+				Expect(err).NotTo(HaveOccurred())
+				defer os.RemoveAll(tempDir)
+
+				Expect(ioutil.WriteFile(filepath.Join(tempDir, "app.log"), []byte("log"), 0644)).To(Succeed())
+
+				sftpClient, err := client.NewSFTPClient(sshClient)
+				Expect(err).NotTo(HaveOccurred())
+				defer sftpClient.Close()
+
+				info, err := sftpClient.Stat(filepath.Join(tempDir, "app.log"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(info.Size()).To(BeEquivalentTo(3))
+			})
+		})
+	})
+
+	Describe("Reconnector", func() {
+		var (
+			reconnector *client.Reconnector
+			echoServer  net.Listener
+			dials       int
+		)
+
+		BeforeEach(func() {
+			var err error
+			echoServer, err = net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+
+			go func() {
+				for {
+					conn, err := echoServer.Accept()
+					if err != nil {
+						return
+					}
+					go func() {
+						defer conn.Close()
+						buf := make([]byte, 64)
+						n, _ := conn.Read(buf)
+						conn.Write([]byte(strings.ToUpper(string(buf[:n]))))
+					}()
+				}
+			}()
+
+			dials = 0
+			reconnector = client.NewReconnector(logger, func() (*ssh.Client, error) {
+				dials++
+				return client.Dial(logger, config)
+			}, 10*time.Millisecond)
+		})
+
+		AfterEach(func() {
+			reconnector.Close()
+			echoServer.Close()
+		})
+
+		exchange := func(address string) string {
+			conn, err := net.Dial("tcp", address)
+			if err != nil {
+				return ""
+			}
+			defer conn.Close()
+
+			_, err = conn.Write([]byte("hello"))
+			if err != nil {
+				return ""
+			}
+
+			reply, _ := ioutil.ReadAll(conn)
+			return string(reply)
+		}
+
+		It("forwards local connections and reconnects when the connection is lost", func() {
+			localListener, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+			defer localListener.Close()
+
+			go reconnector.LocalForward(localListener, echoServer.Addr().String())
+
+			Expect(exchange(localListener.Addr().String())).To(Equal("HELLO"))
+			Expect(dials).To(Equal(1))
+
+			sshClient, err := reconnector.Client()
+			Expect(err).NotTo(HaveOccurred())
+			sshClient.Close()
+
+			Eventually(func() string {
+				return exchange(localListener.Addr().String())
+			}).Should(Equal("HELLO"))
+			Expect(dials).To(BeNumerically(">=", 2))
+		})
+
+		It("fails once it is closed", func() {
+			Expect(reconnector.Close()).To(Succeed())
+
+			_, err := reconnector.Client()
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("NewUAACodeSource", func() {
+		var (
+			uaa      *http.Server
+			uaaLn    net.Listener
+			requests chan *http.Request
+			status   int
+		)
+
+		BeforeEach(func() {
+			requests = make(chan *http.Request, 1)
+			status = http.StatusFound
+
+			var err error
+			uaaLn, err = net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+
+			uaa = &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests <- r
+				w.Header().Set("Location", "https://uaa.example.com/login?code=abc123")
+				w.WriteHeader(status)
+			})}
+			go uaa.Serve(uaaLn)
+		})
+
+		AfterEach(func() {
+			uaaLn.Close()
+		})
+
+		It("requests a code for the client with the access token", func() {
+			codeSource := client.NewUAACodeSource(&http.Client{}, fmt.Sprintf("http://%s/", uaaLn.Addr()), "ssh-proxy", "token")
+
+			code, err := codeSource.Code()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(code).To(Equal("abc123"))
+
+			var request *http.Request
+			Expect(requests).To(Receive(&request))
+			Expect(request.URL.Path).To(Equal("/oauth/authorize"))
+			Expect(request.URL.Query().Get("response_type")).To(Equal("code"))
+			Expect(request.URL.Query().Get("client_id")).To(Equal("ssh-proxy"))
+			Expect(request.Header.Get("Authorization")).To(Equal("bearer token"))
+		})
+
+		Context("when UAA does not redirect", func() {
+			BeforeEach(func() {
+				status = http.StatusUnauthorized
+			})
+
+			It("returns an error", func() {
+				codeSource := client.NewUAACodeSource(&http.Client{}, fmt.Sprintf("http://%s", uaaLn.Addr()), "ssh-proxy", "bearer token")
+
+				_, err := codeSource.Code()
+				Expect(err).To(MatchError(ContainSubstring("401")))
+			})
+		})
+	})
+})
@@ -0,0 +1,85 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// CodeSource provides one-time authorization codes. A new code is requested
+// for every authentication attempt.
+type CodeSource interface {
+	Code() (string, error)
+}
+
+// CodeSourceFunc lets a function be used as a CodeSource.
+type CodeSourceFunc func() (string, error)
+
+func (f CodeSourceFunc) Code() (string, error) {
+	return f()
+}
+
+type uaaCodeSource struct {
+	httpClient  *http.Client
+	uaaURL      string
+	clientID    string
+	accessToken string
+}
+
+// NewUAACodeSource returns a CodeSource that gets one-time codes from UAA
+// for an OAuth client, usually ssh-proxy, with the access token of a user.
+func NewUAACodeSource(httpClient *http.Client, uaaURL, clientID, accessToken string) CodeSource {
+	return &uaaCodeSource{
+		httpClient:  httpClient,
+		uaaURL:      strings.TrimSuffix(uaaURL, "/"),
+		clientID:    clientID,
+		accessToken: accessToken,
+	}
+}
+
+func (u *uaaCodeSource) Code() (string, error) {
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", u.clientID)
+
+	req, err := http.NewRequest("GET", u.uaaURL+"/oauth/authorize?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+
+	accessToken := u.accessToken
+	if !strings.Contains(accessToken, " ") {
+		accessToken = "bearer " + accessToken
+	}
+	req.Header.Set("Authorization", accessToken)
+
+	// The code is handed out in the redirect, which must not be followed
+	client := *u.httpClient
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusFound {
+		return "", fmt.Errorf("authorize request failed: %s", resp.Status)
+	}
+
+	location, err := resp.Location()
+	if err != nil {
+		return "", err
+	}
+
+	code := location.Query().Get("code")
+	if code == "" {
+		return "", errors.New("authorize response does not contain a code")
+	}
+
+	return code, nil
+}
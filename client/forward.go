@@ -0,0 +1,219 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/diego-ssh/helpers"
+	"code.cloudfoundry.org/lager"
+	"golang.org/x/crypto/ssh"
+)
+
+const DefaultReconnectInterval = time.Second
+
+var errClosed = errors.New("reconnector closed")
+
+// DialFunc connects to an app instance, usually by calling Dial with a
+// Config.
+type DialFunc func() (*ssh.Client, error)
+
+// Reconnector holds the connection that port forwards use and dials a new
+// one once it is lost.
+type Reconnector struct {
+	logger   lager.Logger
+	dial     DialFunc
+	interval time.Duration
+
+	lock   sync.Mutex
+	client *ssh.Client
+	closed bool
+}
+
+func NewReconnector(logger lager.Logger, dial DialFunc, interval time.Duration) *Reconnector {
+	if interval == 0 {
+		interval = DefaultReconnectInterval
+	}
+
+	return &Reconnector{
+		logger:   logger.Session("reconnector"),
+		dial:     dial,
+		interval: interval,
+	}
+}
+
+// Client returns the current connection or dials a new one.
+func (r *Reconnector) Client() (*ssh.Client, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.closed {
+		return nil, errClosed
+	}
+
+	if r.client != nil {
+		return r.client, nil
+	}
+
+	client, err := r.dial()
+	if err != nil {
+		r.logger.Error("failed-to-dial", err)
+		return nil, err
+	}
+
+	r.client = client
+	go func() {
+		client.Wait()
+		r.logger.Info("connection-lost")
+		r.discard(client)
+	}()
+
+	return client, nil
+}
+
+// Close closes the current connection and stops reconnecting.
+func (r *Reconnector) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.closed = true
+	if r.client == nil {
+		return nil
+	}
+
+	client := r.client
+	r.client = nil
+	return client.Close()
+}
+
+// discard drops client so that the next call to Client dials again.
+func (r *Reconnector) discard(client *ssh.Client) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.client == client {
+		r.client = nil
+		client.Close()
+	}
+}
+
+func (r *Reconnector) isClosed() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.closed
+}
+
+// LocalForward accepts connections on listener and forwards them to
+// remoteAddress in the container until the listener is closed. Connections
+// that cannot be opened are retried once on a new connection.
+func (r *Reconnector) LocalForward(listener net.Listener, remoteAddress string) error {
+	logger := r.logger.Session("local-forward", lager.Data{"local": listener.Addr().String(), "remote": remoteAddress})
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			logger.Info("stopped", lager.Data{"reason": err.Error()})
+			return err
+		}
+
+		go r.forwardLocal(logger, conn, remoteAddress)
+	}
+}
+
+func (r *Reconnector) forwardLocal(logger lager.Logger, conn net.Conn, remoteAddress string) {
+	remote, err := r.dialRemote(remoteAddress)
+	if err != nil {
+		logger.Error("failed-to-dial-remote", err)
+		conn.Close()
+		return
+	}
+
+	forward(logger, conn, remote)
+}
+
+func (r *Reconnector) dialRemote(remoteAddress string) (net.Conn, error) {
+	client, err := r.Client()
+	if err != nil {
+		return nil, err
+	}
+
+	remote, err := client.Dial("tcp", remoteAddress)
+	if err == nil {
+		return remote, nil
+	}
+
+	// The connection may have been lost without Wait noticing yet
+	r.discard(client)
+
+	client, err = r.Client()
+	if err != nil {
+		return nil, err
+	}
+
+	return client.Dial("tcp", remoteAddress)
+}
+
+// RemoteForward listens on remoteAddress in the container and forwards the
+// connections to localAddress until the Reconnector is closed. The listener
+// is opened again on a new connection when the connection is lost.
+func (r *Reconnector) RemoteForward(remoteAddress, localAddress string) error {
+	logger := r.logger.Session("remote-forward", lager.Data{"remote": remoteAddress, "local": localAddress})
+
+	for !r.isClosed() {
+		client, err := r.Client()
+		if err != nil {
+			time.Sleep(r.interval)
+			continue
+		}
+
+		listener, err := client.Listen("tcp", remoteAddress)
+		if err != nil {
+			logger.Error("failed-to-listen", err)
+			r.discard(client)
+			time.Sleep(r.interval)
+			continue
+		}
+
+		logger.Info("listening")
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				logger.Info("listener-closed", lager.Data{"reason": err.Error()})
+				break
+			}
+
+			go func() {
+				local, err := net.Dial("tcp", localAddress)
+				if err != nil {
+					logger.Error("failed-to-dial-local", err)
+					conn.Close()
+					return
+				}
+
+				forward(logger, conn, local)
+			}()
+		}
+
+		listener.Close()
+		r.discard(client)
+	}
+
+	return errClosed
+}
+
+func forward(logger lager.Logger, a, b net.Conn) {
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+
+	closeBoth := func() {
+		a.Close()
+		b.Close()
+	}
+
+	go helpers.CopyAndClose(logger, wg, a, b, closeBoth)
+	go helpers.CopyAndClose(logger, wg, b, a, closeBoth)
+
+	wg.Wait()
+}
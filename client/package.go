@@ -0,0 +1 @@
+package client // import "code.cloudfoundry.org/diego-ssh/client"
@@ -0,0 +1,114 @@
+package client
+
+import (
+	"io"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Run runs command in a new session and returns its exit status. The error
+// is only set when the command could not be run or did not exit normally.
+func Run(client *ssh.Client, command string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return 0, err
+	}
+	defer session.Close()
+
+	session.Stdin = stdin
+	session.Stdout = stdout
+	session.Stderr = stderr
+
+	err = session.Run(command)
+	if exitErr, ok := err.(*ssh.ExitError); ok {
+		return exitErr.ExitStatus(), nil
+	}
+
+	return 0, err
+}
+
+// WindowSize is the size of a terminal in characters.
+type WindowSize struct {
+	Columns int
+	Rows    int
+}
+
+// TerminalOptions describe the pseudo-terminal of an interactive session.
+type TerminalOptions struct {
+	// Term is the value of TERM, xterm when empty.
+	Term string
+
+	Size  WindowSize
+	Modes ssh.TerminalModes
+
+	// Resize delivers the new size whenever the local terminal changes size.
+	Resize <-chan WindowSize
+
+	// Command is run instead of the login shell when it is set.
+	Command string
+}
+
+// Interactive runs a shell, or the command of the options, with a
+// pseudo-terminal until it exits. Putting the local terminal into raw mode is
+// left to the caller.
+func Interactive(client *ssh.Client, options TerminalOptions, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return 0, err
+	}
+	defer session.Close()
+
+	term := options.Term
+	if term == "" {
+		term = "xterm"
+	}
+
+	modes := options.Modes
+	if modes == nil {
+		modes = ssh.TerminalModes{}
+	}
+
+	err = session.RequestPty(term, options.Size.Rows, options.Size.Columns, modes)
+	if err != nil {
+		return 0, err
+	}
+
+	session.Stdin = stdin
+	session.Stdout = stdout
+	session.Stderr = stderr
+
+	if options.Command != "" {
+		err = session.Start(options.Command)
+	} else {
+		err = session.Shell()
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	if options.Resize != nil {
+		go func() {
+			for {
+				select {
+				case size, ok := <-options.Resize:
+					if !ok {
+						return
+					}
+					session.WindowChange(size.Rows, size.Columns)
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	err = session.Wait()
+	if exitErr, ok := err.(*ssh.ExitError); ok {
+		return exitErr.ExitStatus(), nil
+	}
+
+	return 0, err
+}
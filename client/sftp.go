@@ -0,0 +1,11 @@
+package client
+
+import (
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// NewSFTPClient starts the sftp subsystem of the app instance.
+func NewSFTPClient(client *ssh.Client) (*sftp.Client, error) {
+	return sftp.NewClient(client)
+}
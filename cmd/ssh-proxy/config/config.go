@@ -7,6 +7,7 @@ import (
 	"errors"
 	"io/ioutil"
 	"os"
+	"time"
 
 	"code.cloudfoundry.org/debugserver"
 	loggingclient "code.cloudfoundry.org/diego-logging-client"
@@ -15,6 +16,10 @@ import (
 	"code.cloudfoundry.org/tlsconfig"
 )
 
+// DefaultLoginGraceTime is how long a client has to authenticate when
+// login_grace_time is not set. It matches the default of OpenSSH.
+const DefaultLoginGraceTime = 2 * time.Minute
+
 type SSHProxyConfig struct {
 	lagerflags.LagerConfig
 	debugserver.DebugServerConfig
@@ -22,6 +27,8 @@ type SSHProxyConfig struct {
 	HealthCheckAddress              string                `json:"health_check_address,omitempty"`
 	DisableHealthCheckServer        bool                  `json:"disable_health_check_server,omitempty"`
 	HostKey                         string                `json:"host_key"`
+	HostKeys                        []string              `json:"host_keys,omitempty"`
+	HostCertificates                []string              `json:"host_certificates,omitempty"`
 	BBSAddress                      string                `json:"bbs_address"`
 	CCAPIURL                        string                `json:"cc_api_url"`
 	CCAPICACert                     string                `json:"cc_api_ca_cert"`
@@ -47,6 +54,24 @@ type SSHProxyConfig struct {
 	CommunicationTimeout            durationjson.Duration `json:"communication_timeout,omitempty"`
 	IdleConnectionTimeout           durationjson.Duration `json:"idle_connection_timeout,omitempty"`
 	ConnectToInstanceAddress        bool                  `json:"connect_to_instance_address"`
+	TerminateOnInstanceStop         bool                  `json:"terminate_on_instance_stop,omitempty"`
+	AccessCheckInterval             durationjson.Duration `json:"access_check_interval,omitempty"`
+	MaxSessionDuration              durationjson.Duration `json:"max_session_duration,omitempty"`
+	SessionIdleTimeout              durationjson.Duration `json:"session_idle_timeout,omitempty"`
+	SessionLimitWarning             durationjson.Duration `json:"session_limit_warning,omitempty"`
+	AllowedSourceCIDRs              []string              `json:"allowed_source_cidrs,omitempty"`
+	DeniedSourceCIDRs               []string              `json:"denied_source_cidrs,omitempty"`
+	ConnectionRateLimit             float64               `json:"connection_rate_limit,omitempty"`
+	ConnectionRateBurst             int                   `json:"connection_rate_burst,omitempty"`
+	AuthenticationRateLimit         float64               `json:"authentication_rate_limit,omitempty"`
+	AuthenticationRateBurst         int                   `json:"authentication_rate_burst,omitempty"`
+	BanThreshold                    int                   `json:"ban_threshold,omitempty"`
+	BanWindow                       durationjson.Duration `json:"ban_window,omitempty"`
+	BanDuration                     durationjson.Duration `json:"ban_duration,omitempty"`
+	EnableProxyProtocol             bool                  `json:"enable_proxy_protocol,omitempty"`
+	MaxStartups                     string                `json:"max_startups,omitempty"`
+	LoginGraceTime                  durationjson.Duration `json:"login_grace_time,omitempty"`
+	FanOutWorkers                   int                   `json:"fan_out_workers,omitempty"`
 
 	BackendsTLSEnabled    bool   `json:"backends_tls_enabled,omitempty"`
 	BackendsTLSCACerts    string `json:"backends_tls_ca_certificates,omitempty"`
@@ -54,8 +79,12 @@ type SSHProxyConfig struct {
 	BackendsTLSClientKey  string `json:"backends_tls_client_private_key,omitempty"`
 }
 
+// NewSSHProxyConfig reads the config file at configPath. A login_grace_time
+// that is not present in the file is set to its default, while 0 disables it.
 func NewSSHProxyConfig(configPath string) (SSHProxyConfig, error) {
-	proxyConfig := SSHProxyConfig{}
+	proxyConfig := SSHProxyConfig{
+		LoginGraceTime: durationjson.Duration(DefaultLoginGraceTime),
+	}
 
 	configFile, err := os.Open(configPath)
 	if err != nil {
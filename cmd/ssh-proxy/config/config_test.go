@@ -25,6 +25,8 @@ var _ = Describe("SSHProxyConfig", func() {
 			"health_check_address": "2.2.2.2",
 			"disable_health_check_server": true,
 			"host_key": "I am a host key.",
+			"host_keys": ["I am another host key."],
+			"host_certificates": ["I am a host certificate."],
 			"bbs_address": "3.3.3.3",
 			"cc_api_url": "4.4.4.4",
 			"cc_api_ca_cert": "I am a cc ca cert.",
@@ -50,6 +52,24 @@ var _ = Describe("SSHProxyConfig", func() {
 			"debug_address": "5.5.5.5:9090",
 			"connect_to_instance_address": true,
 			"idle_connection_timeout": "5ms",
+			"terminate_on_instance_stop": true,
+			"access_check_interval": "5m",
+			"max_session_duration": "8h",
+			"session_idle_timeout": "30m",
+			"session_limit_warning": "2m",
+			"allowed_source_cidrs": ["10.0.0.0/8", "192.168.1.1"],
+			"denied_source_cidrs": ["10.1.0.0/16"],
+			"connection_rate_limit": 0.5,
+			"connection_rate_burst": 5,
+			"authentication_rate_limit": 2,
+			"authentication_rate_burst": 10,
+			"ban_threshold": 5,
+			"ban_window": "10m",
+			"ban_duration": "1h",
+			"enable_proxy_protocol": true,
+			"max_startups": "10:30:100",
+			"login_grace_time": "30s",
+			"fan_out_workers": 4,
 
 			"backends_tls_enabled": true,
 			"backends_tls_ca_certificates": "./some_filepath/ca.crt",
@@ -86,6 +106,8 @@ var _ = Describe("SSHProxyConfig", func() {
 				HealthCheckAddress:              "2.2.2.2",
 				DisableHealthCheckServer:        true,
 				HostKey:                         "I am a host key.",
+				HostKeys:                        []string{"I am another host key."},
+				HostCertificates:                []string{"I am a host certificate."},
 				BBSAddress:                      "3.3.3.3",
 				CCAPIURL:                        "4.4.4.4",
 				CCAPICACert:                     "I am a cc ca cert.",
@@ -109,6 +131,24 @@ var _ = Describe("SSHProxyConfig", func() {
 				AllowedKeyExchanges:             "exchange1,exchange2,exchange3",
 				ConnectToInstanceAddress:        true,
 				IdleConnectionTimeout:           durationjson.Duration(5 * time.Millisecond),
+				TerminateOnInstanceStop:         true,
+				AccessCheckInterval:             durationjson.Duration(5 * time.Minute),
+				MaxSessionDuration:              durationjson.Duration(8 * time.Hour),
+				SessionIdleTimeout:              durationjson.Duration(30 * time.Minute),
+				SessionLimitWarning:             durationjson.Duration(2 * time.Minute),
+				AllowedSourceCIDRs:              []string{"10.0.0.0/8", "192.168.1.1"},
+				DeniedSourceCIDRs:               []string{"10.1.0.0/16"},
+				ConnectionRateLimit:             0.5,
+				ConnectionRateBurst:             5,
+				AuthenticationRateLimit:         2,
+				AuthenticationRateBurst:         10,
+				BanThreshold:                    5,
+				BanWindow:                       durationjson.Duration(10 * time.Minute),
+				BanDuration:                     durationjson.Duration(time.Hour),
+				EnableProxyProtocol:             true,
+				MaxStartups:                     "10:30:100",
+				LoginGraceTime:                  durationjson.Duration(30 * time.Second),
+				FanOutWorkers:                   4,
 				LagerConfig: lagerflags.LagerConfig{
 					LogLevel: lagerflags.DEBUG,
 				},
@@ -123,6 +163,30 @@ var _ = Describe("SSHProxyConfig", func() {
 			}))
 		})
 
+		Context("when the login grace time is not set", func() {
+			BeforeEach(func() {
+				configData = `{}`
+			})
+
+			It("uses the default", func() {
+				proxyConfig, err := config.NewSSHProxyConfig(configFilePath)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(proxyConfig.LoginGraceTime).To(Equal(durationjson.Duration(config.DefaultLoginGraceTime)))
+			})
+		})
+
+		Context("when the login grace time is 0", func() {
+			BeforeEach(func() {
+				configData = `{"login_grace_time": "0s"}`
+			})
+
+			It("keeps it disabled", func() {
+				proxyConfig, err := config.NewSSHProxyConfig(configFilePath)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(proxyConfig.LoginGraceTime).To(BeZero())
+			})
+		})
+
 		Context("when the file does not exist", func() {
 			It("returns an error", func() {
 				_, err := config.NewSSHProxyConfig("foobar")
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"code.cloudfoundry.org/diego-ssh/cmd/ssh-proxy/config"
+	"code.cloudfoundry.org/lager"
+	"golang.org/x/crypto/ssh"
+)
+
+// hostKeySet holds the host keys of the proxy and the certificates that are
+// presented for them.
+type hostKeySet struct {
+	keys         []ssh.Signer
+	certificates []ssh.Signer
+}
+
+// presented returns the signers that are offered during the key exchange.
+// Only the first key of each type can be offered; the others are announced
+// to clients after authentication so that the keys can be rotated.
+func (h hostKeySet) presented() []ssh.Signer {
+	signers := append([]ssh.Signer{}, h.certificates...)
+
+	seen := map[string]bool{}
+	for _, key := range h.keys {
+		keyType := key.PublicKey().Type()
+		if seen[keyType] {
+			continue
+		}
+		seen[keyType] = true
+		signers = append(signers, key)
+	}
+
+	return signers
+}
+
+// loadHostKeys parses the host keys and host certificates of the config.
+// host_key is the first key, followed by the keys in host_keys. Every
+// certificate has to certify one of the keys.
+func loadHostKeys(logger lager.Logger, sshProxyConfig config.SSHProxyConfig) (hostKeySet, error) {
+	encodedKeys := sshProxyConfig.HostKeys
+	if sshProxyConfig.HostKey != "" {
+		encodedKeys = append([]string{sshProxyConfig.HostKey}, encodedKeys...)
+	}
+
+	if len(encodedKeys) == 0 {
+		err := errors.New("hostKey is required")
+		logger.Error("host-key-required", err)
+		return hostKeySet{}, err
+	}
+
+	var hostKeys hostKeySet
+	for _, encodedKey := range encodedKeys {
+		key, err := parseHostKey(logger, encodedKey)
+		if err != nil {
+			logger.Error("failed-to-parse-host-key", err)
+			return hostKeySet{}, err
+		}
+
+		hostKeys.keys = append(hostKeys.keys, key)
+	}
+
+	for _, encodedCertificate := range sshProxyConfig.HostCertificates {
+		certificate, err := parseHostCertificate(encodedCertificate)
+		if err != nil {
+			logger.Error("failed-to-parse-host-certificate", err)
+			return hostKeySet{}, err
+		}
+
+		var key ssh.Signer
+		for _, hostKey := range hostKeys.keys {
+			if bytes.Equal(hostKey.PublicKey().Marshal(), certificate.Key.Marshal()) {
+				key = hostKey
+				break
+			}
+		}
+		if key == nil {
+			err := errors.New("host certificate does not match any host key")
+			logger.Error("failed-to-parse-host-certificate", err)
+			return hostKeySet{}, err
+		}
+
+		signer, err := ssh.NewCertSigner(certificate, key)
+		if err != nil {
+			logger.Error("failed-to-parse-host-certificate", err)
+			return hostKeySet{}, err
+		}
+
+		hostKeys.certificates = append(hostKeys.certificates, signer)
+	}
+
+	return hostKeys, nil
+}
+
+// parseHostKey parses a PEM-encoded RSA, ECDSA or Ed25519 private key.
+func parseHostKey(logger lager.Logger, encodedKey string) (ssh.Signer, error) {
+	key, err := parsePrivateKey(logger, encodedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	switch key.PublicKey().Type() {
+	case ssh.KeyAlgoRSA, ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521, ssh.KeyAlgoED25519:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported host key type: %s", key.PublicKey().Type())
+	}
+}
+
+func parseHostCertificate(encodedCertificate string) (*ssh.Certificate, error) {
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(encodedCertificate))
+	if err != nil {
+		return nil, err
+	}
+
+	certificate, ok := publicKey.(*ssh.Certificate)
+	if !ok {
+		return nil, errors.New("not a certificate")
+	}
+
+	if certificate.CertType != ssh.HostCert {
+		return nil, errors.New("not a host certificate")
+	}
+
+	return certificate, nil
+}
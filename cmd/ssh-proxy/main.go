@@ -14,6 +14,7 @@ import (
 	"code.cloudfoundry.org/consuladapter"
 	"code.cloudfoundry.org/debugserver"
 	loggingclient "code.cloudfoundry.org/diego-logging-client"
+	"code.cloudfoundry.org/diego-ssh/admission"
 	"code.cloudfoundry.org/diego-ssh/authenticators"
 	"code.cloudfoundry.org/diego-ssh/cmd/ssh-proxy/config"
 	"code.cloudfoundry.org/diego-ssh/healthcheck"
@@ -38,11 +39,26 @@ var configPath = flag.String(
 	"Path to SSH Proxy config.",
 )
 
+var validate = flag.Bool(
+	"validate",
+	false,
+	"Check the config, report every problem as JSON and exit without starting SSH Proxy.",
+)
+
 func main() {
 	debugserver.AddFlags(flag.CommandLine)
 	flag.Parse()
 
 	sshProxyConfig, err := config.NewSSHProxyConfig(*configPath)
+	if *validate {
+		var problems helpers.ConfigProblems
+		if err != nil {
+			problems.Add("config", err)
+		} else {
+			problems = validateConfig(sshProxyConfig)
+		}
+		os.Exit(helpers.WriteConfigReport(os.Stdout, problems))
+	}
 	if err != nil {
 		logger, _ := lagerflags.New("ssh-proxy")
 		logger.Fatal("failed-to-parse-config", err)
@@ -56,7 +72,23 @@ func main() {
 		os.Exit(1)
 	}
 
-	proxySSHServerConfig, err := configureProxy(logger, sshProxyConfig)
+	bbsClient := initializeBBSClient(logger, sshProxyConfig)
+
+	admissionController, err := initializeAdmission(logger, sshProxyConfig, metronClient)
+	if err != nil {
+		logger.Error("invalid-admission-config", err)
+		os.Exit(1)
+	}
+
+	hostKeys, err := loadHostKeys(logger, sshProxyConfig)
+	if err != nil {
+		logger.Error("invalid-host-keys", err)
+		os.Exit(1)
+	}
+
+	accessGrants := proxy.NewAccessGrants()
+
+	proxySSHServerConfig, accessChecker, err := configureProxy(logger, sshProxyConfig, bbsClient, admissionController, hostKeys, accessGrants)
 	if err != nil {
 		logger.Error("configure-failed", err)
 		os.Exit(1)
@@ -68,11 +100,44 @@ func main() {
 		os.Exit(1)
 	}
 	sshProxy := proxy.New(logger, proxySSHServerConfig, metronClient, tlsConfig)
+	sshProxy.SetHostKeys(hostKeys.keys)
+	sshProxy.SetAccessGrants(accessGrants)
+
+	if sshProxyConfig.MaxSessionDuration < 0 || sshProxyConfig.SessionIdleTimeout < 0 || sshProxyConfig.SessionLimitWarning < 0 {
+		logger.Error("invalid-session-limits", errors.New("session limits must not be negative"))
+		os.Exit(1)
+	}
+
+	sshProxy.SetSessionLimits(proxy.SessionLimits{
+		MaxDuration: time.Duration(sshProxyConfig.MaxSessionDuration),
+		IdleTimeout: time.Duration(sshProxyConfig.SessionIdleTimeout),
+		Warning:     time.Duration(sshProxyConfig.SessionLimitWarning),
+	})
+
+	if sshProxyConfig.FanOutWorkers < 0 {
+		logger.Error("invalid-fan-out-workers", errors.New("fan out workers must not be negative"))
+		os.Exit(1)
+	}
+	sshProxy.SetFanOutWorkers(sshProxyConfig.FanOutWorkers)
+
+	maxStartups, loginGraceTime, err := startupLimits(sshProxyConfig)
+	if err != nil {
+		logger.Error("invalid-startup-limits", err)
+		os.Exit(1)
+	}
+
 	server := server.NewServer(logger, sshProxyConfig.Address, sshProxy, time.Duration(sshProxyConfig.IdleConnectionTimeout))
+	server.SetConnectionFilter(admissionController)
+	server.SetMaxStartups(maxStartups)
+	server.SetLoginGraceTime(loginGraceTime)
+	if sshProxyConfig.EnableProxyProtocol {
+		server.EnableProxyProtocol()
+	}
 
 	healthCheckHandler := healthcheck.NewHandler(logger)
 
 	members := grouper.Members{
+		{"admission", admissionController},
 		{"ssh-proxy", server},
 	}
 
@@ -81,6 +146,34 @@ func main() {
 		members = append(members, grouper.Member{"healthcheck", httpServer})
 	}
 
+	if sshProxyConfig.TerminateOnInstanceStop {
+		instanceMonitor := proxy.NewInstanceMonitor(logger, bbsClient, sshProxy, clock.NewClock())
+		members = append(members, grouper.Member{"instance-monitor", instanceMonitor})
+	}
+
+	if sshProxyConfig.AccessCheckInterval < 0 {
+		logger.Error("invalid-access-check-interval", errors.New("accessCheckInterval must not be negative"))
+		os.Exit(1)
+	}
+
+	reloadableChecker := &reloadableAccessChecker{checker: accessChecker}
+
+	if sshProxyConfig.AccessCheckInterval > 0 && accessChecker != nil {
+		accessMonitor := proxy.NewAccessMonitor(logger, reloadableChecker, sshProxy, time.Duration(sshProxyConfig.AccessCheckInterval), clock.NewClock())
+		members = append(members, grouper.Member{"access-monitor", accessMonitor})
+	}
+
+	members = append(members, grouper.Member{"config-reloader", &configReloader{
+		logger:              logger,
+		configPath:          *configPath,
+		sink:                reconfigurableSink,
+		bbsClient:           bbsClient,
+		admissionController: admissionController,
+		sshProxy:            sshProxy,
+		accessChecker:       reloadableChecker,
+		accessGrants:        accessGrants,
+	}})
+
 	if sshProxyConfig.EnableConsulServiceRegistration {
 		consulClient, err := consuladapter.NewClientFromUrl(sshProxyConfig.ConsulCluster)
 		if err != nil {
@@ -112,18 +205,13 @@ func main() {
 	os.Exit(0)
 }
 
-func configureProxy(logger lager.Logger, sshProxyConfig config.SSHProxyConfig) (*ssh.ServerConfig, error) {
-	if sshProxyConfig.BBSAddress == "" {
-		err := errors.New("bbsAddress is required")
-		logger.Fatal("bbs-address-required", err)
-	}
-
-	url, err := url.Parse(sshProxyConfig.BBSAddress)
-	if err != nil {
-		logger.Fatal("failed-to-parse-bbs-address", err)
-	}
+// configureProxy builds the ssh server config of the proxy with the given
+// host keys. It also returns the checker that verifies the access of open
+// connections again, which is nil when Cloud Foundry authentication is
+// disabled.
+func configureProxy(logger lager.Logger, sshProxyConfig config.SSHProxyConfig, bbsClient bbs.InternalClient, admissionController *admission.Controller, hostKeys hostKeySet, accessGrants *proxy.AccessGrants) (*ssh.ServerConfig, proxy.AccessChecker, error) {
+	var accessChecker proxy.AccessChecker
 
-	bbsClient := initializeBBSClient(logger, sshProxyConfig)
 	permissionsBuilder := authenticators.NewPermissionsBuilder(bbsClient, sshProxyConfig.ConnectToInstanceAddress)
 
 	authens := []authenticators.PasswordAuthenticator{}
@@ -135,34 +223,34 @@ func configureProxy(logger lager.Logger, sshProxyConfig config.SSHProxyConfig) (
 
 	if sshProxyConfig.EnableCFAuth {
 		if sshProxyConfig.CCAPIURL == "" {
-			return nil, errors.New("ccAPIURL is required for Cloud Foundry authentication")
+			return nil, nil, errors.New("ccAPIURL is required for Cloud Foundry authentication")
 		}
 
-		_, err = url.Parse(sshProxyConfig.CCAPIURL)
+		_, err := url.Parse(sshProxyConfig.CCAPIURL)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
 		if sshProxyConfig.UAAPassword == "" {
-			return nil, errors.New("UAA password is required for Cloud Foundry authentication")
+			return nil, nil, errors.New("UAA password is required for Cloud Foundry authentication")
 		}
 
 		if sshProxyConfig.UAAUsername == "" {
-			return nil, errors.New("UAA username is required for Cloud Foundry authentication")
+			return nil, nil, errors.New("UAA username is required for Cloud Foundry authentication")
 		}
 
 		if sshProxyConfig.UAATokenURL == "" {
-			return nil, errors.New("uaaTokenURL is required for Cloud Foundry authentication")
+			return nil, nil, errors.New("uaaTokenURL is required for Cloud Foundry authentication")
 		}
 
 		_, err = url.Parse(sshProxyConfig.UAATokenURL)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
 		client, err := helpers.NewHTTPSClient(sshProxyConfig.SkipCertVerify, []string{sshProxyConfig.UAACACert, sshProxyConfig.CCAPICACert}, time.Duration(sshProxyConfig.CommunicationTimeout))
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
 		cfAuthenticator := authenticators.NewCFAuthenticator(
@@ -173,18 +261,29 @@ func configureProxy(logger lager.Logger, sshProxyConfig config.SSHProxyConfig) (
 			sshProxyConfig.UAAUsername,
 			sshProxyConfig.UAAPassword,
 			permissionsBuilder,
+			accessGrants,
 		)
 		authens = append(authens, cfAuthenticator)
+		accessChecker = cfAuthenticator
 	}
 
 	authenticator := authenticators.NewCompositeAuthenticator(authens...)
 
 	sshConfig := &ssh.ServerConfig{
-		ServerVersion:    "SSH-2.0-diego-ssh-proxy",
-		PasswordCallback: authenticator.Authenticate,
+		ServerVersion: "SSH-2.0-diego-ssh-proxy",
+		PasswordCallback: func(metadata ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			err := admissionController.AdmitAuthentication(logger, metadata.RemoteAddr())
+			if err != nil {
+				return nil, err
+			}
+			return authenticator.Authenticate(metadata, password)
+		},
 		AuthLogCallback: func(cmd ssh.ConnMetadata, method string, err error) {
 			if err != nil {
-				logger.Error("authentication-failed", err, lager.Data{"user": cmd.User()})
+				logger.Error("authentication-failed", err, lager.Data{"user": cmd.User(), "remote": cmd.RemoteAddr().String()})
+				if method != "none" && !admission.IsRejected(err) {
+					admissionController.AuthenticationFailed(logger, cmd.RemoteAddr())
+				}
 			} else {
 				logger.Info("authentication-attempted", lager.Data{"user": cmd.User()})
 			}
@@ -193,18 +292,10 @@ func configureProxy(logger lager.Logger, sshProxyConfig config.SSHProxyConfig) (
 
 	sshConfig.SetDefaults()
 
-	if sshProxyConfig.HostKey == "" {
-		err := errors.New("hostKey is required")
-		logger.Fatal("host-key-required", err)
-	}
-
-	key, err := parsePrivateKey(logger, sshProxyConfig.HostKey)
-	if err != nil {
-		logger.Fatal("failed-to-parse-host-key", err)
+	for _, key := range hostKeys.presented() {
+		sshConfig.AddHostKey(key)
 	}
 
-	sshConfig.AddHostKey(key)
-
 	if sshProxyConfig.AllowedCiphers != "" {
 		sshConfig.Config.Ciphers = strings.Split(sshProxyConfig.AllowedCiphers, ",")
 	} else {
@@ -223,7 +314,7 @@ func configureProxy(logger lager.Logger, sshProxyConfig config.SSHProxyConfig) (
 		sshConfig.Config.KeyExchanges = []string{"curve25519-sha256@libssh.org"}
 	}
 
-	return sshConfig, err
+	return sshConfig, accessChecker, nil
 }
 
 func parsePrivateKey(logger lager.Logger, encodedKey string) (ssh.Signer, error) {
@@ -236,6 +327,16 @@ func parsePrivateKey(logger lager.Logger, encodedKey string) (ssh.Signer, error)
 }
 
 func initializeBBSClient(logger lager.Logger, sshProxyConfig config.SSHProxyConfig) bbs.InternalClient {
+	if sshProxyConfig.BBSAddress == "" {
+		err := errors.New("bbsAddress is required")
+		logger.Fatal("bbs-address-required", err)
+	}
+
+	_, err := url.Parse(sshProxyConfig.BBSAddress)
+	if err != nil {
+		logger.Fatal("failed-to-parse-bbs-address", err)
+	}
+
 	bbsClient, err := bbs.NewClientWithConfig(bbs.ClientConfig{
 		URL:                    sshProxyConfig.BBSAddress,
 		IsTLS:                  true,
@@ -252,6 +353,58 @@ func initializeBBSClient(logger lager.Logger, sshProxyConfig config.SSHProxyConf
 	return bbsClient
 }
 
+func initializeAdmission(logger lager.Logger, sshProxyConfig config.SSHProxyConfig, metronClient loggingclient.IngressClient) (*admission.Controller, error) {
+	allow, err := admission.ParseCIDRs(sshProxyConfig.AllowedSourceCIDRs)
+	if err != nil {
+		return nil, err
+	}
+
+	deny, err := admission.ParseCIDRs(sshProxyConfig.DeniedSourceCIDRs)
+	if err != nil {
+		return nil, err
+	}
+
+	if sshProxyConfig.ConnectionRateLimit < 0 || sshProxyConfig.AuthenticationRateLimit < 0 || sshProxyConfig.BanThreshold < 0 {
+		return nil, errors.New("rate limits and the ban threshold must not be negative")
+	}
+
+	return admission.NewController(logger, metronClient, clock.NewClock(), admission.Config{
+		Allow: allow,
+		Deny:  deny,
+		Connections: admission.Rate{
+			PerSecond: sshProxyConfig.ConnectionRateLimit,
+			Burst:     sshProxyConfig.ConnectionRateBurst,
+		},
+		Authentications: admission.Rate{
+			PerSecond: sshProxyConfig.AuthenticationRateLimit,
+			Burst:     sshProxyConfig.AuthenticationRateBurst,
+		},
+		BanThreshold: sshProxyConfig.BanThreshold,
+		BanWindow:    time.Duration(sshProxyConfig.BanWindow),
+		BanDuration:  time.Duration(sshProxyConfig.BanDuration),
+	}), nil
+}
+
+// startupLimits returns the limits of connections that have not finished
+// authenticating. A login grace time of zero disables it.
+func startupLimits(sshProxyConfig config.SSHProxyConfig) (server.MaxStartups, time.Duration, error) {
+	var maxStartups server.MaxStartups
+	if sshProxyConfig.MaxStartups != "" {
+		var err error
+		maxStartups, err = server.ParseMaxStartups(sshProxyConfig.MaxStartups)
+		if err != nil {
+			return server.MaxStartups{}, 0, err
+		}
+	}
+
+	loginGraceTime := time.Duration(sshProxyConfig.LoginGraceTime)
+	if loginGraceTime < 0 {
+		return server.MaxStartups{}, 0, errors.New("login grace time must not be negative")
+	}
+
+	return maxStartups, loginGraceTime, nil
+}
+
 func initializeRegistrationRunner(logger lager.Logger, consulClient consuladapter.Client, listenAddress string, clock clock.Clock) ifrit.Runner {
 	_, portString, err := net.SplitHostPort(listenAddress)
 	if err != nil {
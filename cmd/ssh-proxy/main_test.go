@@ -1,8 +1,14 @@
 package main_test
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
@@ -11,11 +17,13 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"os/exec"
 	"reflect"
 	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"code.cloudfoundry.org/bbs/models"
@@ -229,6 +237,56 @@ var _ = Describe("SSH proxy", func() {
 		fakeCC.Close()
 	})
 
+	Describe("config validation", func() {
+		type report struct {
+			Valid    bool
+			Problems []struct {
+				Setting string
+				Problem string
+			}
+		}
+
+		validate := func() (int, report) {
+			session, err := gexec.Start(exec.Command(sshProxyPath, "-config="+sshProxyConfigPath, "-validate"), nil, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session, 10*time.Second).Should(gexec.Exit())
+
+			var r report
+			Expect(json.Unmarshal(session.Out.Contents(), &r)).To(Succeed())
+			return session.ExitCode(), r
+		}
+
+		It("reports a valid config", func() {
+			exitCode, r := validate()
+			Expect(exitCode).To(Equal(0))
+			Expect(r.Valid).To(BeTrue())
+			Expect(r.Problems).To(BeEmpty())
+		})
+
+		Context("when several settings are invalid", func() {
+			BeforeEach(func() {
+				sshProxyConfig.AllowedCiphers = "aes128-ctr,rot13"
+				sshProxyConfig.BBSCACert = "/does/not/exist"
+				sshProxyConfig.UAAUsername = ""
+			})
+
+			It("reports all of the problems", func() {
+				exitCode, r := validate()
+				Expect(exitCode).To(Equal(1))
+				Expect(r.Valid).To(BeFalse())
+
+				problems := map[string]string{}
+				for _, problem := range r.Problems {
+					problems[problem.Setting] = problem.Problem
+				}
+				Expect(problems).To(HaveLen(3))
+				Expect(problems).To(HaveKeyWithValue("allowed_ciphers", ContainSubstring("rot13")))
+				Expect(problems).To(HaveKey("bbs_ca_cert"))
+				Expect(problems).To(HaveKeyWithValue("uaa_username", "is required"))
+			})
+		})
+	})
+
 	Describe("argument validation", func() {
 		Context("when the host key is not provided", func() {
 			BeforeEach(func() {
@@ -436,6 +494,117 @@ var _ = Describe("SSH proxy", func() {
 		Expect(proxyHostKey.PublicKey().Marshal()).To(Equal(handshakeHostKey.Marshal()))
 	})
 
+	Describe("host keys", func() {
+		var (
+			ecdsaHostKey ssh.Signer
+			ecdsaPem     string
+		)
+
+		handshakeHostKey := func(algorithms []string, callback ssh.HostKeyCallback) (ssh.PublicKey, error) {
+			var hostKey ssh.PublicKey
+			var callbackErr error
+			_, err := ssh.Dial("tcp", address, &ssh.ClientConfig{
+				User:              "user",
+				Auth:              []ssh.AuthMethod{ssh.Password("")},
+				HostKeyAlgorithms: algorithms,
+				HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+					hostKey = key
+					if callback != nil {
+						callbackErr = callback(hostname, remote, key)
+					}
+					return errors.New("Short-circuit the handshake")
+				},
+			})
+			Expect(err).To(HaveOccurred())
+			return hostKey, callbackErr
+		}
+
+		BeforeEach(func() {
+			privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			Expect(err).NotTo(HaveOccurred())
+
+			der, err := x509.MarshalECPrivateKey(privateKey)
+			Expect(err).NotTo(HaveOccurred())
+			ecdsaPem = string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+
+			ecdsaHostKey, err = ssh.NewSignerFromKey(privateKey)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		Context("when additional host keys are configured", func() {
+			BeforeEach(func() {
+				sshProxyConfig.HostKeys = []string{ecdsaPem}
+			})
+
+			It("presents the key of the type the client asks for", func() {
+				hostKey, _ := handshakeHostKey([]string{ssh.KeyAlgoECDSA256}, nil)
+				Expect(hostKey.Marshal()).To(Equal(ecdsaHostKey.PublicKey().Marshal()))
+			})
+		})
+
+		Context("when an ill-formed additional host key is provided", func() {
+			BeforeEach(func() {
+				sshProxyConfig.HostKeys = []string{"host-key"}
+			})
+
+			It("reports the problem and terminates", func() {
+				Expect(runner).To(gbytes.Say("failed-to-parse-host-key"))
+				Expect(runner).NotTo(gexec.Exit(0))
+			})
+		})
+
+		Context("when a host certificate is configured", func() {
+			var certificateAuthority ssh.Signer
+
+			certify := func(key ssh.PublicKey) string {
+				certificate := &ssh.Certificate{
+					Key:         key,
+					CertType:    ssh.HostCert,
+					ValidBefore: ssh.CertTimeInfinity,
+				}
+				Expect(certificate.SignCert(rand.Reader, certificateAuthority)).To(Succeed())
+				return string(ssh.MarshalAuthorizedKey(certificate))
+			}
+
+			BeforeEach(func() {
+				privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+				Expect(err).NotTo(HaveOccurred())
+
+				certificateAuthority, err = ssh.NewSignerFromKey(privateKey)
+				Expect(err).NotTo(HaveOccurred())
+
+				sshProxyConfig.HostKeys = []string{ecdsaPem}
+				sshProxyConfig.HostCertificates = []string{certify(ecdsaHostKey.PublicKey())}
+			})
+
+			It("presents the certificate", func() {
+				certChecker := &ssh.CertChecker{
+					IsHostAuthority: func(authority ssh.PublicKey, _ string) bool {
+						return bytes.Equal(authority.Marshal(), certificateAuthority.PublicKey().Marshal())
+					},
+				}
+
+				hostKey, err := handshakeHostKey([]string{ssh.CertAlgoECDSA256v01}, certChecker.CheckHostKey)
+				Expect(err).NotTo(HaveOccurred())
+
+				certificate, ok := hostKey.(*ssh.Certificate)
+				Expect(ok).To(BeTrue())
+				Expect(certificate.Key.Marshal()).To(Equal(ecdsaHostKey.PublicKey().Marshal()))
+			})
+
+			Context("when the certificate does not match a host key", func() {
+				BeforeEach(func() {
+					sshProxyConfig.HostKeys = nil
+				})
+
+				It("reports the problem and terminates", func() {
+					Expect(runner).To(gbytes.Say("host certificate does not match any host key"))
+					Expect(runner).NotTo(gexec.Exit(0))
+				})
+			})
+		})
+	})
+
 	Describe("Disabled http healthcheck server", func() {
 		BeforeEach(func() {
 			sshProxyConfig.DisableHealthCheckServer = true
@@ -722,6 +891,53 @@ var _ = Describe("SSH proxy", func() {
 			Expect(string(client.Conn.ServerVersion())).To(Equal("SSH-2.0-diego-ssh-proxy"))
 		})
 
+		Context("when the config is reloaded", func() {
+			writeConfig := func(configData []byte) {
+				err := ioutil.WriteFile(sshProxyConfigPath, configData, 0600)
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			It("uses the new credentials for new connections and leaves open connections alone", func() {
+				client, err := ssh.Dial("tcp", address, clientConfig)
+				Expect(err).NotTo(HaveOccurred())
+				defer client.Close()
+
+				sshProxyConfig.DiegoCredentials = "rotated-creds"
+				configData, err := json.Marshal(&sshProxyConfig)
+				Expect(err).NotTo(HaveOccurred())
+				writeConfig(configData)
+
+				process.Signal(syscall.SIGHUP)
+				Eventually(runner).Should(gbytes.Say("ssh-proxy.reload.reloaded"))
+
+				_, err = ssh.Dial("tcp", address, clientConfig)
+				Expect(err).To(HaveOccurred())
+
+				rotatedClientConfig := *clientConfig
+				rotatedClientConfig.Auth = []ssh.AuthMethod{ssh.Password("rotated-creds")}
+				rotatedClient, err := ssh.Dial("tcp", address, &rotatedClientConfig)
+				Expect(err).NotTo(HaveOccurred())
+				rotatedClient.Close()
+
+				session, err := client.NewSession()
+				Expect(err).NotTo(HaveOccurred())
+				output, err := session.Output("echo -n hello")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(output)).To(Equal("hello"))
+			})
+
+			It("keeps the current config when the new one is invalid", func() {
+				writeConfig([]byte("{{"))
+
+				process.Signal(syscall.SIGHUP)
+				Eventually(runner).Should(gbytes.Say("ssh-proxy.reload.failed-to-parse-config"))
+
+				client, err := ssh.Dial("tcp", address, clientConfig)
+				Expect(err).NotTo(HaveOccurred())
+				client.Close()
+			})
+		})
+
 		Context("when dealing with an idle connection", func() {
 			It("eventually times out", func() {
 				client, err := net.Dial("tcp", address)
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"code.cloudfoundry.org/bbs"
+	"code.cloudfoundry.org/diego-ssh/admission"
+	"code.cloudfoundry.org/diego-ssh/cmd/ssh-proxy/config"
+	"code.cloudfoundry.org/diego-ssh/proxy"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/lager/lagerflags"
+)
+
+// configReloader rereads the config file on SIGHUP. When the new config is
+// valid, it replaces the ssh server config with its algorithms, host keys and
+// authenticator credentials, the backend TLS config and the log level.
+// Connections that are already open are left alone, and other settings only
+// change on restart.
+type configReloader struct {
+	logger              lager.Logger
+	configPath          string
+	sink                *lager.ReconfigurableSink
+	bbsClient           bbs.InternalClient
+	admissionController *admission.Controller
+	sshProxy            *proxy.Proxy
+	accessChecker       *reloadableAccessChecker
+	accessGrants        *proxy.AccessGrants
+}
+
+func (r *configReloader) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+
+	close(ready)
+
+	for {
+		select {
+		case <-hangups:
+			r.reload()
+		case <-signals:
+			return nil
+		}
+	}
+}
+
+func (r *configReloader) reload() {
+	logger := r.logger.Session("reload", lager.Data{"config": r.configPath})
+	logger.Info("started")
+
+	sshProxyConfig, err := config.NewSSHProxyConfig(r.configPath)
+	if err != nil {
+		logger.Error("failed-to-parse-config", err)
+		return
+	}
+
+	minLevel, err := logLevel(sshProxyConfig.LogLevel)
+	if err != nil {
+		logger.Error("invalid-log-level", err)
+		return
+	}
+
+	hostKeys, err := loadHostKeys(r.logger, sshProxyConfig)
+	if err != nil {
+		logger.Error("invalid-host-keys", err)
+		return
+	}
+
+	serverConfig, accessChecker, err := configureProxy(r.logger, sshProxyConfig, r.bbsClient, r.admissionController, hostKeys, r.accessGrants)
+	if err != nil {
+		logger.Error("configure-failed", err)
+		return
+	}
+
+	tlsConfig, err := sshProxyConfig.BackendsTLSConfig()
+	if err != nil {
+		logger.Error("failed-to-get-tls-config", err)
+		return
+	}
+
+	r.sshProxy.Reconfigure(serverConfig, tlsConfig, hostKeys.keys)
+	r.accessChecker.set(accessChecker)
+	r.sink.SetMinLevel(minLevel)
+
+	logger.Info("reloaded")
+}
+
+func logLevel(level string) (lager.LogLevel, error) {
+	switch level {
+	case lagerflags.DEBUG:
+		return lager.DEBUG, nil
+	case lagerflags.INFO, "":
+		return lager.INFO, nil
+	case lagerflags.ERROR:
+		return lager.ERROR, nil
+	case lagerflags.FATAL:
+		return lager.FATAL, nil
+	default:
+		return lager.INFO, fmt.Errorf("unknown log level: %q", level)
+	}
+}
+
+// reloadableAccessChecker checks access with the authenticator of the most
+// recent config.
+type reloadableAccessChecker struct {
+	lock    sync.Mutex
+	checker proxy.AccessChecker
+}
+
+func (c *reloadableAccessChecker) set(checker proxy.AccessChecker) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.checker = checker
+}
+
+func (c *reloadableAccessChecker) CheckAccess(logger lager.Logger, grant proxy.AccessGrant) error {
+	c.lock.Lock()
+	checker := c.checker
+	c.lock.Unlock()
+
+	if checker == nil {
+		return nil
+	}
+	return checker.CheckAccess(logger, grant)
+}
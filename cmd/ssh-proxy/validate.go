@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"code.cloudfoundry.org/diego-ssh/admission"
+	"code.cloudfoundry.org/diego-ssh/cmd/ssh-proxy/config"
+	"code.cloudfoundry.org/diego-ssh/helpers"
+	"code.cloudfoundry.org/diego-ssh/server"
+	"code.cloudfoundry.org/durationjson"
+	"code.cloudfoundry.org/lager"
+)
+
+// validateConfig checks every setting of the config and returns all of the
+// problems it finds. It reads the files the config refers to, but does not
+// connect to any service or start listening.
+func validateConfig(sshProxyConfig config.SSHProxyConfig) helpers.ConfigProblems {
+	var problems helpers.ConfigProblems
+
+	if problems.Require("address", sshProxyConfig.Address) {
+		problems.Add("address", helpers.CheckAddress(sshProxyConfig.Address))
+	}
+
+	if !sshProxyConfig.DisableHealthCheckServer && sshProxyConfig.HealthCheckAddress != "" {
+		problems.Add("health_check_address", helpers.CheckAddress(sshProxyConfig.HealthCheckAddress))
+	}
+
+	if sshProxyConfig.DebugAddress != "" {
+		problems.Add("debug_address", helpers.CheckAddress(sshProxyConfig.DebugAddress))
+	}
+
+	_, err := logLevel(sshProxyConfig.LogLevel)
+	problems.Add("log_level", err)
+
+	validateHostKeys(&problems, sshProxyConfig)
+	validateBBS(&problems, sshProxyConfig)
+	validateAuthentication(&problems, sshProxyConfig)
+
+	problems.AddUnsupportedAlgorithms("allowed_ciphers", helpers.UnsupportedCiphers(sshProxyConfig.AllowedCiphers))
+	problems.AddUnsupportedAlgorithms("allowed_macs", helpers.UnsupportedMACs(sshProxyConfig.AllowedMACs))
+	problems.AddUnsupportedAlgorithms("allowed_key_exchanges", helpers.UnsupportedKeyExchanges(sshProxyConfig.AllowedKeyExchanges))
+
+	if sshProxyConfig.EnableConsulServiceRegistration && problems.Require("consul_cluster", sshProxyConfig.ConsulCluster) {
+		for _, consulURL := range strings.Split(sshProxyConfig.ConsulCluster, ",") {
+			problems.Add("consul_cluster", helpers.CheckURL(consulURL))
+		}
+	}
+
+	loggregatorConfig := sshProxyConfig.LoggregatorConfig
+	if loggregatorConfig.UseV2API {
+		problems.Add("loggregator.loggregator_ca_path", helpers.CheckCACertFile(loggregatorConfig.CACertPath))
+		problems.Add("loggregator.loggregator_cert_path", helpers.CheckKeyPairFiles(loggregatorConfig.CertPath, loggregatorConfig.KeyPath))
+	}
+
+	if sshProxyConfig.BackendsTLSEnabled {
+		if problems.Require("backends_tls_ca_certificates", sshProxyConfig.BackendsTLSCACerts) {
+			problems.Add("backends_tls_ca_certificates", helpers.CheckCACertFile(sshProxyConfig.BackendsTLSCACerts))
+		}
+		if sshProxyConfig.BackendsTLSClientCert != "" || sshProxyConfig.BackendsTLSClientKey != "" {
+			problems.Add("backends_tls_client_certificate", helpers.CheckKeyPairFiles(sshProxyConfig.BackendsTLSClientCert, sshProxyConfig.BackendsTLSClientKey))
+		}
+	}
+
+	durations := []struct {
+		setting  string
+		duration durationjson.Duration
+	}{
+		{"communication_timeout", sshProxyConfig.CommunicationTimeout},
+		{"idle_connection_timeout", sshProxyConfig.IdleConnectionTimeout},
+		{"access_check_interval", sshProxyConfig.AccessCheckInterval},
+		{"max_session_duration", sshProxyConfig.MaxSessionDuration},
+		{"session_idle_timeout", sshProxyConfig.SessionIdleTimeout},
+		{"session_limit_warning", sshProxyConfig.SessionLimitWarning},
+		{"ban_window", sshProxyConfig.BanWindow},
+		{"ban_duration", sshProxyConfig.BanDuration},
+		{"login_grace_time", sshProxyConfig.LoginGraceTime},
+	}
+	for _, d := range durations {
+		if d.duration < 0 {
+			problems.Addf(d.setting, "must not be negative")
+		}
+	}
+
+	_, err = admission.ParseCIDRs(sshProxyConfig.AllowedSourceCIDRs)
+	problems.Add("allowed_source_cidrs", err)
+
+	_, err = admission.ParseCIDRs(sshProxyConfig.DeniedSourceCIDRs)
+	problems.Add("denied_source_cidrs", err)
+
+	numbers := []struct {
+		setting string
+		value   float64
+	}{
+		{"connection_rate_limit", sshProxyConfig.ConnectionRateLimit},
+		{"connection_rate_burst", float64(sshProxyConfig.ConnectionRateBurst)},
+		{"authentication_rate_limit", sshProxyConfig.AuthenticationRateLimit},
+		{"authentication_rate_burst", float64(sshProxyConfig.AuthenticationRateBurst)},
+		{"ban_threshold", float64(sshProxyConfig.BanThreshold)},
+		{"fan_out_workers", float64(sshProxyConfig.FanOutWorkers)},
+	}
+	for _, n := range numbers {
+		if n.value < 0 {
+			problems.Addf(n.setting, "must not be negative")
+		}
+	}
+
+	if sshProxyConfig.MaxStartups != "" {
+		_, err = server.ParseMaxStartups(sshProxyConfig.MaxStartups)
+		problems.Add("max_startups", err)
+	}
+
+	return problems
+}
+
+func validateHostKeys(problems *helpers.ConfigProblems, sshProxyConfig config.SSHProxyConfig) {
+	logger := lager.NewLogger("validate")
+
+	if sshProxyConfig.HostKey == "" && len(sshProxyConfig.HostKeys) == 0 {
+		problems.Addf("host_key", "is required")
+		return
+	}
+
+	valid := true
+	if sshProxyConfig.HostKey != "" {
+		if _, err := parseHostKey(logger, sshProxyConfig.HostKey); err != nil {
+			problems.Add("host_key", err)
+			valid = false
+		}
+	}
+
+	for i, encodedKey := range sshProxyConfig.HostKeys {
+		if _, err := parseHostKey(logger, encodedKey); err != nil {
+			problems.Add(fmt.Sprintf("host_keys[%d]", i), err)
+			valid = false
+		}
+	}
+
+	if valid {
+		_, err := loadHostKeys(logger, sshProxyConfig)
+		problems.Add("host_certificates", err)
+	}
+}
+
+func validateBBS(problems *helpers.ConfigProblems, sshProxyConfig config.SSHProxyConfig) {
+	if problems.Require("bbs_address", sshProxyConfig.BBSAddress) {
+		problems.Add("bbs_address", helpers.CheckURL(sshProxyConfig.BBSAddress))
+	}
+
+	if problems.Require("bbs_ca_cert", sshProxyConfig.BBSCACert) {
+		problems.Add("bbs_ca_cert", helpers.CheckCACertFile(sshProxyConfig.BBSCACert))
+	}
+
+	problems.Add("bbs_client_cert", helpers.CheckKeyPairFiles(sshProxyConfig.BBSClientCert, sshProxyConfig.BBSClientKey))
+}
+
+func validateAuthentication(problems *helpers.ConfigProblems, sshProxyConfig config.SSHProxyConfig) {
+	if !sshProxyConfig.EnableCFAuth {
+		return
+	}
+
+	if problems.Require("cc_api_url", sshProxyConfig.CCAPIURL) {
+		problems.Add("cc_api_url", helpers.CheckURL(sshProxyConfig.CCAPIURL))
+	}
+
+	if problems.Require("uaa_token_url", sshProxyConfig.UAATokenURL) {
+		problems.Add("uaa_token_url", helpers.CheckURL(sshProxyConfig.UAATokenURL))
+	}
+
+	problems.Require("uaa_username", sshProxyConfig.UAAUsername)
+	problems.Require("uaa_password", sshProxyConfig.UAAPassword)
+
+	if sshProxyConfig.CCAPICACert != "" {
+		problems.Add("cc_api_ca_cert", helpers.CheckCACertFile(sshProxyConfig.CCAPICACert))
+	}
+
+	if sshProxyConfig.UAACACert != "" {
+		problems.Add("uaa_ca_cert", helpers.CheckCACertFile(sshProxyConfig.UAACACert))
+	}
+}
@@ -0,0 +1,101 @@
+package config
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"time"
+
+	"code.cloudfoundry.org/debugserver"
+	"code.cloudfoundry.org/durationjson"
+	"code.cloudfoundry.org/lager/lagerflags"
+)
+
+const (
+	DefaultAddress            = "127.0.0.1:2222"
+	DefaultAppDir             = "/home/vcap/app"
+	DefaultKeepaliveInterval  = 15 * time.Second
+	DefaultKeepaliveCountMax  = 3
+	DefaultKeepaliveAction    = "hangup"
+	DefaultAllowTCPForwarding = "yes"
+	DefaultSCPSymlinks        = "follow"
+	DefaultLoginGraceTime     = 2 * time.Minute
+	DefaultMaxStartups        = "10:30:100"
+)
+
+type SSHDConfig struct {
+	lagerflags.LagerConfig
+	debugserver.DebugServerConfig
+	Address                     string                `json:"address"`
+	HostKey                     string                `json:"host_key"`
+	AuthorizedKey               string                `json:"authorized_key"`
+	AllowUnauthenticatedClients bool                  `json:"allow_unauthenticated_clients"`
+	InheritDaemonEnv            bool                  `json:"inherit_daemon_env"`
+	AllowedCiphers              string                `json:"allowed_ciphers"`
+	AllowedMACs                 string                `json:"allowed_macs"`
+	AllowedKeyExchanges         string                `json:"allowed_key_exchanges"`
+	KeepaliveInterval           durationjson.Duration `json:"keepalive_interval"`
+	KeepaliveCountMax           int                   `json:"keepalive_count_max"`
+	KeepaliveAction             string                `json:"keepalive_action"`
+	AllowTCPForwarding          string                `json:"allow_tcp_forwarding"`
+	Subsystems                  []string              `json:"subsystems"`
+	LoginEnvironment            bool                  `json:"login_environment"`
+	AppDir                      string                `json:"app_dir"`
+	AcceptEnv                   *string               `json:"accept_env,omitempty"`
+	MaxEnvValueLength           int                   `json:"max_env_value_length"`
+	MaxEnvVariables             int                   `json:"max_env_variables"`
+	ExecArgv                    bool                  `json:"exec_argv"`
+	ExecPath                    string                `json:"exec_path"`
+	SFTPRoot                    string                `json:"sftp_root"`
+	SFTPMounts                  string                `json:"sftp_mounts"`
+	SFTPReadOnly                bool                  `json:"sftp_read_only"`
+	SFTPDeny                    string                `json:"sftp_deny"`
+	SCPRoot                     string                `json:"scp_root"`
+	SCPSymlinks                 string                `json:"scp_symlinks"`
+	SCPBandwidthLimit           int                   `json:"scp_bandwidth_limit"`
+	UploadMaxFileSize           int64                 `json:"upload_max_file_size"`
+	UploadMaxSessionSize        int64                 `json:"upload_max_session_size"`
+	UploadMinFreeSpace          int64                 `json:"upload_min_free_space"`
+	LoginGraceTime              durationjson.Duration `json:"login_grace_time"`
+	MaxStartups                 string                `json:"max_startups"`
+}
+
+func DefaultSSHDConfig() SSHDConfig {
+	return SSHDConfig{
+		LagerConfig:        lagerflags.DefaultLagerConfig(),
+		Address:            DefaultAddress,
+		KeepaliveInterval:  durationjson.Duration(DefaultKeepaliveInterval),
+		KeepaliveCountMax:  DefaultKeepaliveCountMax,
+		KeepaliveAction:    DefaultKeepaliveAction,
+		AllowTCPForwarding: DefaultAllowTCPForwarding,
+		Subsystems:         []string{"sftp"},
+		AppDir:             DefaultAppDir,
+		SCPSymlinks:        DefaultSCPSymlinks,
+		LoginGraceTime:     durationjson.Duration(DefaultLoginGraceTime),
+		MaxStartups:        DefaultMaxStartups,
+	}
+}
+
+// NewSSHDConfig reads the config file at configPath. Settings that are not
+// present in the file keep their default values.
+func NewSSHDConfig(configPath string) (SSHDConfig, error) {
+	payload, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return SSHDConfig{}, err
+	}
+
+	return ParseSSHDConfig(payload)
+}
+
+// ParseSSHDConfig decodes a JSON config, such as the contents of a config file
+// or the config handed to the daemon when it re-executes itself. Settings that
+// are not present keep their default values.
+func ParseSSHDConfig(payload []byte) (SSHDConfig, error) {
+	sshdConfig := DefaultSSHDConfig()
+
+	err := json.Unmarshal(payload, &sshdConfig)
+	if err != nil {
+		return SSHDConfig{}, err
+	}
+
+	return sshdConfig, nil
+}
@@ -0,0 +1,218 @@
+package config_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"code.cloudfoundry.org/debugserver"
+	"code.cloudfoundry.org/diego-ssh/cmd/sshd/config"
+	"code.cloudfoundry.org/durationjson"
+	"code.cloudfoundry.org/lager/lagerflags"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("SSHDConfig", func() {
+	Describe("#NewSSHDConfig", func() {
+		var configFilePath, configData string
+
+		BeforeEach(func() {
+			configData = `{
+			"address": "1.1.1.1:2222",
+			"host_key": "I am a host key.",
+			"authorized_key": "I am an authorized key.",
+			"allow_unauthenticated_clients": true,
+			"inherit_daemon_env": true,
+			"allowed_ciphers": "cipher1,cipher2,cipher3",
+			"allowed_macs": "mac1,mac2,mac3",
+			"allowed_key_exchanges": "exchange1,exchange2,exchange3",
+			"keepalive_interval": "30s",
+			"keepalive_count_max": 5,
+			"keepalive_action": "detach",
+			"allow_tcp_forwarding": "local",
+			"subsystems": [],
+			"login_environment": true,
+			"app_dir": "/app",
+			"accept_env": "LANG,LC_*",
+			"max_env_value_length": 1024,
+			"max_env_variables": 16,
+			"exec_argv": true,
+			"exec_path": "/usr/bin:/bin",
+			"sftp_root": "/home/vcap/logs",
+			"sftp_mounts": "/app=/home/vcap/app",
+			"sftp_read_only": true,
+			"sftp_deny": "remove,rename",
+			"scp_root": "/home/vcap/app",
+			"scp_symlinks": "skip",
+			"scp_bandwidth_limit": 8192,
+			"upload_max_file_size": 1048576,
+			"upload_max_session_size": 10485760,
+			"upload_min_free_space": 536870912,
+			"login_grace_time": "30s",
+			"max_startups": "5:50:20",
+			"log_level": "debug",
+			"debug_address": "5.5.5.5:9090"
+		}`
+		})
+
+		JustBeforeEach(func() {
+			configFile, err := ioutil.TempFile("", "sshd-config")
+			Expect(err).NotTo(HaveOccurred())
+
+			n, err := configFile.WriteString(configData)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(Equal(len(configData)))
+
+			err = configFile.Close()
+			Expect(err).NotTo(HaveOccurred())
+
+			configFilePath = configFile.Name()
+		})
+
+		AfterEach(func() {
+			err := os.RemoveAll(configFilePath)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("correctly parses the config file", func() {
+			sshdConfig, err := config.NewSSHDConfig(configFilePath)
+			Expect(err).NotTo(HaveOccurred())
+
+			acceptEnv := "LANG,LC_*"
+
+			Expect(sshdConfig).To(Equal(config.SSHDConfig{
+				Address:                     "1.1.1.1:2222",
+				HostKey:                     "I am a host key.",
+				AuthorizedKey:               "I am an authorized key.",
+				AllowUnauthenticatedClients: true,
+				InheritDaemonEnv:            true,
+				AllowedCiphers:              "cipher1,cipher2,cipher3",
+				AllowedMACs:                 "mac1,mac2,mac3",
+				AllowedKeyExchanges:         "exchange1,exchange2,exchange3",
+				KeepaliveInterval:           durationjson.Duration(30 * time.Second),
+				KeepaliveCountMax:           5,
+				KeepaliveAction:             "detach",
+				AllowTCPForwarding:          "local",
+				Subsystems:                  []string{},
+				LoginEnvironment:            true,
+				AppDir:                      "/app",
+				AcceptEnv:                   &acceptEnv,
+				MaxEnvValueLength:           1024,
+				MaxEnvVariables:             16,
+				ExecArgv:                    true,
+				ExecPath:                    "/usr/bin:/bin",
+				SFTPRoot:                    "/home/vcap/logs",
+				SFTPMounts:                  "/app=/home/vcap/app",
+				SFTPReadOnly:                true,
+				SFTPDeny:                    "remove,rename",
+				SCPRoot:                     "/home/vcap/app",
+				SCPSymlinks:                 "skip",
+				SCPBandwidthLimit:           8192,
+				UploadMaxFileSize:           1048576,
+				UploadMaxSessionSize:        10485760,
+				UploadMinFreeSpace:          536870912,
+				LoginGraceTime:              durationjson.Duration(30 * time.Second),
+				MaxStartups:                 "5:50:20",
+				LagerConfig: lagerflags.LagerConfig{
+					LogLevel:   lagerflags.DEBUG,
+					TimeFormat: lagerflags.DefaultLagerConfig().TimeFormat,
+				},
+				DebugServerConfig: debugserver.DebugServerConfig{
+					DebugAddress: "5.5.5.5:9090",
+				},
+			}))
+		})
+
+		Context("when settings are missing from the file", func() {
+			BeforeEach(func() {
+				configData = `{"authorized_key": "I am an authorized key."}`
+			})
+
+			It("uses the defaults", func() {
+				sshdConfig, err := config.NewSSHDConfig(configFilePath)
+				Expect(err).NotTo(HaveOccurred())
+
+				expectedConfig := config.DefaultSSHDConfig()
+				expectedConfig.AuthorizedKey = "I am an authorized key."
+				Expect(sshdConfig).To(Equal(expectedConfig))
+
+				Expect(sshdConfig.Address).To(Equal(config.DefaultAddress))
+				Expect(sshdConfig.KeepaliveInterval).To(Equal(durationjson.Duration(config.DefaultKeepaliveInterval)))
+				Expect(sshdConfig.KeepaliveCountMax).To(Equal(3))
+				Expect(sshdConfig.KeepaliveAction).To(Equal("hangup"))
+				Expect(sshdConfig.AllowTCPForwarding).To(Equal("yes"))
+				Expect(sshdConfig.Subsystems).To(Equal([]string{"sftp"}))
+				Expect(sshdConfig.SCPSymlinks).To(Equal("follow"))
+				Expect(sshdConfig.LoginGraceTime).To(Equal(durationjson.Duration(2 * time.Minute)))
+				Expect(sshdConfig.MaxStartups).To(Equal("10:30:100"))
+				Expect(sshdConfig.AcceptEnv).To(BeNil())
+			})
+		})
+
+		Context("when accept_env is empty", func() {
+			BeforeEach(func() {
+				configData = `{"accept_env": ""}`
+			})
+
+			It("tells it apart from an unset accept_env", func() {
+				sshdConfig, err := config.NewSSHDConfig(configFilePath)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(sshdConfig.AcceptEnv).NotTo(BeNil())
+				Expect(*sshdConfig.AcceptEnv).To(BeEmpty())
+			})
+		})
+
+		Context("when the file does not exist", func() {
+			It("returns an error", func() {
+				_, err := config.NewSSHDConfig("foobar")
+				Expect(err).To(HaveOccurred())
+			})
+		})
+
+		Context("when the file does not contain valid json", func() {
+			BeforeEach(func() {
+				configData = "{{"
+			})
+
+			It("returns an error", func() {
+				_, err := config.NewSSHDConfig(configFilePath)
+				Expect(err).To(HaveOccurred())
+			})
+
+			Context("because the keepalive_interval is not valid", func() {
+				BeforeEach(func() {
+					configData = `{"keepalive_interval": "forever"}`
+				})
+
+				It("returns an error", func() {
+					_, err := config.NewSSHDConfig(configFilePath)
+					Expect(err).To(HaveOccurred())
+				})
+			})
+		})
+	})
+
+	Describe("#ParseSSHDConfig", func() {
+		It("round trips a marshaled config", func() {
+			sshdConfig := config.DefaultSSHDConfig()
+			sshdConfig.HostKey = "I am a host key."
+			sshdConfig.AllowTCPForwarding = "no"
+			sshdConfig.Subsystems = nil
+
+			payload, err := json.Marshal(sshdConfig)
+			Expect(err).NotTo(HaveOccurred())
+
+			parsedConfig, err := config.ParseSSHDConfig(payload)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(parsedConfig).To(Equal(sshdConfig))
+		})
+
+		It("returns an error when the payload is not valid json", func() {
+			_, err := config.ParseSSHDConfig([]byte("{{"))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
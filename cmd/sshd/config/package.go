@@ -0,0 +1 @@
+package config // import "code.cloudfoundry.org/diego-ssh/cmd/sshd/config"
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"net"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strings"
 	"syscall"
@@ -13,10 +15,17 @@ import (
 
 	"code.cloudfoundry.org/debugserver"
 	"code.cloudfoundry.org/diego-ssh/authenticators"
+	"code.cloudfoundry.org/diego-ssh/cmd/sshd/config"
 	"code.cloudfoundry.org/diego-ssh/daemon"
 	"code.cloudfoundry.org/diego-ssh/handlers"
 	"code.cloudfoundry.org/diego-ssh/handlers/globalrequest"
+	"code.cloudfoundry.org/diego-ssh/helpers"
 	"code.cloudfoundry.org/diego-ssh/keys"
+	"code.cloudfoundry.org/diego-ssh/quota"
+	"code.cloudfoundry.org/diego-ssh/scp"
+	"code.cloudfoundry.org/diego-ssh/server"
+	"code.cloudfoundry.org/diego-ssh/sftpserver"
+	"code.cloudfoundry.org/durationjson"
 	"code.cloudfoundry.org/lager"
 	"code.cloudfoundry.org/lager/lagerflags"
 	"github.com/tedsuo/ifrit"
@@ -25,9 +34,15 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
+var configPath = flag.String(
+	"config",
+	"",
+	"Path to SSH daemon config, flags that are provided take precedence",
+)
+
 var address = flag.String(
 	"address",
-	"127.0.0.1:2222",
+	config.DefaultAddress,
 	"listen address for ssh daemon",
 )
 
@@ -55,6 +70,138 @@ var inheritDaemonEnv = flag.Bool(
 	"Inherit daemon's environment",
 )
 
+var loginEnvironment = flag.Bool(
+	"loginEnvironment",
+	false,
+	"Emulate the Cloud Foundry launcher: source .profile and .profile.d/*.sh and start in the app directory",
+)
+
+var appDir = flag.String(
+	"appDir",
+	config.DefaultAppDir,
+	"App directory used by the login environment",
+)
+
+var acceptEnv = flag.String(
+	"acceptEnv",
+	"",
+	"Limit environment variables clients may set to names matching the provided glob patterns (comma separated, empty accepts none)",
+)
+
+var maxEnvValueLength = flag.Int(
+	"maxEnvValueLength",
+	0,
+	"Maximum length of an environment variable value set by a client (0 for no limit)",
+)
+
+var maxEnvVariables = flag.Int(
+	"maxEnvVariables",
+	0,
+	"Maximum number of environment variables a client may set per session (0 for no limit)",
+)
+
+var execArgv = flag.Bool(
+	"execArgv",
+	false,
+	"Run exec requests without a shell by splitting the command into words",
+)
+
+var execPath = flag.String(
+	"execPath",
+	"",
+	"Search path for commands run without a shell (defaults to the PATH of the session)",
+)
+
+var sftpRoot = flag.String(
+	"sftpRoot",
+	"",
+	"Directory served as the root of the sftp subsystem (defaults to the whole filesystem)",
+)
+
+var sftpMounts = flag.String(
+	"sftpMounts",
+	"",
+	"Directories served by the sftp subsystem as mount points, such as /logs=/home/vcap/logs (comma separated)",
+)
+
+var sftpReadOnly = flag.Bool(
+	"sftpReadOnly",
+	false,
+	"Refuse every sftp request that writes to the filesystem",
+)
+
+var sftpDeny = flag.String(
+	"sftpDeny",
+	"",
+	"Refuse the provided sftp operations: remove, rename, setstat or symlink (comma separated)",
+)
+
+var scpRoot = flag.String(
+	"scpRoot",
+	"",
+	"Directory that scp upload targets are resolved in (defaults to the whole filesystem)",
+)
+
+var scpSymlinks = flag.String(
+	"scpSymlinks",
+	config.DefaultSCPSymlinks,
+	"Whether scp follows or skips symbolic links when sending files: follow or skip",
+)
+
+var scpBandwidthLimit = flag.Int(
+	"scpBandwidthLimit",
+	0,
+	"Largest rate in Kbit/s that scp transfers file contents at (0 for no limit)",
+)
+
+var uploadMaxFileSize = flag.Int64(
+	"uploadMaxFileSize",
+	0,
+	"Largest file in bytes that can be written with scp or sftp (0 for no limit)",
+)
+
+var uploadMaxSessionSize = flag.Int64(
+	"uploadMaxSessionSize",
+	0,
+	"Number of bytes that can be written with scp or sftp in a session (0 for no limit)",
+)
+
+var uploadMinFreeSpace = flag.Int64(
+	"uploadMinFreeSpace",
+	0,
+	"Number of bytes that have to remain free on the filesystem written to by scp or sftp (0 for no limit)",
+)
+
+var keepaliveInterval = flag.Duration(
+	"keepaliveInterval",
+	config.DefaultKeepaliveInterval,
+	"Interval between keepalive requests to the client (0 to disable)",
+)
+
+var keepaliveCountMax = flag.Int(
+	"keepaliveCountMax",
+	config.DefaultKeepaliveCountMax,
+	"Number of unanswered keepalive requests before the client is considered gone",
+)
+
+var keepaliveAction = flag.String(
+	"keepaliveAction",
+	config.DefaultKeepaliveAction,
+	"Action taken when the client is gone: hangup, continue or detach",
+)
+
+var loginGraceTime = flag.Duration(
+	"loginGraceTime",
+	config.DefaultLoginGraceTime,
+	"Time a client has to authenticate before the connection is closed (0 to disable)",
+)
+
+var maxStartups = flag.String(
+	"maxStartups",
+	config.DefaultMaxStartups,
+	"Limit of unauthenticated connections as start:rate:full, like the OpenSSH MaxStartups option",
+)
+
 var allowedCiphers = flag.String(
 	"allowedCiphers",
 	"",
@@ -73,8 +220,11 @@ var allowedKeyExchanges = flag.String(
 	"Limit key exchanges algorithms to those provided (comma separated)",
 )
 
-var hostKeyPEM string
-var authorizedKeyValue string
+var validate = flag.Bool(
+	"validate",
+	false,
+	"Check the config and flags, report every problem as JSON and exit without starting the daemon",
+)
 
 func runServer() error {
 	debugserver.AddFlags(flag.CommandLine)
@@ -82,93 +232,199 @@ func runServer() error {
 	flag.Parse()
 	exec := false
 
-	logger, reconfigurableSink := lagerflags.New("sshd")
+	sshdConfig, err := loadConfig()
+	if *validate {
+		var problems helpers.ConfigProblems
+		if err != nil {
+			problems.Add("config", err)
+		} else {
+			problems = validateConfig(sshdConfig)
+		}
+		if helpers.WriteConfigReport(os.Stdout, problems) != 0 {
+			return errors.New("invalid config")
+		}
+		return nil
+	}
+	if err != nil {
+		logger, _ := lagerflags.New("sshd")
+		logger.Error("failed-to-parse-config", err)
+		return err
+	}
+
+	logger, reconfigurableSink := lagerflags.NewFromConfig("sshd", sshdConfig.LagerConfig)
 
-	hostKeyPEM = os.Getenv("SSHD_HOSTKEY")
-	if hostKeyPEM != "" {
-		authorizedKeyValue = os.Getenv("SSHD_AUTHKEY")
+	if os.Getenv("SSHD_CONFIG") != "" {
+		// unset the variable so child processes don't inherit it
+		os.Unsetenv("SSHD_CONFIG")
+	} else if hostKeyPEM := os.Getenv("SSHD_HOSTKEY"); hostKeyPEM != "" {
+		sshdConfig.HostKey = hostKeyPEM
+		sshdConfig.AuthorizedKey = os.Getenv("SSHD_AUTHKEY")
 
 		// unset the variables so child processes don't inherit them
 		os.Unsetenv("SSHD_HOSTKEY")
 		os.Unsetenv("SSHD_AUTHKEY")
 	} else {
-		hostKeyPEM = *hostKey
-		if hostKeyPEM == "" {
-			var err error
-			hostKeyPEM, err = generateNewHostKey()
+		if sshdConfig.HostKey == "" {
+			sshdConfig.HostKey, err = generateNewHostKey()
 			if err != nil {
 				logger.Error("failed-to-generate-host-key", err)
 				return err
 			}
 		}
-		authorizedKeyValue = *authorizedKey
 		exec = true
 	}
 
 	if exec && runtime.GOOS != "windows" {
-		os.Setenv("SSHD_HOSTKEY", hostKeyPEM)
-		os.Setenv("SSHD_AUTHKEY", authorizedKeyValue)
-
-		logLevel := "info"
-		flag.CommandLine.Lookup("logLevel")
-		logLevelFlag := flag.CommandLine.Lookup("logLevel")
-		if logLevelFlag != nil {
-			logLevel = logLevelFlag.Value.String()
+		payload, err := json.Marshal(sshdConfig)
+		if err != nil {
+			logger.Error("failed-to-marshal-config", err)
+			return err
 		}
 
+		// pass the complete config through the environment so that keys are
+		// not exposed on the command line of the daemon
+		os.Setenv("SSHD_CONFIG", string(payload))
+
 		runtime.GOMAXPROCS(1)
-		err := syscall.Exec(os.Args[0], []string{
-			os.Args[0],
-			fmt.Sprintf("--allowedKeyExchanges=%s", *allowedKeyExchanges),
-			fmt.Sprintf("--address=%s", *address),
-			fmt.Sprintf("--allowUnauthenticatedClients=%t", *allowUnauthenticatedClients),
-			fmt.Sprintf("--inheritDaemonEnv=%t", *inheritDaemonEnv),
-			fmt.Sprintf("--allowedCiphers=%s", *allowedCiphers),
-			fmt.Sprintf("--allowedMACs=%s", *allowedMACs),
-			fmt.Sprintf("--logLevel=%s", logLevel),
-			fmt.Sprintf("--debugAddr=%s", debugserver.DebugAddress(flag.CommandLine)),
-		}, os.Environ())
+		err = syscall.Exec(os.Args[0], []string{os.Args[0]}, os.Environ())
 		if err != nil {
 			logger.Error("failed-exec", err)
 			return err
 		}
 	}
 
-	serverConfig, err := configure(logger)
+	serverConfig, err := configure(logger, sshdConfig)
 	if err != nil {
 		logger.Error("configure-failed", err)
 		return err
 	}
 
+	allowLocalForwarding, allowRemoteForwarding, err := forwardingPolicy(sshdConfig.AllowTCPForwarding)
+	if err != nil {
+		logger.Error("invalid-forwarding-policy", err)
+		return err
+	}
+
 	runner := handlers.NewCommandRunner()
 	shellLocator := handlers.NewShellLocator()
 	dialer := &net.Dialer{}
 
+	envPolicy, err := getEnvPolicy(sshdConfig)
+	if err != nil {
+		logger.Error("invalid-env-policy", err)
+		return err
+	}
+
+	keepaliveAction, err := getKeepaliveAction(sshdConfig.KeepaliveAction)
+	if err != nil {
+		logger.Error("invalid-keepalive-action", err)
+		return err
+	}
+
+	sftpOptions, err := getSFTPOptions(logger, sshdConfig)
+	if err != nil {
+		logger.Error("invalid-sftp-options", err)
+		return err
+	}
+
+	resolvedSCPRoot, err := getSCPRoot(sshdConfig.SCPRoot)
+	if err != nil {
+		logger.Error("invalid-scp-root", err)
+		return err
+	}
+
+	scpSymlinks, err := scp.ParseSymlinkPolicy(sshdConfig.SCPSymlinks)
+	if err != nil {
+		logger.Error("invalid-scp-symlinks", err)
+		return err
+	}
+
+	if sshdConfig.SCPBandwidthLimit < 0 {
+		err := errors.New("scp bandwidth limit cannot be negative")
+		logger.Error("invalid-scp-bandwidth-limit", err)
+		return err
+	}
+
+	uploadLimits, err := getUploadLimits(sshdConfig)
+	if err != nil {
+		logger.Error("invalid-upload-limits", err)
+		return err
+	}
+
+	forcedCommand, err := getForcedCommand(sshdConfig.AuthorizedKey)
+	if err != nil {
+		logger.Error("invalid-forced-command", err)
+		return err
+	}
+
+	maxStartups, err := getMaxStartups(sshdConfig.MaxStartups)
+	if err != nil {
+		logger.Error("invalid-max-startups", err)
+		return err
+	}
+
+	if sshdConfig.LoginGraceTime < 0 {
+		err := errors.New("login grace time cannot be negative")
+		logger.Error("invalid-login-grace-time", err)
+		return err
+	}
+
+	sessionOptions := handlers.SessionOptions{
+		LoginEnvironment:  getLoginEnvironment(sshdConfig),
+		EnvPolicy:         envPolicy,
+		Subsystems:        sshdConfig.Subsystems,
+		KeepaliveCountMax: sshdConfig.KeepaliveCountMax,
+		KeepaliveAction:   keepaliveAction,
+		ExecArgv:          sshdConfig.ExecArgv,
+		ExecPath:          sshdConfig.ExecPath,
+		ForcedCommand:     forcedCommand,
+		SFTP:              sftpOptions,
+		SCPRoot:           resolvedSCPRoot,
+		SCPSymlinks:       scpSymlinks,
+		SCPBandwidthLimit: sshdConfig.SCPBandwidthLimit,
+		UploadLimits:      uploadLimits,
+	}
+
+	globalRequestHandlers := map[string]handlers.GlobalRequestHandler{}
+	if allowRemoteForwarding {
+		globalRequestHandlers[globalrequest.TCPIPForward] = new(globalrequest.TCPIPForwardHandler)
+		globalRequestHandlers[globalrequest.CancelTCPIPForward] = new(globalrequest.CancelTCPIPForwardHandler)
+	}
+
+	newChannelHandlers := map[string]handlers.NewChannelHandler{
+		"session": handlers.NewSessionChannelHandler(
+			runner,
+			shellLocator,
+			getDaemonEnvironment(sshdConfig),
+			time.Duration(sshdConfig.KeepaliveInterval),
+			sessionOptions,
+		),
+	}
+	if allowLocalForwarding {
+		newChannelHandlers["direct-tcpip"] = handlers.NewDirectTcpipChannelHandler(dialer)
+	}
+
 	sshDaemon := daemon.New(
 		logger,
 		serverConfig,
-		map[string]handlers.GlobalRequestHandler{
-			globalrequest.TCPIPForward:       new(globalrequest.TCPIPForwardHandler),
-			globalrequest.CancelTCPIPForward: new(globalrequest.CancelTCPIPForwardHandler),
-		},
-		map[string]handlers.NewChannelHandler{
-			"session":      handlers.NewSessionChannelHandler(runner, shellLocator, getDaemonEnvironment(), 15*time.Second),
-			"direct-tcpip": handlers.NewDirectTcpipChannelHandler(dialer),
-		},
+		globalRequestHandlers,
+		newChannelHandlers,
 	)
-	server, err := createServer(logger, *address, sshDaemon)
+	server, err := createServer(logger, sshdConfig.Address, sshDaemon)
 	if err != nil {
 		logger.Error("create-server-failure", err)
 		return err
 	}
+	server.SetMaxStartups(maxStartups)
+	server.SetLoginGraceTime(time.Duration(sshdConfig.LoginGraceTime))
 
 	members := grouper.Members{
 		{"sshd", server},
 	}
 
-	if dbgAddr := debugserver.DebugAddress(flag.CommandLine); dbgAddr != "" {
+	if sshdConfig.DebugAddress != "" {
 		members = append(grouper.Members{
-			{"debug-server", debugserver.Runner(dbgAddr, reconfigurableSink)},
+			{"debug-server", debugserver.Runner(sshdConfig.DebugAddress, reconfigurableSink)},
 		}, members...)
 	}
 
@@ -192,10 +448,139 @@ func main() {
 	}
 }
 
-func getDaemonEnvironment() map[string]string {
+// loadConfig builds the daemon configuration. A config handed over through
+// SSHD_CONFIG by a re-exec is used as is. Otherwise the config file is read,
+// when provided, and any flags that were set on the command line override
+// the values it contains.
+func loadConfig() (config.SSHDConfig, error) {
+	if payload := os.Getenv("SSHD_CONFIG"); payload != "" {
+		return config.ParseSSHDConfig([]byte(payload))
+	}
+
+	sshdConfig := config.DefaultSSHDConfig()
+	if *configPath != "" {
+		var err error
+		sshdConfig, err = config.NewSSHDConfig(*configPath)
+		if err != nil {
+			return config.SSHDConfig{}, err
+		}
+	}
+
+	lagerConfig := lagerflags.ConfigFromFlags()
+
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "address":
+			sshdConfig.Address = *address
+		case "hostKey":
+			sshdConfig.HostKey = *hostKey
+		case "authorizedKey":
+			sshdConfig.AuthorizedKey = *authorizedKey
+		case "allowUnauthenticatedClients":
+			sshdConfig.AllowUnauthenticatedClients = *allowUnauthenticatedClients
+		case "inheritDaemonEnv":
+			sshdConfig.InheritDaemonEnv = *inheritDaemonEnv
+		case "loginEnvironment":
+			sshdConfig.LoginEnvironment = *loginEnvironment
+		case "appDir":
+			sshdConfig.AppDir = *appDir
+		case "acceptEnv":
+			sshdConfig.AcceptEnv = acceptEnv
+		case "maxEnvValueLength":
+			sshdConfig.MaxEnvValueLength = *maxEnvValueLength
+		case "maxEnvVariables":
+			sshdConfig.MaxEnvVariables = *maxEnvVariables
+		case "execArgv":
+			sshdConfig.ExecArgv = *execArgv
+		case "execPath":
+			sshdConfig.ExecPath = *execPath
+		case "sftpRoot":
+			sshdConfig.SFTPRoot = *sftpRoot
+		case "sftpMounts":
+			sshdConfig.SFTPMounts = *sftpMounts
+		case "sftpReadOnly":
+			sshdConfig.SFTPReadOnly = *sftpReadOnly
+		case "sftpDeny":
+			sshdConfig.SFTPDeny = *sftpDeny
+		case "scpRoot":
+			sshdConfig.SCPRoot = *scpRoot
+		case "scpSymlinks":
+			sshdConfig.SCPSymlinks = *scpSymlinks
+		case "scpBandwidthLimit":
+			sshdConfig.SCPBandwidthLimit = *scpBandwidthLimit
+		case "uploadMaxFileSize":
+			sshdConfig.UploadMaxFileSize = *uploadMaxFileSize
+		case "uploadMaxSessionSize":
+			sshdConfig.UploadMaxSessionSize = *uploadMaxSessionSize
+		case "uploadMinFreeSpace":
+			sshdConfig.UploadMinFreeSpace = *uploadMinFreeSpace
+		case "keepaliveInterval":
+			sshdConfig.KeepaliveInterval = durationjson.Duration(*keepaliveInterval)
+		case "keepaliveCountMax":
+			sshdConfig.KeepaliveCountMax = *keepaliveCountMax
+		case "keepaliveAction":
+			sshdConfig.KeepaliveAction = *keepaliveAction
+		case "loginGraceTime":
+			sshdConfig.LoginGraceTime = durationjson.Duration(*loginGraceTime)
+		case "maxStartups":
+			sshdConfig.MaxStartups = *maxStartups
+		case "allowedCiphers":
+			sshdConfig.AllowedCiphers = *allowedCiphers
+		case "allowedMACs":
+			sshdConfig.AllowedMACs = *allowedMACs
+		case "allowedKeyExchanges":
+			sshdConfig.AllowedKeyExchanges = *allowedKeyExchanges
+		case "logLevel":
+			sshdConfig.LogLevel = lagerConfig.LogLevel
+		case "redactSecrets":
+			sshdConfig.RedactSecrets = lagerConfig.RedactSecrets
+		case "timeFormat":
+			sshdConfig.TimeFormat = lagerConfig.TimeFormat
+		case debugserver.DebugFlag:
+			sshdConfig.DebugAddress = debugserver.DebugAddress(flag.CommandLine)
+		}
+	})
+
+	return sshdConfig, nil
+}
+
+func forwardingPolicy(allowTCPForwarding string) (bool, bool, error) {
+	switch allowTCPForwarding {
+	case "yes":
+		return true, true, nil
+	case "local":
+		return true, false, nil
+	case "remote":
+		return false, true, nil
+	case "no":
+		return false, false, nil
+	default:
+		return false, false, fmt.Errorf("unknown allow_tcp_forwarding value: %q", allowTCPForwarding)
+	}
+}
+
+// getMaxStartups parses the limit of unauthenticated connections. An empty
+// value disables the limit.
+func getMaxStartups(maxStartups string) (server.MaxStartups, error) {
+	if maxStartups == "" {
+		return server.MaxStartups{}, nil
+	}
+	return server.ParseMaxStartups(maxStartups)
+}
+
+func getKeepaliveAction(keepaliveAction string) (handlers.KeepaliveAction, error) {
+	switch action := handlers.KeepaliveAction(keepaliveAction); action {
+	case handlers.KeepaliveActionHangup, handlers.KeepaliveActionContinue, handlers.KeepaliveActionDetach:
+		return action, nil
+	default:
+		return "", fmt.Errorf("unknown keepalive_action value: %q", keepaliveAction)
+	}
+}
+
+func getDaemonEnvironment(sshdConfig config.SSHDConfig) map[string]string {
 	daemonEnv := map[string]string{}
 
-	if *inheritDaemonEnv {
+	if sshdConfig.InheritDaemonEnv {
 		envs := os.Environ()
 		for _, env := range envs {
 			nvp := strings.SplitN(env, "=", 2)
@@ -208,27 +593,149 @@ func getDaemonEnvironment() map[string]string {
 	return daemonEnv
 }
 
-func configure(logger lager.Logger) (*ssh.ServerConfig, error) {
+func getEnvPolicy(sshdConfig config.SSHDConfig) (*handlers.EnvPolicy, error) {
+	// an unset accept_env accepts every name but the dangerous ones, while
+	// an empty one accepts none
+	var patterns []string
+	if sshdConfig.AcceptEnv != nil {
+		patterns = []string{}
+		if *sshdConfig.AcceptEnv != "" {
+			patterns = strings.Split(*sshdConfig.AcceptEnv, ",")
+		}
+	}
+
+	return handlers.NewEnvPolicy(patterns, sshdConfig.MaxEnvValueLength, sshdConfig.MaxEnvVariables)
+}
+
+func getSFTPOptions(logger lager.Logger, sshdConfig config.SSHDConfig) (sftpserver.Options, error) {
+	options := sftpserver.Options{
+		ReadOnly: sshdConfig.SFTPReadOnly,
+	}
+
+	if sshdConfig.SFTPRoot != "" && sshdConfig.SFTPMounts != "" {
+		return sftpserver.Options{}, errors.New("sftp root and sftp mounts cannot be used together")
+	}
+
+	if sshdConfig.SFTPRoot != "" {
+		fs, err := sftpserver.NewOSFileSystem(logger, sshdConfig.SFTPRoot)
+		if err != nil {
+			return sftpserver.Options{}, err
+		}
+		options.FileSystem = fs
+	}
+
+	if sshdConfig.SFTPMounts != "" {
+		mounts := map[string]sftpserver.FileSystem{}
+		for _, mount := range strings.Split(sshdConfig.SFTPMounts, ",") {
+			mountPoint := strings.SplitN(mount, "=", 2)
+			if len(mountPoint) != 2 || mountPoint[0] == "" || mountPoint[1] == "" {
+				return sftpserver.Options{}, fmt.Errorf("invalid sftp mount %q", mount)
+			}
+
+			fs, err := sftpserver.NewOSFileSystem(logger, mountPoint[1])
+			if err != nil {
+				return sftpserver.Options{}, err
+			}
+			mounts[mountPoint[0]] = fs
+		}
+
+		fs, err := sftpserver.NewOverlayFileSystem(mounts)
+		if err != nil {
+			return sftpserver.Options{}, err
+		}
+		options.FileSystem = fs
+	}
+
+	if sshdConfig.SFTPDeny != "" {
+		for _, name := range strings.Split(sshdConfig.SFTPDeny, ",") {
+			op, err := sftpserver.ParseOperation(name)
+			if err != nil {
+				return sftpserver.Options{}, err
+			}
+			options.Deny = append(options.Deny, op)
+		}
+	}
+
+	return options, nil
+}
+
+// getSCPRoot checks the scp root and resolves its symbolic links, so that the
+// paths that are confined to it are compared with the real directory.
+func getSCPRoot(root string) (string, error) {
+	if root == "" {
+		return "", nil
+	}
+
+	resolved, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("scp root %q is not a directory", root)
+	}
+
+	return resolved, nil
+}
+
+func getUploadLimits(sshdConfig config.SSHDConfig) (quota.Limits, error) {
+	limits := quota.Limits{
+		MaxFileSize:    sshdConfig.UploadMaxFileSize,
+		MaxSessionSize: sshdConfig.UploadMaxSessionSize,
+		MinFreeSpace:   sshdConfig.UploadMinFreeSpace,
+	}
+
+	if limits.MaxFileSize < 0 || limits.MaxSessionSize < 0 || limits.MinFreeSpace < 0 {
+		return quota.Limits{}, errors.New("upload limits cannot be negative")
+	}
+
+	return limits, nil
+}
+
+func getLoginEnvironment(sshdConfig config.SSHDConfig) *handlers.LoginEnvironment {
+	if !sshdConfig.LoginEnvironment {
+		return nil
+	}
+
+	appEnv := map[string]string{}
+	for _, env := range os.Environ() {
+		nvp := strings.SplitN(env, "=", 2)
+		if len(nvp) == 2 && (nvp[0] == "PATH" || strings.HasPrefix(nvp[0], "VCAP_")) {
+			appEnv[nvp[0]] = nvp[1]
+		}
+	}
+
+	return &handlers.LoginEnvironment{
+		AppDir: sshdConfig.AppDir,
+		Env:    appEnv,
+	}
+}
+
+func configure(logger lager.Logger, sshdConfig config.SSHDConfig) (*ssh.ServerConfig, error) {
 	errorStrings := []string{}
 	sshConfig := &ssh.ServerConfig{ServerVersion: "SSH-2.0-diego-sshd"}
 	sshConfig.SetDefaults()
 
-	key, err := acquireHostKey(logger)
+	key, err := acquireHostKey(logger, sshdConfig.HostKey)
 	if err != nil {
 		logger.Error("failed-to-acquire-host-key", err)
 		errorStrings = append(errorStrings, err.Error())
 	}
 
 	sshConfig.AddHostKey(key)
-	sshConfig.NoClientAuth = *allowUnauthenticatedClients
+	sshConfig.NoClientAuth = sshdConfig.AllowUnauthenticatedClients
 
-	if authorizedKeyValue == "" && !*allowUnauthenticatedClients {
+	if sshdConfig.AuthorizedKey == "" && !sshdConfig.AllowUnauthenticatedClients {
 		logger.Error("authorized-key-required", nil)
 		errorStrings = append(errorStrings, "Public user key is required")
 	}
 
-	if authorizedKeyValue != "" {
-		decodedPublicKey, err := decodeAuthorizedKey(logger)
+	if sshdConfig.AuthorizedKey != "" {
+		decodedPublicKey, err := decodeAuthorizedKey(logger, sshdConfig.AuthorizedKey)
 		if err == nil {
 			authenticator := authenticators.NewPublicKeyAuthenticator(decodedPublicKey)
 			sshConfig.PublicKeyCallback = authenticator.Authenticate
@@ -237,20 +744,20 @@ func configure(logger lager.Logger) (*ssh.ServerConfig, error) {
 		}
 	}
 
-	if *allowedCiphers != "" {
-		sshConfig.Config.Ciphers = strings.Split(*allowedCiphers, ",")
+	if sshdConfig.AllowedCiphers != "" {
+		sshConfig.Config.Ciphers = strings.Split(sshdConfig.AllowedCiphers, ",")
 	} else {
 		sshConfig.Config.Ciphers = []string{"chacha20-poly1305@openssh.com", "aes128-gcm@openssh.com", "aes256-ctr", "aes192-ctr", "aes128-ctr"}
 	}
 
-	if *allowedMACs != "" {
-		sshConfig.Config.MACs = strings.Split(*allowedMACs, ",")
+	if sshdConfig.AllowedMACs != "" {
+		sshConfig.Config.MACs = strings.Split(sshdConfig.AllowedMACs, ",")
 	} else {
 		sshConfig.Config.MACs = []string{"hmac-sha2-256-etm@openssh.com", "hmac-sha2-256"}
 	}
 
-	if *allowedKeyExchanges != "" {
-		sshConfig.Config.KeyExchanges = strings.Split(*allowedKeyExchanges, ",")
+	if sshdConfig.AllowedKeyExchanges != "" {
+		sshConfig.Config.KeyExchanges = strings.Split(sshdConfig.AllowedKeyExchanges, ",")
 	} else {
 		sshConfig.Config.KeyExchanges = []string{"curve25519-sha256@libssh.org"}
 	}
@@ -263,12 +770,42 @@ func configure(logger lager.Logger) (*ssh.ServerConfig, error) {
 	return sshConfig, err
 }
 
-func decodeAuthorizedKey(logger lager.Logger) (ssh.PublicKey, error) {
-	publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(authorizedKeyValue))
+func decodeAuthorizedKey(logger lager.Logger, authorizedKey string) (ssh.PublicKey, error) {
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(authorizedKey))
 	return publicKey, err
 }
 
-func acquireHostKey(logger lager.Logger) (ssh.Signer, error) {
+// getForcedCommand returns the command option of the authorized key, if any.
+func getForcedCommand(authorizedKey string) (string, error) {
+	if authorizedKey == "" {
+		return "", nil
+	}
+
+	_, _, options, _, err := ssh.ParseAuthorizedKey([]byte(authorizedKey))
+	if err != nil {
+		return "", err
+	}
+
+	for _, option := range options {
+		if strings.HasPrefix(option, "command=") {
+			return unquoteKeyOption(strings.TrimPrefix(option, "command="))
+		}
+	}
+
+	return "", nil
+}
+
+// unquoteKeyOption removes the quotes around the value of an authorized key
+// option. Like OpenSSH, only \" is unescaped; other backslashes are kept.
+func unquoteKeyOption(value string) (string, error) {
+	if len(value) < 2 || value[0] != '"' || value[len(value)-1] != '"' {
+		return "", fmt.Errorf("authorized key option value is not quoted: %s", value)
+	}
+
+	return strings.Replace(value[1:len(value)-1], `\"`, `"`, -1), nil
+}
+
+func acquireHostKey(logger lager.Logger, hostKeyPEM string) (ssh.Signer, error) {
 	var encoded []byte
 	if hostKeyPEM == "" {
 		return nil, errors.New("empty-host-key")
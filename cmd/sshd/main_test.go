@@ -1,3 +1,4 @@
+//go:build !windows2012R2
 // +build !windows2012R2
 
 package main_test
@@ -5,8 +6,10 @@ package main_test
 import (
 	"bufio"
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
@@ -46,6 +49,16 @@ var _ = Describe("SSH daemon", func() {
 
 		allowUnauthenticatedClients bool
 		inheritDaemonEnv            bool
+
+		configPath string
+
+		sftpRoot   string
+		sftpMounts string
+		sftpDeny   string
+		scpRoot    string
+
+		loginGraceTime time.Duration
+		maxStartups    string
 	)
 
 	BeforeEach(func() {
@@ -60,6 +73,13 @@ var _ = Describe("SSH daemon", func() {
 		allowUnauthenticatedClients = false
 		inheritDaemonEnv = false
 		address = fmt.Sprintf("127.0.0.1:%d", sshdPort)
+		configPath = ""
+		sftpRoot = ""
+		sftpMounts = ""
+		sftpDeny = ""
+		scpRoot = ""
+		loginGraceTime = 0
+		maxStartups = ""
 	})
 
 	JustBeforeEach(func() {
@@ -73,6 +93,16 @@ var _ = Describe("SSH daemon", func() {
 
 			AllowUnauthenticatedClients: allowUnauthenticatedClients,
 			InheritDaemonEnv:            inheritDaemonEnv,
+
+			ConfigPath: configPath,
+
+			SFTPRoot:   sftpRoot,
+			SFTPMounts: sftpMounts,
+			SFTPDeny:   sftpDeny,
+			SCPRoot:    scpRoot,
+
+			LoginGraceTime: loginGraceTime,
+			MaxStartups:    maxStartups,
 		}
 
 		runner, process = startSshd(sshdPath, args, "127.0.0.1", int(sshdPort))
@@ -82,6 +112,67 @@ var _ = Describe("SSH daemon", func() {
 		ginkgomon.Kill(process, 3*time.Second)
 	})
 
+	Describe("config validation", func() {
+		var validationArgs testrunner.Args
+
+		type report struct {
+			Valid    bool
+			Problems []struct {
+				Setting string
+				Problem string
+			}
+		}
+
+		validate := func() (int, report) {
+			command := exec.Command(sshdPath, append(validationArgs.ArgSlice(), "-validate")...)
+			session, err := gexec.Start(command, nil, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session, 10*time.Second).Should(gexec.Exit())
+
+			var r report
+			Expect(json.Unmarshal(session.Out.Contents(), &r)).To(Succeed())
+			return session.ExitCode(), r
+		}
+
+		BeforeEach(func() {
+			validationArgs = testrunner.Args{
+				Address:       "127.0.0.1:0",
+				HostKey:       hostKeyPem,
+				AuthorizedKey: publicAuthorizedKey,
+			}
+		})
+
+		It("reports a valid config", func() {
+			exitCode, r := validate()
+			Expect(exitCode).To(Equal(0))
+			Expect(r.Valid).To(BeTrue())
+			Expect(r.Problems).To(BeEmpty())
+		})
+
+		Context("when several flags are invalid", func() {
+			BeforeEach(func() {
+				validationArgs.AllowedMACs = "hmac-sha2-256,not-a-mac"
+				validationArgs.MaxStartups = "many"
+				validationArgs.SCPRoot = "/does/not/exist"
+			})
+
+			It("reports all of the problems", func() {
+				exitCode, r := validate()
+				Expect(exitCode).To(Equal(1))
+				Expect(r.Valid).To(BeFalse())
+
+				problems := map[string]string{}
+				for _, problem := range r.Problems {
+					problems[problem.Setting] = problem.Problem
+				}
+				Expect(problems).To(HaveLen(3))
+				Expect(problems).To(HaveKeyWithValue("allowed_macs", ContainSubstring("not-a-mac")))
+				Expect(problems).To(HaveKey("max_startups"))
+				Expect(problems).To(HaveKey("scp_root"))
+			})
+		})
+	})
+
 	Describe("argument validation", func() {
 		Context("when an ill-formed host key is provided", func() {
 			BeforeEach(func() {
@@ -105,6 +196,73 @@ var _ = Describe("SSH daemon", func() {
 			})
 		})
 
+		Context("when the sftp root does not exist", func() {
+			BeforeEach(func() {
+				sftpRoot = "/nonexistent/sftp/root"
+			})
+
+			It("reports and dies", func() {
+				Expect(runner).To(gbytes.Say("invalid-sftp-options"))
+				Expect(runner).NotTo(gexec.Exit(0))
+			})
+		})
+
+		Context("when the scp root does not exist", func() {
+			BeforeEach(func() {
+				scpRoot = "/nonexistent/scp/root"
+			})
+
+			It("reports and dies", func() {
+				Expect(runner).To(gbytes.Say("invalid-scp-root"))
+				Expect(runner).NotTo(gexec.Exit(0))
+			})
+		})
+
+		Context("when both an sftp root and sftp mounts are provided", func() {
+			BeforeEach(func() {
+				sftpRoot = os.TempDir()
+				sftpMounts = "/tmp=" + os.TempDir()
+			})
+
+			It("reports and dies", func() {
+				Expect(runner).To(gbytes.Say("invalid-sftp-options.*cannot be used together"))
+				Expect(runner).NotTo(gexec.Exit(0))
+			})
+		})
+
+		Context("when an sftp mount is malformed", func() {
+			BeforeEach(func() {
+				sftpMounts = "/logs"
+			})
+
+			It("reports and dies", func() {
+				Expect(runner).To(gbytes.Say(`invalid-sftp-options.*invalid sftp mount \\"/logs\\"`))
+				Expect(runner).NotTo(gexec.Exit(0))
+			})
+		})
+
+		Context("when an unknown sftp operation is denied", func() {
+			BeforeEach(func() {
+				sftpDeny = "remove,chown"
+			})
+
+			It("reports and dies", func() {
+				Expect(runner).To(gbytes.Say(`invalid-sftp-options.*unknown sftp operation \\"chown\\"`))
+				Expect(runner).NotTo(gexec.Exit(0))
+			})
+		})
+
+		Context("when max startups is malformed", func() {
+			BeforeEach(func() {
+				maxStartups = "10:30"
+			})
+
+			It("reports and dies", func() {
+				Expect(runner).To(gbytes.Say(`invalid-max-startups.*invalid max startups: \\"10:30\\"`))
+				Expect(runner).NotTo(gexec.Exit(0))
+			})
+		})
+
 		Context("the authorized key is not provided", func() {
 			BeforeEach(func() {
 				authorizedKey = ""
@@ -301,6 +459,31 @@ var _ = Describe("SSH daemon", func() {
 			ItDoesNotExposeSensitiveInformation()
 		})
 
+		Context("when a client does not authenticate within the login grace time", func() {
+			BeforeEach(func() {
+				loginGraceTime = 500 * time.Millisecond
+				clientConfig = &ssh.ClientConfig{
+					HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+				}
+			})
+
+			It("closes the connection", func() {
+				conn, err := net.Dial("tcp", address)
+				Expect(err).NotTo(HaveOccurred())
+				defer conn.Close()
+
+				closed := make(chan error, 1)
+				go func() {
+					_, err := ioutil.ReadAll(conn)
+					closed <- err
+				}()
+
+				Consistently(closed, 200*time.Millisecond).ShouldNot(Receive())
+				Eventually(closed, 2*time.Second).Should(Receive())
+				Expect(runner).To(gbytes.Say("login-grace-time-exceeded"))
+			})
+		})
+
 		Context("when unauthenticated clients are not allowed", func() {
 			BeforeEach(func() {
 				clientConfig = &ssh.ClientConfig{
@@ -715,6 +898,94 @@ var _ = Describe("SSH daemon", func() {
 			})
 		})
 
+		Context("when a config file is provided", func() {
+			BeforeEach(func() {
+				configFile, err := ioutil.TempFile("", "sshd-config")
+				Expect(err).NotTo(HaveOccurred())
+
+				_, err = configFile.WriteString(`{
+					"allow_unauthenticated_clients": false,
+					"allow_tcp_forwarding": "no",
+					"subsystems": []
+				}`)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(configFile.Close()).To(Succeed())
+
+				configPath = configFile.Name()
+			})
+
+			AfterEach(func() {
+				Expect(os.RemoveAll(configPath)).To(Succeed())
+			})
+
+			It("lets flags take precedence over the file", func() {
+				session, err := client.NewSession()
+				Expect(err).NotTo(HaveOccurred())
+
+				result, err := session.Output("/bin/echo -n 'Hello there!'")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(result)).To(Equal("Hello there!"))
+			})
+
+			It("applies the settings from the file after re-executing", func() {
+				_, err := client.Dial("tcp", "127.0.0.1:1")
+				Expect(err).To(MatchError(ContainSubstring("unknown channel type")))
+
+				session, err := client.NewSession()
+				Expect(err).NotTo(HaveOccurred())
+				defer session.Close()
+
+				type subsysMsg struct{ Subsystem string }
+				accepted, err := session.SendRequest("subsystem", true, ssh.Marshal(subsysMsg{Subsystem: "sftp"}))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(accepted).To(BeFalse())
+			})
+		})
+
+		Context("when the authorized key has a command option", func() {
+			BeforeEach(func() {
+				if runtime.GOOS == "windows" {
+					Skip("forced commands run through the shell on windows")
+				}
+
+				allowUnauthenticatedClients = false
+				authorizedKey = `command="/bin/echo -n forced" ` + publicAuthorizedKey
+
+				key, err := ssh.ParsePrivateKey([]byte(privateKey))
+				Expect(err).NotTo(HaveOccurred())
+
+				clientConfig = &ssh.ClientConfig{
+					User:            os.Getenv("USER"),
+					Auth:            []ssh.AuthMethod{ssh.PublicKeys(key)},
+					HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+				}
+			})
+
+			It("runs the forced command", func() {
+				session, err := client.NewSession()
+				Expect(err).NotTo(HaveOccurred())
+
+				result, err := session.Output("/bin/echo -n 'Hello there!'")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(result)).To(Equal("forced"))
+			})
+
+			Context("when the command contains backslashes", func() {
+				BeforeEach(func() {
+					authorizedKey = `command="/bin/echo -n \"forced\" 'a\.b'" ` + publicAuthorizedKey
+				})
+
+				It("only unescapes quotes, like OpenSSH", func() {
+					session, err := client.NewSession()
+					Expect(err).NotTo(HaveOccurred())
+
+					result, err := session.Output("/bin/echo -n 'Hello there!'")
+					Expect(err).NotTo(HaveOccurred())
+					Expect(string(result)).To(Equal(`forced a\.b`))
+				})
+			})
+		})
+
 		Context("when a client requests a remote port forward", func() {
 			var (
 				server *ghttp.Server
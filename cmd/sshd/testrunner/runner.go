@@ -9,6 +9,7 @@ import (
 )
 
 type Args struct {
+	ConfigPath                  string
 	Address                     string
 	HostKey                     string
 	AuthorizedKey               string
@@ -17,10 +18,26 @@ type Args struct {
 	AllowedKeyExchanges         string
 	AllowUnauthenticatedClients bool
 	InheritDaemonEnv            bool
+	LoginEnvironment            bool
+	AppDir                      string
+	AcceptEnv                   string
+	MaxEnvValueLength           int
+	MaxEnvVariables             int
+	ExecArgv                    bool
+	ExecPath                    string
+	SFTPRoot                    string
+	SFTPMounts                  string
+	SFTPDeny                    string
+	SCPRoot                     string
+	KeepaliveInterval           time.Duration
+	KeepaliveCountMax           int
+	KeepaliveAction             string
+	LoginGraceTime              time.Duration
+	MaxStartups                 string
 }
 
 func (args Args) ArgSlice() []string {
-	return []string{
+	argSlice := []string{
 		"-address=" + args.Address,
 		"-hostKey=" + args.HostKey,
 		"-authorizedKey=" + args.AuthorizedKey,
@@ -29,7 +46,59 @@ func (args Args) ArgSlice() []string {
 		"-allowedKeyExchanges=" + args.AllowedKeyExchanges,
 		"-allowUnauthenticatedClients=" + strconv.FormatBool(args.AllowUnauthenticatedClients),
 		"-inheritDaemonEnv=" + strconv.FormatBool(args.InheritDaemonEnv),
+		"-loginEnvironment=" + strconv.FormatBool(args.LoginEnvironment),
+		"-appDir=" + args.AppDir,
+		"-maxEnvValueLength=" + strconv.Itoa(args.MaxEnvValueLength),
+		"-maxEnvVariables=" + strconv.Itoa(args.MaxEnvVariables),
+		"-execArgv=" + strconv.FormatBool(args.ExecArgv),
+		"-execPath=" + args.ExecPath,
 	}
+
+	if args.AcceptEnv != "" {
+		argSlice = append(argSlice, "-acceptEnv="+args.AcceptEnv)
+	}
+
+	if args.KeepaliveInterval != 0 {
+		argSlice = append(argSlice, "-keepaliveInterval="+args.KeepaliveInterval.String())
+	}
+
+	if args.KeepaliveCountMax != 0 {
+		argSlice = append(argSlice, "-keepaliveCountMax="+strconv.Itoa(args.KeepaliveCountMax))
+	}
+
+	if args.KeepaliveAction != "" {
+		argSlice = append(argSlice, "-keepaliveAction="+args.KeepaliveAction)
+	}
+
+	if args.LoginGraceTime != 0 {
+		argSlice = append(argSlice, "-loginGraceTime="+args.LoginGraceTime.String())
+	}
+
+	if args.MaxStartups != "" {
+		argSlice = append(argSlice, "-maxStartups="+args.MaxStartups)
+	}
+
+	if args.SFTPRoot != "" {
+		argSlice = append(argSlice, "-sftpRoot="+args.SFTPRoot)
+	}
+
+	if args.SFTPMounts != "" {
+		argSlice = append(argSlice, "-sftpMounts="+args.SFTPMounts)
+	}
+
+	if args.SFTPDeny != "" {
+		argSlice = append(argSlice, "-sftpDeny="+args.SFTPDeny)
+	}
+
+	if args.SCPRoot != "" {
+		argSlice = append(argSlice, "-scpRoot="+args.SCPRoot)
+	}
+
+	if args.ConfigPath != "" {
+		argSlice = append(argSlice, "-config="+args.ConfigPath)
+	}
+
+	return argSlice
 }
 
 func New(binPath string, args Args) *ginkgomon.Runner {
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"code.cloudfoundry.org/diego-ssh/cmd/sshd/config"
+	"code.cloudfoundry.org/diego-ssh/helpers"
+	"code.cloudfoundry.org/diego-ssh/scp"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/lager/lagerflags"
+	"golang.org/x/crypto/ssh"
+)
+
+// validateConfig checks every setting of the config and returns all of the
+// problems it finds, without starting the daemon. An empty host key is not a
+// problem because the daemon generates one.
+func validateConfig(sshdConfig config.SSHDConfig) helpers.ConfigProblems {
+	var problems helpers.ConfigProblems
+	logger := lager.NewLogger("validate")
+
+	if problems.Require("address", sshdConfig.Address) {
+		problems.Add("address", helpers.CheckAddress(sshdConfig.Address))
+	}
+
+	if sshdConfig.DebugAddress != "" {
+		problems.Add("debug_address", helpers.CheckAddress(sshdConfig.DebugAddress))
+	}
+
+	switch sshdConfig.LogLevel {
+	case lagerflags.DEBUG, lagerflags.INFO, lagerflags.ERROR, lagerflags.FATAL, "":
+	default:
+		problems.Addf("log_level", "unknown log level: %q", sshdConfig.LogLevel)
+	}
+
+	if sshdConfig.HostKey != "" {
+		_, err := ssh.ParsePrivateKey([]byte(sshdConfig.HostKey))
+		problems.Add("host_key", err)
+	}
+
+	if sshdConfig.AuthorizedKey == "" {
+		if !sshdConfig.AllowUnauthenticatedClients {
+			problems.Addf("authorized_key", "is required unless allow_unauthenticated_clients is set")
+		}
+	} else if _, err := getForcedCommand(sshdConfig.AuthorizedKey); err != nil {
+		problems.Add("authorized_key", err)
+	}
+
+	problems.AddUnsupportedAlgorithms("allowed_ciphers", helpers.UnsupportedCiphers(sshdConfig.AllowedCiphers))
+	problems.AddUnsupportedAlgorithms("allowed_macs", helpers.UnsupportedMACs(sshdConfig.AllowedMACs))
+	problems.AddUnsupportedAlgorithms("allowed_key_exchanges", helpers.UnsupportedKeyExchanges(sshdConfig.AllowedKeyExchanges))
+
+	if sshdConfig.KeepaliveInterval < 0 {
+		problems.Addf("keepalive_interval", "must not be negative")
+	}
+
+	if sshdConfig.KeepaliveCountMax < 0 {
+		problems.Addf("keepalive_count_max", "must not be negative")
+	}
+
+	_, err := getKeepaliveAction(sshdConfig.KeepaliveAction)
+	problems.Add("keepalive_action", err)
+
+	_, _, err = forwardingPolicy(sshdConfig.AllowTCPForwarding)
+	problems.Add("allow_tcp_forwarding", err)
+
+	_, err = getEnvPolicy(sshdConfig)
+	problems.Add("accept_env", err)
+
+	_, err = getSFTPOptions(logger, sshdConfig)
+	problems.Add("sftp", err)
+
+	_, err = getSCPRoot(sshdConfig.SCPRoot)
+	problems.Add("scp_root", err)
+
+	_, err = scp.ParseSymlinkPolicy(sshdConfig.SCPSymlinks)
+	problems.Add("scp_symlinks", err)
+
+	if sshdConfig.SCPBandwidthLimit < 0 {
+		problems.Addf("scp_bandwidth_limit", "must not be negative")
+	}
+
+	_, err = getUploadLimits(sshdConfig)
+	problems.Add("upload_limits", err)
+
+	_, err = getMaxStartups(sshdConfig.MaxStartups)
+	problems.Add("max_startups", err)
+
+	if sshdConfig.LoginGraceTime < 0 {
+		problems.Addf("login_grace_time", "must not be negative")
+	}
+
+	return problems
+}
@@ -5,6 +5,7 @@ import (
 
 	"code.cloudfoundry.org/diego-ssh/handlers"
 	"code.cloudfoundry.org/diego-ssh/helpers"
+	"code.cloudfoundry.org/diego-ssh/server"
 	"code.cloudfoundry.org/lager"
 	"golang.org/x/crypto/ssh"
 )
@@ -43,6 +44,8 @@ func (d *Daemon) HandleConnection(netConn net.Conn) {
 		return
 	}
 
+	server.HandshakeComplete(netConn)
+
 	lnStore := helpers.NewListenerStore()
 	go d.handleGlobalRequests(logger, serverRequests, serverConn, lnStore)
 	go d.handleNewChannels(logger, serverChannels)
@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"io"
+	"sync"
+)
+
+// detachableWriter passes writes through to a session channel until the
+// session is detached. From then on output is discarded so that the command
+// does not block or fail on a channel that nobody reads.
+type detachableWriter struct {
+	sync.Mutex
+	writer   io.Writer
+	detached bool
+}
+
+func newDetachableWriter(writer io.Writer) *detachableWriter {
+	return &detachableWriter{writer: writer}
+}
+
+func (w *detachableWriter) Write(p []byte) (int, error) {
+	if w.isDetached() {
+		return len(p), nil
+	}
+
+	n, err := w.writer.Write(p)
+	if err != nil && w.isDetached() {
+		return len(p), nil
+	}
+
+	return n, err
+}
+
+func (w *detachableWriter) detach() {
+	if w == nil {
+		return
+	}
+
+	w.Lock()
+	w.detached = true
+	w.Unlock()
+}
+
+func (w *detachableWriter) isDetached() bool {
+	w.Lock()
+	defer w.Unlock()
+	return w.detached
+}
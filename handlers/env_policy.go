@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"path"
+)
+
+var errEnvNameNotAccepted = errors.New("name not accepted")
+var errEnvValueTooLong = errors.New("value too long")
+var errTooManyEnvVariables = errors.New("too many variables")
+
+// deniedEnv lists the names that change how programs are loaded or how the
+// shell runs commands. Clients may only set them when the accepted patterns
+// list them explicitly.
+var deniedEnv = []string{"LD_*", "BASH_ENV", "ENV", "PATH", "IFS"}
+
+// EnvPolicy decides which environment variables a client may set with `env`
+// requests. Names are matched against glob patterns in the style of the
+// OpenSSH AcceptEnv option.
+type EnvPolicy struct {
+	acceptEnv      []string
+	maxValueLength int
+	maxVariables   int
+}
+
+// NewEnvPolicy returns a policy that accepts the names matching acceptEnv.
+// A nil acceptEnv accepts every name and an empty one accepts none, like
+// OpenSSH. Either way, the names in deniedEnv are only accepted when a
+// pattern is the name itself or the deniedEnv pattern that covers it. A
+// limit of zero disables the corresponding check.
+func NewEnvPolicy(acceptEnv []string, maxValueLength, maxVariables int) (*EnvPolicy, error) {
+	for _, pattern := range acceptEnv {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid accept env pattern %q: %s", pattern, err)
+		}
+	}
+
+	return &EnvPolicy{
+		acceptEnv:      acceptEnv,
+		maxValueLength: maxValueLength,
+		maxVariables:   maxVariables,
+	}, nil
+}
+
+func (p *EnvPolicy) Accepts(name string) bool {
+	for _, denied := range deniedEnv {
+		if matched, _ := path.Match(denied, name); matched {
+			return p.listed(name) || p.listed(denied)
+		}
+	}
+
+	if p.acceptEnv == nil {
+		return true
+	}
+
+	for _, pattern := range p.acceptEnv {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *EnvPolicy) listed(pattern string) bool {
+	for _, accepted := range p.acceptEnv {
+		if accepted == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// check validates a request to set name to value given the names that the
+// client has already set in the session.
+func (p *EnvPolicy) check(name, value string, requested map[string]struct{}) error {
+	if p == nil {
+		return nil
+	}
+
+	if !p.Accepts(name) {
+		return errEnvNameNotAccepted
+	}
+
+	if p.maxValueLength > 0 && len(value) > p.maxValueLength {
+		return errEnvValueTooLong
+	}
+
+	if _, ok := requested[name]; !ok && p.maxVariables > 0 && len(requested) >= p.maxVariables {
+		return errTooManyEnvVariables
+	}
+
+	return nil
+}
+
+func copyEnv(env map[string]string) map[string]string {
+	envCopy := make(map[string]string, len(env))
+	for k, v := range env {
+		envCopy[k] = v
+	}
+	return envCopy
+}
@@ -0,0 +1,71 @@
+package handlers_test
+
+import (
+	"code.cloudfoundry.org/diego-ssh/handlers"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("EnvPolicy", func() {
+	Describe("NewEnvPolicy", func() {
+		It("rejects malformed patterns", func() {
+			_, err := handlers.NewEnvPolicy([]string{"LC_[*"}, 0, 0)
+			Expect(err).To(MatchError(ContainSubstring("LC_[*")))
+		})
+	})
+
+	Describe("Accepts", func() {
+		It("accepts every name but the dangerous ones when no patterns are provided", func() {
+			policy, err := handlers.NewEnvPolicy(nil, 0, 0)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(policy.Accepts("LANG")).To(BeTrue())
+			Expect(policy.Accepts("ENV_VAR")).To(BeTrue())
+
+			Expect(policy.Accepts("LD_PRELOAD")).To(BeFalse())
+			Expect(policy.Accepts("LD_LIBRARY_PATH")).To(BeFalse())
+			Expect(policy.Accepts("BASH_ENV")).To(BeFalse())
+			Expect(policy.Accepts("ENV")).To(BeFalse())
+			Expect(policy.Accepts("PATH")).To(BeFalse())
+			Expect(policy.Accepts("IFS")).To(BeFalse())
+		})
+
+		It("accepts no name when the patterns are empty", func() {
+			policy, err := handlers.NewEnvPolicy([]string{}, 0, 0)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(policy.Accepts("LANG")).To(BeFalse())
+			Expect(policy.Accepts("PATH")).To(BeFalse())
+		})
+
+		It("accepts dangerous names only when they are listed explicitly", func() {
+			policy, err := handlers.NewEnvPolicy([]string{"*"}, 0, 0)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(policy.Accepts("LANG")).To(BeTrue())
+			Expect(policy.Accepts("PATH")).To(BeFalse())
+			Expect(policy.Accepts("LD_PRELOAD")).To(BeFalse())
+
+			policy, err = handlers.NewEnvPolicy([]string{"PATH", "LD_*"}, 0, 0)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(policy.Accepts("PATH")).To(BeTrue())
+			Expect(policy.Accepts("LD_PRELOAD")).To(BeTrue())
+			Expect(policy.Accepts("BASH_ENV")).To(BeFalse())
+		})
+
+		It("accepts names matching the patterns", func() {
+			policy, err := handlers.NewEnvPolicy([]string{"LANG", "LC_*", "GIT_?"}, 0, 0)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(policy.Accepts("LANG")).To(BeTrue())
+			Expect(policy.Accepts("LC_ALL")).To(BeTrue())
+			Expect(policy.Accepts("GIT_X")).To(BeTrue())
+
+			Expect(policy.Accepts("LANGUAGE")).To(BeFalse())
+			Expect(policy.Accepts("GIT_XY")).To(BeFalse())
+			Expect(policy.Accepts("LD_PRELOAD")).To(BeFalse())
+			Expect(policy.Accepts("BASH_ENV")).To(BeFalse())
+		})
+	})
+})
@@ -0,0 +1,37 @@
+// +build !windows
+
+package handlers
+
+// launcherScript mirrors the Cloud Foundry launcher: it changes to the app
+// directory, sources .profile.d/*.sh and .profile, and then either evaluates
+// the requested command or replaces itself with an interactive shell.
+//
+// It is invoked as `shell -c launcherScript <shell> <app-dir> [<command>]`.
+const launcherScript = `cd "$1" || exit 1
+shift
+if [ -d .profile.d ]; then
+  for env_file in .profile.d/*.sh; do
+    if [ -r "$env_file" ]; then
+      . "$env_file"
+    fi
+  done
+  unset env_file
+fi
+if [ -r .profile ]; then
+  . ./.profile
+fi
+if [ $# -eq 0 ]; then
+  exec "$0"
+fi
+eval "$1"
+`
+
+func (le *LoginEnvironment) shellArgs(shellPath string, args []string) []string {
+	launcherArgs := []string{"-c", launcherScript, shellPath, le.AppDir}
+
+	if len(args) == 2 && args[0] == "-c" {
+		launcherArgs = append(launcherArgs, args[1])
+	}
+
+	return launcherArgs
+}
@@ -7,6 +7,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"regexp"
@@ -14,24 +15,37 @@ import (
 	"syscall"
 	"time"
 
+	"code.cloudfoundry.org/diego-ssh/builtins"
 	"code.cloudfoundry.org/diego-ssh/helpers"
+	"code.cloudfoundry.org/diego-ssh/quota"
 	"code.cloudfoundry.org/diego-ssh/scp"
+	"code.cloudfoundry.org/diego-ssh/sftpserver"
 	"code.cloudfoundry.org/diego-ssh/signals"
 	"code.cloudfoundry.org/diego-ssh/termcodes"
 	"code.cloudfoundry.org/lager"
-	"github.com/docker/docker/pkg/term"
+	"github.com/google/shlex"
 	"github.com/kr/pty"
-	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 )
 
 var scpRegex = regexp.MustCompile(`^\s*scp($|\s+)`)
 
+// sftpServerRegex matches the command lines that clients run to start an
+// sftp server when they do not request the subsystem.
+var sftpServerRegex = regexp.MustCompile(`^\s*(\S*/)?(sftp-server|internal-sftp)($|\s+)`)
+
+// builtinPrefix is the reserved command name that selects the commands
+// implemented by the daemon itself, even when a shell is available.
+const builtinPrefix = "cf-builtin"
+
+var builtinRegex = regexp.MustCompile(`^\s*` + builtinPrefix + `($|\s+)`)
+
 type SessionChannelHandler struct {
 	runner       Runner
 	shellLocator ShellLocator
 	defaultEnv   map[string]string
 	keepalive    time.Duration
+	options      SessionOptions
 }
 
 func NewSessionChannelHandler(
@@ -39,12 +53,14 @@ func NewSessionChannelHandler(
 	shellLocator ShellLocator,
 	defaultEnv map[string]string,
 	keepalive time.Duration,
+	options SessionOptions,
 ) *SessionChannelHandler {
 	return &SessionChannelHandler{
 		runner:       runner,
 		shellLocator: shellLocator,
 		defaultEnv:   defaultEnv,
 		keepalive:    keepalive,
+		options:      options,
 	}
 }
 
@@ -73,19 +89,29 @@ type session struct {
 	keepaliveDuration time.Duration
 	keepaliveStopCh   chan struct{}
 
-	shellPath string
-	runner    Runner
-	channel   ssh.Channel
+	shellPath        string
+	runner           Runner
+	channel          ssh.Channel
+	loginEnvironment *LoginEnvironment
 
 	sync.Mutex
-	env     map[string]string
-	command *exec.Cmd
+	env          map[string]string
+	requestedEnv map[string]struct{}
+	envPolicy    *EnvPolicy
+	options      SessionOptions
+	command      *exec.Cmd
 
 	wg         sync.WaitGroup
 	allocPty   bool
 	ptyRequest ptyRequestMsg
 
 	ptyMaster *os.File
+
+	builtinStarted bool
+
+	stdin  io.WriteCloser
+	stdout *detachableWriter
+	stderr *detachableWriter
 }
 
 func (handler *SessionChannelHandler) newSession(logger lager.Logger, channel ssh.Channel, keepalive time.Duration) *session {
@@ -95,7 +121,11 @@ func (handler *SessionChannelHandler) newSession(logger lager.Logger, channel ss
 		runner:            handler.runner,
 		shellPath:         handler.shellLocator.ShellPath(),
 		channel:           channel,
-		env:               handler.defaultEnv,
+		loginEnvironment:  handler.options.LoginEnvironment,
+		env:               copyEnv(handler.defaultEnv),
+		requestedEnv:      map[string]struct{}{},
+		envPolicy:         handler.options.EnvPolicy,
+		options:           handler.options,
 	}
 }
 
@@ -118,11 +148,17 @@ func (sess *session) serviceRequests(requests <-chan *ssh.Request) {
 		case "window-change":
 			sess.handleWindowChangeRequest(req)
 		case "exec":
-			sess.handleExecRequest(req)
+			sess.handleExecRequest(req, sess.options.ExecArgv)
+		case "exec-argv@cloudfoundry.org":
+			sess.handleExecRequest(req, true)
 		case "shell":
 			sess.handleShellRequest(req)
 		case "subsystem":
 			sess.handleSubsystemRequest(req)
+		case "break":
+			sess.handleBreakRequest(req)
+		case "eow@openssh.com":
+			sess.handleEndOfWriteRequest(req)
 		default:
 			if req.WantReply {
 				req.Reply(false, nil)
@@ -148,9 +184,21 @@ func (sess *session) handleEnvironmentRequest(request *ssh.Request) {
 	}
 
 	sess.Lock()
-	sess.env[envMessage.Name] = envMessage.Value
+	err = sess.envPolicy.check(envMessage.Name, envMessage.Value, sess.requestedEnv)
+	if err == nil {
+		sess.env[envMessage.Name] = envMessage.Value
+		sess.requestedEnv[envMessage.Name] = struct{}{}
+	}
 	sess.Unlock()
 
+	if err != nil {
+		logger.Info("env-request-denied", lager.Data{"name": envMessage.Name, "reason": err.Error()})
+		if request.WantReply {
+			request.Reply(false, nil)
+		}
+		return
+	}
+
 	if request.WantReply {
 		request.Reply(true, nil)
 	}
@@ -243,10 +291,12 @@ func (sess *session) handleWindowChangeRequest(request *ssh.Request) {
 	if sess.allocPty {
 		sess.ptyRequest.Columns = windowChangeMessage.Columns
 		sess.ptyRequest.Rows = windowChangeMessage.Rows
+		sess.ptyRequest.Width = windowChangeMessage.WidthPx
+		sess.ptyRequest.Height = windowChangeMessage.HeightPx
 	}
 
 	if sess.ptyMaster != nil {
-		err = setWindowSize(logger, sess.ptyMaster, sess.ptyRequest.Columns, sess.ptyRequest.Rows)
+		err = setWindowSize(logger, sess.ptyMaster, sess.ptyRequest)
 		if err != nil {
 			logger.Error("failed-to-set-window-size", err)
 		}
@@ -257,7 +307,72 @@ func (sess *session) handleWindowChangeRequest(request *ssh.Request) {
 	}
 }
 
-func (sess *session) handleExecRequest(request *ssh.Request) {
+func (sess *session) handleBreakRequest(request *ssh.Request) {
+	logger := sess.logger.Session("handle-break-request")
+
+	type breakMsg struct {
+		Length uint32
+	}
+	var breakMessage breakMsg
+
+	err := ssh.Unmarshal(request.Payload, &breakMessage)
+	if err != nil {
+		logger.Error("unmarshal-failed", err)
+		if request.WantReply {
+			request.Reply(false, nil)
+		}
+		return
+	}
+
+	sess.Lock()
+	defer sess.Unlock()
+
+	if sess.command == nil {
+		if request.WantReply {
+			request.Reply(false, nil)
+		}
+		return
+	}
+
+	if sess.ptyMaster != nil {
+		err = termcodes.SendBreak(sess.ptyMaster, time.Duration(breakMessage.Length)*time.Millisecond)
+	} else {
+		err = sess.runner.Signal(sess.command, syscall.SIGINT)
+	}
+
+	if err != nil {
+		logger.Error("send-break-failed", err)
+	}
+
+	if request.WantReply {
+		request.Reply(err == nil, nil)
+	}
+}
+
+func (sess *session) handleEndOfWriteRequest(request *ssh.Request) {
+	logger := sess.logger.Session("handle-end-of-write-request")
+
+	sess.Lock()
+	defer sess.Unlock()
+
+	if sess.stdin == nil {
+		if request.WantReply {
+			request.Reply(false, nil)
+		}
+		return
+	}
+
+	err := sess.stdin.Close()
+	if err != nil {
+		logger.Error("close-stdin-failed", err)
+	}
+
+	if request.WantReply {
+		request.Reply(true, nil)
+	}
+}
+
+func (sess *session) handleExecRequest(request *ssh.Request, argv bool) {
 	logger := sess.logger.Session("handle-exec-request")
 
 	type execMsg struct {
@@ -274,15 +389,39 @@ func (sess *session) handleExecRequest(request *ssh.Request) {
 		return
 	}
 
+	if sess.options.ForcedCommand != "" {
+		logger.Info("running-forced-command", lager.Data{"original-command": execMessage.Command})
+		sess.Lock()
+		sess.env["SSH_ORIGINAL_COMMAND"] = execMessage.Command
+		sess.Unlock()
+		sess.executeArgv(request, sess.options.ForcedCommand)
+		return
+	}
+
 	if scpRegex.MatchString(execMessage.Command) {
 		logger.Info("handling-scp-command", lager.Data{"Command": execMessage.Command})
 		sess.executeSCP(execMessage.Command, request)
+	} else if sftpServerRegex.MatchString(execMessage.Command) {
+		logger.Info("handling-sftp-server-command", lager.Data{"Command": execMessage.Command})
+		sess.executeSFTPServer(logger, execMessage.Command, request)
+	} else if argv || builtinRegex.MatchString(execMessage.Command) || sess.shellPath == "" {
+		sess.executeArgv(request, execMessage.Command)
 	} else {
 		sess.executeShell(request, "-c", execMessage.Command)
 	}
 }
 
 func (sess *session) handleShellRequest(request *ssh.Request) {
+	if sess.options.ForcedCommand != "" {
+		sess.executeArgv(request, sess.options.ForcedCommand)
+		return
+	}
+
+	if sess.shellPath == "" {
+		sess.executeBuiltin(request, builtins.Shell)
+		return
+	}
+
 	sess.executeShell(request)
 }
 
@@ -313,8 +452,53 @@ func (sess *session) handleSubsystemRequest(request *ssh.Request) {
 		return
 	}
 
-	lagerWriter := helpers.NewLagerWriter(logger.Session("sftp-server"))
-	sftpServer, err := sftp.NewServer(sess.channel, sftp.WithDebug(lagerWriter))
+	if sess.options.ForcedCommand != "" {
+		logger.Info("subsystem-denied-by-forced-command", lager.Data{"subsystem": subsystemMessage.Subsystem})
+		if request.WantReply {
+			request.Reply(false, nil)
+		}
+		return
+	}
+
+	if !sess.options.subsystemEnabled(subsystemMessage.Subsystem) {
+		logger.Info("subsystem-disabled", lager.Data{"subsystem": subsystemMessage.Subsystem})
+		if request.WantReply {
+			request.Reply(false, nil)
+		}
+		return
+	}
+
+	sess.serveSFTP(logger, request, sess.options.SFTP)
+}
+
+// executeSFTPServer serves sftp to clients that exec an sftp server binary,
+// which does not exist in most containers. The flags of the command can only
+// restrict the configured options further.
+func (sess *session) executeSFTPServer(logger lager.Logger, command string, request *ssh.Request) {
+	if !sess.options.subsystemEnabled("sftp") {
+		logger.Info("subsystem-disabled", lager.Data{"subsystem": "sftp"})
+		if request.WantReply {
+			request.Reply(false, nil)
+		}
+		return
+	}
+
+	options, err := sftpServerOptions(command, sess.options.SFTP)
+	if err != nil {
+		logger.Error("invalid-sftp-server-command", err)
+		if request.WantReply {
+			request.Reply(false, nil)
+		}
+		return
+	}
+
+	sess.serveSFTP(logger, request, options)
+}
+
+func (sess *session) serveSFTP(logger lager.Logger, request *ssh.Request, options sftpserver.Options) {
+	options.Quota = sess.options.UploadLimits
+
+	sftpServer, err := sftpserver.New(logger, sess.channel, options)
 	if err != nil {
 		logger.Error("sftp-new-server-failed", err)
 		if request.WantReply {
@@ -330,18 +514,148 @@ func (sess *session) handleSubsystemRequest(request *ssh.Request) {
 	logger.Info("starting-server")
 	go func() {
 		defer sess.destroy()
-		err = sftpServer.Serve()
+		err := sftpServer.Serve()
 		if err != nil {
 			logger.Error("sftp-serve-error", err)
 		}
+
+		sess.sendSFTPSummary(logger, sftpServer.Summary())
 	}()
 }
 
+// sendSFTPSummary tells the proxy which files were transferred so that it
+// can be recorded in the app logs.
+func (sess *session) sendSFTPSummary(logger lager.Logger, summary sftpserver.Summary) {
+	if summary.Empty() {
+		return
+	}
+
+	_, err := sess.channel.SendRequest(sftpserver.SummaryRequest, false, summary.Payload())
+	if err != nil {
+		logger.Debug("failed-to-send-sftp-summary", lager.Data{"error": err.Error()})
+	}
+}
+
 func (sess *session) executeShell(request *ssh.Request, args ...string) {
-	logger := sess.logger.Session("execute-shell")
+	sess.execute(sess.logger.Session("execute-shell"), request, func() (*exec.Cmd, error) {
+		return sess.createCommand(args...)
+	})
+}
+
+// executeArgv runs a command without a shell. Built-in commands are served
+// by the daemon when asked for or when there is no shell. Anything else is
+// run directly from the PATH.
+func (sess *session) executeArgv(request *ssh.Request, command string) {
+	logger := sess.logger.Session("execute-argv")
+
+	args, err := shlex.Split(command)
+
+	builtin := false
+	if err == nil && len(args) > 0 && args[0] == builtinPrefix {
+		args = args[1:]
+		builtin = true
+	}
+
+	if err != nil || len(args) == 0 {
+		logger.Error("invalid-command", err, lager.Data{"command": command})
+		if request.WantReply {
+			request.Reply(false, nil)
+		}
+		return
+	}
 
+	if _, ok := builtins.Lookup(args[0]); builtin || (ok && sess.shellPath == "") {
+		logger.Info("handling-builtin-command", lager.Data{"command": args[0]})
+		sess.executeBuiltin(request, func(stdio builtins.Stdio) error {
+			return builtins.Run(stdio, args)
+		})
+		return
+	}
+
+	sess.execute(logger, request, func() (*exec.Cmd, error) {
+		return sess.createArgvCommand(args)
+	})
+}
+
+func (sess *session) executeBuiltin(request *ssh.Request, run func(builtins.Stdio) error) {
+	logger := sess.logger.Session("execute-builtin")
+
+	sess.Lock()
+	if sess.command != nil || sess.builtinStarted {
+		sess.Unlock()
+		logger.Error("failed-to-start-builtin", errors.New("command already started"))
+		if request.WantReply {
+			request.Reply(false, nil)
+		}
+		return
+	}
+
+	sess.builtinStarted = true
+
+	stdio := builtins.Stdio{
+		Stdin:  sess.channel,
+		Stdout: sess.channel,
+		Stderr: sess.channel.Stderr(),
+		Env:    sess.environment(),
+		Dir:    sess.workingDir(),
+	}
+
+	var ptySlave *os.File
+	if sess.allocPty {
+		var err error
+		ptySlave, err = sess.openBuiltinPty(logger)
+		if err != nil {
+			sess.Unlock()
+			if request.WantReply {
+				request.Reply(false, nil)
+			}
+			sess.destroy()
+			return
+		}
+
+		stdio.Stdin, stdio.Stdout, stdio.Stderr = ptySlave, ptySlave, ptySlave
+	}
+	sess.Unlock()
+
+	if request.WantReply {
+		request.Reply(true, nil)
+	}
+
+	go func() {
+		err := run(stdio)
+		if ptySlave != nil {
+			ptySlave.Close()
+		}
+		sess.sendExitMessage(err)
+		sess.destroy()
+	}()
+}
+
+func (sess *session) openBuiltinPty(logger lager.Logger) (*os.File, error) {
+	ptyMaster, ptySlave, err := pty.Open()
+	if err != nil {
+		logger.Error("failed-to-open-pty", err)
+		return nil, err
+	}
+
+	sess.ptyMaster = ptyMaster
+
+	setTerminalAttributes(logger, ptyMaster, sess.ptyRequest.Modelist)
+	setWindowSize(logger, ptyMaster, sess.ptyRequest)
+
+	sess.wg.Add(1)
+	go helpers.Copy(logger.Session("to-pty"), nil, ptyMaster, sess.channel)
+	go func() {
+		helpers.Copy(logger.Session("from-pty"), &sess.wg, sess.channel, ptyMaster)
+		sess.channel.CloseWrite()
+	}()
+
+	return ptySlave, nil
+}
+
+func (sess *session) execute(logger lager.Logger, request *ssh.Request, createCommand func() (*exec.Cmd, error)) {
 	sess.Lock()
-	cmd, err := sess.createCommand(args...)
+	cmd, err := createCommand()
 	if err != nil {
 		sess.Unlock()
 		logger.Error("failed-to-create-command", err)
@@ -377,10 +691,14 @@ func (sess *session) executeShell(request *ssh.Request, args ...string) {
 }
 
 func (sess *session) createCommand(args ...string) (*exec.Cmd, error) {
-	if sess.command != nil {
+	if sess.command != nil || sess.builtinStarted {
 		return nil, errors.New("command already started")
 	}
 
+	if sess.loginEnvironment != nil {
+		args = sess.loginEnvironment.shellArgs(sess.shellPath, args)
+	}
+
 	cmd := exec.Command(sess.shellPath, args...)
 	cmd.Env = sess.environment()
 	sess.command = cmd
@@ -388,12 +706,50 @@ func (sess *session) createCommand(args ...string) (*exec.Cmd, error) {
 	return cmd, nil
 }
 
+func (sess *session) createArgvCommand(args []string) (*exec.Cmd, error) {
+	if sess.command != nil || sess.builtinStarted {
+		return nil, errors.New("command already started")
+	}
+
+	env := sess.environment()
+
+	searchEnv := env
+	if sess.options.ExecPath != "" {
+		searchEnv = []string{"PATH=" + sess.options.ExecPath}
+	}
+
+	path, err := builtins.LookPath(args[0], searchEnv)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(path, args[1:]...)
+	cmd.Env = env
+	cmd.Dir = sess.workingDir()
+	sess.command = cmd
+
+	return cmd, nil
+}
+
+func (sess *session) workingDir() string {
+	if sess.loginEnvironment != nil {
+		return sess.loginEnvironment.AppDir
+	}
+	return ""
+}
+
 func (sess *session) environment() []string {
 	env := []string{}
 
 	env = append(env, "PATH=/bin:/usr/bin")
 	env = append(env, "LANG=en_US.UTF8")
 
+	if sess.loginEnvironment != nil {
+		for k, v := range sess.loginEnvironment.Env {
+			env = append(env, fmt.Sprintf("%s=%s", k, v))
+		}
+	}
+
 	for k, v := range sess.env {
 		if k != "HOME" && k != "USER" {
 			env = append(env, fmt.Sprintf("%s=%s", k, v))
@@ -434,6 +790,15 @@ func (sess *session) sendExitMessage(err error) {
 		return
 	}
 
+	if builtinError, ok := err.(*builtins.ExitError); ok {
+		exitMessage := exitStatusMsg{Status: uint32(builtinError.Status)}
+		_, sendErr := sess.channel.SendRequest("exit-status", false, ssh.Marshal(exitMessage))
+		if sendErr != nil {
+			logger.Error("send-exit-status-failed", sendErr)
+		}
+		return
+	}
+
 	exitError, ok := err.(*exec.ExitError)
 	if !ok {
 		exitMessage := exitStatusMsg{Status: 255}
@@ -473,14 +838,44 @@ func (sess *session) sendExitMessage(err error) {
 	}
 }
 
-func setWindowSize(logger lager.Logger, pseudoTty *os.File, columns, rows uint32) error {
-	logger.Info("new-size", lager.Data{"columns": columns, "rows": rows})
-	return term.SetWinsize(pseudoTty.Fd(), &term.Winsize{
-		Width:  uint16(columns),
-		Height: uint16(rows),
+func setWindowSize(logger lager.Logger, pseudoTty *os.File, size ptyRequestMsg) error {
+	logger.Info("new-size", lager.Data{
+		"columns": size.Columns,
+		"rows":    size.Rows,
+		"width":   size.Width,
+		"height":  size.Height,
+	})
+	return pty.Setsize(pseudoTty, &pty.Winsize{
+		Cols: uint16(size.Columns),
+		Rows: uint16(size.Rows),
+		X:    uint16(size.Width),
+		Y:    uint16(size.Height),
 	})
 }
 
+// sendFlowControl tells the client whether it may handle ^S and ^Q locally,
+// which is the case when the terminal does output flow control with the
+// default start and stop characters.
+func (sess *session) sendFlowControl(logger lager.Logger, pseudoTty *os.File) {
+	termios, err := termcodes.GetAttr(pseudoTty)
+	if err != nil {
+		logger.Error("failed-to-get-terminal-attrs", err)
+		return
+	}
+
+	type xonXoffMsg struct {
+		ClientCanDo bool
+	}
+	clientCanDo := termios.Iflag&syscall.IXON != 0 &&
+		termios.Cc[syscall.VSTART] == 0x11 &&
+		termios.Cc[syscall.VSTOP] == 0x13
+
+	_, err = sess.channel.SendRequest("xon-xoff", false, ssh.Marshal(xonXoffMsg{ClientCanDo: clientCanDo}))
+	if err != nil {
+		logger.Error("send-xon-xoff-failed", err)
+	}
+}
+
 func setTerminalAttributes(logger lager.Logger, pseudoTty *os.File, modelist string) {
 	reader := bytes.NewReader([]byte(modelist))
 
@@ -537,17 +932,26 @@ func setTerminalAttributes(logger lager.Logger, pseudoTty *os.File, modelist str
 func (sess *session) run(command *exec.Cmd) error {
 	logger := sess.logger.Session("run")
 
-	command.Stdout = sess.channel
-	command.Stderr = sess.channel.Stderr()
+	sess.stdout = newDetachableWriter(sess.channel)
+	sess.stderr = newDetachableWriter(sess.channel.Stderr())
+
+	command.Stdout = sess.stdout
+	command.Stderr = sess.stderr
 
 	stdin, err := command.StdinPipe()
 	if err != nil {
 		return err
 	}
 
+	sess.stdin = stdin
+
 	go helpers.CopyAndClose(logger.Session("to-stdin"), nil, stdin, sess.channel, func() { stdin.Close() })
 
-	return sess.runner.Start(command)
+	err = sess.runner.Start(command)
+	if err == nil {
+		sess.startKeepalive(command)
+	}
+	return err
 }
 
 func (sess *session) runWithPty(command *exec.Cmd) error {
@@ -572,42 +976,91 @@ func (sess *session) runWithPty(command *exec.Cmd) error {
 	}
 
 	setTerminalAttributes(logger, ptyMaster, sess.ptyRequest.Modelist)
-	setWindowSize(logger, ptyMaster, sess.ptyRequest.Columns, sess.ptyRequest.Rows)
+	setWindowSize(logger, ptyMaster, sess.ptyRequest)
+	sess.sendFlowControl(logger, ptyMaster)
+
+	sess.stdout = newDetachableWriter(sess.channel)
 
 	sess.wg.Add(1)
 	go helpers.Copy(logger.Session("to-pty"), nil, ptyMaster, sess.channel)
 	go func() {
-		helpers.Copy(logger.Session("from-pty"), &sess.wg, sess.channel, ptyMaster)
+		helpers.Copy(logger.Session("from-pty"), &sess.wg, sess.stdout, ptyMaster)
 		sess.channel.CloseWrite()
 	}()
 
 	err = sess.runner.Start(command)
 	if err == nil {
-		sess.keepaliveStopCh = make(chan struct{})
-		go sess.keepalive(command, sess.keepaliveStopCh)
+		sess.startKeepalive(command)
 	}
 	return err
 }
 
+func (sess *session) startKeepalive(command *exec.Cmd) {
+	if sess.keepaliveDuration <= 0 {
+		return
+	}
+
+	sess.keepaliveStopCh = make(chan struct{})
+	go sess.keepalive(command, sess.keepaliveStopCh)
+}
+
 func (sess *session) keepalive(command *exec.Cmd, stopCh chan struct{}) {
 	logger := sess.logger.Session("keepalive")
 
+	countMax := sess.options.KeepaliveCountMax
+	if countMax < 1 {
+		countMax = 1
+	}
+
+	replies := make(chan error, 1)
+	pending := false
+	missed := 0
+
 	ticker := time.NewTicker(sess.keepaliveDuration)
 	defer ticker.Stop()
 	for {
 		select {
 		case <-ticker.C:
-			_, err := sess.channel.SendRequest("keepalive@cloudfoundry.org", true, nil)
+			if pending {
+				missed++
+			} else {
+				pending = true
+				go func() {
+					_, err := sess.channel.SendRequest("keepalive@cloudfoundry.org", true, nil)
+					replies <- err
+				}()
+			}
+		case err := <-replies:
+			pending = false
 			logger.Info("keepalive", lager.Data{"success": err == nil})
 
-			if err != nil {
-				err = sess.runner.Signal(command, syscall.SIGHUP)
-				logger.Info("process-signaled", lager.Data{"error": err})
-				return
+			if err == nil {
+				missed = 0
+				continue
 			}
+			missed++
 		case <-stopCh:
 			return
 		}
+
+		if missed >= countMax {
+			logger.Info("client-unresponsive", lager.Data{"missed": missed, "action": sess.options.KeepaliveAction})
+			sess.clientGone(logger, command)
+			return
+		}
+	}
+}
+
+func (sess *session) clientGone(logger lager.Logger, command *exec.Cmd) {
+	switch sess.options.KeepaliveAction {
+	case KeepaliveActionContinue:
+	case KeepaliveActionDetach:
+		sess.stdout.detach()
+		sess.stderr.detach()
+		sess.channel.Close()
+	default:
+		err := sess.runner.Signal(command, syscall.SIGHUP)
+		logger.Info("process-signaled", lager.Data{"error": err})
 	}
 }
 
@@ -654,9 +1107,17 @@ func (sess *session) executeSCP(command string, request *ssh.Request) {
 		request.Reply(true, nil)
 	}
 
-	copier, err := scp.NewFromCommand(command, sess.channel, sess.channel, sess.channel.Stderr(), logger)
+	args, err := scp.ParseCommand(command)
 	if err == nil {
-		err = copier.Copy()
+		var options *scp.Options
+		options, err = scp.ParseFlags(args)
+		if err == nil {
+			options.Quota = quota.New(sess.options.UploadLimits)
+			options.Root = sess.options.SCPRoot
+			options.Symlinks = sess.options.SCPSymlinks
+			options.CapBandwidth(sess.options.SCPBandwidthLimit)
+			err = scp.New(options, sess.channel, sess.channel, sess.channel.Stderr(), logger).Copy()
+		}
 	}
 
 	sess.sendSCPExitMessage(err)
@@ -14,15 +14,18 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"syscall"
 	"time"
 
 	"code.cloudfoundry.org/diego-ssh/daemon"
 	"code.cloudfoundry.org/diego-ssh/handlers"
 	"code.cloudfoundry.org/diego-ssh/handlers/fakes"
+	"code.cloudfoundry.org/diego-ssh/sftpserver"
 	"code.cloudfoundry.org/diego-ssh/test_helpers"
 	"code.cloudfoundry.org/lager/lagertest"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 )
@@ -44,6 +47,33 @@ var _ = Describe("SessionChannelHandler", func() {
 		connectionFinished chan struct{}
 	)
 
+	startDaemon := func(options handlers.SessionOptions) {
+		sessionChannelHandler = handlers.NewSessionChannelHandler(runner, shellLocator, defaultEnv, time.Second, options)
+
+		newChannelHandlers = map[string]handlers.NewChannelHandler{
+			"session": sessionChannelHandler,
+		}
+
+		serverNetConn, clientNetConn := test_helpers.Pipe()
+
+		sshd = daemon.New(logger, serverSSHConfig, nil, newChannelHandlers)
+		connectionFinished = make(chan struct{})
+		go func() {
+			sshd.HandleConnection(serverNetConn)
+			close(connectionFinished)
+		}()
+
+		client = test_helpers.NewClient(clientNetConn, nil)
+	}
+
+	restartDaemon := func(options handlers.SessionOptions) {
+		err := client.Close()
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(connectionFinished).Should(BeClosed())
+
+		startDaemon(options)
+	}
+
 	BeforeEach(func() {
 		logger = lagertest.NewTestLogger("test")
 		serverSSHConfig = &ssh.ServerConfig{
@@ -63,22 +93,7 @@ var _ = Describe("SessionChannelHandler", func() {
 		defaultEnv = map[string]string{}
 		defaultEnv["TEST"] = "FOO"
 
-		sessionChannelHandler = handlers.NewSessionChannelHandler(runner, shellLocator, defaultEnv, time.Second)
-
-		newChannelHandlers = map[string]handlers.NewChannelHandler{
-			"session": sessionChannelHandler,
-		}
-
-		serverNetConn, clientNetConn := test_helpers.Pipe()
-
-		sshd = daemon.New(logger, serverSSHConfig, nil, newChannelHandlers)
-		connectionFinished = make(chan struct{})
-		go func() {
-			sshd.HandleConnection(serverNetConn)
-			close(connectionFinished)
-		}()
-
-		client = test_helpers.NewClient(clientNetConn, nil)
+		startDaemon(handlers.SessionOptions{})
 	})
 
 	AfterEach(func() {
@@ -452,6 +467,24 @@ var _ = Describe("SessionChannelHandler", func() {
 				})
 			})
 
+			It("does not leak variables into other sessions", func() {
+				err := session.Setenv("TEST", "BAR")
+				Expect(err).NotTo(HaveOccurred())
+
+				err = session.Setenv("ENV1", "value1")
+				Expect(err).NotTo(HaveOccurred())
+
+				otherSession, err := client.NewSession()
+				Expect(err).NotTo(HaveOccurred())
+
+				result, err := otherSession.Output("/usr/bin/env")
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(result).To(ContainSubstring("TEST=FOO"))
+				Expect(result).NotTo(ContainSubstring("ENV1=value1"))
+				Expect(defaultEnv).To(Equal(map[string]string{"TEST": "FOO"}))
+			})
+
 			Context("after starting the command", func() {
 				var stdin io.WriteCloser
 				var stdout io.Reader
@@ -736,6 +769,127 @@ var _ = Describe("SessionChannelHandler", func() {
 					Expect(result).To(ContainSubstring("50 132"))
 				})
 			})
+
+			Context("with pixel dimensions", func() {
+				BeforeEach(func() {
+					err := session.RequestPty("vt100", 43, 80, ssh.TerminalModes{})
+					Expect(err).NotTo(HaveOccurred())
+
+					_, err = session.SendRequest("window-change", false, ssh.Marshal(winChangeMsg{
+						Rows:     50,
+						Columns:  132,
+						WidthPx:  800,
+						HeightPx: 600,
+					}))
+					Expect(err).NotTo(HaveOccurred())
+
+					result, err = session.Output("stty size")
+					Expect(err).NotTo(HaveOccurred())
+				})
+
+				It("passes them to the terminal", func() {
+					Expect(result).To(ContainSubstring("50 132"))
+					Expect(logger).To(gbytes.Say(`new-size.*"columns":132,"height":600,"rows":50,.*"width":800`))
+				})
+			})
+		})
+
+		Context("when a break request is received", func() {
+			type breakMsg struct {
+				Length uint32
+			}
+
+			Context("before a command has been run", func() {
+				It("rejects the request", func() {
+					accepted, err := session.SendRequest("break", true, ssh.Marshal(breakMsg{Length: 500}))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(accepted).To(BeFalse())
+				})
+			})
+
+			Context("while a command without a pty is running", func() {
+				var stdout io.Reader
+
+				BeforeEach(func() {
+					var err error
+					stdout, err = session.StdoutPipe()
+					Expect(err).NotTo(HaveOccurred())
+
+					err = session.Start("trap 'echo Caught SIGINT; exit 3' INT; echo trapped; while true; do sleep 0.1; done")
+					Expect(err).NotTo(HaveOccurred())
+
+					reader := bufio.NewReader(stdout)
+					Eventually(reader.ReadLine).Should(ContainSubstring("trapped"))
+				})
+
+				It("interrupts the command", func() {
+					accepted, err := session.SendRequest("break", true, ssh.Marshal(breakMsg{Length: 500}))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(accepted).To(BeTrue())
+
+					Eventually(runner.SignalCallCount).Should(Equal(1))
+					_, signal := runner.SignalArgsForCall(0)
+					Expect(signal).To(Equal(syscall.SIGINT))
+
+					err = session.Wait()
+					Expect(err).To(HaveOccurred())
+
+					stdoutBytes, err := ioutil.ReadAll(stdout)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(stdoutBytes).To(ContainSubstring("Caught SIGINT"))
+				})
+			})
+
+			Context("while a command with a pty is running", func() {
+				BeforeEach(func() {
+					err := session.RequestPty("vt100", 43, 80, ssh.TerminalModes{})
+					Expect(err).NotTo(HaveOccurred())
+
+					err = session.Start("sleep 1")
+					Expect(err).NotTo(HaveOccurred())
+
+					Eventually(runner.StartCallCount).Should(Equal(1))
+				})
+
+				It("sends a break to the terminal instead of signaling", func() {
+					accepted, err := session.SendRequest("break", true, ssh.Marshal(breakMsg{Length: 100}))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(accepted).To(BeTrue())
+
+					Expect(runner.SignalCallCount()).To(Equal(0))
+				})
+			})
+		})
+
+		Context("when an end of write request is received", func() {
+			It("closes the standard input of the command", func() {
+				stdin, err := session.StdinPipe()
+				Expect(err).NotTo(HaveOccurred())
+
+				stdout, err := session.StdoutPipe()
+				Expect(err).NotTo(HaveOccurred())
+
+				err = session.Start("cat; echo -n done")
+				Expect(err).NotTo(HaveOccurred())
+
+				_, err = stdin.Write([]byte("hello "))
+				Expect(err).NotTo(HaveOccurred())
+
+				echoed := make([]byte, 6)
+				_, err = io.ReadFull(stdout, echoed)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(echoed)).To(Equal("hello "))
+
+				_, err = session.SendRequest("eow@openssh.com", false, nil)
+				Expect(err).NotTo(HaveOccurred())
+
+				err = session.Wait()
+				Expect(err).NotTo(HaveOccurred())
+
+				stdoutBytes, err := ioutil.ReadAll(stdout)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(stdoutBytes)).To(Equal("done"))
+			})
 		})
 
 		Context("after executing a command", func() {
@@ -897,61 +1051,821 @@ var _ = Describe("SessionChannelHandler", func() {
 		})
 	})
 
-	Context("when the sftp subystem is requested", func() {
-		It("accepts the request", func() {
-			type subsysMsg struct{ Subsystem string }
-			session, err := client.NewSession()
+	Context("when an env policy is configured", func() {
+		var session *ssh.Session
+
+		BeforeEach(func() {
+			envPolicy, err := handlers.NewEnvPolicy([]string{"LANG", "LC_*", "GIT_*"}, 8, 2)
 			Expect(err).NotTo(HaveOccurred())
-			defer session.Close()
 
-			accepted, err := session.SendRequest("subsystem", true, ssh.Marshal(subsysMsg{Subsystem: "sftp"}))
+			restartDaemon(handlers.SessionOptions{EnvPolicy: envPolicy})
+
+			session, err = client.NewSession()
 			Expect(err).NotTo(HaveOccurred())
-			Expect(accepted).To(BeTrue())
 		})
 
-		It("starts an sftp server in write mode", func() {
-			tempDir, err := ioutil.TempDir("", "sftp")
+		It("accepts variables matching the patterns", func() {
+			err := session.Setenv("LC_ALL", "C")
 			Expect(err).NotTo(HaveOccurred())
-			defer os.RemoveAll(tempDir)
 
-			sftp, err := sftp.NewClient(client)
+			result, err := session.Output("/usr/bin/env")
 			Expect(err).NotTo(HaveOccurred())
-			defer sftp.Close()
 
-			By("creating the file")
-			target := filepath.Join(tempDir, "textfile.txt")
-			file, err := sftp.Create(target)
+			Expect(result).To(ContainSubstring("LC_ALL=C"))
+		})
+
+		It("rejects and logs variables that do not match", func() {
+			err := session.Setenv("LD_PRELOAD", "/tmp/evil.so")
+			Expect(err).To(HaveOccurred())
+
+			err = session.Setenv("PATH", "/tmp")
+			Expect(err).To(HaveOccurred())
+
+			result, err := session.Output("/usr/bin/env")
 			Expect(err).NotTo(HaveOccurred())
 
-			fileContents := []byte("---\nthis is a simple file\n\n")
-			_, err = file.Write(fileContents)
+			Expect(result).NotTo(ContainSubstring("LD_PRELOAD"))
+			Expect(result).To(ContainSubstring("PATH=/bin:/usr/bin"))
+			Expect(logger).To(gbytes.Say("env-request-denied.*\"name\":\"LD_PRELOAD\".*\"reason\":\"name not accepted\""))
+		})
+
+		It("rejects values that are too long", func() {
+			err := session.Setenv("LANG", "en_US.UTF-8")
+			Expect(err).To(HaveOccurred())
+
+			Expect(logger).To(gbytes.Say("env-request-denied.*\"reason\":\"value too long\""))
+		})
+
+		It("limits the number of variables a client can set", func() {
+			Expect(session.Setenv("LANG", "C")).To(Succeed())
+			Expect(session.Setenv("LC_ALL", "C")).To(Succeed())
+			Expect(session.Setenv("LC_ALL", "POSIX")).To(Succeed())
+
+			err := session.Setenv("GIT_DIR", "/tmp")
+			Expect(err).To(HaveOccurred())
+
+			Expect(logger).To(gbytes.Say("env-request-denied.*\"reason\":\"too many variables\""))
+		})
+	})
+
+	Context("when no shell is available", func() {
+		var session *ssh.Session
+
+		BeforeEach(func() {
+			shellLocator.ShellPathReturns("")
+
+			var err error
+			session, err = client.NewSession()
 			Expect(err).NotTo(HaveOccurred())
+		})
 
-			err = file.Close()
+		It("serves built-in commands", func() {
+			result, err := session.Output("env")
 			Expect(err).NotTo(HaveOccurred())
+			Expect(string(result)).To(ContainSubstring("TEST=FOO"))
 
-			Expect(ioutil.ReadFile(target)).To(Equal(fileContents))
+			Expect(runner.StartCallCount()).To(Equal(0))
+		})
 
-			By("reading the file")
-			file, err = sftp.Open(target)
+		It("preserves the exit status of built-in commands", func() {
+			err := session.Run("cat /nonexistent")
+			Expect(err).To(HaveOccurred())
+
+			exitErr, ok := err.(*ssh.ExitError)
+			Expect(ok).To(BeTrue())
+			Expect(exitErr.ExitStatus()).To(Equal(1))
+		})
+
+		It("runs other commands directly from the PATH", func() {
+			result, err := session.Output("echo -n '$TEST' \"two words\"")
 			Expect(err).NotTo(HaveOccurred())
+			Expect(string(result)).To(Equal("$TEST two words"))
 
-			buffer := &bytes.Buffer{}
-			_, err = buffer.ReadFrom(file)
+			Expect(runner.StartCallCount()).To(Equal(1))
+			cmd := runner.StartArgsForCall(0)
+			Expect(cmd.Path).To(Equal("/bin/echo"))
+			Expect(cmd.Args).To(Equal([]string{"/bin/echo", "-n", "$TEST", "two words"}))
+		})
+
+		It("rejects commands that cannot be found", func() {
+			err := session.Run("bogus-command")
+			Expect(err).To(HaveOccurred())
+			Expect(runner.StartCallCount()).To(Equal(0))
+		})
+
+		Context("when a shell is requested", func() {
+			It("serves the built-in shell", func() {
+				session.Stdin = strings.NewReader("env\nexit 4\n")
+
+				stdout := gbytes.NewBuffer()
+				session.Stdout = stdout
+
+				err := session.Shell()
+				Expect(err).NotTo(HaveOccurred())
+
+				err = session.Wait()
+				Expect(err).To(HaveOccurred())
+				exitErr, ok := err.(*ssh.ExitError)
+				Expect(ok).To(BeTrue())
+				Expect(exitErr.ExitStatus()).To(Equal(4))
+
+				Expect(stdout).To(gbytes.Say(`(?s)\$ .*TEST=FOO`))
+			})
+
+			It("runs the built-in shell on a pty", func() {
+				err := session.RequestPty("vt100", 43, 80, ssh.TerminalModes{})
+				Expect(err).NotTo(HaveOccurred())
+
+				stdin, err := session.StdinPipe()
+				Expect(err).NotTo(HaveOccurred())
+
+				stdout := gbytes.NewBuffer()
+				session.Stdout = stdout
+
+				err = session.Shell()
+				Expect(err).NotTo(HaveOccurred())
+
+				_, err = stdin.Write([]byte("tty\n"))
+				Expect(err).NotTo(HaveOccurred())
+				Eventually(stdout).Should(gbytes.Say(`/dev/pts/\d+`))
+
+				_, err = stdin.Write([]byte("exit\n"))
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(session.Wait()).To(Succeed())
+			})
+		})
+	})
+
+	Context("when a command is prefixed with the built-in command name", func() {
+		It("runs the built-in command even though a shell is available", func() {
+			session, err := client.NewSession()
 			Expect(err).NotTo(HaveOccurred())
 
-			err = file.Close()
+			result, err := session.Output("cf-builtin env")
 			Expect(err).NotTo(HaveOccurred())
+			Expect(string(result)).To(ContainSubstring("TEST=FOO"))
 
-			Expect(buffer.Bytes()).To(Equal(fileContents))
+			Expect(runner.StartCallCount()).To(Equal(0))
+		})
 
-			By("removing the file")
-			err = sftp.Remove(target)
+		It("fails when the built-in command does not exist", func() {
+			session, err := client.NewSession()
 			Expect(err).NotTo(HaveOccurred())
 
-			_, err = os.Stat(target)
+			err = session.Run("cf-builtin echo hello")
 			Expect(err).To(HaveOccurred())
-			Expect(os.IsNotExist(err)).To(BeTrue())
+
+			exitErr, ok := err.(*ssh.ExitError)
+			Expect(ok).To(BeTrue())
+			Expect(exitErr.ExitStatus()).To(Equal(127))
+			Expect(runner.StartCallCount()).To(Equal(0))
+		})
+	})
+
+	Context("when exec requests run without a shell", func() {
+		BeforeEach(func() {
+			restartDaemon(handlers.SessionOptions{ExecArgv: true})
+		})
+
+		It("runs the command directly from the PATH", func() {
+			session, err := client.NewSession()
+			Expect(err).NotTo(HaveOccurred())
+
+			result, err := session.Output("echo -n '$TEST' \"two words\"")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(result)).To(Equal("$TEST two words"))
+
+			Expect(runner.StartCallCount()).To(Equal(1))
+			cmd := runner.StartArgsForCall(0)
+			Expect(cmd.Path).To(Equal("/bin/echo"))
+			Expect(cmd.Args).To(Equal([]string{"/bin/echo", "-n", "$TEST", "two words"}))
+		})
+
+		It("does not serve built-in commands", func() {
+			session, err := client.NewSession()
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = session.Output("env")
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(runner.StartCallCount()).To(Equal(1))
+			cmd := runner.StartArgsForCall(0)
+			Expect(cmd.Path).To(HaveSuffix("/env"))
+		})
+
+		Context("when a search path is configured", func() {
+			var binDir string
+
+			BeforeEach(func() {
+				var err error
+				binDir, err = ioutil.TempDir("", "exec-path")
+				Expect(err).NotTo(HaveOccurred())
+
+				err = ioutil.WriteFile(filepath.Join(binDir, "hello"), []byte("#!/bin/sh\necho -n hello\n"), 0755)
+				Expect(err).NotTo(HaveOccurred())
+
+				restartDaemon(handlers.SessionOptions{ExecArgv: true, ExecPath: binDir})
+			})
+
+			AfterEach(func() {
+				os.RemoveAll(binDir)
+			})
+
+			It("looks up commands on the search path", func() {
+				session, err := client.NewSession()
+				Expect(err).NotTo(HaveOccurred())
+
+				result, err := session.Output("hello")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(result)).To(Equal("hello"))
+
+				cmd := runner.StartArgsForCall(0)
+				Expect(cmd.Path).To(Equal(filepath.Join(binDir, "hello")))
+			})
+
+			It("does not look up commands on the PATH of the session", func() {
+				session, err := client.NewSession()
+				Expect(err).NotTo(HaveOccurred())
+
+				err = session.Run("echo hello")
+				Expect(err).To(HaveOccurred())
+				Expect(runner.StartCallCount()).To(Equal(0))
+			})
+		})
+	})
+
+	Context("when an exec-argv@cloudfoundry.org request is received", func() {
+		It("runs the command without a shell", func() {
+			session, err := client.NewSession()
+			Expect(err).NotTo(HaveOccurred())
+
+			stdout, err := session.StdoutPipe()
+			Expect(err).NotTo(HaveOccurred())
+
+			accepted, err := session.SendRequest("exec-argv@cloudfoundry.org", true, ssh.Marshal(struct{ Command string }{"echo -n '$TEST' ';' true"}))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(accepted).To(BeTrue())
+
+			result, err := ioutil.ReadAll(stdout)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(result)).To(Equal("$TEST ; true"))
+
+			Expect(runner.StartCallCount()).To(Equal(1))
+			cmd := runner.StartArgsForCall(0)
+			Expect(cmd.Path).To(Equal("/bin/echo"))
+		})
+	})
+
+	Context("when a forced command is configured", func() {
+		BeforeEach(func() {
+			restartDaemon(handlers.SessionOptions{ForcedCommand: "env"})
+		})
+
+		It("runs the forced command instead of the requested command", func() {
+			session, err := client.NewSession()
+			Expect(err).NotTo(HaveOccurred())
+
+			result, err := session.Output("echo hello; exit 3")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(result)).To(ContainSubstring("SSH_ORIGINAL_COMMAND=echo hello; exit 3\n"))
+
+			cmd := runner.StartArgsForCall(0)
+			Expect(cmd.Path).To(HaveSuffix("/env"))
+			Expect(cmd.Args).To(HaveLen(1))
+		})
+
+		It("runs the forced command when a shell is requested", func() {
+			session, err := client.NewSession()
+			Expect(err).NotTo(HaveOccurred())
+
+			stdout := gbytes.NewBuffer()
+			session.Stdout = stdout
+
+			err = session.Shell()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(session.Wait()).To(Succeed())
+
+			Expect(stdout).To(gbytes.Say("TEST=FOO"))
+			Expect(stdout.Contents()).NotTo(ContainSubstring("SSH_ORIGINAL_COMMAND"))
+		})
+
+		It("rejects subsystem requests", func() {
+			session, err := client.NewSession()
+			Expect(err).NotTo(HaveOccurred())
+
+			err = session.RequestSubsystem("sftp")
+			Expect(err).To(HaveOccurred())
+			Expect(logger).To(gbytes.Say("subsystem-denied-by-forced-command"))
+		})
+	})
+
+	Context("when a pty session starts", func() {
+		It("tells the client whether it can do flow control", func() {
+			channel, requests, err := client.OpenChannel("session", nil)
+			Expect(err).NotTo(HaveOccurred())
+			defer channel.Close()
+
+			xonXoff := make(chan *ssh.Request, 1)
+			go func() {
+				for req := range requests {
+					if req.Type == "xon-xoff" {
+						xonXoff <- req
+					} else if req.WantReply {
+						req.Reply(false, nil)
+					}
+				}
+			}()
+
+			type ptyRequestMsg struct {
+				Term     string
+				Columns  uint32
+				Rows     uint32
+				Width    uint32
+				Height   uint32
+				Modelist string
+			}
+			accepted, err := channel.SendRequest("pty-req", true, ssh.Marshal(ptyRequestMsg{Term: "vt100", Columns: 80, Rows: 43}))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(accepted).To(BeTrue())
+
+			type execMsg struct{ Command string }
+			accepted, err = channel.SendRequest("exec", true, ssh.Marshal(execMsg{Command: "true"}))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(accepted).To(BeTrue())
+
+			var req *ssh.Request
+			Eventually(xonXoff).Should(Receive(&req))
+
+			var xonXoffMessage struct{ ClientCanDo bool }
+			Expect(ssh.Unmarshal(req.Payload, &xonXoffMessage)).To(Succeed())
+			Expect(xonXoffMessage.ClientCanDo).To(BeTrue())
+		})
+	})
+
+	Context("when keepalives are sent", func() {
+		var (
+			options          handlers.SessionOptions
+			answerKeepalives bool
+			channel          ssh.Channel
+		)
+
+		BeforeEach(func() {
+			options = handlers.SessionOptions{KeepaliveCountMax: 2}
+			answerKeepalives = false
+		})
+
+		JustBeforeEach(func() {
+			restartDaemon(options)
+
+			var requests <-chan *ssh.Request
+			var err error
+			channel, requests, err = client.OpenChannel("session", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			answer := answerKeepalives
+			go func() {
+				for req := range requests {
+					if req.Type != "keepalive@cloudfoundry.org" || answer {
+						req.Reply(false, nil)
+					}
+				}
+			}()
+
+			type execMsg struct{ Command string }
+			accepted, err := channel.SendRequest("exec", true, ssh.Marshal(execMsg{Command: "sleep 5"}))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(accepted).To(BeTrue())
+		})
+
+		Context("when the client answers them", func() {
+			BeforeEach(func() {
+				answerKeepalives = true
+			})
+
+			It("leaves the command running", func() {
+				Consistently(runner.SignalCallCount, 3*time.Second).Should(Equal(0))
+				Expect(logger).To(gbytes.Say("keepalive.*\"success\":true"))
+			})
+		})
+
+		Context("when the client stops answering them", func() {
+			It("hangs up the command once the maximum count is missed", func() {
+				Consistently(runner.SignalCallCount, 1500*time.Millisecond).Should(Equal(0))
+				Eventually(runner.SignalCallCount, 3*time.Second).Should(Equal(1))
+
+				_, signal := runner.SignalArgsForCall(0)
+				Expect(signal).To(Equal(syscall.SIGHUP))
+				Expect(logger).To(gbytes.Say("client-unresponsive.*\"missed\":2"))
+			})
+
+			Context("when the action is continue", func() {
+				BeforeEach(func() {
+					options.KeepaliveAction = handlers.KeepaliveActionContinue
+				})
+
+				It("lets the command run on", func() {
+					Eventually(logger, 5*time.Second).Should(gbytes.Say("client-unresponsive"))
+					Consistently(runner.SignalCallCount).Should(Equal(0))
+				})
+			})
+
+			Context("when the action is detach", func() {
+				BeforeEach(func() {
+					options.KeepaliveAction = handlers.KeepaliveActionDetach
+				})
+
+				It("closes the channel without signaling the command", func() {
+					Eventually(logger, 5*time.Second).Should(gbytes.Say("client-unresponsive"))
+
+					_, err := ioutil.ReadAll(channel)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(runner.SignalCallCount()).To(Equal(0))
+				})
+			})
+		})
+	})
+
+	Context("when a login environment is configured", func() {
+		var appDir string
+
+		BeforeEach(func() {
+			var err error
+			appDir, err = ioutil.TempDir("", "app")
+			Expect(err).NotTo(HaveOccurred())
+
+			appDir, err = filepath.EvalSymlinks(appDir)
+			Expect(err).NotTo(HaveOccurred())
+
+			err = os.Mkdir(filepath.Join(appDir, ".profile.d"), 0755)
+			Expect(err).NotTo(HaveOccurred())
+
+			err = ioutil.WriteFile(filepath.Join(appDir, ".profile.d", "a.sh"), []byte("export FROM_PROFILE_D=profile-d\n"), 0644)
+			Expect(err).NotTo(HaveOccurred())
+
+			err = ioutil.WriteFile(filepath.Join(appDir, ".profile"), []byte("FROM_PROFILE=profile\n"), 0644)
+			Expect(err).NotTo(HaveOccurred())
+
+			restartDaemon(handlers.SessionOptions{
+				LoginEnvironment: &handlers.LoginEnvironment{
+					AppDir: appDir,
+					Env: map[string]string{
+						"PATH":             "/usr/bin:/bin:/app/bin",
+						"VCAP_APPLICATION": "{}",
+					},
+				},
+			})
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(appDir)
+		})
+
+		It("runs exec requests in the app directory after sourcing the profile scripts", func() {
+			session, err := client.NewSession()
+			Expect(err).NotTo(HaveOccurred())
+
+			result, err := session.Output("pwd; echo $FROM_PROFILE_D $FROM_PROFILE; /usr/bin/env")
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(string(result)).To(HavePrefix(appDir + "\nprofile-d profile\n"))
+			Expect(result).To(ContainSubstring("PATH=/usr/bin:/bin:/app/bin"))
+			Expect(result).To(ContainSubstring("VCAP_APPLICATION={}"))
+			Expect(result).To(ContainSubstring("TEST=FOO"))
+		})
+
+		It("preserves the exit status of the command", func() {
+			session, err := client.NewSession()
+			Expect(err).NotTo(HaveOccurred())
+
+			err = session.Run("exit 3")
+			Expect(err).To(HaveOccurred())
+
+			exitErr, ok := err.(*ssh.ExitError)
+			Expect(ok).To(BeTrue())
+			Expect(exitErr.ExitStatus()).To(Equal(3))
+		})
+
+		It("starts interactive shells in the app directory", func() {
+			session, err := client.NewSession()
+			Expect(err).NotTo(HaveOccurred())
+
+			session.Stdin = strings.NewReader("pwd\necho $FROM_PROFILE_D\nexit\n")
+			stdout := &bytes.Buffer{}
+			session.Stdout = stdout
+
+			err = session.Shell()
+			Expect(err).NotTo(HaveOccurred())
+
+			err = session.Wait()
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(stdout.String()).To(Equal(appDir + "\nprofile-d\n"))
+		})
+
+		Context("when the app directory does not exist", func() {
+			BeforeEach(func() {
+				os.RemoveAll(appDir)
+			})
+
+			It("fails the command", func() {
+				session, err := client.NewSession()
+				Expect(err).NotTo(HaveOccurred())
+
+				err = session.Run("true")
+				Expect(err).To(HaveOccurred())
+			})
+		})
+	})
+
+	Context("when the sftp subystem is requested", func() {
+		Context("when the subsystem is not enabled", func() {
+			BeforeEach(func() {
+				restartDaemon(handlers.SessionOptions{Subsystems: []string{}})
+			})
+
+			It("rejects the request", func() {
+				type subsysMsg struct{ Subsystem string }
+				session, err := client.NewSession()
+				Expect(err).NotTo(HaveOccurred())
+				defer session.Close()
+
+				accepted, err := session.SendRequest("subsystem", true, ssh.Marshal(subsysMsg{Subsystem: "sftp"}))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(accepted).To(BeFalse())
+
+				Expect(logger).To(gbytes.Say("subsystem-disabled.*\"subsystem\":\"sftp\""))
+			})
+		})
+
+		Context("when the sftp server is restricted", func() {
+			var tempDir string
+
+			BeforeEach(func() {
+				var err error
+				tempDir, err = ioutil.TempDir("", "sftp")
+				Expect(err).NotTo(HaveOccurred())
+
+				err = ioutil.WriteFile(filepath.Join(tempDir, "app.log"), []byte("log data"), 0644)
+				Expect(err).NotTo(HaveOccurred())
+
+				fs, err := sftpserver.NewOSFileSystem(logger, tempDir)
+				Expect(err).NotTo(HaveOccurred())
+
+				restartDaemon(handlers.SessionOptions{
+					SFTP: sftpserver.Options{FileSystem: fs, ReadOnly: true},
+				})
+			})
+
+			AfterEach(func() {
+				os.RemoveAll(tempDir)
+			})
+
+			It("serves the root directory read-only", func() {
+				sftp, err := sftp.NewClient(client)
+				Expect(err).NotTo(HaveOccurred())
+				defer sftp.Close()
+
+				file, err := sftp.Open("/app.log")
+				Expect(err).NotTo(HaveOccurred())
+
+				contents, err := ioutil.ReadAll(file)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(contents)).To(Equal("log data"))
+				Expect(file.Close()).To(Succeed())
+
+				err = sftp.Remove("/app.log")
+				Expect(err).To(HaveOccurred())
+
+				_, err = os.Stat(filepath.Join(tempDir, "app.log"))
+				Expect(err).NotTo(HaveOccurred())
+			})
+		})
+
+		It("reports the files that were transferred before closing the channel", func() {
+			tempDir, err := ioutil.TempDir("", "sftp")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(tempDir)
+
+			channel, requests, err := client.OpenChannel("session", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			type subsysMsg struct{ Subsystem string }
+			accepted, err := channel.SendRequest("subsystem", true, ssh.Marshal(subsysMsg{Subsystem: "sftp"}))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(accepted).To(BeTrue())
+
+			sftpClient, err := sftp.NewClientPipe(channel, channel)
+			Expect(err).NotTo(HaveOccurred())
+
+			target := filepath.Join(tempDir, "upload")
+			file, err := sftpClient.Create(target)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = file.Write([]byte("hello"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(file.Close()).To(Succeed())
+
+			Expect(channel.CloseWrite()).To(Succeed())
+
+			var summaryRequest *ssh.Request
+			for req := range requests {
+				if req.Type == sftpserver.SummaryRequest {
+					summaryRequest = req
+				}
+			}
+			Expect(summaryRequest).NotTo(BeNil())
+
+			summary, err := sftpserver.ParseSummary(summaryRequest.Payload)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(summary.Uploaded).To(Equal([]sftpserver.Transfer{{Path: target, Bytes: 5}}))
+		})
+
+		It("accepts the request", func() {
+			type subsysMsg struct{ Subsystem string }
+			session, err := client.NewSession()
+			Expect(err).NotTo(HaveOccurred())
+			defer session.Close()
+
+			accepted, err := session.SendRequest("subsystem", true, ssh.Marshal(subsysMsg{Subsystem: "sftp"}))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(accepted).To(BeTrue())
+		})
+
+		It("starts an sftp server in write mode", func() {
+			tempDir, err := ioutil.TempDir("", "sftp")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(tempDir)
+
+			sftp, err := sftp.NewClient(client)
+			Expect(err).NotTo(HaveOccurred())
+			defer sftp.Close()
+
+			By("creating the file")
+			target := filepath.Join(tempDir, "textfile.txt")
+			file, err := sftp.Create(target)
+			Expect(err).NotTo(HaveOccurred())
+
+			fileContents := []byte("---\nthis is a simple file\n\n")
+			_, err = file.Write(fileContents)
+			Expect(err).NotTo(HaveOccurred())
+
+			err = file.Close()
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(ioutil.ReadFile(target)).To(Equal(fileContents))
+
+			By("reading the file")
+			file, err = sftp.Open(target)
+			Expect(err).NotTo(HaveOccurred())
+
+			buffer := &bytes.Buffer{}
+			_, err = buffer.ReadFrom(file)
+			Expect(err).NotTo(HaveOccurred())
+
+			err = file.Close()
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(buffer.Bytes()).To(Equal(fileContents))
+
+			By("removing the file")
+			err = sftp.Remove(target)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = os.Stat(target)
+			Expect(err).To(HaveOccurred())
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+	})
+
+	Context("when an sftp server is executed", func() {
+		var tempDir string
+
+		BeforeEach(func() {
+			var err error
+			tempDir, err = ioutil.TempDir("", "sftp")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = ioutil.WriteFile(filepath.Join(tempDir, "app.log"), []byte("log data"), 0644)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(tempDir)
+		})
+
+		startSFTPServer := func(command string) (*sftp.Client, *ssh.Session) {
+			session, err := client.NewSession()
+			Expect(err).NotTo(HaveOccurred())
+
+			stdin, err := session.StdinPipe()
+			Expect(err).NotTo(HaveOccurred())
+
+			stdout, err := session.StdoutPipe()
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(session.Start(command)).To(Succeed())
+
+			sftpClient, err := sftp.NewClientPipe(stdout, stdin)
+			Expect(err).NotTo(HaveOccurred())
+
+			return sftpClient, session
+		}
+
+		for _, command := range []string{"/usr/lib/openssh/sftp-server", "sftp-server -e -l INFO", "internal-sftp"} {
+			command := command
+
+			It("serves sftp on the channel for "+command, func() {
+				sftpClient, session := startSFTPServer(command)
+				defer session.Close()
+				defer sftpClient.Close()
+
+				file, err := sftpClient.Open(filepath.Join(tempDir, "app.log"))
+				Expect(err).NotTo(HaveOccurred())
+
+				contents, err := ioutil.ReadAll(file)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(contents)).To(Equal("log data"))
+				Expect(file.Close()).To(Succeed())
+
+				Expect(logger).To(gbytes.Say("handling-sftp-server-command"))
+			})
+		}
+
+		It("makes the session read-only for -R", func() {
+			sftpClient, session := startSFTPServer("/usr/lib/openssh/sftp-server -R")
+			defer session.Close()
+			defer sftpClient.Close()
+
+			_, err := sftpClient.Stat(filepath.Join(tempDir, "app.log"))
+			Expect(err).NotTo(HaveOccurred())
+
+			err = sftpClient.Remove(filepath.Join(tempDir, "app.log"))
+			Expect(err).To(HaveOccurred())
+			Expect(filepath.Join(tempDir, "app.log")).To(BeAnExistingFile())
+		})
+
+		It("starts in the directory given with -d", func() {
+			sftpClient, session := startSFTPServer("internal-sftp -d " + tempDir)
+			defer session.Close()
+			defer sftpClient.Close()
+
+			_, err := sftpClient.Stat("app.log")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("rejects unsupported options", func() {
+			type execMsg struct{ Command string }
+			session, err := client.NewSession()
+			Expect(err).NotTo(HaveOccurred())
+			defer session.Close()
+
+			accepted, err := session.SendRequest("exec", true, ssh.Marshal(execMsg{Command: "/usr/lib/openssh/sftp-server -P remove"}))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(accepted).To(BeFalse())
+
+			Expect(logger).To(gbytes.Say("invalid-sftp-server-command"))
+		})
+
+		Context("when the sftp server is restricted", func() {
+			BeforeEach(func() {
+				fs, err := sftpserver.NewOSFileSystem(logger, tempDir)
+				Expect(err).NotTo(HaveOccurred())
+
+				restartDaemon(handlers.SessionOptions{
+					SFTP: sftpserver.Options{FileSystem: fs, ReadOnly: true},
+				})
+			})
+
+			It("applies the same options as the subsystem", func() {
+				sftpClient, session := startSFTPServer("/usr/libexec/sftp-server")
+				defer session.Close()
+				defer sftpClient.Close()
+
+				_, err := sftpClient.Stat("/app.log")
+				Expect(err).NotTo(HaveOccurred())
+
+				err = sftpClient.Remove("/app.log")
+				Expect(err).To(HaveOccurred())
+			})
+		})
+
+		Context("when the sftp subsystem is not enabled", func() {
+			BeforeEach(func() {
+				restartDaemon(handlers.SessionOptions{Subsystems: []string{}})
+			})
+
+			It("rejects the request", func() {
+				type execMsg struct{ Command string }
+				session, err := client.NewSession()
+				Expect(err).NotTo(HaveOccurred())
+				defer session.Close()
+
+				accepted, err := session.SendRequest("exec", true, ssh.Marshal(execMsg{Command: "/usr/lib/openssh/sftp-server"}))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(accepted).To(BeFalse())
+
+				Expect(logger).To(gbytes.Say("subsystem-disabled.*\"subsystem\":\"sftp\""))
+			})
 		})
 	})
 
@@ -17,6 +17,7 @@ func NewSessionChannelHandler(
 	shellLocator ShellLocator,
 	defaultEnv map[string]string,
 	keepalive time.Duration,
+	options SessionOptions,
 ) *SessionChannelHandler {
 	return &SessionChannelHandler{}
 }
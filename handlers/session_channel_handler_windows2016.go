@@ -5,6 +5,7 @@ package handlers
 import (
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"regexp"
@@ -13,21 +14,27 @@ import (
 	"time"
 
 	"code.cloudfoundry.org/diego-ssh/helpers"
+	"code.cloudfoundry.org/diego-ssh/quota"
 	"code.cloudfoundry.org/diego-ssh/scp"
+	"code.cloudfoundry.org/diego-ssh/sftpserver"
 	"code.cloudfoundry.org/diego-ssh/signals"
 	"code.cloudfoundry.org/diego-ssh/winpty"
 	"code.cloudfoundry.org/lager"
-	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 )
 
 var scpRegex = regexp.MustCompile(`^\s*scp($|\s+)`)
 
+// sftpServerRegex matches the command lines that clients run to start an
+// sftp server when they do not request the subsystem.
+var sftpServerRegex = regexp.MustCompile(`^\s*(\S*/)?(sftp-server|internal-sftp)($|\s+)`)
+
 type SessionChannelHandler struct {
 	runner       Runner
 	shellLocator ShellLocator
 	defaultEnv   map[string]string
 	keepalive    time.Duration
+	options      SessionOptions
 	winPTYDLLDir string
 }
 
@@ -36,6 +43,7 @@ func NewSessionChannelHandler(
 	shellLocator ShellLocator,
 	defaultEnv map[string]string,
 	keepalive time.Duration,
+	options SessionOptions,
 ) *SessionChannelHandler {
 	winPTYDLLDir := os.Getenv("WINPTY_DLL_DIR")
 	return &SessionChannelHandler{
@@ -43,6 +51,7 @@ func NewSessionChannelHandler(
 		shellLocator: shellLocator,
 		defaultEnv:   defaultEnv,
 		keepalive:    keepalive,
+		options:      options,
 		winPTYDLLDir: winPTYDLLDir,
 	}
 }
@@ -77,8 +86,11 @@ type session struct {
 	channel   ssh.Channel
 
 	sync.Mutex
-	env     map[string]string
-	command *exec.Cmd
+	env          map[string]string
+	requestedEnv map[string]struct{}
+	envPolicy    *EnvPolicy
+	options      SessionOptions
+	command      *exec.Cmd
 
 	wg         sync.WaitGroup
 	allocPty   bool
@@ -86,6 +98,10 @@ type session struct {
 
 	winpty       *winpty.WinPTY
 	winPTYDLLDir string
+
+	stdin  io.WriteCloser
+	stdout *detachableWriter
+	stderr *detachableWriter
 }
 
 func (handler *SessionChannelHandler) newSession(logger lager.Logger, channel ssh.Channel, keepalive time.Duration) *session {
@@ -95,7 +111,10 @@ func (handler *SessionChannelHandler) newSession(logger lager.Logger, channel ss
 		runner:            handler.runner,
 		shellPath:         handler.shellLocator.ShellPath(),
 		channel:           channel,
-		env:               handler.defaultEnv,
+		env:               copyEnv(handler.defaultEnv),
+		requestedEnv:      map[string]struct{}{},
+		envPolicy:         handler.options.EnvPolicy,
+		options:           handler.options,
 		winPTYDLLDir:      handler.winPTYDLLDir,
 	}
 }
@@ -124,6 +143,10 @@ func (sess *session) serviceRequests(requests <-chan *ssh.Request) {
 			sess.handleShellRequest(req)
 		case "subsystem":
 			sess.handleSubsystemRequest(req)
+		case "break":
+			sess.handleBreakRequest(req)
+		case "eow@openssh.com":
+			sess.handleEndOfWriteRequest(req)
 		default:
 			if req.WantReply {
 				req.Reply(false, nil)
@@ -149,9 +172,21 @@ func (sess *session) handleEnvironmentRequest(request *ssh.Request) {
 	}
 
 	sess.Lock()
-	sess.env[envMessage.Name] = envMessage.Value
+	err = sess.envPolicy.check(envMessage.Name, envMessage.Value, sess.requestedEnv)
+	if err == nil {
+		sess.env[envMessage.Name] = envMessage.Value
+		sess.requestedEnv[envMessage.Name] = struct{}{}
+	}
 	sess.Unlock()
 
+	if err != nil {
+		logger.Info("env-request-denied", lager.Data{"name": envMessage.Name, "reason": err.Error()})
+		if request.WantReply {
+			request.Reply(false, nil)
+		}
+		return
+	}
+
 	if request.WantReply {
 		request.Reply(true, nil)
 	}
@@ -272,6 +307,58 @@ func (sess *session) handleWindowChangeRequest(request *ssh.Request) {
 	}
 }
 
+func (sess *session) handleBreakRequest(request *ssh.Request) {
+	logger := sess.logger.Session("handle-break-request")
+
+	sess.Lock()
+	defer sess.Unlock()
+
+	if sess.command == nil {
+		if request.WantReply {
+			request.Reply(false, nil)
+		}
+		return
+	}
+
+	var err error
+	if sess.winpty != nil {
+		err = sess.winpty.Signal(syscall.SIGINT)
+	} else {
+		err = sess.runner.Signal(sess.command, syscall.SIGINT)
+	}
+
+	if err != nil {
+		logger.Error("send-break-failed", err)
+	}
+
+	if request.WantReply {
+		request.Reply(err == nil, nil)
+	}
+}
+
+func (sess *session) handleEndOfWriteRequest(request *ssh.Request) {
+	logger := sess.logger.Session("handle-end-of-write-request")
+
+	sess.Lock()
+	defer sess.Unlock()
+
+	if sess.stdin == nil {
+		if request.WantReply {
+			request.Reply(false, nil)
+		}
+		return
+	}
+
+	err := sess.stdin.Close()
+	if err != nil {
+		logger.Error("close-stdin-failed", err)
+	}
+
+	if request.WantReply {
+		request.Reply(true, nil)
+	}
+}
+
 func (sess *session) handleExecRequest(request *ssh.Request) {
 	logger := sess.logger.Session("handle-exec-request")
 
@@ -289,15 +376,32 @@ func (sess *session) handleExecRequest(request *ssh.Request) {
 		return
 	}
 
+	if sess.options.ForcedCommand != "" {
+		logger.Info("running-forced-command", lager.Data{"original-command": execMessage.Command})
+		sess.Lock()
+		sess.env["SSH_ORIGINAL_COMMAND"] = execMessage.Command
+		sess.Unlock()
+		sess.executeShell(request, "/c", sess.options.ForcedCommand)
+		return
+	}
+
 	if scpRegex.MatchString(execMessage.Command) {
 		logger.Info("handling-scp-command", lager.Data{"Command": execMessage.Command})
 		sess.executeSCP(execMessage.Command, request)
+	} else if sftpServerRegex.MatchString(execMessage.Command) {
+		logger.Info("handling-sftp-server-command", lager.Data{"Command": execMessage.Command})
+		sess.executeSFTPServer(logger, execMessage.Command, request)
 	} else {
 		sess.executeShell(request, "/c", execMessage.Command)
 	}
 }
 
 func (sess *session) handleShellRequest(request *ssh.Request) {
+	if sess.options.ForcedCommand != "" {
+		sess.executeShell(request, "/c", sess.options.ForcedCommand)
+		return
+	}
+
 	sess.executeShell(request)
 }
 
@@ -320,6 +424,14 @@ func (sess *session) handleSubsystemRequest(request *ssh.Request) {
 		return
 	}
 
+	if sess.options.ForcedCommand != "" {
+		logger.Info("subsystem-denied-by-forced-command", lager.Data{"subsystem": subsystemMessage.Subsystem})
+		if request.WantReply {
+			request.Reply(false, nil)
+		}
+		return
+	}
+
 	if subsystemMessage.Subsystem != "sftp" {
 		logger.Info("unsupported-subsystem", lager.Data{"subsystem": subsystemMessage.Subsystem})
 		if request.WantReply {
@@ -328,8 +440,45 @@ func (sess *session) handleSubsystemRequest(request *ssh.Request) {
 		return
 	}
 
-	lagerWriter := helpers.NewLagerWriter(logger.Session("sftp-server"))
-	sftpServer, err := sftp.NewServer(sess.channel, sftp.WithDebug(lagerWriter))
+	if !sess.options.subsystemEnabled(subsystemMessage.Subsystem) {
+		logger.Info("subsystem-disabled", lager.Data{"subsystem": subsystemMessage.Subsystem})
+		if request.WantReply {
+			request.Reply(false, nil)
+		}
+		return
+	}
+
+	sess.serveSFTP(logger, request, sess.options.SFTP)
+}
+
+// executeSFTPServer serves sftp to clients that exec an sftp server binary,
+// which does not exist in most containers. The flags of the command can only
+// restrict the configured options further.
+func (sess *session) executeSFTPServer(logger lager.Logger, command string, request *ssh.Request) {
+	if !sess.options.subsystemEnabled("sftp") {
+		logger.Info("subsystem-disabled", lager.Data{"subsystem": "sftp"})
+		if request.WantReply {
+			request.Reply(false, nil)
+		}
+		return
+	}
+
+	options, err := sftpServerOptions(command, sess.options.SFTP)
+	if err != nil {
+		logger.Error("invalid-sftp-server-command", err)
+		if request.WantReply {
+			request.Reply(false, nil)
+		}
+		return
+	}
+
+	sess.serveSFTP(logger, request, options)
+}
+
+func (sess *session) serveSFTP(logger lager.Logger, request *ssh.Request, options sftpserver.Options) {
+	options.Quota = sess.options.UploadLimits
+
+	sftpServer, err := sftpserver.New(logger, sess.channel, options)
 	if err != nil {
 		logger.Error("sftp-new-server-failed", err)
 		if request.WantReply {
@@ -345,13 +494,28 @@ func (sess *session) handleSubsystemRequest(request *ssh.Request) {
 	logger.Info("starting-server")
 	go func() {
 		defer sess.destroy()
-		err = sftpServer.Serve()
+		err := sftpServer.Serve()
 		if err != nil {
 			logger.Error("sftp-serve-error", err)
 		}
+
+		sess.sendSFTPSummary(logger, sftpServer.Summary())
 	}()
 }
 
+// sendSFTPSummary tells the proxy which files were transferred so that it
+// can be recorded in the app logs.
+func (sess *session) sendSFTPSummary(logger lager.Logger, summary sftpserver.Summary) {
+	if summary.Empty() {
+		return
+	}
+
+	_, err := sess.channel.SendRequest(sftpserver.SummaryRequest, false, summary.Payload())
+	if err != nil {
+		logger.Debug("failed-to-send-sftp-summary", lager.Data{"error": err.Error()})
+	}
+}
+
 func (sess *session) executeShell(request *ssh.Request, args ...string) {
 	logger := sess.logger.Session("execute-shell")
 
@@ -504,17 +668,26 @@ func setWindowSize(logger lager.Logger, pty *winpty.WinPTY, columns, rows uint32
 func (sess *session) run(command *exec.Cmd) error {
 	logger := sess.logger.Session("run")
 
-	command.Stdout = sess.channel
-	command.Stderr = sess.channel.Stderr()
+	sess.stdout = newDetachableWriter(sess.channel)
+	sess.stderr = newDetachableWriter(sess.channel.Stderr())
+
+	command.Stdout = sess.stdout
+	command.Stderr = sess.stderr
 
 	stdin, err := command.StdinPipe()
 	if err != nil {
 		return err
 	}
 
+	sess.stdin = stdin
+
 	go helpers.CopyAndClose(logger.Session("to-stdin"), nil, stdin, sess.channel, func() { stdin.Close() })
 
-	return sess.runner.Start(command)
+	err = sess.runner.Start(command)
+	if err == nil {
+		sess.startKeepalive(command)
+	}
+	return err
 }
 
 func (sess *session) runWithPty(command *exec.Cmd) error {
@@ -528,40 +701,93 @@ func (sess *session) runWithPty(command *exec.Cmd) error {
 
 	setWindowSize(logger, sess.winpty, sess.ptyRequest.Columns, sess.ptyRequest.Rows)
 
+	sess.stdout = newDetachableWriter(sess.channel)
+
 	sess.wg.Add(1)
 	go helpers.Copy(logger.Session("to-pty"), nil, sess.winpty.StdIn, sess.channel)
 	go func() {
-		helpers.Copy(logger.Session("from-pty-out"), &sess.wg, sess.channel, sess.winpty.StdOut)
+		helpers.Copy(logger.Session("from-pty-out"), &sess.wg, sess.stdout, sess.winpty.StdOut)
 		sess.channel.CloseWrite()
 	}()
 
 	err = sess.winpty.Run(command)
 	if err == nil {
-		sess.keepaliveStopCh = make(chan struct{})
-		go sess.keepalive(sess.keepaliveStopCh)
+		sess.startKeepalive(command)
 	}
 	return err
 }
 
-func (sess *session) keepalive(stopCh chan struct{}) {
+func (sess *session) startKeepalive(command *exec.Cmd) {
+	if sess.keepaliveDuration <= 0 {
+		return
+	}
+
+	sess.keepaliveStopCh = make(chan struct{})
+	go sess.keepalive(command, sess.keepaliveStopCh)
+}
+
+func (sess *session) keepalive(command *exec.Cmd, stopCh chan struct{}) {
 	logger := sess.logger.Session("keepalive")
 
+	countMax := sess.options.KeepaliveCountMax
+	if countMax < 1 {
+		countMax = 1
+	}
+
+	replies := make(chan error, 1)
+	pending := false
+	missed := 0
+
 	ticker := time.NewTicker(sess.keepaliveDuration)
 	defer ticker.Stop()
 	for {
 		select {
 		case <-ticker.C:
-			_, err := sess.channel.SendRequest("keepalive@cloudfoundry.org", true, nil)
+			if pending {
+				missed++
+			} else {
+				pending = true
+				go func() {
+					_, err := sess.channel.SendRequest("keepalive@cloudfoundry.org", true, nil)
+					replies <- err
+				}()
+			}
+		case err := <-replies:
+			pending = false
 			logger.Info("keepalive", lager.Data{"success": err == nil})
 
-			if err != nil {
-				err = sess.winpty.Signal(syscall.SIGINT)
-				logger.Info("process-signaled", lager.Data{"error": err})
-				return
+			if err == nil {
+				missed = 0
+				continue
 			}
+			missed++
 		case <-stopCh:
 			return
 		}
+
+		if missed >= countMax {
+			logger.Info("client-unresponsive", lager.Data{"missed": missed, "action": sess.options.KeepaliveAction})
+			sess.clientGone(logger, command)
+			return
+		}
+	}
+}
+
+func (sess *session) clientGone(logger lager.Logger, command *exec.Cmd) {
+	switch sess.options.KeepaliveAction {
+	case KeepaliveActionContinue:
+	case KeepaliveActionDetach:
+		sess.stdout.detach()
+		sess.stderr.detach()
+		sess.channel.Close()
+	default:
+		var err error
+		if sess.allocPty {
+			err = sess.winpty.Signal(syscall.SIGINT)
+		} else {
+			err = sess.runner.Signal(command, syscall.SIGINT)
+		}
+		logger.Info("process-signaled", lager.Data{"error": err})
 	}
 }
 
@@ -612,9 +838,17 @@ func (sess *session) executeSCP(command string, request *ssh.Request) {
 		request.Reply(true, nil)
 	}
 
-	copier, err := scp.NewFromCommand(command, sess.channel, sess.channel, sess.channel.Stderr(), logger)
+	args, err := scp.ParseCommand(command)
 	if err == nil {
-		err = copier.Copy()
+		var options *scp.Options
+		options, err = scp.ParseFlags(args)
+		if err == nil {
+			options.Quota = quota.New(sess.options.UploadLimits)
+			options.Root = sess.options.SCPRoot
+			options.Symlinks = sess.options.SCPSymlinks
+			options.CapBandwidth(sess.options.SCPBandwidthLimit)
+			err = scp.New(options, sess.channel, sess.channel, sess.channel.Stderr(), logger).Copy()
+		}
 	}
 
 	sess.sendSCPExitMessage(err)
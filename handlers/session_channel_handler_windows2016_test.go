@@ -85,7 +85,7 @@ var _ = Describe("SessionChannelHandler", func() {
 		delete(defaultEnv, "Path")
 		delete(defaultEnv, "PATH")
 
-		sessionChannelHandler = handlers.NewSessionChannelHandler(runner, shellLocator, defaultEnv, time.Second)
+		sessionChannelHandler = handlers.NewSessionChannelHandler(runner, shellLocator, defaultEnv, time.Second, handlers.SessionOptions{})
 
 		newChannelHandlers = map[string]handlers.NewChannelHandler{
 			"session": sessionChannelHandler,
@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"code.cloudfoundry.org/diego-ssh/quota"
+	"code.cloudfoundry.org/diego-ssh/scp"
+	"code.cloudfoundry.org/diego-ssh/sftpserver"
+)
+
+// KeepaliveAction determines what happens to a running command when the
+// client stops answering keepalive requests.
+type KeepaliveAction string
+
+const (
+	// KeepaliveActionHangup signals the command as if its terminal had been
+	// hung up. This is the default.
+	KeepaliveActionHangup KeepaliveAction = "hangup"
+
+	// KeepaliveActionContinue stops sending keepalives and lets the command
+	// run on in the session.
+	KeepaliveActionContinue KeepaliveAction = "continue"
+
+	// KeepaliveActionDetach closes the session channel and discards the
+	// output of the command, which keeps running until it exits.
+	KeepaliveActionDetach KeepaliveAction = "detach"
+)
+
+type SessionOptions struct {
+	// When set, shell and exec requests are run in an environment that
+	// emulates the Cloud Foundry launcher.
+	LoginEnvironment *LoginEnvironment
+
+	// When set, restricts the environment variables that clients may set
+	// with env requests. All requests are accepted when nil.
+	EnvPolicy *EnvPolicy
+
+	// Subsystems lists the subsystems that clients may request. All
+	// supported subsystems are enabled when nil.
+	Subsystems []string
+
+	// KeepaliveCountMax is the number of consecutive keepalive requests that
+	// may go unanswered before KeepaliveAction is taken. Values below one
+	// act on the first missed reply.
+	KeepaliveCountMax int
+
+	// KeepaliveAction is taken once the client is considered gone. The
+	// command is hung up when empty.
+	KeepaliveAction KeepaliveAction
+
+	// ExecArgv runs exec requests without a shell. The command is split into
+	// words and the program is looked up and run directly.
+	ExecArgv bool
+
+	// ExecPath is the search path for programs run without a shell. The PATH
+	// of the session is used when empty.
+	ExecPath string
+
+	// ForcedCommand replaces the command of every exec and shell request,
+	// like the command option of an OpenSSH authorized key. It is run
+	// without a shell and the requested command is made available in
+	// SSH_ORIGINAL_COMMAND.
+	ForcedCommand string
+
+	// SFTP restricts the sftp subsystem to a root directory and to the
+	// operations that are allowed.
+	SFTP sftpserver.Options
+
+	// SCPRoot is the directory that scp targets are resolved in.
+	SCPRoot string
+
+	// SCPSymlinks determines whether scp follows or skips symbolic links
+	// when sending files.
+	SCPSymlinks scp.SymlinkPolicy
+
+	// SCPBandwidthLimit caps the rate in Kbit/s that scp transfers file
+	// contents at, including transfers that ask for a higher limit with -l.
+	// The rate is not capped when it is zero.
+	SCPBandwidthLimit int
+
+	// UploadLimits restrict the files written with scp and sftp in a
+	// session.
+	UploadLimits quota.Limits
+}
+
+func (o SessionOptions) subsystemEnabled(name string) bool {
+	if o.Subsystems == nil {
+		return true
+	}
+
+	for _, subsystem := range o.Subsystems {
+		if subsystem == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+type LoginEnvironment struct {
+	// AppDir is the working directory of the session and the location of
+	// the .profile and .profile.d scripts that are sourced before the
+	// requested command is run.
+	AppDir string
+
+	// Env holds the variables of the app process, such as PATH and VCAP_*,
+	// that take precedence over the daemon defaults.
+	Env map[string]string
+}
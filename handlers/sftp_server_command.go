@@ -0,0 +1,40 @@
+package handlers
+
+import (
+	"fmt"
+
+	"code.cloudfoundry.org/diego-ssh/sftpserver"
+	"github.com/google/shlex"
+)
+
+// sftpServerOptions applies the flags of an sftp-server command line to
+// options. -R makes the session read-only and -d sets the directory that
+// relative paths start at. The logging flags -e, -l and -f have no effect.
+// Other flags are rejected instead of being ignored.
+func sftpServerOptions(command string, options sftpserver.Options) (sftpserver.Options, error) {
+	args, err := shlex.Split(command)
+	if err != nil {
+		return options, err
+	}
+
+	for i := 1; i < len(args); i++ {
+		switch flag := args[i]; flag {
+		case "-R":
+			options.ReadOnly = true
+		case "-e":
+		case "-d", "-l", "-f":
+			if i+1 == len(args) {
+				return options, fmt.Errorf("sftp-server option %s requires an argument", flag)
+			}
+			i++
+
+			if flag == "-d" {
+				options.StartDirectory = args[i]
+			}
+		default:
+			return options, fmt.Errorf("unsupported sftp-server option %q", flag)
+		}
+	}
+
+	return options, nil
+}
@@ -17,5 +17,5 @@ func (shellLocator) ShellPath() string {
 		}
 	}
 
-	return "/bin/sh"
+	return ""
 }
@@ -0,0 +1,147 @@
+package helpers
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// UnsupportedCiphers returns the ciphers of a comma separated list that
+// golang.org/x/crypto/ssh cannot negotiate. An empty list selects the
+// defaults and has no unsupported ciphers.
+func UnsupportedCiphers(ciphers string) []string {
+	return unsupportedAlgorithms(ciphers, func(config *ssh.Config, cipher string) {
+		config.Ciphers = []string{cipher}
+	})
+}
+
+// UnsupportedMACs returns the MACs of a comma separated list that
+// golang.org/x/crypto/ssh cannot negotiate.
+func UnsupportedMACs(macs string) []string {
+	return unsupportedAlgorithms(macs, func(config *ssh.Config, mac string) {
+		// MACs are not negotiated for AEAD ciphers
+		config.Ciphers = []string{"aes128-ctr"}
+		config.MACs = []string{mac}
+	})
+}
+
+// UnsupportedKeyExchanges returns the key exchanges of a comma separated list
+// that golang.org/x/crypto/ssh cannot negotiate.
+func UnsupportedKeyExchanges(keyExchanges string) []string {
+	return unsupportedAlgorithms(keyExchanges, func(config *ssh.Config, keyExchange string) {
+		config.KeyExchanges = []string{keyExchange}
+	})
+}
+
+// unsupportedAlgorithms tries a handshake over a local pipe with each
+// algorithm of the list. Some versions of x/crypto silently ignore algorithms
+// they do not know, so a handshake is the only reliable check.
+func unsupportedAlgorithms(algorithms string, configure func(*ssh.Config, string)) []string {
+	if algorithms == "" {
+		return nil
+	}
+
+	var unsupported []string
+
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return strings.Split(algorithms, ",")
+	}
+
+	hostKey, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		return strings.Split(algorithms, ",")
+	}
+
+	for _, algorithm := range strings.Split(algorithms, ",") {
+		var config ssh.Config
+		configure(&config, algorithm)
+
+		if algorithm == "" || !handshake(config, hostKey) {
+			unsupported = append(unsupported, algorithm)
+		}
+	}
+
+	return unsupported
+}
+
+func handshake(config ssh.Config, hostKey ssh.Signer) bool {
+	serverNetConn, clientNetConn, err := pipe()
+	if err != nil {
+		return false
+	}
+	defer clientNetConn.Close()
+
+	serverConfig := &ssh.ServerConfig{Config: config, NoClientAuth: true}
+	serverConfig.AddHostKey(hostKey)
+
+	go func() {
+		defer serverNetConn.Close()
+
+		serverConn, _, _, err := ssh.NewServerConn(serverNetConn, serverConfig)
+		if err == nil {
+			serverConn.Wait()
+		}
+	}()
+
+	clientConfig := &ssh.ClientConfig{
+		Config:          config,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+
+	clientConn, _, _, err := ssh.NewClientConn(clientNetConn, "", clientConfig)
+	if err != nil {
+		return false
+	}
+
+	clientConn.Close()
+	return true
+}
+
+// pipe returns the two ends of a connection over operating system pipes.
+// Unlike with net.Pipe, writes do not wait for the other end to read, which
+// the SSH version exchange relies on because both ends write first.
+func pipe() (net.Conn, net.Conn, error) {
+	serverReader, clientWriter, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	clientReader, serverWriter, err := os.Pipe()
+	if err != nil {
+		serverReader.Close()
+		clientWriter.Close()
+		return nil, nil, err
+	}
+
+	return &pipeConn{reader: serverReader, writer: serverWriter}, &pipeConn{reader: clientReader, writer: clientWriter}, nil
+}
+
+type pipeConn struct {
+	reader *os.File
+	writer *os.File
+}
+
+func (c *pipeConn) Read(b []byte) (int, error)  { return c.reader.Read(b) }
+func (c *pipeConn) Write(b []byte) (int, error) { return c.writer.Write(b) }
+
+func (c *pipeConn) Close() error {
+	c.writer.Close()
+	return c.reader.Close()
+}
+
+func (c *pipeConn) LocalAddr() net.Addr                { return pipeAddr{} }
+func (c *pipeConn) RemoteAddr() net.Addr               { return pipeAddr{} }
+func (c *pipeConn) SetDeadline(t time.Time) error      { return nil }
+func (c *pipeConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *pipeConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
@@ -0,0 +1,37 @@
+package helpers_test
+
+import (
+	"code.cloudfoundry.org/diego-ssh/helpers"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Unsupported algorithms", func() {
+	It("returns nothing for an empty list", func() {
+		Expect(helpers.UnsupportedCiphers("")).To(BeEmpty())
+		Expect(helpers.UnsupportedMACs("")).To(BeEmpty())
+		Expect(helpers.UnsupportedKeyExchanges("")).To(BeEmpty())
+	})
+
+	Describe("UnsupportedCiphers", func() {
+		It("returns the ciphers that cannot be negotiated", func() {
+			Expect(helpers.UnsupportedCiphers("chacha20-poly1305@openssh.com,rot13,aes128-ctr")).To(ConsistOf("rot13"))
+		})
+	})
+
+	Describe("UnsupportedMACs", func() {
+		It("returns the MACs that cannot be negotiated", func() {
+			Expect(helpers.UnsupportedMACs("hmac-sha2-256,hmac-md5-42,hmac-sha2-256-etm@openssh.com")).To(ConsistOf("hmac-md5-42"))
+		})
+	})
+
+	Describe("UnsupportedKeyExchanges", func() {
+		It("returns the key exchanges that cannot be negotiated", func() {
+			Expect(helpers.UnsupportedKeyExchanges("curve25519-sha256@libssh.org,ecdh-sha2-nistp256,kex-by-carrier-pigeon")).To(ConsistOf("kex-by-carrier-pigeon"))
+		})
+
+		It("reports empty names", func() {
+			Expect(helpers.UnsupportedKeyExchanges("curve25519-sha256@libssh.org,")).To(ConsistOf(""))
+		})
+	})
+})
@@ -0,0 +1,132 @@
+package helpers
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strconv"
+)
+
+// ConfigProblem is a problem with one setting of a config.
+type ConfigProblem struct {
+	Setting string `json:"setting"`
+	Problem string `json:"problem"`
+}
+
+// ConfigProblems collects the problems that are found while a config is
+// validated, so that all of them can be reported at once.
+type ConfigProblems []ConfigProblem
+
+// Add records err as a problem of setting. A nil err is ignored.
+func (p *ConfigProblems) Add(setting string, err error) {
+	if err != nil {
+		*p = append(*p, ConfigProblem{Setting: setting, Problem: err.Error()})
+	}
+}
+
+// Addf records a formatted problem of setting.
+func (p *ConfigProblems) Addf(setting string, format string, args ...interface{}) {
+	*p = append(*p, ConfigProblem{Setting: setting, Problem: fmt.Sprintf(format, args...)})
+}
+
+// Require records a problem when a required setting is empty.
+func (p *ConfigProblems) Require(setting string, value string) bool {
+	if value == "" {
+		p.Addf(setting, "is required")
+		return false
+	}
+	return true
+}
+
+// AddUnsupportedAlgorithms records a problem for each of the algorithms.
+func (p *ConfigProblems) AddUnsupportedAlgorithms(setting string, algorithms []string) {
+	for _, algorithm := range algorithms {
+		p.Addf(setting, "unsupported algorithm %q", algorithm)
+	}
+}
+
+// WriteConfigReport writes the problems to w as a JSON document and returns
+// the exit status of the validation, which is 1 when there are problems.
+func WriteConfigReport(w io.Writer, problems ConfigProblems) int {
+	if problems == nil {
+		problems = ConfigProblems{}
+	}
+
+	report := struct {
+		Valid    bool           `json:"valid"`
+		Problems ConfigProblems `json:"problems"`
+	}{
+		Valid:    len(problems) == 0,
+		Problems: problems,
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(report)
+
+	if !report.Valid {
+		return 1
+	}
+	return 0
+}
+
+// CheckAddress checks that address is a host and port to listen on or to
+// connect to.
+func CheckAddress(address string) error {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return fmt.Errorf("invalid port %q", port)
+	}
+
+	return nil
+}
+
+// CheckURL checks that rawURL is an absolute URL with a host.
+func CheckURL(rawURL string) error {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+
+	if parsed.Scheme == "" || parsed.Host == "" {
+		return fmt.Errorf("%q is not an absolute URL", rawURL)
+	}
+
+	return nil
+}
+
+// CheckCACertFile checks that path can be read and contains at least one
+// PEM-encoded certificate.
+func CheckCACertFile(path string) error {
+	certBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	if !x509.NewCertPool().AppendCertsFromPEM(certBytes) {
+		return fmt.Errorf("%s does not contain a PEM-encoded certificate", path)
+	}
+
+	return nil
+}
+
+// CheckKeyPairFiles checks that certFile and keyFile can be read and hold a
+// matching PEM-encoded certificate and private key.
+func CheckKeyPairFiles(certFile, keyFile string) error {
+	if certFile == "" || keyFile == "" {
+		return errors.New("a certificate and a private key are required")
+	}
+
+	_, err := tls.LoadX509KeyPair(certFile, keyFile)
+	return err
+}
@@ -0,0 +1,132 @@
+package helpers_test
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+
+	"code.cloudfoundry.org/diego-ssh/helpers"
+	"code.cloudfoundry.org/inigo/helpers/certauthority"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Config validation", func() {
+	Describe("ConfigProblems", func() {
+		It("collects problems", func() {
+			var problems helpers.ConfigProblems
+			problems.Add("address", errors.New("missing port"))
+			problems.Add("host_key", nil)
+			problems.Addf("log_level", "unknown log level: %q", "loud")
+			Expect(problems.Require("bbs_address", "")).To(BeFalse())
+			Expect(problems.Require("cc_api_url", "https://cc")).To(BeTrue())
+			problems.AddUnsupportedAlgorithms("allowed_ciphers", []string{"rot13"})
+
+			Expect(problems).To(Equal(helpers.ConfigProblems{
+				{Setting: "address", Problem: "missing port"},
+				{Setting: "log_level", Problem: `unknown log level: "loud"`},
+				{Setting: "bbs_address", Problem: "is required"},
+				{Setting: "allowed_ciphers", Problem: `unsupported algorithm "rot13"`},
+			}))
+		})
+	})
+
+	Describe("WriteConfigReport", func() {
+		var buffer *bytes.Buffer
+
+		BeforeEach(func() {
+			buffer = &bytes.Buffer{}
+		})
+
+		It("reports a valid config", func() {
+			Expect(helpers.WriteConfigReport(buffer, nil)).To(Equal(0))
+			Expect(buffer.String()).To(MatchJSON(`{"valid": true, "problems": []}`))
+		})
+
+		It("reports the problems of an invalid config", func() {
+			problems := helpers.ConfigProblems{{Setting: "address", Problem: "missing port"}}
+
+			Expect(helpers.WriteConfigReport(buffer, problems)).To(Equal(1))
+			Expect(buffer.String()).To(MatchJSON(`{
+				"valid": false,
+				"problems": [{"setting": "address", "problem": "missing port"}]
+			}`))
+		})
+	})
+
+	Describe("CheckAddress", func() {
+		It("accepts a host and port", func() {
+			Expect(helpers.CheckAddress("127.0.0.1:2222")).To(Succeed())
+			Expect(helpers.CheckAddress(":2222")).To(Succeed())
+		})
+
+		It("rejects a missing or invalid port", func() {
+			Expect(helpers.CheckAddress("127.0.0.1")).NotTo(Succeed())
+			Expect(helpers.CheckAddress("127.0.0.1:ssh")).NotTo(Succeed())
+			Expect(helpers.CheckAddress("127.0.0.1:70000")).NotTo(Succeed())
+		})
+	})
+
+	Describe("CheckURL", func() {
+		It("accepts absolute URLs", func() {
+			Expect(helpers.CheckURL("https://bbs.service.cf.internal:8889")).To(Succeed())
+		})
+
+		It("rejects relative or malformed URLs", func() {
+			Expect(helpers.CheckURL("bbs.service.cf.internal")).NotTo(Succeed())
+			Expect(helpers.CheckURL("https://%zz")).NotTo(Succeed())
+		})
+	})
+
+	Describe("certificate files", func() {
+		var (
+			certDepotDir string
+			ca           certauthority.CertAuthority
+		)
+
+		BeforeEach(func() {
+			var err error
+			certDepotDir, err = ioutil.TempDir("", "")
+			Expect(err).NotTo(HaveOccurred())
+
+			ca, err = certauthority.NewCertAuthority(certDepotDir, "one")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(certDepotDir)).To(Succeed())
+		})
+
+		Describe("CheckCACertFile", func() {
+			It("accepts a PEM-encoded certificate", func() {
+				_, caFile := ca.CAAndKey()
+				Expect(helpers.CheckCACertFile(caFile)).To(Succeed())
+			})
+
+			It("rejects missing files and files without certificates", func() {
+				caKeyFile, _ := ca.CAAndKey()
+				Expect(helpers.CheckCACertFile(caKeyFile)).NotTo(Succeed())
+				Expect(helpers.CheckCACertFile("/does/not/exist")).NotTo(Succeed())
+			})
+		})
+
+		Describe("CheckKeyPairFiles", func() {
+			It("accepts a matching certificate and key", func() {
+				keyFile, certFile, err := ca.GenerateSelfSignedCertAndKey("client", []string{}, false)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(helpers.CheckKeyPairFiles(certFile, keyFile)).To(Succeed())
+			})
+
+			It("rejects a missing or mismatched key", func() {
+				_, certFile, err := ca.GenerateSelfSignedCertAndKey("client", []string{}, false)
+				Expect(err).NotTo(HaveOccurred())
+
+				caKeyFile, _ := ca.CAAndKey()
+				Expect(helpers.CheckKeyPairFiles(certFile, caKeyFile)).NotTo(Succeed())
+				Expect(helpers.CheckKeyPairFiles(certFile, "")).NotTo(Succeed())
+			})
+		})
+	})
+})
@@ -0,0 +1,111 @@
+package helpers
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const maxSymlinks = 40
+
+var ErrOutsideRoot = errors.New("path is outside of the root directory")
+var ErrTooManySymlinks = errors.New("too many levels of symbolic links")
+
+// ResolveWithin maps the client path p to a path below root. Symbolic links
+// are resolved as if root was the root of the filesystem, so that neither
+// relative nor absolute link targets lead outside of it. The last element of
+// p is left alone unless followLast is set. Like the kernel, it fails when ".."
+// follows an element that does not exist.
+func ResolveWithin(root, p string, followLast bool) (string, error) {
+	pending := splitPath(p)
+	resolved := root
+	links := 0
+	missing := false
+
+	for len(pending) > 0 {
+		name := pending[0]
+		pending = pending[1:]
+
+		if missing {
+			if name == ".." {
+				return "", &os.PathError{Op: "resolve", Path: p, Err: os.ErrNotExist}
+			}
+			resolved = filepath.Join(resolved, name)
+			continue
+		}
+
+		if name == ".." {
+			if resolved != root {
+				resolved = filepath.Dir(resolved)
+			}
+			continue
+		}
+
+		next := filepath.Join(resolved, name)
+		if len(pending) == 0 && !followLast {
+			resolved = next
+			break
+		}
+
+		info, err := os.Lstat(next)
+		if os.IsNotExist(err) {
+			resolved = next
+			missing = true
+			continue
+		} else if err != nil {
+			return "", err
+		}
+
+		if info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", ErrTooManySymlinks
+		}
+
+		target, err := os.Readlink(next)
+		if err != nil {
+			return "", err
+		}
+
+		if filepath.IsAbs(target) {
+			if !Within(root, target) {
+				return "", ErrOutsideRoot
+			}
+			target, _ = filepath.Rel(root, target)
+			resolved = root
+		}
+
+		pending = append(splitPath(target), pending...)
+	}
+
+	if !Within(root, resolved) {
+		return "", ErrOutsideRoot
+	}
+
+	return resolved, nil
+}
+
+func splitPath(p string) []string {
+	var names []string
+	for _, name := range strings.Split(filepath.ToSlash(p), "/") {
+		if name != "" && name != "." {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Within returns whether p is root or below it.
+func Within(root, p string) bool {
+	rel, err := filepath.Rel(root, filepath.Clean(p))
+	if err != nil {
+		return false
+	}
+
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
+}
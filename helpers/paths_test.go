@@ -0,0 +1,83 @@
+package helpers_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/diego-ssh/helpers"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Paths", func() {
+	var root string
+
+	BeforeEach(func() {
+		var err error
+		root, err = ioutil.TempDir("", "paths")
+		Expect(err).NotTo(HaveOccurred())
+
+		root, err = filepath.EvalSymlinks(root)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(os.Mkdir(filepath.Join(root, "dir"), 0755)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(root)
+	})
+
+	Describe("ResolveWithin", func() {
+		It("resolves paths below the root", func() {
+			Expect(helpers.ResolveWithin(root, "/dir/file", true)).To(Equal(filepath.Join(root, "dir", "file")))
+			Expect(helpers.ResolveWithin(root, "dir/../../../file", true)).To(Equal(filepath.Join(root, "file")))
+		})
+
+		It("resolves absolute symbolic links as if the root was /", func() {
+			Expect(os.Symlink("/dir", filepath.Join(root, "link"))).To(Succeed())
+			Expect(helpers.ResolveWithin(root, "/link/file", true)).To(Equal(filepath.Join(root, "dir", "file")))
+		})
+
+		It("leaves the last element alone unless it is followed", func() {
+			Expect(os.Symlink("/dir", filepath.Join(root, "link"))).To(Succeed())
+			Expect(helpers.ResolveWithin(root, "/link", false)).To(Equal(filepath.Join(root, "link")))
+		})
+
+		It("does not let '..' after a missing element skip symbolic links", func() {
+			Expect(os.Symlink("../../../../../../etc", filepath.Join(root, "out"))).To(Succeed())
+			Expect(os.Symlink("nope/../out/passwd", filepath.Join(root, "a"))).To(Succeed())
+
+			_, err := helpers.ResolveWithin(root, "/a", true)
+			Expect(os.IsNotExist(err)).To(BeTrue())
+
+			_, err = helpers.ResolveWithin(root, "/nope/../out/passwd", true)
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+
+		It("resolves paths below a missing element", func() {
+			Expect(helpers.ResolveWithin(root, "/dir/new/file", true)).To(Equal(filepath.Join(root, "dir", "new", "file")))
+		})
+
+		It("fails on symbolic link loops", func() {
+			Expect(os.Symlink("loop", filepath.Join(root, "loop"))).To(Succeed())
+			_, err := helpers.ResolveWithin(root, "/loop/file", true)
+			Expect(err).To(Equal(helpers.ErrTooManySymlinks))
+		})
+	})
+
+	Describe("Within", func() {
+		It("accepts the root and paths below it", func() {
+			Expect(helpers.Within(root, root)).To(BeTrue())
+			Expect(helpers.Within(root, filepath.Join(root, "dir", "file"))).To(BeTrue())
+			Expect(helpers.Within(root, filepath.Join(root, "..file"))).To(BeTrue())
+		})
+
+		It("rejects paths outside of the root", func() {
+			Expect(helpers.Within(root, filepath.Dir(root))).To(BeFalse())
+			Expect(helpers.Within(root, root+"-sibling")).To(BeFalse())
+			Expect(helpers.Within(root, filepath.Join(root, "..", "file"))).To(BeFalse())
+		})
+	})
+})
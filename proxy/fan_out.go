@@ -0,0 +1,349 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"code.cloudfoundry.org/lager"
+	"golang.org/x/crypto/ssh"
+)
+
+// fanOutFailureStatus is the exit status reported for instances that could
+// not run the command at all, matching what ssh reports for connection
+// failures.
+const fanOutFailureStatus = 255
+
+// DefaultFanOutWorkers is how many instances a command runs on at the same
+// time when no other number is set.
+const DefaultFanOutWorkers = 16
+
+type instanceResult struct {
+	index  int
+	status int
+	err    error
+}
+
+// handleFanOut serves a connection that was authenticated for all instances
+// of an app. Only session channels that exec a command are supported; the
+// command runs on every instance and the output is prefixed with the index
+// of the instance that produced it.
+func (p *Proxy) handleFanOut(logger lager.Logger, serverConn *ssh.ServerConn, tlsConfig *tls.Config, hostKeys []ssh.Signer, accessGrant AccessGrant, channels <-chan ssh.NewChannel, requests <-chan *ssh.Request) {
+	logger = logger.Session("fan-out")
+
+	var targets []InstanceTarget
+	err := json.Unmarshal([]byte(serverConn.Permissions.CriticalOptions["proxy-instance-targets"]), &targets)
+	if err != nil {
+		logger.Error("unmarshal-failed", err)
+		return
+	}
+
+	sort.Slice(targets, func(i, j int) bool { return targets[i].Index < targets[j].Index })
+
+	for _, target := range targets {
+		if target.LogMessage != nil {
+			p.metronClient.SendAppLog(target.LogMessage.Message, "SSH", target.LogMessage.Tags)
+		}
+	}
+
+	defer func() {
+		endMessage := fmt.Sprintf("Remote access ended for %s", serverConn.RemoteAddr().String())
+		for _, target := range targets {
+			if target.LogMessage != nil {
+				p.metronClient.SendAppLog(endMessage, "SSH", target.LogMessage.Tags)
+			}
+		}
+	}()
+
+	logMessages := make([]*LogMessage, len(targets))
+	for i, target := range targets {
+		logMessages[i] = target.LogMessage
+	}
+
+	live := p.register(serverConn, "", accessGrant, logMessages...)
+	defer p.unregister(live)
+
+	limitsDone := make(chan struct{})
+	defer close(limitsDone)
+	go p.enforceLimits(logger, live, p.limitsFor(logger, serverConn.Permissions), limitsDone)
+
+	p.emitConnectionOpened(logger)
+	defer func() {
+		p.emitConnectionClosing(logger)
+	}()
+
+	go discardGlobalRequests(requests, interceptHostKeysProve(logger, serverConn, hostKeys))
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			logger.Info("rejecting-channel", lager.Data{"channelType": newChannel.ChannelType()})
+			newChannel.Reject(ssh.Prohibited, "only commands can be run on all instances")
+			continue
+		}
+
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			logger.Error("failed-to-accept-channel", err)
+			continue
+		}
+
+		untrack := live.track(channel)
+		go func() {
+			p.handleFanOutSession(logger, live, tlsConfig, targets, channel, channelRequests)
+			untrack()
+		}()
+	}
+}
+
+func (p *Proxy) handleFanOutSession(logger lager.Logger, live *liveConnection, tlsConfig *tls.Config, targets []InstanceTarget, channel ssh.Channel, requests <-chan *ssh.Request) {
+	logger = logger.Session("session")
+	defer channel.Close()
+
+	env := map[string]string{}
+
+	for req := range requests {
+		switch req.Type {
+		case "env":
+			var envMessage struct {
+				Name  string
+				Value string
+			}
+			err := ssh.Unmarshal(req.Payload, &envMessage)
+			if err == nil {
+				env[envMessage.Name] = envMessage.Value
+			}
+			if req.WantReply {
+				req.Reply(err == nil, nil)
+			}
+		case "exec":
+			var execMessage struct {
+				Command string
+			}
+			err := ssh.Unmarshal(req.Payload, &execMessage)
+			if req.WantReply {
+				req.Reply(err == nil, nil)
+			}
+			if err != nil {
+				logger.Error("invalid-exec-request", err)
+				continue
+			}
+
+			go ssh.DiscardRequests(requests)
+
+			status := p.runOnAllInstances(logger, live, tlsConfig, targets, env, execMessage.Command, channel)
+			channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(status)}))
+			return
+		default:
+			logger.Info("unsupported-request", lager.Data{"type": req.Type})
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+// SetFanOutWorkers sets how many instances a command that runs on all
+// instances is run on at the same time. Zero selects DefaultFanOutWorkers.
+func (p *Proxy) SetFanOutWorkers(workers int) {
+	p.limitsLock.Lock()
+	defer p.limitsLock.Unlock()
+
+	p.fanOutWorkers = workers
+}
+
+func (p *Proxy) fanOutWorkerCount() int {
+	p.limitsLock.Lock()
+	defer p.limitsLock.Unlock()
+
+	if p.fanOutWorkers <= 0 {
+		return DefaultFanOutWorkers
+	}
+	return p.fanOutWorkers
+}
+
+// runOnAllInstances runs command on the targets, on at most the configured
+// number of workers at a time, and reports the failures once all of them are
+// done. The combined exit status is the highest exit status of all
+// instances.
+func (p *Proxy) runOnAllInstances(logger lager.Logger, live *liveConnection, tlsConfig *tls.Config, targets []InstanceTarget, env map[string]string, command string, channel ssh.Channel) int {
+	logger = logger.Session("run-on-all-instances", lager.Data{"instances": len(targets)})
+	logger.Info("started")
+	defer logger.Info("finished")
+
+	outputLock := &sync.Mutex{}
+	results := make([]instanceResult, len(targets))
+
+	workers := make(chan struct{}, p.fanOutWorkerCount())
+
+	wg := &sync.WaitGroup{}
+	for i, target := range targets {
+		wg.Add(1)
+		workers <- struct{}{}
+		go func(i int, target InstanceTarget) {
+			defer wg.Done()
+			defer func() { <-workers }()
+
+			stdout := newPrefixWriter(outputLock, live.observe(channel), target.Index)
+			stderr := newPrefixWriter(outputLock, live.observe(channel.Stderr()), target.Index)
+
+			status, err := p.runOnInstance(logger, tlsConfig, target, env, command, stdout, stderr)
+
+			stdout.Flush()
+			stderr.Flush()
+
+			results[i] = instanceResult{index: target.Index, status: status, err: err}
+		}(i, target)
+	}
+	wg.Wait()
+
+	combined := 0
+	failed := 0
+	for _, result := range results {
+		if result.err != nil {
+			fmt.Fprintf(channel.Stderr(), "[%d] failed: %s\n", result.index, result.err)
+		} else if result.status != 0 {
+			fmt.Fprintf(channel.Stderr(), "[%d] exited with status %d\n", result.index, result.status)
+		}
+
+		if result.status != 0 {
+			failed++
+		}
+		if result.status > combined {
+			combined = result.status
+		}
+	}
+
+	fmt.Fprintf(channel.Stderr(), "%d of %d instances succeeded\n", len(results)-failed, len(results))
+
+	return combined
+}
+
+func (p *Proxy) runOnInstance(logger lager.Logger, tlsConfig *tls.Config, target InstanceTarget, env map[string]string, command string, stdout, stderr io.Writer) (int, error) {
+	logger = logger.Session("instance", lager.Data{"index": target.Index})
+
+	conn, channels, requests, err := dialTarget(logger, target.TargetConfig, tlsConfig)
+	if err != nil {
+		return fanOutFailureStatus, err
+	}
+
+	client := ssh.NewClient(conn, channels, requests)
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		logger.Error("failed-to-open-session", err)
+		return fanOutFailureStatus, err
+	}
+	defer session.Close()
+
+	for name, value := range env {
+		err := session.Setenv(name, value)
+		if err != nil {
+			logger.Debug("setenv-rejected", lager.Data{"name": name})
+		}
+	}
+
+	session.Stdout = stdout
+	session.Stderr = stderr
+
+	err = session.Run(command)
+	if err != nil {
+		if exitErr, ok := err.(*ssh.ExitError); ok {
+			return exitErr.ExitStatus(), nil
+		}
+
+		logger.Error("run-failed", err)
+		return fanOutFailureStatus, err
+	}
+
+	return 0, nil
+}
+
+// maxPrefixLineLength is the longest line that a prefixWriter holds back
+// while it waits for a newline. Longer lines are written in parts so that
+// output without newlines cannot exhaust the memory of the proxy.
+const maxPrefixLineLength = 64 * 1024
+
+// prefixWriter writes complete lines to a writer that is shared with other
+// instances, prefixing every line with the index of the instance.
+type prefixWriter struct {
+	lock   *sync.Mutex
+	writer io.Writer
+	prefix []byte
+	buffer []byte
+}
+
+func newPrefixWriter(lock *sync.Mutex, writer io.Writer, index int) *prefixWriter {
+	return &prefixWriter{
+		lock:   lock,
+		writer: writer,
+		prefix: []byte(fmt.Sprintf("[%d] ", index)),
+	}
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.buffer = append(w.buffer, p...)
+
+	for {
+		newline := bytes.IndexByte(w.buffer, '\n')
+		if newline < 0 {
+			break
+		}
+
+		err := w.writeLine(w.buffer[:newline+1])
+		w.buffer = w.buffer[newline+1:]
+		if err != nil {
+			return len(p), err
+		}
+	}
+
+	for len(w.buffer) >= maxPrefixLineLength {
+		line := append(append([]byte{}, w.buffer[:maxPrefixLineLength]...), '\n')
+		w.buffer = w.buffer[maxPrefixLineLength:]
+
+		err := w.writeLine(line)
+		if err != nil {
+			return len(p), err
+		}
+	}
+
+	return len(p), nil
+}
+
+// Flush writes the last line when it is not terminated by a newline.
+func (w *prefixWriter) Flush() error {
+	if len(w.buffer) == 0 {
+		return nil
+	}
+
+	line := append(w.buffer, '\n')
+	w.buffer = nil
+	return w.writeLine(line)
+}
+
+func (w *prefixWriter) writeLine(line []byte) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	_, err := w.writer.Write(append(append([]byte{}, w.prefix...), line...))
+	return err
+}
+
+// discardGlobalRequests rejects the global requests of a fan-out connection,
+// which has no single target to forward them to, unless intercept handles
+// them.
+func discardGlobalRequests(reqs <-chan *ssh.Request, intercept requestInterceptor) {
+	for req := range reqs {
+		if intercept(req) {
+			continue
+		}
+
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+
+	"code.cloudfoundry.org/lager"
+	"golang.org/x/crypto/ssh"
+)
+
+// The OpenSSH host key rotation extension. After authentication the server
+// announces all of its host keys, and clients ask it to prove that it holds
+// the keys they do not know yet.
+const (
+	hostKeysRequest      = "hostkeys-00@openssh.com"
+	hostKeysProveRequest = "hostkeys-prove-00@openssh.com"
+)
+
+var errUnknownHostKey = errors.New("unknown host key")
+
+// SetHostKeys sets the host keys that are announced to clients once they
+// have authenticated. Clients that support the announcement, such as OpenSSH
+// with UpdateHostKeys, learn every key, including the ones that the proxy
+// does not present yet. Use Reconfigure to replace the keys together with
+// the ssh server config that presents them.
+func (p *Proxy) SetHostKeys(hostKeys []ssh.Signer) {
+	p.configLock.Lock()
+	defer p.configLock.Unlock()
+
+	p.hostKeys = hostKeys
+}
+
+func announceHostKeys(logger lager.Logger, conn ssh.Conn, hostKeys []ssh.Signer) {
+	if len(hostKeys) == 0 {
+		return
+	}
+
+	var payload []byte
+	for _, hostKey := range hostKeys {
+		payload = appendString(payload, hostKey.PublicKey().Marshal())
+	}
+
+	_, _, err := conn.SendRequest(hostKeysRequest, false, payload)
+	if err != nil {
+		logger.Error("failed-to-announce-host-keys", err)
+	}
+}
+
+// interceptHostKeysProve answers the requests of clients that want the proxy
+// to prove that it holds announced host keys.
+func interceptHostKeysProve(logger lager.Logger, conn ssh.ConnMetadata, hostKeys []ssh.Signer) requestInterceptor {
+	return func(req *ssh.Request) bool {
+		if req.Type != hostKeysProveRequest {
+			return false
+		}
+
+		signatures, err := proveHostKeys(conn.SessionID(), hostKeys, req.Payload)
+		if err != nil {
+			logger.Error("failed-to-prove-host-keys", err)
+		}
+
+		if req.WantReply {
+			req.Reply(err == nil, signatures)
+		}
+		return true
+	}
+}
+
+// proveHostKeys signs the session with every host key in the payload of a
+// prove request and returns the signatures in the same order.
+func proveHostKeys(sessionID []byte, hostKeys []ssh.Signer, payload []byte) ([]byte, error) {
+	var signatures []byte
+
+	for len(payload) > 0 {
+		blob, rest, ok := parseString(payload)
+		if !ok {
+			return nil, errors.New("malformed prove request")
+		}
+		payload = rest
+
+		var signer ssh.Signer
+		for _, hostKey := range hostKeys {
+			if bytes.Equal(hostKey.PublicKey().Marshal(), blob) {
+				signer = hostKey
+				break
+			}
+		}
+		if signer == nil {
+			return nil, errUnknownHostKey
+		}
+
+		var data []byte
+		data = appendString(data, []byte(hostKeysProveRequest))
+		data = appendString(data, sessionID)
+		data = appendString(data, blob)
+
+		signature, err := signHostKeyProof(signer, data)
+		if err != nil {
+			return nil, err
+		}
+
+		signatures = appendString(signatures, ssh.Marshal(signature))
+	}
+
+	return signatures, nil
+}
+
+// signHostKeyProof signs data like OpenSSH does, with SHA-512 for RSA keys.
+func signHostKeyProof(signer ssh.Signer, data []byte) (*ssh.Signature, error) {
+	if algorithmSigner, ok := signer.(ssh.AlgorithmSigner); ok && signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+		return algorithmSigner.SignWithAlgorithm(rand.Reader, data, ssh.SigAlgoRSASHA2512)
+	}
+	return signer.Sign(rand.Reader, data)
+}
+
+func appendString(buf []byte, s []byte) []byte {
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(len(s)))
+	return append(append(buf, length...), s...)
+}
+
+func parseString(in []byte) ([]byte, []byte, bool) {
+	if len(in) < 4 {
+		return nil, nil, false
+	}
+
+	length := binary.BigEndian.Uint32(in)
+	in = in[4:]
+	if uint32(len(in)) < length {
+		return nil, nil, false
+	}
+
+	return in[:length], in[length:], true
+}
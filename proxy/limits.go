@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultSessionWarning is how long before a session limit is reached the
+// client is warned when no other lead time is configured.
+const DefaultSessionWarning = time.Minute
+
+// SessionLimits bound how long a connection through the proxy may last.
+// MaxDuration limits the lifetime of the connection and IdleTimeout the time
+// without channel data in either direction. Keepalives and other requests
+// do not count as activity. Zero values disable a limit.
+type SessionLimits struct {
+	MaxDuration time.Duration `json:"max_duration,omitempty"`
+	IdleTimeout time.Duration `json:"idle_timeout,omitempty"`
+
+	// Warning is how long before a limit is reached the client is warned.
+	// It is only taken from the proxy configuration.
+	Warning time.Duration `json:"-"`
+}
+
+// restrict returns the limits with the ones that are set in other applied.
+// Where both set a limit the smaller one wins, so other can lower the limits
+// but never raise them.
+func (l SessionLimits) restrict(other SessionLimits) SessionLimits {
+	l.MaxDuration = smallerLimit(l.MaxDuration, other.MaxDuration)
+	l.IdleTimeout = smallerLimit(l.IdleTimeout, other.IdleTimeout)
+	return l
+}
+
+func smallerLimit(limit, other time.Duration) time.Duration {
+	if other <= 0 {
+		return limit
+	}
+	if limit <= 0 || other < limit {
+		return other
+	}
+	return limit
+}
+
+func (l SessionLimits) enabled() bool {
+	return l.MaxDuration > 0 || l.IdleTimeout > 0
+}
+
+// SetSessionLimits sets the limits of connections that are opened from now
+// on. Limits that the permissions of a connection carry can only lower them.
+func (p *Proxy) SetSessionLimits(limits SessionLimits) {
+	p.limitsLock.Lock()
+	defer p.limitsLock.Unlock()
+
+	p.sessionLimits = limits
+}
+
+func (p *Proxy) limitsFor(logger lager.Logger, permissions *ssh.Permissions) SessionLimits {
+	p.limitsLock.Lock()
+	limits := p.sessionLimits
+	p.limitsLock.Unlock()
+
+	if permissions == nil || permissions.CriticalOptions["session-limits"] == "" {
+		return limits
+	}
+
+	var appLimits SessionLimits
+	err := json.Unmarshal([]byte(permissions.CriticalOptions["session-limits"]), &appLimits)
+	if err != nil {
+		logger.Error("invalid-session-limits", err)
+		return limits
+	}
+
+	return limits.restrict(appLimits)
+}
+
+// enforceLimits warns the client before a limit is reached and ends the
+// connection when it is. It returns when done is closed.
+func (p *Proxy) enforceLimits(logger lager.Logger, live *liveConnection, limits SessionLimits, done <-chan struct{}) {
+	if !limits.enabled() {
+		return
+	}
+
+	logger = logger.Session("enforce-limits", lager.Data{
+		"max-duration": limits.MaxDuration.String(),
+		"idle-timeout": limits.IdleTimeout.String(),
+	})
+
+	warning := limits.Warning
+	if warning <= 0 {
+		warning = DefaultSessionWarning
+	}
+
+	var warnedDeadline time.Time
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+		case <-done:
+			return
+		}
+
+		deadline, idle := limits.deadline(live)
+		now := time.Now()
+
+		if !now.Before(deadline) {
+			if idle {
+				p.terminate(logger, live, fmt.Sprintf("the session has been idle for %s", limits.IdleTimeout))
+			} else {
+				p.terminate(logger, live, fmt.Sprintf("the session has reached its maximum duration of %s", limits.MaxDuration))
+			}
+			return
+		}
+
+		warnAt := deadline.Add(-warning)
+		if !now.Before(warnAt) && !deadline.Equal(warnedDeadline) {
+			warnedDeadline = deadline
+			remaining := deadline.Sub(now).Round(time.Second)
+			if idle {
+				live.warn(fmt.Sprintf("this session will be closed in %s unless there is activity (idle timeout %s)", remaining, limits.IdleTimeout))
+			} else {
+				live.warn(fmt.Sprintf("this session will be closed in %s (maximum duration %s)", remaining, limits.MaxDuration))
+			}
+		}
+
+		next := deadline
+		if now.Before(warnAt) {
+			next = warnAt
+		}
+		timer.Reset(next.Sub(now))
+	}
+}
+
+// deadline returns the earliest time at which a limit is reached and whether
+// it is the idle timeout.
+func (l SessionLimits) deadline(live *liveConnection) (time.Time, bool) {
+	var deadline time.Time
+	idle := false
+
+	if l.MaxDuration > 0 {
+		deadline = live.started.Add(l.MaxDuration)
+	}
+
+	if l.IdleTimeout > 0 {
+		idleDeadline := live.lastActivity().Add(l.IdleTimeout)
+		if deadline.IsZero() || idleDeadline.Before(deadline) {
+			deadline = idleDeadline
+			idle = true
+		}
+	}
+
+	return deadline, idle
+}
+
+func (c *liveConnection) touch() {
+	atomic.StoreInt64(&c.activity, time.Now().UnixNano())
+}
+
+func (c *liveConnection) lastActivity() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.activity))
+}
+
+// observe returns a writer that records writes to w as activity on the
+// connection.
+func (c *liveConnection) observe(w io.Writer) io.Writer {
+	if c == nil {
+		return w
+	}
+	return &activityWriter{Writer: w, live: c}
+}
+
+type activityWriter struct {
+	io.Writer
+	live *liveConnection
+}
+
+func (w *activityWriter) Write(p []byte) (int, error) {
+	w.live.touch()
+	return w.Writer.Write(p)
+}
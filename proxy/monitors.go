@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"os"
+	"time"
+
+	"code.cloudfoundry.org/bbs"
+	"code.cloudfoundry.org/bbs/events"
+	"code.cloudfoundry.org/bbs/models"
+	"code.cloudfoundry.org/clock"
+	"code.cloudfoundry.org/lager"
+)
+
+const (
+	instanceStoppedReason    = "the app instance has stopped"
+	instanceEvacuatedReason  = "the app instance is being moved to another cell"
+	resubscribeRetryInterval = time.Second
+)
+
+// InstanceMonitor ends connections to app instances that stop running, as
+// reported by the BBS instance event stream.
+type InstanceMonitor struct {
+	logger    lager.Logger
+	bbsClient bbs.Client
+	proxy     *Proxy
+	clock     clock.Clock
+}
+
+func NewInstanceMonitor(logger lager.Logger, bbsClient bbs.Client, proxy *Proxy, clock clock.Clock) *InstanceMonitor {
+	return &InstanceMonitor{
+		logger:    logger.Session("instance-monitor"),
+		bbsClient: bbsClient,
+		proxy:     proxy,
+		clock:     clock,
+	}
+}
+
+func (m *InstanceMonitor) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	events := make(chan models.Event)
+	stopped := make(chan struct{})
+	defer close(stopped)
+
+	go m.subscribe(events, stopped)
+
+	close(ready)
+
+	for {
+		select {
+		case event := <-events:
+			m.handleEvent(event)
+		case <-signals:
+			return nil
+		}
+	}
+}
+
+// subscribe sends the instance events to events until stopped is closed,
+// subscribing again whenever the stream fails.
+func (m *InstanceMonitor) subscribe(events chan<- models.Event, stopped <-chan struct{}) {
+	logger := m.logger.Session("subscribe")
+
+	for {
+		eventSource, err := m.bbsClient.SubscribeToInstanceEvents(logger)
+		if err != nil {
+			logger.Error("failed-to-subscribe", err)
+		} else if m.forward(logger, eventSource, events, stopped) {
+			return
+		}
+
+		select {
+		case <-m.clock.NewTimer(resubscribeRetryInterval).C():
+		case <-stopped:
+			return
+		}
+	}
+}
+
+// forward sends the events of eventSource to out until the stream fails or
+// stopped is closed. It reports whether stopped was closed.
+func (m *InstanceMonitor) forward(logger lager.Logger, eventSource events.EventSource, out chan<- models.Event, stopped <-chan struct{}) bool {
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-stopped:
+			eventSource.Close()
+		case <-done:
+		}
+	}()
+
+	for {
+		event, err := eventSource.Next()
+		if err != nil {
+			logger.Error("failed-to-get-next-event", err)
+			eventSource.Close()
+			return false
+		}
+
+		select {
+		case out <- event:
+		case <-stopped:
+			return true
+		}
+	}
+}
+
+func (m *InstanceMonitor) handleEvent(event models.Event) {
+	switch event := event.(type) {
+	case *models.ActualLRPInstanceRemovedEvent:
+		if event.ActualLrp != nil {
+			m.terminate(event.ActualLrp.InstanceGuid, instanceStoppedReason)
+		}
+	case *models.ActualLRPInstanceChangedEvent:
+		if event.After == nil {
+			return
+		}
+
+		if event.After.State != models.ActualLRPStateRunning {
+			m.terminate(event.InstanceGuid, instanceStoppedReason)
+		} else if event.After.Presence == models.ActualLRP_Evacuating {
+			m.terminate(event.InstanceGuid, instanceEvacuatedReason)
+		}
+	}
+}
+
+func (m *InstanceMonitor) terminate(instanceGuid, reason string) {
+	if instanceGuid == "" {
+		return
+	}
+
+	terminated := m.proxy.TerminateInstance(m.logger, instanceGuid, reason)
+	if terminated > 0 {
+		m.logger.Info("terminated-instance-connections", lager.Data{
+			"instance-guid": instanceGuid,
+			"connections":   terminated,
+		})
+	}
+}
+
+// AccessMonitor checks the access of every connection at a fixed interval
+// and ends the connections whose access has been revoked.
+type AccessMonitor struct {
+	logger   lager.Logger
+	checker  AccessChecker
+	proxy    *Proxy
+	interval time.Duration
+	clock    clock.Clock
+}
+
+func NewAccessMonitor(logger lager.Logger, checker AccessChecker, proxy *Proxy, interval time.Duration, clock clock.Clock) *AccessMonitor {
+	return &AccessMonitor{
+		logger:   logger.Session("access-monitor"),
+		checker:  checker,
+		proxy:    proxy,
+		interval: interval,
+		clock:    clock,
+	}
+}
+
+func (m *AccessMonitor) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	ticker := m.clock.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	close(ready)
+
+	for {
+		select {
+		case <-ticker.C():
+			m.proxy.CheckAccess(m.logger, m.checker)
+		case <-signals:
+			return nil
+		}
+	}
+}
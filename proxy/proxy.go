@@ -6,11 +6,16 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"strconv"
+	"strings"
 	"sync"
+	"unicode"
 	"unicode/utf8"
 
 	loggingclient "code.cloudfoundry.org/diego-logging-client"
 	"code.cloudfoundry.org/diego-ssh/helpers"
+	"code.cloudfoundry.org/diego-ssh/server"
+	"code.cloudfoundry.org/diego-ssh/sftpserver"
 	"code.cloudfoundry.org/lager"
 	"golang.org/x/crypto/ssh"
 )
@@ -33,20 +38,42 @@ type TargetConfig struct {
 	PrivateKey          string `json:"private_key,omitempty"`
 }
 
+// A requestInterceptor handles a channel request instead of the proxy
+// forwarding it, and reports whether it did so.
+type requestInterceptor func(req *ssh.Request) bool
+
+// An InstanceTarget is one of the instances that a fan-out connection runs
+// commands on.
+type InstanceTarget struct {
+	Index        int          `json:"index"`
+	TargetConfig TargetConfig `json:"target_config"`
+	LogMessage   *LogMessage  `json:"log_message,omitempty"`
+}
+
 type LogMessage struct {
 	Message string            `json:"message"`
 	Tags    map[string]string `json:"tags"`
 }
 
 type Proxy struct {
-	logger       lager.Logger
+	logger lager.Logger
+
+	configLock   *sync.Mutex
 	serverConfig *ssh.ServerConfig
+	tlsConfig    *tls.Config
+	hostKeys     []ssh.Signer
+	accessGrants *AccessGrants
 
 	connectionLock *sync.Mutex
 	connections    int
 	metronClient   loggingclient.IngressClient
 
-	tlsConfig *tls.Config
+	liveLock *sync.Mutex
+	live     map[*liveConnection]struct{}
+
+	limitsLock    *sync.Mutex
+	sessionLimits SessionLimits
+	fanOutWorkers int
 }
 
 func New(
@@ -57,24 +84,61 @@ func New(
 ) *Proxy {
 	return &Proxy{
 		logger:         logger,
+		configLock:     &sync.Mutex{},
 		serverConfig:   serverConfig,
+		tlsConfig:      tlsConfig,
 		connectionLock: &sync.Mutex{},
 		metronClient:   metronClient,
-		tlsConfig:      tlsConfig,
+		liveLock:       &sync.Mutex{},
+		live:           map[*liveConnection]struct{}{},
+		limitsLock:     &sync.Mutex{},
 	}
 }
 
+// Reconfigure replaces the ssh server config, the backend TLS config and the
+// host keys that are announced to clients, all at once. Connections that are
+// opened from now on use the new configs; open connections keep the ones
+// they started with.
+func (p *Proxy) Reconfigure(serverConfig *ssh.ServerConfig, tlsConfig *tls.Config, hostKeys []ssh.Signer) {
+	p.configLock.Lock()
+	defer p.configLock.Unlock()
+
+	p.serverConfig = serverConfig
+	p.tlsConfig = tlsConfig
+	p.hostKeys = hostKeys
+}
+
+func (p *Proxy) configs() (*ssh.ServerConfig, *tls.Config, []ssh.Signer) {
+	p.configLock.Lock()
+	defer p.configLock.Unlock()
+
+	return p.serverConfig, p.tlsConfig, p.hostKeys
+}
+
 func (p *Proxy) HandleConnection(netConn net.Conn) {
 	logger := p.logger.Session("handle-connection")
 	defer netConn.Close()
 
-	serverConn, serverChannels, serverRequests, err := ssh.NewServerConn(netConn, p.serverConfig)
+	serverConfig, tlsConfig, hostKeys := p.configs()
+
+	serverConn, serverChannels, serverRequests, err := ssh.NewServerConn(netConn, serverConfig)
 	if err != nil {
 		return
 	}
 	defer serverConn.Close()
 
-	clientConn, clientChannels, clientRequests, err := NewClientConn(logger, serverConn.Permissions, p.tlsConfig)
+	server.HandshakeComplete(netConn)
+
+	accessGrant := p.takeAccessGrant(serverConn)
+
+	announceHostKeys(logger, serverConn, hostKeys)
+
+	if serverConn.Permissions != nil && serverConn.Permissions.CriticalOptions["proxy-instance-targets"] != "" {
+		p.handleFanOut(logger, serverConn, tlsConfig, hostKeys, accessGrant, serverChannels, serverRequests)
+		return
+	}
+
+	clientConn, clientChannels, clientRequests, err := NewClientConn(logger, serverConn.Permissions, tlsConfig)
 	if err != nil {
 		return
 	}
@@ -93,23 +157,23 @@ func (p *Proxy) HandleConnection(netConn net.Conn) {
 		p.metronClient.SendAppLog(logMessage.Message, "SSH", logMessage.Tags)
 	}
 
+	live := p.register(serverConn, serverConn.Permissions.CriticalOptions["instance-guid"], accessGrant, logMessage)
+	defer p.unregister(live)
+
+	limitsDone := make(chan struct{})
+	defer close(limitsDone)
+	go p.enforceLimits(logger, live, p.limitsFor(logger, serverConn.Permissions), limitsDone)
+
 	fromClientLogger := logger.Session("from-client")
 	fromDaemonLogger := logger.Session("from-daemon")
 
-	go ProxyGlobalRequests(fromClientLogger, clientConn, serverRequests)
+	go proxyGlobalRequests(fromClientLogger, clientConn, serverRequests, interceptHostKeysProve(logger, serverConn, hostKeys))
 	go ProxyGlobalRequests(fromDaemonLogger, serverConn, clientRequests)
 
-	go ProxyChannels(fromClientLogger, clientConn, serverChannels)
+	go proxyChannels(fromClientLogger, clientConn, serverChannels, p.interceptSFTPSummary(logger, logMessage), live)
 	go ProxyChannels(fromDaemonLogger, serverConn, clientChannels)
 
-	p.connectionLock.Lock()
-	p.connections++
-	err = p.metronClient.SendMetric(sshConnectionsMetric, p.connections)
-	if err != nil {
-		logger.Error("failed-to-send-ssh-connections-metric", err)
-	}
-	p.connectionLock.Unlock()
-
+	p.emitConnectionOpened(logger)
 	defer func() {
 		p.emitConnectionClosing(logger)
 	}()
@@ -117,6 +181,17 @@ func (p *Proxy) HandleConnection(netConn net.Conn) {
 	Wait(logger, serverConn, clientConn)
 }
 
+func (p *Proxy) emitConnectionOpened(logger lager.Logger) {
+	p.connectionLock.Lock()
+	p.connections++
+	err := p.metronClient.SendMetric(sshConnectionsMetric, p.connections)
+	p.connectionLock.Unlock()
+
+	if err != nil {
+		logger.Error("failed-to-send-ssh-connections-metric", err)
+	}
+}
+
 func (p *Proxy) emitConnectionClosing(logger lager.Logger) {
 	p.connectionLock.Lock()
 	p.connections--
@@ -128,6 +203,72 @@ func (p *Proxy) emitConnectionClosing(logger lager.Logger) {
 	}
 }
 
+// sftpSummarySourceType is the source type of SFTP summaries in the app logs.
+// The summaries are reported by the daemon in the container, which the app
+// controls, so they are kept apart from the messages of the proxy itself.
+const sftpSummarySourceType = "APP/SSH"
+
+// interceptSFTPSummary sends the transfer summary of SFTP sessions to the app
+// logs. The summary is meant for the proxy and is not passed on to the client.
+func (p *Proxy) interceptSFTPSummary(logger lager.Logger, logMessage *LogMessage) requestInterceptor {
+	return func(req *ssh.Request) bool {
+		if req.Type != sftpserver.SummaryRequest {
+			return false
+		}
+
+		if req.WantReply {
+			req.Reply(true, nil)
+		}
+
+		summary, err := sftpserver.ParseSummary(req.Payload)
+		if err != nil {
+			logger.Error("invalid-sftp-summary", err)
+			return true
+		}
+
+		if logMessage != nil {
+			p.metronClient.SendAppLog(sftpSummaryMessage(summary), sftpSummarySourceType, logMessage.Tags)
+		}
+
+		return true
+	}
+}
+
+func sftpSummaryMessage(summary sftpserver.Summary) string {
+	var parts []string
+	if len(summary.Uploaded) > 0 {
+		parts = append(parts, "uploaded "+formatTransfers(summary.Uploaded))
+	}
+	if len(summary.Downloaded) > 0 {
+		parts = append(parts, "downloaded "+formatTransfers(summary.Downloaded))
+	}
+
+	if summary.Omitted > 0 {
+		parts = append(parts, fmt.Sprintf("%d more files", summary.Omitted))
+	}
+
+	return "SFTP transfers: " + strings.Join(parts, "; ")
+}
+
+func formatTransfers(transfers []sftpserver.Transfer) string {
+	formatted := make([]string, len(transfers))
+	for i, transfer := range transfers {
+		formatted[i] = fmt.Sprintf("%s (%d bytes)", formatPath(transfer.Path), transfer.Bytes)
+	}
+	return strings.Join(formatted, ", ")
+}
+
+// formatPath quotes paths that could break up the log line or pass for
+// another message.
+func formatPath(path string) string {
+	for _, r := range path {
+		if !unicode.IsPrint(r) {
+			return strconv.Quote(path)
+		}
+	}
+	return path
+}
+
 func extractLogMessage(logger lager.Logger, perms *ssh.Permissions) *LogMessage {
 	logMessageJson := perms.CriticalOptions["log-message"]
 	if logMessageJson == "" {
@@ -145,6 +286,10 @@ func extractLogMessage(logger lager.Logger, perms *ssh.Permissions) *LogMessage
 }
 
 func ProxyGlobalRequests(logger lager.Logger, conn ssh.Conn, reqs <-chan *ssh.Request) {
+	proxyGlobalRequests(logger, conn, reqs, nil)
+}
+
+func proxyGlobalRequests(logger lager.Logger, conn ssh.Conn, reqs <-chan *ssh.Request, intercept requestInterceptor) {
 	logger = logger.Session("proxy-global-requests")
 
 	logger.Info("started")
@@ -157,6 +302,10 @@ func ProxyGlobalRequests(logger lager.Logger, conn ssh.Conn, reqs <-chan *ssh.Re
 			"payload":   req.Payload,
 		})
 
+		if intercept != nil && intercept(req) {
+			continue
+		}
+
 		success, reply, err := conn.SendRequest(req.Type, req.WantReply, req.Payload)
 		if err != nil {
 			logger.Error("send-request-failed", err)
@@ -170,6 +319,10 @@ func ProxyGlobalRequests(logger lager.Logger, conn ssh.Conn, reqs <-chan *ssh.Re
 }
 
 func ProxyChannels(logger lager.Logger, conn ssh.Conn, channels <-chan ssh.NewChannel) {
+	proxyChannels(logger, conn, channels, nil, nil)
+}
+
+func proxyChannels(logger lager.Logger, conn ssh.Conn, channels <-chan ssh.NewChannel, fromTarget requestInterceptor, live *liveConnection) {
 	logger = logger.Session("proxy-channels")
 
 	logger.Info("started")
@@ -179,11 +332,11 @@ func ProxyChannels(logger lager.Logger, conn ssh.Conn, channels <-chan ssh.NewCh
 	}()
 
 	for newChannel := range channels {
-		handleNewChannel(logger, conn, newChannel)
+		handleNewChannel(logger, conn, newChannel, fromTarget, live)
 	}
 }
 
-func handleNewChannel(logger lager.Logger, conn ssh.Conn, newChannel ssh.NewChannel) {
+func handleNewChannel(logger lager.Logger, conn ssh.Conn, newChannel ssh.NewChannel, fromTarget requestInterceptor, live *liveConnection) {
 	logger.Info("new-channel", lager.Data{
 		"channelType": newChannel.ChannelType(),
 		"extraData":   newChannel.ExtraData(),
@@ -217,26 +370,34 @@ func handleNewChannel(logger lager.Logger, conn ssh.Conn, newChannel ssh.NewChan
 	sourceWg := &sync.WaitGroup{}
 
 	targetWg.Add(2)
-	go helpers.Copy(toTargetLogger.Session("stdout"), targetWg, targetChan, sourceChan)
-	go helpers.Copy(toTargetLogger.Session("stderr"), targetWg, targetChan.Stderr(), sourceChan.Stderr())
+	go helpers.Copy(toTargetLogger.Session("stdout"), targetWg, live.observe(targetChan), sourceChan)
+	go helpers.Copy(toTargetLogger.Session("stderr"), targetWg, live.observe(targetChan.Stderr()), sourceChan.Stderr())
 	go func() {
 		targetWg.Wait()
 		targetChan.CloseWrite()
 	}()
 
 	sourceWg.Add(2)
-	go helpers.Copy(toSourceLogger.Session("stdout"), sourceWg, sourceChan, targetChan)
-	go helpers.Copy(toSourceLogger.Session("stderr"), sourceWg, sourceChan.Stderr(), targetChan.Stderr())
+	go helpers.Copy(toSourceLogger.Session("stdout"), sourceWg, live.observe(sourceChan), targetChan)
+	go helpers.Copy(toSourceLogger.Session("stderr"), sourceWg, live.observe(sourceChan.Stderr()), targetChan.Stderr())
 	go func() {
 		sourceWg.Wait()
 		sourceChan.CloseWrite()
 	}()
 
 	go ProxyRequests(toTargetLogger, newChannel.ChannelType(), sourceReqs, targetChan, targetWg)
-	go ProxyRequests(toSourceLogger, newChannel.ChannelType(), targetReqs, sourceChan, sourceWg)
+	untrack := live.track(sourceChan)
+	go func() {
+		proxyRequests(toSourceLogger, newChannel.ChannelType(), targetReqs, sourceChan, sourceWg, fromTarget)
+		untrack()
+	}()
 }
 
 func ProxyRequests(logger lager.Logger, channelType string, reqs <-chan *ssh.Request, channel ssh.Channel, wg *sync.WaitGroup) {
+	proxyRequests(logger, channelType, reqs, channel, wg, nil)
+}
+
+func proxyRequests(logger lager.Logger, channelType string, reqs <-chan *ssh.Request, channel ssh.Channel, wg *sync.WaitGroup, intercept requestInterceptor) {
 	logger = logger.Session("proxy-requests", lager.Data{
 		"channel-type": channelType,
 	})
@@ -254,6 +415,11 @@ func ProxyRequests(logger lager.Logger, channelType string, reqs <-chan *ssh.Req
 			"wantReply": req.WantReply,
 			"payload":   req.Payload,
 		})
+
+		if intercept != nil && intercept(req) {
+			continue
+		}
+
 		success, err := channel.SendRequest(req.Type, req.WantReply, req.Payload)
 		if err != nil {
 			logger.Error("send-request-failed", err)
@@ -303,6 +469,10 @@ func NewClientConn(logger lager.Logger, permissions *ssh.Permissions, tlsConfig
 		return nil, nil, nil, err
 	}
 
+	return dialTarget(logger, targetConfig, tlsConfig)
+}
+
+func dialTarget(logger lager.Logger, targetConfig TargetConfig, tlsConfig *tls.Config) (ssh.Conn, <-chan ssh.NewChannel, <-chan *ssh.Request, error) {
 	dialer := func() (net.Conn, error) {
 		tlsConfig := tlsConfigWithServerName(tlsConfig, targetConfig.ServerCertDomainSAN)
 		if tlsConfig != nil && targetConfig.TLSAddress != "" {
@@ -1,16 +1,25 @@
 package proxy_test
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
+	"code.cloudfoundry.org/bbs/events/eventfakes"
+	"code.cloudfoundry.org/bbs/fake_bbs"
+	"code.cloudfoundry.org/bbs/models"
+	"code.cloudfoundry.org/clock"
 	mfakes "code.cloudfoundry.org/diego-logging-client/testhelpers"
 	"code.cloudfoundry.org/diego-ssh/authenticators/fake_authenticators"
 	"code.cloudfoundry.org/diego-ssh/daemon"
@@ -20,6 +29,7 @@ import (
 	"code.cloudfoundry.org/diego-ssh/proxy"
 	"code.cloudfoundry.org/diego-ssh/server"
 	server_fakes "code.cloudfoundry.org/diego-ssh/server/fakes"
+	"code.cloudfoundry.org/diego-ssh/sftpserver"
 	"code.cloudfoundry.org/diego-ssh/test_helpers"
 	"code.cloudfoundry.org/diego-ssh/test_helpers/fake_net"
 	"code.cloudfoundry.org/diego-ssh/test_helpers/fake_ssh"
@@ -31,6 +41,7 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/onsi/gomega/gbytes"
+	"github.com/tedsuo/ifrit"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -48,6 +59,7 @@ var _ = Describe("Proxy", func() {
 		var (
 			proxyAuthenticator *fake_authenticators.FakePasswordAuthenticator
 			proxySSHConfig     *ssh.ServerConfig
+			accessGrants       *proxy.AccessGrants
 			sshProxy           *proxy.Proxy
 
 			daemonTargetConfig          proxy.TargetConfig
@@ -68,6 +80,9 @@ var _ = Describe("Proxy", func() {
 
 			proxyDone  chan struct{}
 			daemonDone chan struct{}
+
+			proxyPermissions *ssh.Permissions
+			sessionLimits    proxy.SessionLimits
 		)
 
 		BeforeEach(func() {
@@ -77,6 +92,7 @@ var _ = Describe("Proxy", func() {
 			fakeMetronClient = &mfakes.FakeIngressClient{}
 
 			proxyAuthenticator = &fake_authenticators.FakePasswordAuthenticator{}
+			accessGrants = proxy.NewAccessGrants()
 
 			proxySSHConfig = &ssh.ServerConfig{}
 			proxySSHConfig.PasswordCallback = proxyAuthenticator.Authenticate
@@ -119,17 +135,22 @@ var _ = Describe("Proxy", func() {
 			})
 			Expect(err).NotTo(HaveOccurred())
 
-			permissions := &ssh.Permissions{
+			proxyPermissions = &ssh.Permissions{
 				CriticalOptions: map[string]string{
 					"proxy-target-config": string(targetConfigJson),
 					"log-message":         string(logMessageJson),
+					"instance-guid":       "some-instance-guid",
 				},
 			}
-			proxyAuthenticator.AuthenticateReturns(permissions, nil)
+			proxyAuthenticator.AuthenticateReturns(proxyPermissions, nil)
+
+			sessionLimits = proxy.SessionLimits{}
 		})
 
 		JustBeforeEach(func() {
 			sshProxy = proxy.New(logger.Session("proxy"), proxySSHConfig, fakeMetronClient, nil)
+			sshProxy.SetSessionLimits(sessionLimits)
+			sshProxy.SetAccessGrants(accessGrants)
 			proxyServer = server.NewServer(logger.Session("proxy-server"), "", sshProxy, 500*time.Millisecond)
 			proxyServer.SetListener(proxyListener)
 			go func() {
@@ -436,6 +457,85 @@ var _ = Describe("Proxy", func() {
 				})
 			})
 
+			Describe("host keys", func() {
+				var (
+					rotatedHostKey ssh.Signer
+					clientConn     ssh.Conn
+					clientRequests <-chan *ssh.Request
+				)
+
+				BeforeEach(func() {
+					_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+					Expect(err).NotTo(HaveOccurred())
+
+					rotatedHostKey, err = ssh.NewSignerFromKey(privateKey)
+					Expect(err).NotTo(HaveOccurred())
+				})
+
+				JustBeforeEach(func() {
+					sshProxy.Reconfigure(proxySSHConfig, nil, []ssh.Signer{TestHostKey, rotatedHostKey})
+
+					clientNetConn, err := net.Dial("tcp", proxyAddress)
+					Expect(err).NotTo(HaveOccurred())
+
+					clientConn, _, clientRequests, err = ssh.NewClientConn(clientNetConn, proxyAddress, clientConfig)
+					Expect(err).NotTo(HaveOccurred())
+				})
+
+				AfterEach(func() {
+					clientConn.Close()
+				})
+
+				It("announces all host keys after authentication", func() {
+					var req *ssh.Request
+					Eventually(clientRequests).Should(Receive(&req))
+
+					Expect(req.Type).To(Equal("hostkeys-00@openssh.com"))
+					Expect(req.WantReply).To(BeFalse())
+
+					expectedPayload := append(
+						ssh.Marshal(struct{ Key []byte }{TestHostKey.PublicKey().Marshal()}),
+						ssh.Marshal(struct{ Key []byte }{rotatedHostKey.PublicKey().Marshal()})...,
+					)
+					Expect(req.Payload).To(Equal(expectedPayload))
+				})
+
+				It("proves that it holds the announced host keys", func() {
+					blob := rotatedHostKey.PublicKey().Marshal()
+
+					accepted, response, err := clientConn.SendRequest("hostkeys-prove-00@openssh.com", true, ssh.Marshal(struct{ Key []byte }{blob}))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(accepted).To(BeTrue())
+
+					var proof struct{ Signature []byte }
+					Expect(ssh.Unmarshal(response, &proof)).To(Succeed())
+
+					var signature ssh.Signature
+					Expect(ssh.Unmarshal(proof.Signature, &signature)).To(Succeed())
+
+					signedData := ssh.Marshal(struct {
+						Request   string
+						SessionID []byte
+						Key       []byte
+					}{"hostkeys-prove-00@openssh.com", clientConn.SessionID(), blob})
+					Expect(rotatedHostKey.PublicKey().Verify(signedData, &signature)).To(Succeed())
+				})
+
+				Context("when the client asks for a key that was not announced", func() {
+					It("rejects the request", func() {
+						_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+						Expect(err).NotTo(HaveOccurred())
+
+						unknownKey, err := ssh.NewSignerFromKey(privateKey)
+						Expect(err).NotTo(HaveOccurred())
+
+						accepted, _, err := clientConn.SendRequest("hostkeys-prove-00@openssh.com", true, ssh.Marshal(struct{ Key []byte }{unknownKey.PublicKey().Marshal()}))
+						Expect(err).NotTo(HaveOccurred())
+						Expect(accepted).To(BeFalse())
+					})
+				})
+			})
+
 			Describe("target requests to client", func() {
 				var (
 					connectionHandler *server_fakes.FakeConnectionHandler
@@ -628,6 +728,313 @@ var _ = Describe("Proxy", func() {
 				})
 			})
 
+			Describe("ending connections", func() {
+				var (
+					client  *ssh.Client
+					session *ssh.Session
+					stderr  *gbytes.Buffer
+					waitErr chan error
+					command string
+				)
+
+				BeforeEach(func() {
+					command = "sleep 10"
+					daemonNewChannelHandlers["session"] = handlers.NewSessionChannelHandler(
+						handlers.NewCommandRunner(),
+						handlers.NewShellLocator(),
+						map[string]string{},
+						time.Second,
+						handlers.SessionOptions{},
+					)
+				})
+
+				JustBeforeEach(func() {
+					var err error
+					client, err = ssh.Dial("tcp", proxyAddress, clientConfig)
+					Expect(err).NotTo(HaveOccurred())
+
+					session, err = client.NewSession()
+					Expect(err).NotTo(HaveOccurred())
+
+					stderr = gbytes.NewBuffer()
+					session.Stderr = stderr
+
+					Expect(session.Start(command)).To(Succeed())
+
+					waitErr = make(chan error, 1)
+					go func() {
+						waitErr <- session.Wait()
+					}()
+				})
+
+				AfterEach(func() {
+					client.Close()
+				})
+
+				Describe("TerminateInstance", func() {
+					It("ends the connections to the instance and tells the client why", func() {
+						Eventually(func() int {
+							return sshProxy.TerminateInstance(logger, "some-instance-guid", "the app instance has stopped")
+						}).Should(Equal(1))
+
+						Eventually(waitErr).Should(Receive(HaveOccurred()))
+						Expect(stderr).To(gbytes.Say("Connection closed by ssh-proxy: the app instance has stopped"))
+
+						Expect(logger).To(gbytes.Say("terminated-connection.*the app instance has stopped"))
+
+						Eventually(fakeMetronClient.SendAppLogCallCount).Should(BeNumerically(">=", 2))
+						message, sourceType, tags := fakeMetronClient.SendAppLogArgsForCall(1)
+						Expect(message).To(MatchRegexp("Remote access by .* terminated: the app instance has stopped"))
+						Expect(sourceType).To(Equal("SSH"))
+						Expect(tags["instance_id"]).To(Equal("1"))
+					})
+
+					It("leaves connections to other instances open", func() {
+						Expect(sshProxy.TerminateInstance(logger, "other-instance-guid", "stopped")).To(Equal(0))
+						Consistently(waitErr).ShouldNot(Receive())
+					})
+				})
+
+				Describe("Reconfigure", func() {
+					It("uses the new config for new connections and leaves open connections alone", func() {
+						rotatedAuthenticator := &fake_authenticators.FakePasswordAuthenticator{}
+						rotatedAuthenticator.AuthenticateReturns(nil, errors.New("rotated"))
+
+						rotatedSSHConfig := &ssh.ServerConfig{}
+						rotatedSSHConfig.PasswordCallback = rotatedAuthenticator.Authenticate
+						rotatedSSHConfig.AddHostKey(TestHostKey)
+
+						sshProxy.Reconfigure(rotatedSSHConfig, nil, nil)
+
+						_, err := ssh.Dial("tcp", proxyAddress, clientConfig)
+						Expect(err).To(HaveOccurred())
+						Expect(rotatedAuthenticator.AuthenticateCallCount()).To(BeNumerically(">=", 1))
+
+						otherSession, err := client.NewSession()
+						Expect(err).NotTo(HaveOccurred())
+						Expect(otherSession.Output("echo still here")).To(Equal([]byte("still here\n")))
+
+						Consistently(waitErr).ShouldNot(Receive())
+					})
+				})
+
+				Describe("session limits", func() {
+					Context("when the session is idle for too long", func() {
+						BeforeEach(func() {
+							sessionLimits = proxy.SessionLimits{
+								IdleTimeout: 500 * time.Millisecond,
+								Warning:     300 * time.Millisecond,
+							}
+						})
+
+						It("warns the client and ends the connection", func() {
+							Eventually(stderr).Should(gbytes.Say("ssh-proxy: this session will be closed in .* unless there is activity"))
+							Consistently(waitErr, 100*time.Millisecond).ShouldNot(Receive())
+
+							Eventually(waitErr).Should(Receive(HaveOccurred()))
+							Expect(stderr).To(gbytes.Say("Connection closed by ssh-proxy: the session has been idle for 500ms"))
+						})
+					})
+
+					Context("when there is channel data", func() {
+						BeforeEach(func() {
+							command = "for i in $(seq 20); do echo tick; sleep 0.1; done"
+							sessionLimits = proxy.SessionLimits{
+								IdleTimeout: 500 * time.Millisecond,
+							}
+						})
+
+						It("does not consider the session idle", func() {
+							Consistently(waitErr, time.Second).ShouldNot(Receive())
+						})
+					})
+
+					Context("when the session reaches its maximum duration", func() {
+						BeforeEach(func() {
+							command = "for i in $(seq 100); do echo tick; sleep 0.1; done"
+							sessionLimits = proxy.SessionLimits{
+								MaxDuration: 700 * time.Millisecond,
+								Warning:     500 * time.Millisecond,
+							}
+						})
+
+						It("warns the client and ends the connection despite the activity", func() {
+							Eventually(stderr).Should(gbytes.Say(`ssh-proxy: this session will be closed in .* \(maximum duration 700ms\)`))
+
+							Eventually(waitErr, 2*time.Second).Should(Receive(HaveOccurred()))
+							Expect(stderr).To(gbytes.Say("Connection closed by ssh-proxy: the session has reached its maximum duration of 700ms"))
+						})
+					})
+
+					Context("when the permissions carry limits for the app", func() {
+						BeforeEach(func() {
+							sessionLimits = proxy.SessionLimits{
+								IdleTimeout: time.Hour,
+							}
+
+							limitsJson, err := json.Marshal(proxy.SessionLimits{IdleTimeout: 300 * time.Millisecond})
+							Expect(err).NotTo(HaveOccurred())
+							proxyPermissions.CriticalOptions["session-limits"] = string(limitsJson)
+						})
+
+						It("uses them instead of the limits of the proxy", func() {
+							Eventually(waitErr).Should(Receive(HaveOccurred()))
+							Expect(stderr).To(gbytes.Say("Connection closed by ssh-proxy: the session has been idle for 300ms"))
+						})
+					})
+
+					Context("when the permissions carry limits above the limits of the proxy", func() {
+						BeforeEach(func() {
+							sessionLimits = proxy.SessionLimits{
+								IdleTimeout: 300 * time.Millisecond,
+							}
+
+							limitsJson, err := json.Marshal(proxy.SessionLimits{IdleTimeout: time.Hour})
+							Expect(err).NotTo(HaveOccurred())
+							proxyPermissions.CriticalOptions["session-limits"] = string(limitsJson)
+						})
+
+						It("keeps the limits of the proxy", func() {
+							Eventually(waitErr).Should(Receive(HaveOccurred()))
+							Expect(stderr).To(gbytes.Say("Connection closed by ssh-proxy: the session has been idle for 300ms"))
+						})
+					})
+				})
+
+				Describe("InstanceMonitor", func() {
+					var (
+						bbsClient *fake_bbs.FakeInternalClient
+						events    chan models.Event
+						process   ifrit.Process
+					)
+
+					BeforeEach(func() {
+						events = make(chan models.Event, 1)
+
+						eventSource := &eventfakes.FakeEventSource{}
+						eventSource.NextStub = func() (models.Event, error) {
+							event, ok := <-events
+							if !ok {
+								return nil, errors.New("closed")
+							}
+							return event, nil
+						}
+
+						bbsClient = &fake_bbs.FakeInternalClient{}
+						bbsClient.SubscribeToInstanceEventsReturns(eventSource, nil)
+					})
+
+					JustBeforeEach(func() {
+						process = ifrit.Invoke(proxy.NewInstanceMonitor(logger, bbsClient, sshProxy, clock.NewClock()))
+						Eventually(fakeMetronClient.SendAppLogCallCount).Should(Equal(1))
+					})
+
+					AfterEach(func() {
+						process.Signal(os.Interrupt)
+						Eventually(process.Wait()).Should(Receive())
+						close(events)
+					})
+
+					It("ends the connections to instances that are removed", func() {
+						events <- &models.ActualLRPInstanceRemovedEvent{
+							ActualLrp: &models.ActualLRP{
+								ActualLRPInstanceKey: models.NewActualLRPInstanceKey("some-instance-guid", "some-cell-id"),
+							},
+						}
+
+						Eventually(waitErr).Should(Receive(HaveOccurred()))
+						Expect(stderr).To(gbytes.Say("Connection closed by ssh-proxy: the app instance has stopped"))
+					})
+
+					It("ends the connections to instances that are evacuated", func() {
+						events <- &models.ActualLRPInstanceChangedEvent{
+							ActualLRPInstanceKey: models.NewActualLRPInstanceKey("some-instance-guid", "some-cell-id"),
+							After: &models.ActualLRPInfo{
+								State:    models.ActualLRPStateRunning,
+								Presence: models.ActualLRP_Evacuating,
+							},
+						}
+
+						Eventually(waitErr).Should(Receive(HaveOccurred()))
+						Expect(stderr).To(gbytes.Say("Connection closed by ssh-proxy: the app instance is being moved to another cell"))
+					})
+
+					It("leaves connections open when other instances change", func() {
+						events <- &models.ActualLRPInstanceChangedEvent{
+							ActualLRPInstanceKey: models.NewActualLRPInstanceKey("other-instance-guid", "some-cell-id"),
+							After: &models.ActualLRPInfo{
+								State: models.ActualLRPStateCrashed,
+							},
+						}
+
+						Consistently(waitErr).ShouldNot(Receive())
+					})
+
+					Context("when the event stream fails", func() {
+						var failedSource *eventfakes.FakeEventSource
+
+						BeforeEach(func() {
+							failedSource = &eventfakes.FakeEventSource{}
+							failedSource.NextReturns(nil, errors.New("boom"))
+							bbsClient.SubscribeToInstanceEventsReturnsOnCall(0, failedSource, nil)
+						})
+
+						It("subscribes again and closes the failed stream only once", func() {
+							Eventually(bbsClient.SubscribeToInstanceEventsCallCount, 3*time.Second).Should(Equal(2))
+
+							process.Signal(os.Interrupt)
+							Eventually(process.Wait()).Should(Receive())
+
+							Consistently(failedSource.CloseCallCount).Should(Equal(1))
+						})
+					})
+				})
+
+				Describe("CheckAccess", func() {
+					var checkErr error
+
+					BeforeEach(func() {
+						proxyAuthenticator.AuthenticateStub = func(metadata ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+							accessGrants.Put(metadata.SessionID(), "some-grant")
+							return proxyPermissions, nil
+						}
+					})
+
+					JustBeforeEach(func() {
+						Eventually(func() []proxy.AccessGrant {
+							var checked []proxy.AccessGrant
+							sshProxy.CheckAccess(logger, proxy.AccessCheckerFunc(func(logger lager.Logger, grant proxy.AccessGrant) error {
+								checked = append(checked, grant)
+								return checkErr
+							}))
+							return checked
+						}).Should(Equal([]proxy.AccessGrant{"some-grant"}))
+					})
+
+					Context("when access has been revoked", func() {
+						BeforeEach(func() {
+							checkErr = proxy.ErrAccessRevoked
+						})
+
+						It("ends the connection", func() {
+							Eventually(waitErr).Should(Receive(HaveOccurred()))
+							Expect(stderr).To(gbytes.Say("Connection closed by ssh-proxy: SSH access to the app has been revoked"))
+						})
+					})
+
+					Context("when access cannot be checked", func() {
+						BeforeEach(func() {
+							checkErr = errors.New("cloud controller is down")
+						})
+
+						It("leaves the connection open", func() {
+							Consistently(waitErr).ShouldNot(Receive())
+							Expect(logger).To(gbytes.Say("failed-to-check-access"))
+						})
+					})
+				})
+			})
+
 			Describe("app logs", func() {
 				Context("when a connection is closed", func() {
 					It("logs that the connection has been closed", func() {
@@ -644,6 +1051,287 @@ var _ = Describe("Proxy", func() {
 						Expect(tags["instance_id"]).To(Equal("1"))
 					})
 				})
+
+				Context("when the daemon reports an sftp transfer summary", func() {
+					var summaryPayload []byte
+
+					BeforeEach(func() {
+						summary := sftpserver.Summary{
+							Uploaded:   []sftpserver.Transfer{{Path: "/tmp/upload", Bytes: 10}},
+							Downloaded: []sftpserver.Transfer{{Path: "/tmp/a", Bytes: 5}, {Path: "/tmp/b", Bytes: 7}},
+						}
+						summaryPayload = summary.Payload()
+
+						sessionHandler := &fake_handlers.FakeNewChannelHandler{}
+						sessionHandler.HandleNewChannelStub = func(logger lager.Logger, newChannel ssh.NewChannel) {
+							channel, requests, err := newChannel.Accept()
+							if err != nil {
+								return
+							}
+							go ssh.DiscardRequests(requests)
+
+							channel.SendRequest(sftpserver.SummaryRequest, false, summaryPayload)
+							channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+							channel.Close()
+						}
+						daemonNewChannelHandlers["session"] = sessionHandler
+					})
+
+					It("sends it to the app logs instead of the client", func() {
+						client, err := ssh.Dial("tcp", proxyAddress, clientConfig)
+						Expect(err).NotTo(HaveOccurred())
+						defer client.Close()
+
+						_, requests, err := client.OpenChannel("session", nil)
+						Expect(err).NotTo(HaveOccurred())
+
+						var requestTypes []string
+						for req := range requests {
+							requestTypes = append(requestTypes, req.Type)
+						}
+						Expect(requestTypes).To(Equal([]string{"exit-status"}))
+
+						Eventually(fakeMetronClient.SendAppLogCallCount).Should(BeNumerically(">=", 2))
+						message, sourceType, tags := fakeMetronClient.SendAppLogArgsForCall(1)
+						Expect(message).To(Equal("SFTP transfers: uploaded /tmp/upload (10 bytes); downloaded /tmp/a (5 bytes), /tmp/b (7 bytes)"))
+						Expect(sourceType).To(Equal("APP/SSH"))
+						Expect(tags["source_id"]).To(Equal("a-guid"))
+					})
+
+					Context("when the summary is not well formed", func() {
+						BeforeEach(func() {
+							summaryPayload = ssh.Marshal(struct{ Summary string }{`{"uploaded": [{"path": "/tmp/upload", "bytes": -1}]}`})
+						})
+
+						It("drops it", func() {
+							client, err := ssh.Dial("tcp", proxyAddress, clientConfig)
+							Expect(err).NotTo(HaveOccurred())
+							defer client.Close()
+
+							_, requests, err := client.OpenChannel("session", nil)
+							Expect(err).NotTo(HaveOccurred())
+							for range requests {
+							}
+
+							Eventually(logger).Should(gbytes.Say("invalid-sftp-summary"))
+							Consistently(fakeMetronClient.SendAppLogCallCount).Should(Equal(1))
+						})
+					})
+				})
+			})
+		})
+
+		Context("when the client is authenticated for all instances", func() {
+			var (
+				clientConfig *ssh.ClientConfig
+				targets      []proxy.InstanceTarget
+			)
+
+			BeforeEach(func() {
+				clientConfig = &ssh.ClientConfig{
+					User:            "cf:some-app-guid/*",
+					Auth:            []ssh.AuthMethod{ssh.Password("code")},
+					HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+				}
+
+				daemonNewChannelHandlers["session"] = handlers.NewSessionChannelHandler(
+					handlers.NewCommandRunner(),
+					handlers.NewShellLocator(),
+					map[string]string{},
+					time.Second,
+					handlers.SessionOptions{},
+				)
+
+				targets = []proxy.InstanceTarget{}
+				for _, index := range []int{1, 0} {
+					targetConfig := daemonTargetConfig
+					targetConfig.User = fmt.Sprintf("user-%d", index)
+					targets = append(targets, proxy.InstanceTarget{
+						Index:        index,
+						TargetConfig: targetConfig,
+						LogMessage: &proxy.LogMessage{
+							Message: "a-message",
+							Tags:    map[string]string{"instance_id": fmt.Sprintf("%d", index)},
+						},
+					})
+				}
+			})
+
+			JustBeforeEach(func() {
+				targetsJson, err := json.Marshal(targets)
+				Expect(err).NotTo(HaveOccurred())
+
+				proxyAuthenticator.AuthenticateReturns(&ssh.Permissions{
+					CriticalOptions: map[string]string{
+						"proxy-instance-targets": string(targetsJson),
+					},
+				}, nil)
+			})
+
+			run := func(command string) (string, string, error) {
+				client, err := ssh.Dial("tcp", proxyAddress, clientConfig)
+				Expect(err).NotTo(HaveOccurred())
+				defer client.Close()
+
+				session, err := client.NewSession()
+				Expect(err).NotTo(HaveOccurred())
+
+				stdout := &bytes.Buffer{}
+				stderr := &bytes.Buffer{}
+				session.Stdout = stdout
+				session.Stderr = stderr
+
+				err = session.Run(command)
+				return stdout.String(), stderr.String(), err
+			}
+
+			It("runs the command on every instance and prefixes the output with the index", func() {
+				stdout, stderr, err := run("echo hello; echo -n world")
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(stdout).To(ContainSubstring("[0] hello\n"))
+				Expect(stdout).To(ContainSubstring("[0] world\n"))
+				Expect(stdout).To(ContainSubstring("[1] hello\n"))
+				Expect(stdout).To(ContainSubstring("[1] world\n"))
+				Expect(stderr).To(Equal("2 of 2 instances succeeded\n"))
+
+				Expect(daemonAuthenticator.AuthenticateCallCount()).To(Equal(2))
+				users := []string{}
+				for i := 0; i < 2; i++ {
+					metadata, _ := daemonAuthenticator.AuthenticateArgsForCall(i)
+					users = append(users, metadata.User())
+				}
+				Expect(users).To(ConsistOf("user-0", "user-1"))
+			})
+
+			It("writes long lines without newlines in prefixed parts", func() {
+				stdout, _, err := run("head -c 150000 /dev/zero | tr '\\0' a")
+				Expect(err).NotTo(HaveOccurred())
+
+				lines := strings.Split(strings.TrimSuffix(stdout, "\n"), "\n")
+				Expect(lines).To(HaveLen(6))
+				for _, line := range lines {
+					Expect(line).To(MatchRegexp(`^\[[01]\] a+$`))
+					Expect(len(line)).To(BeNumerically("<=", 64*1024+4))
+				}
+			})
+
+			It("logs the access for every instance", func() {
+				_, _, err := run("true")
+				Expect(err).NotTo(HaveOccurred())
+
+				Eventually(fakeMetronClient.SendAppLogCallCount).Should(Equal(4))
+				instances := []string{}
+				for i := 0; i < 2; i++ {
+					message, _, tags := fakeMetronClient.SendAppLogArgsForCall(i)
+					Expect(message).To(Equal("a-message"))
+					instances = append(instances, tags["instance_id"])
+				}
+				Expect(instances).To(Equal([]string{"0", "1"}))
+			})
+
+			It("reports the instances that failed and their exit status", func() {
+				_, stderr, err := run("exit 3")
+				Expect(err).To(HaveOccurred())
+
+				exitErr, ok := err.(*ssh.ExitError)
+				Expect(ok).To(BeTrue())
+				Expect(exitErr.ExitStatus()).To(Equal(3))
+
+				Expect(stderr).To(Equal("[0] exited with status 3\n[1] exited with status 3\n0 of 2 instances succeeded\n"))
+			})
+
+			Context("when an instance cannot be reached", func() {
+				BeforeEach(func() {
+					targets[0].TargetConfig.Address = "127.0.0.1:1"
+				})
+
+				It("reports the failure and the combined exit status", func() {
+					stdout, stderr, err := run("echo hello")
+					Expect(err).To(HaveOccurred())
+
+					exitErr, ok := err.(*ssh.ExitError)
+					Expect(ok).To(BeTrue())
+					Expect(exitErr.ExitStatus()).To(Equal(255))
+
+					Expect(stdout).To(Equal("[0] hello\n"))
+					Expect(stderr).To(ContainSubstring("[1] failed: "))
+					Expect(stderr).To(HaveSuffix("1 of 2 instances succeeded\n"))
+				})
+			})
+
+			Context("when there are more instances than workers", func() {
+				var (
+					lock       sync.Mutex
+					running    int
+					maxRunning int
+				)
+
+				BeforeEach(func() {
+					running, maxRunning = 0, 0
+
+					for _, index := range []int{2, 3, 4} {
+						target := targets[0]
+						target.Index = index
+						targets = append(targets, target)
+					}
+
+					sessionHandler := &fake_handlers.FakeNewChannelHandler{}
+					sessionHandler.HandleNewChannelStub = func(logger lager.Logger, newChannel ssh.NewChannel) {
+						channel, requests, err := newChannel.Accept()
+						if err != nil {
+							return
+						}
+						defer channel.Close()
+
+						for req := range requests {
+							if req.WantReply {
+								req.Reply(true, nil)
+							}
+							if req.Type != "exec" {
+								continue
+							}
+
+							lock.Lock()
+							running++
+							if running > maxRunning {
+								maxRunning = running
+							}
+							lock.Unlock()
+
+							time.Sleep(100 * time.Millisecond)
+
+							lock.Lock()
+							running--
+							lock.Unlock()
+
+							channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+							return
+						}
+					}
+					daemonNewChannelHandlers["session"] = sessionHandler
+				})
+
+				It("runs the command on at most that many instances at a time", func() {
+					sshProxy.SetFanOutWorkers(2)
+
+					_, stderr, err := run("true")
+					Expect(err).NotTo(HaveOccurred())
+					Expect(stderr).To(Equal("5 of 5 instances succeeded\n"))
+
+					lock.Lock()
+					defer lock.Unlock()
+					Expect(maxRunning).To(Equal(2))
+				})
+			})
+
+			It("rejects channels other than sessions", func() {
+				client, err := ssh.Dial("tcp", proxyAddress, clientConfig)
+				Expect(err).NotTo(HaveOccurred())
+				defer client.Close()
+
+				_, err = client.Dial("tcp", "127.0.0.1:80")
+				Expect(err).To(MatchError(ContainSubstring("only commands can be run on all instances")))
 			})
 		})
 	})
@@ -0,0 +1,300 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrAccessRevoked is returned by an AccessChecker when the user that opened
+// a connection may no longer access the app.
+var ErrAccessRevoked = errors.New("SSH access revoked")
+
+// accessGrantTimeout is how long a grant waits for its handshake to
+// complete. Grants of handshakes that failed after authentication are dropped
+// once it has passed.
+const accessGrantTimeout = time.Minute
+
+// An AccessGrant is what an authenticator needs to check the access of a
+// connection again, such as the tokens of the user. Grants are kept by the
+// proxy instead of in the ssh.Permissions of the connection, which are
+// shared by the code that serves the connection, so that they may hold
+// secrets and may be updated.
+type AccessGrant interface{}
+
+// An AccessChecker checks again whether the grant that a connection was
+// authenticated with still holds. It may update the grant, for example to
+// refresh a token; the grant of a connection is never checked concurrently.
+// Errors other than ErrAccessRevoked mean that access could not be checked
+// and leave the connection open.
+type AccessChecker interface {
+	CheckAccess(logger lager.Logger, grant AccessGrant) error
+}
+
+// AccessCheckerFunc adapts a function to an AccessChecker.
+type AccessCheckerFunc func(logger lager.Logger, grant AccessGrant) error
+
+func (f AccessCheckerFunc) CheckAccess(logger lager.Logger, grant AccessGrant) error {
+	return f(logger, grant)
+}
+
+// AccessGrants passes the grants of authenticators to the proxy. Grants are
+// keyed by the session id of the connection, and the proxy takes the grant of
+// a connection once its handshake is complete.
+type AccessGrants struct {
+	lock   sync.Mutex
+	grants map[string]pendingAccessGrant
+}
+
+type pendingAccessGrant struct {
+	grant AccessGrant
+	added time.Time
+}
+
+func NewAccessGrants() *AccessGrants {
+	return &AccessGrants{
+		grants: map[string]pendingAccessGrant{},
+	}
+}
+
+// Put records the grant of the connection with the given session id.
+func (g *AccessGrants) Put(sessionID []byte, grant AccessGrant) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	now := time.Now()
+	for id, pending := range g.grants {
+		if now.Sub(pending.added) > accessGrantTimeout {
+			delete(g.grants, id)
+		}
+	}
+
+	g.grants[string(sessionID)] = pendingAccessGrant{grant: grant, added: now}
+}
+
+// Take removes the grant of the connection with the given session id and
+// returns it, or nil when the connection has none.
+func (g *AccessGrants) Take(sessionID []byte) AccessGrant {
+	if g == nil {
+		return nil
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	pending, ok := g.grants[string(sessionID)]
+	if !ok {
+		return nil
+	}
+
+	delete(g.grants, string(sessionID))
+	return pending.grant
+}
+
+// SetAccessGrants sets where the proxy takes the grants of new connections
+// from.
+func (p *Proxy) SetAccessGrants(grants *AccessGrants) {
+	p.configLock.Lock()
+	defer p.configLock.Unlock()
+
+	p.accessGrants = grants
+}
+
+func (p *Proxy) takeAccessGrant(serverConn *ssh.ServerConn) AccessGrant {
+	p.configLock.Lock()
+	grants := p.accessGrants
+	p.configLock.Unlock()
+
+	return grants.Take(serverConn.SessionID())
+}
+
+// liveConnection is a client connection that the proxy is serving. It keeps
+// the channels that the client opened so that the client can be told why the
+// connection is ended.
+type liveConnection struct {
+	// activity is the time of the last channel data in nanoseconds. It is
+	// accessed atomically and kept first to be 64-bit aligned.
+	activity int64
+	started  time.Time
+
+	serverConn   *ssh.ServerConn
+	instanceGuid string
+	logMessages  []*LogMessage
+
+	accessLock  sync.Mutex
+	accessGrant AccessGrant
+
+	lock       sync.Mutex
+	channels   map[ssh.Channel]struct{}
+	terminated bool
+}
+
+func (c *liveConnection) track(channel ssh.Channel) func() {
+	if c == nil {
+		return func() {}
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.channels[channel] = struct{}{}
+
+	return func() {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+
+		delete(c.channels, channel)
+	}
+}
+
+// snapshot returns the open channels. It must be called with the lock held.
+func (c *liveConnection) snapshot() []ssh.Channel {
+	channels := make([]ssh.Channel, 0, len(c.channels))
+	for channel := range c.channels {
+		channels = append(channels, channel)
+	}
+	return channels
+}
+
+// warn writes message to the client's channels.
+func (c *liveConnection) warn(message string) {
+	c.lock.Lock()
+	channels := c.snapshot()
+	c.lock.Unlock()
+
+	for _, channel := range channels {
+		channel.Stderr().Write([]byte(fmt.Sprintf("\r\nssh-proxy: %s\r\n", message)))
+	}
+}
+
+// terminate writes reason to the client's channels and closes the
+// connection. It reports whether the connection was still open.
+func (c *liveConnection) terminate(reason string) bool {
+	c.lock.Lock()
+	if c.terminated {
+		c.lock.Unlock()
+		return false
+	}
+	c.terminated = true
+	channels := c.snapshot()
+	c.lock.Unlock()
+
+	message := fmt.Sprintf("\r\nConnection closed by ssh-proxy: %s\r\n", reason)
+	for _, channel := range channels {
+		channel.Stderr().Write([]byte(message))
+		channel.Close()
+	}
+
+	c.serverConn.Close()
+	return true
+}
+
+// checkAccess checks the grant of the connection with checker. Connections
+// without a grant were not authenticated by an AccessChecker and are not
+// checked.
+func (c *liveConnection) checkAccess(logger lager.Logger, checker AccessChecker) error {
+	c.accessLock.Lock()
+	defer c.accessLock.Unlock()
+
+	if c.accessGrant == nil {
+		return nil
+	}
+	return checker.CheckAccess(logger, c.accessGrant)
+}
+
+func (p *Proxy) register(serverConn *ssh.ServerConn, instanceGuid string, accessGrant AccessGrant, logMessages ...*LogMessage) *liveConnection {
+	conn := &liveConnection{
+		activity:     time.Now().UnixNano(),
+		started:      time.Now(),
+		serverConn:   serverConn,
+		instanceGuid: instanceGuid,
+		accessGrant:  accessGrant,
+		channels:     map[ssh.Channel]struct{}{},
+	}
+
+	for _, logMessage := range logMessages {
+		if logMessage != nil {
+			conn.logMessages = append(conn.logMessages, logMessage)
+		}
+	}
+
+	p.liveLock.Lock()
+	p.live[conn] = struct{}{}
+	p.liveLock.Unlock()
+
+	return conn
+}
+
+func (p *Proxy) unregister(conn *liveConnection) {
+	p.liveLock.Lock()
+	delete(p.live, conn)
+	p.liveLock.Unlock()
+}
+
+func (p *Proxy) liveConnections() []*liveConnection {
+	p.liveLock.Lock()
+	defer p.liveLock.Unlock()
+
+	conns := make([]*liveConnection, 0, len(p.live))
+	for conn := range p.live {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+// TerminateInstance ends the connections to the app instance with the given
+// instance guid and returns how many were ended.
+func (p *Proxy) TerminateInstance(logger lager.Logger, instanceGuid, reason string) int {
+	terminated := 0
+	for _, conn := range p.liveConnections() {
+		if conn.instanceGuid != instanceGuid {
+			continue
+		}
+
+		if p.terminate(logger, conn, reason) {
+			terminated++
+		}
+	}
+	return terminated
+}
+
+// CheckAccess checks every connection with checker and ends the ones whose
+// access has been revoked.
+func (p *Proxy) CheckAccess(logger lager.Logger, checker AccessChecker) {
+	logger = logger.Session("check-access")
+
+	for _, conn := range p.liveConnections() {
+		err := conn.checkAccess(logger, checker)
+		if err == ErrAccessRevoked {
+			p.terminate(logger, conn, "SSH access to the app has been revoked")
+		} else if err != nil {
+			logger.Error("failed-to-check-access", err, lager.Data{
+				"user":   conn.serverConn.User(),
+				"remote": conn.serverConn.RemoteAddr().String(),
+			})
+		}
+	}
+}
+
+func (p *Proxy) terminate(logger lager.Logger, conn *liveConnection, reason string) bool {
+	if !conn.terminate(reason) {
+		return false
+	}
+
+	logger.Info("terminated-connection", lager.Data{
+		"user":   conn.serverConn.User(),
+		"remote": conn.serverConn.RemoteAddr().String(),
+		"reason": reason,
+	})
+
+	message := fmt.Sprintf("Remote access by %s terminated: %s", conn.serverConn.RemoteAddr().String(), reason)
+	for _, logMessage := range conn.logMessages {
+		p.metronClient.SendAppLog(message, "SSH", logMessage.Tags)
+	}
+
+	return true
+}
@@ -0,0 +1,17 @@
+// +build !windows
+
+package quota
+
+import "golang.org/x/sys/unix"
+
+// FreeSpace returns the number of bytes available to unprivileged users on
+// the filesystem that contains path.
+func FreeSpace(path string) (uint64, error) {
+	var stat unix.Statfs_t
+	err := unix.Statfs(path, &stat)
+	if err != nil {
+		return 0, err
+	}
+
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,22 @@
+// +build windows
+
+package quota
+
+import "golang.org/x/sys/windows"
+
+// FreeSpace returns the number of bytes available to the calling user on the
+// volume that contains path.
+func FreeSpace(path string) (uint64, error) {
+	pathPtr, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+
+	var available, total, free uint64
+	err = windows.GetDiskFreeSpaceEx(pathPtr, &available, &total, &free)
+	if err != nil {
+		return 0, err
+	}
+
+	return available, nil
+}
@@ -0,0 +1 @@
+package quota // import "code.cloudfoundry.org/diego-ssh/quota"
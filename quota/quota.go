@@ -0,0 +1,159 @@
+package quota
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+var (
+	ErrFileTooLarge      = errors.New("file exceeds the upload size limit")
+	ErrQuotaExceeded     = errors.New("upload quota of the session exceeded")
+	ErrInsufficientSpace = errors.New("not enough free space on the target filesystem")
+)
+
+// IsExceeded returns whether err reports that a limit would be exceeded.
+func IsExceeded(err error) bool {
+	return err == ErrFileTooLarge || err == ErrQuotaExceeded || err == ErrInsufficientSpace
+}
+
+// Limits restrict the data that a session can upload. Zero values are not
+// enforced.
+type Limits struct {
+	// MaxFileSize is the largest file, in bytes, that can be written.
+	MaxFileSize int64
+
+	// MaxSessionSize is the number of bytes that can be written in a
+	// session.
+	MaxSessionSize int64
+
+	// MinFreeSpace is the number of bytes that have to remain free on the
+	// filesystem that is written to.
+	MinFreeSpace int64
+}
+
+func (l Limits) Enabled() bool {
+	return l.MaxFileSize > 0 || l.MaxSessionSize > 0 || l.MinFreeSpace > 0
+}
+
+// FreeSpaceFunc reports the free space of the filesystem that a file is
+// written to. The free space floor is not enforced when it is nil.
+type FreeSpaceFunc func() (uint64, error)
+
+// Quota keeps track of the bytes written in one session. A nil Quota allows
+// every write.
+type Quota struct {
+	limits Limits
+
+	lock    sync.Mutex
+	written int64
+}
+
+func New(limits Limits) *Quota {
+	if !limits.Enabled() {
+		return nil
+	}
+
+	return &Quota{limits: limits}
+}
+
+// Check refuses a file of the announced size before any of it is written.
+// The size is not counted against the session.
+func (q *Quota) Check(size int64, freeSpace FreeSpaceFunc) error {
+	if q == nil {
+		return nil
+	}
+
+	if q.limits.MaxFileSize > 0 && size > q.limits.MaxFileSize {
+		return ErrFileTooLarge
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.limits.MaxSessionSize > 0 && q.written+size > q.limits.MaxSessionSize {
+		return ErrQuotaExceeded
+	}
+
+	return q.checkFreeSpace(size, freeSpace)
+}
+
+// Write counts n bytes that grow a file to fileSize against the session,
+// or returns the limit that would be exceeded by writing them.
+func (q *Quota) Write(n, fileSize int64, freeSpace FreeSpaceFunc) error {
+	if q == nil {
+		return nil
+	}
+
+	if q.limits.MaxFileSize > 0 && fileSize > q.limits.MaxFileSize {
+		return ErrFileTooLarge
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.limits.MaxSessionSize > 0 && q.written+n > q.limits.MaxSessionSize {
+		return ErrQuotaExceeded
+	}
+
+	err := q.checkFreeSpace(n, freeSpace)
+	if err != nil {
+		return err
+	}
+
+	q.written += n
+	return nil
+}
+
+// Written returns the number of bytes counted against the session.
+func (q *Quota) Written() int64 {
+	if q == nil {
+		return 0
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return q.written
+}
+
+func (q *Quota) checkFreeSpace(size int64, freeSpace FreeSpaceFunc) error {
+	if q.limits.MinFreeSpace <= 0 || freeSpace == nil {
+		return nil
+	}
+
+	free, err := freeSpace()
+	if err != nil {
+		return err
+	}
+
+	if int64(free)-size < q.limits.MinFreeSpace {
+		return ErrInsufficientSpace
+	}
+
+	return nil
+}
+
+// Writer counts the bytes written to w against q. Writes that would exceed
+// a limit fail without writing anything.
+type Writer struct {
+	w         io.Writer
+	quota     *Quota
+	freeSpace FreeSpaceFunc
+	offset    int64
+}
+
+func NewWriter(w io.Writer, q *Quota, freeSpace FreeSpaceFunc) *Writer {
+	return &Writer{w: w, quota: q, freeSpace: freeSpace}
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	err := w.quota.Write(int64(len(p)), w.offset+int64(len(p)), w.freeSpace)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := w.w.Write(p)
+	w.offset += int64(n)
+	return n, err
+}
@@ -0,0 +1,125 @@
+package quota_test
+
+import (
+	"bytes"
+	"errors"
+
+	"code.cloudfoundry.org/diego-ssh/quota"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Quota", func() {
+	var (
+		limits quota.Limits
+		q      *quota.Quota
+	)
+
+	BeforeEach(func() {
+		limits = quota.Limits{}
+	})
+
+	JustBeforeEach(func() {
+		q = quota.New(limits)
+	})
+
+	freeSpace := func(free uint64) quota.FreeSpaceFunc {
+		return func() (uint64, error) {
+			return free, nil
+		}
+	}
+
+	Context("when no limits are set", func() {
+		It("does not create a quota", func() {
+			Expect(q).To(BeNil())
+		})
+
+		It("allows every write", func() {
+			Expect(q.Check(1<<40, nil)).To(Succeed())
+			Expect(q.Write(1<<40, 1<<40, nil)).To(Succeed())
+			Expect(q.Written()).To(BeZero())
+		})
+	})
+
+	Context("when the file size is limited", func() {
+		BeforeEach(func() {
+			limits.MaxFileSize = 10
+		})
+
+		It("refuses larger files", func() {
+			Expect(q.Check(10, nil)).To(Succeed())
+			Expect(q.Check(11, nil)).To(Equal(quota.ErrFileTooLarge))
+		})
+
+		It("refuses writes that grow a file beyond the limit", func() {
+			Expect(q.Write(5, 10, nil)).To(Succeed())
+			Expect(q.Write(1, 11, nil)).To(Equal(quota.ErrFileTooLarge))
+			Expect(q.Written()).To(BeEquivalentTo(5))
+		})
+	})
+
+	Context("when the session size is limited", func() {
+		BeforeEach(func() {
+			limits.MaxSessionSize = 10
+		})
+
+		It("counts every write against the session", func() {
+			Expect(q.Write(6, 6, nil)).To(Succeed())
+			Expect(q.Check(5, nil)).To(Equal(quota.ErrQuotaExceeded))
+			Expect(q.Write(4, 4, nil)).To(Succeed())
+			Expect(q.Write(1, 1, nil)).To(Equal(quota.ErrQuotaExceeded))
+			Expect(q.Written()).To(BeEquivalentTo(10))
+		})
+	})
+
+	Context("when a free space floor is set", func() {
+		BeforeEach(func() {
+			limits.MinFreeSpace = 100
+		})
+
+		It("refuses writes that go below the floor", func() {
+			Expect(q.Check(50, freeSpace(150))).To(Succeed())
+			Expect(q.Check(51, freeSpace(150))).To(Equal(quota.ErrInsufficientSpace))
+			Expect(q.Write(1, 1, freeSpace(100))).To(Equal(quota.ErrInsufficientSpace))
+		})
+
+		It("does not enforce the floor without a free space function", func() {
+			Expect(q.Write(1, 1, nil)).To(Succeed())
+		})
+
+		It("returns the error of the free space function", func() {
+			failure := func() (uint64, error) {
+				return 0, errors.New("statfs failed")
+			}
+			Expect(q.Check(1, failure)).To(MatchError("statfs failed"))
+		})
+	})
+
+	Describe("Writer", func() {
+		BeforeEach(func() {
+			limits.MaxFileSize = 4
+		})
+
+		It("writes until a limit is exceeded", func() {
+			buffer := &bytes.Buffer{}
+			writer := quota.NewWriter(buffer, q, nil)
+
+			_, err := writer.Write([]byte("abc"))
+			Expect(err).NotTo(HaveOccurred())
+
+			n, err := writer.Write([]byte("de"))
+			Expect(err).To(Equal(quota.ErrFileTooLarge))
+			Expect(n).To(BeZero())
+			Expect(buffer.String()).To(Equal("abc"))
+		})
+	})
+
+	Describe("IsExceeded", func() {
+		It("recognizes the limit errors", func() {
+			Expect(quota.IsExceeded(quota.ErrFileTooLarge)).To(BeTrue())
+			Expect(quota.IsExceeded(quota.ErrQuotaExceeded)).To(BeTrue())
+			Expect(quota.IsExceeded(quota.ErrInsufficientSpace)).To(BeTrue())
+			Expect(quota.IsExceeded(errors.New("boom"))).To(BeFalse())
+		})
+	})
+})
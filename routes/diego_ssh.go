@@ -8,4 +8,10 @@ type SSHRoute struct {
 	User            string `json:"user,omitempty"`
 	Password        string `json:"password,omitempty"`
 	PrivateKey      string `json:"private_key,omitempty"`
+
+	// MaxSessionDurationSeconds and IdleTimeoutSeconds lower the session
+	// limits of the proxy for the app when they are set. They cannot raise
+	// them.
+	MaxSessionDurationSeconds int `json:"max_session_duration_seconds,omitempty"`
+	IdleTimeoutSeconds        int `json:"idle_timeout_seconds,omitempty"`
 }
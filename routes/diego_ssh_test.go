@@ -68,6 +68,21 @@ var _ = Describe("Diego SSH Route", func() {
 		})
 	})
 
+	Describe("JSON Unmarshalling", func() {
+		It("reads the session limits", func() {
+			var result routes.SSHRoute
+			err := json.Unmarshal([]byte(`{
+				"container_port": 2222,
+				"max_session_duration_seconds": 3600,
+				"idle_timeout_seconds": 600
+			}`), &result)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(result.MaxSessionDurationSeconds).To(Equal(3600))
+			Expect(result.IdleTimeoutSeconds).To(Equal(600))
+		})
+	})
+
 	Describe("Round Trip Marshalling", func() {
 		It("successfully marshals and unmarshals", func() {
 			payload, err := json.Marshal(route)
@@ -0,0 +1,127 @@
+package scp
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"code.cloudfoundry.org/lager"
+	"golang.org/x/crypto/ssh"
+)
+
+// ClientOptions configure transfers to and from a remote scp.
+type ClientOptions struct {
+	// Recursive copies directories and their contents.
+	Recursive bool
+
+	// PreserveTimesAndMode keeps the modification times, access times and
+	// modes of the copied files.
+	PreserveTimesAndMode bool
+
+	// BandwidthLimit is the rate in Kbit/s that file contents are copied at.
+	// The rate is not limited when it is zero.
+	BandwidthLimit int
+
+	// Progress is called while the contents of files are copied.
+	Progress ProgressFunc
+
+	// Stderr receives the warnings of both sides. They are discarded when it
+	// is nil.
+	Stderr io.Writer
+}
+
+// Upload copies the local sources to target by running scp -t in session.
+// Sources can be globs, as they can be for scp -f.
+func Upload(session *ssh.Session, sources []string, target string, options ClientOptions, logger lager.Logger) error {
+	logger = logger.Session("upload", lager.Data{"Target": target})
+
+	flags := options.flags("-t")
+	if len(sources) > 1 || options.Recursive {
+		flags = append(flags, "-d")
+	}
+
+	return options.run(session, flags, target, &Options{
+		SourceMode:           true,
+		Recursive:            options.Recursive,
+		PreserveTimesAndMode: options.PreserveTimesAndMode,
+		BandwidthLimit:       options.BandwidthLimit,
+		Progress:             options.Progress,
+		Sources:              sources,
+	}, logger)
+}
+
+// Download copies source to the local target by running scp -f in session.
+func Download(session *ssh.Session, source string, target string, options ClientOptions, logger lager.Logger) error {
+	logger = logger.Session("download", lager.Data{"Source": source})
+
+	return options.run(session, options.flags("-f"), source, &Options{
+		TargetMode:           true,
+		Recursive:            options.Recursive,
+		PreserveTimesAndMode: options.PreserveTimesAndMode,
+		BandwidthLimit:       options.BandwidthLimit,
+		Progress:             options.Progress,
+		Target:               target,
+	}, logger)
+}
+
+func (o ClientOptions) flags(mode string) []string {
+	flags := []string{mode}
+	if o.Recursive {
+		flags = append(flags, "-r")
+	}
+	if o.PreserveTimesAndMode {
+		flags = append(flags, "-p")
+	}
+	return flags
+}
+
+// run starts the remote scp for path and copies with the local side in the
+// opposite mode.
+func (o ClientOptions) run(session *ssh.Session, flags []string, path string, options *Options, logger lager.Logger) error {
+	stderr := o.Stderr
+	if stderr == nil {
+		stderr = ioutil.Discard
+	}
+	session.Stderr = stderr
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	command := fmt.Sprintf("scp %s %s", strings.Join(flags, " "), quoteArgument(path))
+
+	logger.Info("starting", lager.Data{"Command": command})
+	err = session.Start(command)
+	if err != nil {
+		logger.Error("failed-to-start", err)
+		return err
+	}
+
+	copyErr := New(options, stdout, stdin, stderr, logger).Copy()
+	stdin.Close()
+
+	err = session.Wait()
+	if copyErr != nil {
+		logger.Error("failed-to-copy", copyErr)
+		return copyErr
+	}
+	if err != nil {
+		logger.Error("remote-scp-failed", err)
+		return err
+	}
+
+	logger.Info("finished")
+	return nil
+}
+
+// quoteArgument quotes arg for the shell that runs the remote command.
+func quoteArgument(arg string) string {
+	return "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+}
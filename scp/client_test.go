@@ -0,0 +1,203 @@
+package scp_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.cloudfoundry.org/diego-ssh/keys"
+	"code.cloudfoundry.org/diego-ssh/scp"
+	"code.cloudfoundry.org/diego-ssh/test_helpers"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/lager/lagertest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/crypto/ssh"
+)
+
+// serveSCP runs the commands of exec requests with the server side of the
+// scp package.
+func serveSCP(conn *ssh.ServerConn, channels <-chan ssh.NewChannel, logger lager.Logger) {
+	for newChannel := range channels {
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+
+		go func() {
+			defer channel.Close()
+
+			for request := range requests {
+				var exec struct{ Command string }
+				if request.Type != "exec" || ssh.Unmarshal(request.Payload, &exec) != nil {
+					request.Reply(false, nil)
+					continue
+				}
+				request.Reply(true, nil)
+
+				copier, err := scp.NewFromCommand(exec.Command, channel, channel, channel.Stderr(), logger)
+				if err == nil {
+					err = copier.Copy()
+				}
+
+				status := struct{ Status uint32 }{0}
+				if err != nil {
+					status.Status = 1
+				}
+				channel.SendRequest("exit-status", false, ssh.Marshal(status))
+				return
+			}
+		}()
+	}
+}
+
+var _ = Describe("Client", func() {
+	var (
+		logger    *lagertest.TestLogger
+		client    *ssh.Client
+		session   *ssh.Session
+		options   scp.ClientOptions
+		localDir  string
+		remoteDir string
+	)
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test")
+		options = scp.ClientOptions{}
+
+		hostKey, err := keys.RSAKeyPairFactory.NewKeyPair(1024)
+		Expect(err).NotTo(HaveOccurred())
+
+		serverConfig := &ssh.ServerConfig{NoClientAuth: true}
+		serverConfig.AddHostKey(hostKey.PrivateKey())
+
+		serverNetConn, clientNetConn := test_helpers.Pipe()
+		go func() {
+			conn, channels, requests, err := ssh.NewServerConn(serverNetConn, serverConfig)
+			if err != nil {
+				return
+			}
+			go ssh.DiscardRequests(requests)
+			serveSCP(conn, channels, logger)
+		}()
+
+		client = test_helpers.NewClient(clientNetConn, nil)
+
+		session, err = client.NewSession()
+		Expect(err).NotTo(HaveOccurred())
+
+		localDir, err = ioutil.TempDir("", "scp-local")
+		Expect(err).NotTo(HaveOccurred())
+
+		remoteDir, err = ioutil.TempDir("", "scp-remote")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		client.Close()
+		os.RemoveAll(localDir)
+		os.RemoveAll(remoteDir)
+	})
+
+	Describe("Upload", func() {
+		var source string
+
+		BeforeEach(func() {
+			source = filepath.Join(localDir, "heap dump's.hprof")
+			Expect(ioutil.WriteFile(source, []byte("heap contents"), 0600)).To(Succeed())
+		})
+
+		It("copies the file to the remote target", func() {
+			err := scp.Upload(session, []string{source}, remoteDir, options, logger)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(ioutil.ReadFile(filepath.Join(remoteDir, "heap dump's.hprof"))).To(BeEquivalentTo("heap contents"))
+		})
+
+		It("reports the progress of the file", func() {
+			var transferred, size int64
+			options.Progress = func(name string, t, s int64) {
+				Expect(name).To(Equal("heap dump's.hprof"))
+				transferred, size = t, s
+			}
+
+			err := scp.Upload(session, []string{source}, remoteDir, options, logger)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(transferred).To(BeEquivalentTo(13))
+			Expect(size).To(BeEquivalentTo(13))
+		})
+
+		Context("when recursive and preserving times and modes", func() {
+			var modificationTime time.Time
+
+			BeforeEach(func() {
+				options.Recursive = true
+				options.PreserveTimesAndMode = true
+
+				Expect(os.Mkdir(filepath.Join(localDir, "logs"), 0750)).To(Succeed())
+				Expect(ioutil.WriteFile(filepath.Join(localDir, "logs", "app.log"), []byte("log"), 0640)).To(Succeed())
+
+				modificationTime = time.Unix(123456789, 0)
+				Expect(os.Chtimes(filepath.Join(localDir, "logs", "app.log"), modificationTime, modificationTime)).To(Succeed())
+			})
+
+			It("copies the directory and keeps the times and modes", func() {
+				err := scp.Upload(session, []string{filepath.Join(localDir, "logs")}, remoteDir, options, logger)
+				Expect(err).NotTo(HaveOccurred())
+
+				info, err := os.Stat(filepath.Join(remoteDir, "logs", "app.log"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(info.Mode()).To(Equal(os.FileMode(0640)))
+				Expect(info.ModTime().Unix()).To(Equal(modificationTime.Unix()))
+			})
+		})
+
+		Context("when the remote target does not exist", func() {
+			It("returns an error", func() {
+				err := scp.Upload(session, []string{source, source}, filepath.Join(remoteDir, "missing"), options, logger)
+				Expect(err).To(HaveOccurred())
+			})
+		})
+	})
+
+	Describe("Download", func() {
+		BeforeEach(func() {
+			Expect(os.Mkdir(filepath.Join(remoteDir, "logs"), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(remoteDir, "logs", "app.log"), []byte("log contents"), 0644)).To(Succeed())
+		})
+
+		It("copies the remote file to the local target", func() {
+			err := scp.Download(session, filepath.Join(remoteDir, "logs", "app.log"), localDir, options, logger)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(ioutil.ReadFile(filepath.Join(localDir, "app.log"))).To(BeEquivalentTo("log contents"))
+		})
+
+		Context("when recursive", func() {
+			BeforeEach(func() {
+				options.Recursive = true
+			})
+
+			It("copies the remote directory", func() {
+				err := scp.Download(session, filepath.Join(remoteDir, "logs"), localDir, options, logger)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(ioutil.ReadFile(filepath.Join(localDir, "logs", "app.log"))).To(BeEquivalentTo("log contents"))
+			})
+		})
+
+		Context("when the remote file does not exist", func() {
+			It("returns the error of the remote side", func() {
+				stderr := &bytes.Buffer{}
+				options.Stderr = stderr
+
+				err := scp.Download(session, filepath.Join(remoteDir, "missing"), localDir, options, logger)
+				Expect(err).To(MatchError(ContainSubstring("no such file or directory")))
+				Expect(stderr.String()).To(ContainSubstring("no such file or directory"))
+			})
+		})
+	})
+})
@@ -6,6 +6,8 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+
+	"code.cloudfoundry.org/lager"
 )
 
 func (s *secureCopy) SendDirectory(dir string, dirInfo os.FileInfo) error {
@@ -43,6 +45,11 @@ func (s *secureCopy) ReceiveDirectory(dir string, timeMessage *TimeMessage) erro
 		return err
 	}
 
+	err = validateName(dirName)
+	if err != nil {
+		return err
+	}
+
 	err = s.session.sendConfirmation()
 	if err != nil {
 		return err
@@ -54,6 +61,11 @@ func (s *secureCopy) ReceiveDirectory(dir string, timeMessage *TimeMessage) erro
 		targetPath = dir
 	}
 
+	err = s.confine(targetPath)
+	if err != nil {
+		return err
+	}
+
 	targetInfo, err := os.Stat(targetPath)
 	if err != nil {
 		if !os.IsNotExist(err) {
@@ -115,6 +127,11 @@ func (s *secureCopy) processDirectoryMessages(dirPath string) error {
 		}
 
 		switch messageType {
+		case 1, 2:
+			err := s.receiveError()
+			if err != nil {
+				return err
+			}
 		case 'D':
 			err := s.ReceiveDirectory(dirPath, timeMessage)
 			if err != nil {
@@ -137,6 +154,23 @@ func (s *secureCopy) processDirectoryMessages(dirPath string) error {
 }
 
 func (s *secureCopy) sendDirectory(dirname string, directoryInfo os.FileInfo) error {
+	for _, ancestor := range s.directories {
+		if os.SameFile(ancestor, directoryInfo) {
+			s.session.logger.Info("detected-directory-loop", lager.Data{"Directory": dirname})
+			return fmt.Errorf("%s: directory loop detected", dirname)
+		}
+	}
+
+	fileInfos, err := ioutil.ReadDir(dirname)
+	if err != nil {
+		return err
+	}
+
+	s.directories = append(s.directories, directoryInfo)
+	defer func() {
+		s.directories = s.directories[:len(s.directories)-1]
+	}()
+
 	if s.session.preserveTimesAndMode {
 		timeMessage := NewTimeMessage(directoryInfo)
 		err := timeMessage.Send(s.session)
@@ -145,7 +179,7 @@ func (s *secureCopy) sendDirectory(dirname string, directoryInfo os.FileInfo) er
 		}
 	}
 
-	_, err := fmt.Fprintf(s.session.stdout, "D%.4o 0 %s\n", directoryInfo.Mode()&07777, directoryInfo.Name())
+	_, err = fmt.Fprintf(s.session.stdout, "D%.4o 0 %s\n", directoryInfo.Mode()&07777, directoryInfo.Name())
 	if err != nil {
 		return err
 	}
@@ -155,16 +189,14 @@ func (s *secureCopy) sendDirectory(dirname string, directoryInfo os.FileInfo) er
 		return err
 	}
 
-	fileInfos, err := ioutil.ReadDir(dirname)
-	if err != nil {
-		return err
-	}
-
 	for _, fileInfo := range fileInfos {
 		source := filepath.Join(dirname, fileInfo.Name())
+
+		// Errors have been reported to the client, the remaining entries
+		// are sent regardless
 		err := s.send(source)
 		if err != nil {
-			// Ignore error, probably log
+			s.session.logger.Error("failed-sending-entry", err, lager.Data{"Source": source})
 		}
 	}
 
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"io"
 	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
 	"time"
@@ -274,6 +275,92 @@ var _ = Describe("Directory Message", func() {
 				Expect(stdout.ReadString('\n')).To(Equal("E\n"))
 			})
 		})
+
+		Context("when a symbolic link leads back to an enclosing directory", func() {
+			BeforeEach(func() {
+				err := os.Symlink(tempDir, filepath.Join(subdir, "loop"))
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("reports the loop and continues to send the other files", func() {
+				stdin := bytes.NewReader(bytes.Repeat([]byte{0}, 10))
+				stdout := &bytes.Buffer{}
+				stderr := &bytes.Buffer{}
+
+				copier = newTestCopier(stdin, stdout, stderr, false)
+				err = copier.SendDirectory(tempDir, dirInfo)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(stdout.ReadString('\n')).To(Equal("D0700 0 " + filepath.Base(tempDir) + "\n"))
+				Expect(stdout.ReadString('\n')).To(Equal("D0775 0 empty-dir\n"))
+				Expect(stdout.ReadString('\n')).To(Equal("E\n"))
+				Expect(stdout.ReadString('\n')).To(Equal("D0700 0 subdir\n"))
+				Expect(stdout.ReadByte()).To(BeEquivalentTo(1))
+				Expect(stdout.ReadString('\n')).To(ContainSubstring("directory loop detected"))
+				Expect(stdout.ReadString('\n')).To(Equal("C0644 21 subdir-file.txt\n"))
+				Expect(stdout.ReadString('\n')).To(Equal("subdir-file-contents\n"))
+				Expect(stdout.ReadByte()).To(BeEquivalentTo(0))
+				Expect(stdout.ReadString('\n')).To(Equal("E\n"))
+			})
+		})
+
+		Context("when symbolic links are skipped", func() {
+			BeforeEach(func() {
+				err := os.Symlink(tempFile, filepath.Join(subdir, "link.txt"))
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("leaves them out of the transfer", func() {
+				stdin := bytes.NewReader(bytes.Repeat([]byte{0}, 10))
+				stdout := &bytes.Buffer{}
+
+				options := &scp.Options{Symlinks: scp.SymlinkPolicySkip}
+				copier, ok := scp.New(options, stdin, stdout, &bytes.Buffer{}, logger).(TestCopier)
+				Expect(ok).To(BeTrue())
+
+				err = copier.SendDirectory(tempDir, dirInfo)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(stdout.ReadString('\n')).To(Equal("D0700 0 " + filepath.Base(tempDir) + "\n"))
+				Expect(stdout.ReadString('\n')).To(Equal("D0775 0 empty-dir\n"))
+				Expect(stdout.ReadString('\n')).To(Equal("E\n"))
+				Expect(stdout.ReadString('\n')).To(Equal("D0700 0 subdir\n"))
+				Expect(stdout.ReadString('\n')).To(Equal("C0644 21 subdir-file.txt\n"))
+				Expect(stdout.String()).NotTo(ContainSubstring("link.txt"))
+			})
+		})
+
+		Context("when the directory contains a special file", func() {
+			var listener net.Listener
+
+			BeforeEach(func() {
+				var err error
+				listener, err = net.Listen("unix", filepath.Join(subdir, "app.sock"))
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			AfterEach(func() {
+				listener.Close()
+			})
+
+			It("warns about it and continues to send the other files", func() {
+				stdin := bytes.NewReader(bytes.Repeat([]byte{0}, 10))
+				stdout := &bytes.Buffer{}
+				stderr := &bytes.Buffer{}
+
+				copier = newTestCopier(stdin, stdout, stderr, false)
+				err = copier.SendDirectory(tempDir, dirInfo)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(stdout.ReadString('\n')).To(Equal("D0700 0 " + filepath.Base(tempDir) + "\n"))
+				Expect(stdout.ReadString('\n')).To(Equal("D0775 0 empty-dir\n"))
+				Expect(stdout.ReadString('\n')).To(Equal("E\n"))
+				Expect(stdout.ReadString('\n')).To(Equal("D0700 0 subdir\n"))
+				Expect(stdout.ReadByte()).To(BeEquivalentTo(1))
+				Expect(stdout.ReadString('\n')).To(Equal("scp: app.sock: not a regular file\n"))
+				Expect(stdout.ReadString('\n')).To(Equal("C0644 21 subdir-file.txt\n"))
+			})
+		})
 	})
 
 	Context("when receiving a directory from an scp source", func() {
@@ -8,6 +8,7 @@ import (
 	"path/filepath"
 	"strconv"
 
+	"code.cloudfoundry.org/diego-ssh/quota"
 	"code.cloudfoundry.org/lager"
 )
 
@@ -35,7 +36,9 @@ func (s *secureCopy) SendFile(file *os.File, fileInfo os.FileInfo) error {
 		return err
 	}
 
-	bytesSent, err := io.CopyN(s.session.stdout, file, fileInfo.Size())
+	writer, finish := s.transferWriter(s.session.stdout, fileInfo.Name(), fileInfo.Size())
+	bytesSent, err := io.CopyN(writer, file, fileInfo.Size())
+	finish()
 	if err != nil {
 		return err
 	}
@@ -91,7 +94,7 @@ func (s *secureCopy) ReceiveFile(path string, pathIsDir bool, timeMessage *TimeM
 		return err
 	}
 
-	err = s.session.sendConfirmation()
+	err = validateName(fileName)
 	if err != nil {
 		return err
 	}
@@ -99,6 +102,26 @@ func (s *secureCopy) ReceiveFile(path string, pathIsDir bool, timeMessage *TimeM
 	targetPath := path
 	if pathIsDir {
 		targetPath = filepath.Join(path, fileName)
+
+		err = s.confine(targetPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	freeSpace := func() (uint64, error) {
+		return quota.FreeSpace(filepath.Dir(targetPath))
+	}
+
+	err = s.options.Quota.Check(length, freeSpace)
+	if err != nil {
+		s.session.logger.Info("upload-refused", lager.Data{"path": targetPath, "length": length, "reason": err.Error()})
+		return err
+	}
+
+	err = s.session.sendConfirmation()
+	if err != nil {
+		return err
 	}
 
 	targetFile, err := os.OpenFile(targetPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(fileMode))
@@ -106,9 +129,15 @@ func (s *secureCopy) ReceiveFile(path string, pathIsDir bool, timeMessage *TimeM
 		return err
 	}
 
-	_, err = io.CopyN(targetFile, s.session.stdin, length)
+	writer, finish := s.transferWriter(quota.NewWriter(targetFile, s.options.Quota, freeSpace), fileName, length)
+	_, err = io.CopyN(writer, s.session.stdin, length)
+	finish()
 	targetFile.Close()
 	if err != nil {
+		if quota.IsExceeded(err) {
+			s.session.logger.Info("upload-aborted", lager.Data{"path": targetPath, "length": length, "reason": err.Error()})
+			os.Remove(targetPath)
+		}
 		return err
 	}
 
@@ -10,14 +10,22 @@ import (
 	"path/filepath"
 	"time"
 
+	"code.cloudfoundry.org/diego-ssh/quota"
 	"code.cloudfoundry.org/diego-ssh/scp"
 	"code.cloudfoundry.org/diego-ssh/scp/atime"
 	"code.cloudfoundry.org/diego-ssh/test_helpers/fake_io"
 	"code.cloudfoundry.org/lager/lagertest"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
 )
 
+type readerFunc func([]byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
+
 var _ = Describe("File Message", func() {
 	var (
 		tempDir  string
@@ -295,6 +303,38 @@ var _ = Describe("File Message", func() {
 			})
 		})
 
+		Context("when the bandwidth is limited", func() {
+			It("sends the contents no faster than the limit", func() {
+				stdin := bytes.NewReader([]byte{0, 0})
+				stdout := &bytes.Buffer{}
+
+				// 64 Kbit/s is 8 KiB/s, so 1 KiB takes an eighth of a second
+				options := &scp.Options{BandwidthLimit: 64}
+				copier, ok := scp.New(options, stdin, stdout, &bytes.Buffer{}, logger).(TestCopier)
+				Expect(ok).To(BeTrue())
+
+				start := time.Now()
+				err := copier.SendFile(file, fileInfo)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(time.Since(start)).To(BeNumerically(">=", 120*time.Millisecond))
+			})
+		})
+
+		Context("when verbose", func() {
+			It("logs the bytes and the throughput of the file", func() {
+				stdin := bytes.NewReader([]byte{0, 0})
+
+				options := &scp.Options{Verbose: true}
+				copier, ok := scp.New(options, stdin, &bytes.Buffer{}, &bytes.Buffer{}, logger).(TestCopier)
+				Expect(ok).To(BeTrue())
+
+				err := copier.SendFile(file, fileInfo)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(logger).To(gbytes.Say(`transfer\.finished.*"Bytes":1024,"Bytes Per Second":\d+`))
+			})
+		})
+
 		Context("when sending the confirmation fails", func() {
 			It("returns an error", func() {
 				stdin := bytes.NewReader([]byte{0, 0})
@@ -646,6 +686,82 @@ var _ = Describe("File Message", func() {
 			})
 		})
 
+		Context("when upload limits are configured", func() {
+			var limits *quota.Quota
+
+			newLimitedCopier := func(stdin io.Reader, stdout io.Writer) TestCopier {
+				options := &scp.Options{Quota: limits}
+				secureCopier, ok := scp.New(options, stdin, stdout, &bytes.Buffer{}, logger).(TestCopier)
+				Expect(ok).To(BeTrue())
+				return secureCopier
+			}
+
+			BeforeEach(func() {
+				limits = quota.New(quota.Limits{MaxFileSize: 8, MaxSessionSize: 12})
+			})
+
+			It("receives files within the limits", func() {
+				stdin := &bytes.Buffer{}
+				stdin.WriteString("C0640 5 hello.txt\n")
+				stdin.WriteString("hello")
+				stdin.WriteByte(0)
+
+				err := newLimitedCopier(stdin, &bytes.Buffer{}).ReceiveFile(tempFile, false, nil)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(ioutil.ReadFile(tempFile)).To(BeEquivalentTo("hello"))
+				Expect(limits.Written()).To(BeEquivalentTo(5))
+			})
+
+			It("refuses a file whose announced length is too large before confirming it", func() {
+				stdin := &bytes.Buffer{}
+				stdout := &bytes.Buffer{}
+				stdin.WriteString("C0640 9 hello.txt\n")
+				stdin.WriteString("123456789")
+
+				err := newLimitedCopier(stdin, stdout).ReceiveFile(tempDir, true, nil)
+				Expect(err).To(Equal(quota.ErrFileTooLarge))
+				Expect(stdout.Len()).To(Equal(0))
+
+				_, err = os.Stat(filepath.Join(tempDir, "hello.txt"))
+				Expect(os.IsNotExist(err)).To(BeTrue())
+			})
+
+			It("refuses a file that does not fit in the rest of the session quota", func() {
+				stdin := &bytes.Buffer{}
+				stdin.WriteString("C0640 8 one.txt\n")
+				stdin.WriteString("12345678")
+				stdin.WriteByte(0)
+				stdin.WriteString("C0640 8 two.txt\n")
+				stdin.WriteString("12345678")
+
+				copier := newLimitedCopier(stdin, &bytes.Buffer{})
+				Expect(copier.ReceiveFile(tempDir, true, nil)).To(Succeed())
+
+				err := copier.ReceiveFile(tempDir, true, nil)
+				Expect(err).To(Equal(quota.ErrQuotaExceeded))
+			})
+
+			Context("when the quota is used up while the file is received", func() {
+				It("fails and removes the partial file", func() {
+					stdin := io.MultiReader(
+						bytes.NewBufferString("C0640 8 hello.txt\n1234"),
+						readerFunc(func(p []byte) (int, error) {
+							Expect(limits.Write(8, 8, nil)).To(Succeed())
+							return 0, io.EOF
+						}),
+						bytes.NewBufferString("5678"),
+					)
+
+					err := newLimitedCopier(stdin, &bytes.Buffer{}).ReceiveFile(tempDir, true, nil)
+					Expect(err).To(Equal(quota.ErrQuotaExceeded))
+
+					_, err = os.Stat(filepath.Join(tempDir, "hello.txt"))
+					Expect(os.IsNotExist(err)).To(BeTrue())
+				})
+			})
+		})
+
 		Context("when the confirmation of the file fails", func() {
 			It("returns an error", func() {
 				stdin := &bytes.Buffer{}
@@ -2,11 +2,35 @@ package scp
 
 import (
 	"errors"
+	"fmt"
+
+	"code.cloudfoundry.org/diego-ssh/quota"
 
 	"github.com/google/shlex"
 	"github.com/pborman/getopt"
 )
 
+// SymlinkPolicy determines how symbolic links are sent in source mode.
+type SymlinkPolicy string
+
+const (
+	// SymlinkPolicyFollow sends the file or directory that a link points
+	// to, as OpenSSH does. This is the default.
+	SymlinkPolicyFollow SymlinkPolicy = "follow"
+
+	// SymlinkPolicySkip leaves symbolic links out of the transfer.
+	SymlinkPolicySkip SymlinkPolicy = "skip"
+)
+
+func ParseSymlinkPolicy(policy string) (SymlinkPolicy, error) {
+	switch p := SymlinkPolicy(policy); p {
+	case SymlinkPolicyFollow, SymlinkPolicySkip:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown scp symlink policy: %q", policy)
+	}
+}
+
 type Options struct {
 	SourceMode           bool
 	TargetMode           bool
@@ -18,6 +42,32 @@ type Options struct {
 
 	Sources []string
 	Target  string
+
+	// Quota limits the files received in target mode.
+	Quota *quota.Quota
+
+	// Root is the directory that the target is resolved in. Symbolic links
+	// cannot lead outside of it.
+	Root string
+
+	// Symlinks determines how symbolic links are sent in source mode. They
+	// are followed when empty.
+	Symlinks SymlinkPolicy
+
+	// BandwidthLimit is the rate in Kbit/s that file contents are sent and
+	// received at. The rate is not limited when it is zero.
+	BandwidthLimit int
+
+	// Progress is called while the contents of files are transferred.
+	Progress ProgressFunc
+}
+
+// CapBandwidth lowers the bandwidth limit to limit when the client asked for
+// no limit or a higher one.
+func (o *Options) CapBandwidth(limit int) {
+	if limit > 0 && (o.BandwidthLimit <= 0 || o.BandwidthLimit > limit) {
+		o.BandwidthLimit = limit
+	}
 }
 
 func ParseCommand(command string) ([]string, error) {
@@ -55,6 +105,8 @@ func ParseFlags(args []string) (*Options, error) {
 	recursive := opts.Bool('r', "", "Indicates a recursive transfer, must be set if source is a directory")
 	opts.Lookup('r').SetOptional()
 
+	bandwidthLimit := opts.Int('l', 0, "Limits the used bandwidth, specified in Kbit/s")
+
 	// showprogress option is not used but can be provided
 	quiet := opts.Bool('q', "", "Indicates that the user wishes to run in quiet mode")
 	opts.Lookup('q').SetOptional()
@@ -64,6 +116,10 @@ func ParseFlags(args []string) (*Options, error) {
 		return nil, err
 	}
 
+	if opts.Lookup('l').Seen() && *bandwidthLimit < 1 {
+		return nil, errors.New("Bandwidth limit must be at least 1 Kbit/s")
+	}
+
 	if *targetMode == *sourceMode {
 		return nil, errors.New("Must specify either target mode(-t) or source mode(-f) at a time")
 	}
@@ -95,6 +151,7 @@ func ParseFlags(args []string) (*Options, error) {
 		PreserveTimesAndMode: *preserveTimesAndMode,
 		Recursive:            *recursive,
 		Quiet:                *quiet,
+		BandwidthLimit:       *bandwidthLimit,
 		Sources:              sources,
 		Target:               target,
 	}, nil
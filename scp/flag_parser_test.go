@@ -128,6 +128,19 @@ var _ = Describe("FlagParser", func() {
 			})
 		})
 
+		Context("when a bandwidth limit is specified", func() {
+			It("returns Options with the limit", func() {
+				scpOptions, err := scp.ParseFlags([]string{"scp", "-l", "800", "-t", "/tmp/foo"})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(scpOptions.BandwidthLimit).To(Equal(800))
+			})
+
+			It("does not allow a limit below 1 Kbit/s", func() {
+				_, err := scp.ParseFlags([]string{"scp", "-l", "0", "-t", "/tmp/foo"})
+				Expect(err).To(HaveOccurred())
+			})
+		})
+
 		Context("when the command is not scp", func() {
 			It("returns an error", func() {
 				_, err := scp.ParseFlags([]string{"foobar", ""})
@@ -200,4 +213,37 @@ var _ = Describe("FlagParser", func() {
 			})
 		})
 	})
+
+	Describe("CapBandwidth", func() {
+		It("caps unlimited and higher limits", func() {
+			options := &scp.Options{}
+			options.CapBandwidth(800)
+			Expect(options.BandwidthLimit).To(Equal(800))
+
+			options.BandwidthLimit = 1600
+			options.CapBandwidth(800)
+			Expect(options.BandwidthLimit).To(Equal(800))
+		})
+
+		It("keeps lower limits", func() {
+			options := &scp.Options{BandwidthLimit: 400}
+			options.CapBandwidth(800)
+			Expect(options.BandwidthLimit).To(Equal(400))
+
+			options.CapBandwidth(0)
+			Expect(options.BandwidthLimit).To(Equal(400))
+		})
+	})
+
+	Describe("ParseSymlinkPolicy", func() {
+		It("parses known policies", func() {
+			Expect(scp.ParseSymlinkPolicy("follow")).To(Equal(scp.SymlinkPolicyFollow))
+			Expect(scp.ParseSymlinkPolicy("skip")).To(Equal(scp.SymlinkPolicySkip))
+		})
+
+		It("rejects unknown policies", func() {
+			_, err := scp.ParseSymlinkPolicy("copy")
+			Expect(err).To(MatchError(`unknown scp symlink policy: "copy"`))
+		})
+	})
 })
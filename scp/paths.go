@@ -0,0 +1,82 @@
+package scp
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"code.cloudfoundry.org/diego-ssh/helpers"
+	"code.cloudfoundry.org/lager"
+)
+
+// validateName refuses file and directory names sent by the source that
+// would lead out of the directory they are received into, the same way the
+// OpenSSH sink does.
+func validateName(name string) error {
+	if name == "" || name == "." || name == ".." ||
+		strings.ContainsRune(name, '/') || strings.ContainsRune(name, filepath.Separator) {
+		return fmt.Errorf("unexpected filename: %s", name)
+	}
+
+	return nil
+}
+
+// resolveTarget maps the requested target to a path below the scp root and
+// records the directory tree that received files are confined to.
+func (s *secureCopy) resolveTarget() (string, error) {
+	target := s.options.Target
+	if s.options.Root != "" {
+		var err error
+		target, err = helpers.ResolveWithin(s.options.Root, target, true)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	target, err := filepath.Abs(target)
+	if err != nil {
+		return "", err
+	}
+
+	treeRoot := target
+	info, err := os.Stat(target)
+	if err != nil || !info.IsDir() {
+		treeRoot = filepath.Dir(target)
+	}
+
+	resolved, err := filepath.EvalSymlinks(treeRoot)
+	if err == nil {
+		treeRoot = resolved
+	}
+
+	s.targetTree = treeRoot
+	return target, nil
+}
+
+// confine refuses to write to p when it is a symbolic link that resolves
+// outside of the target tree.
+func (s *secureCopy) confine(p string) error {
+	if s.targetTree == "" {
+		return nil
+	}
+
+	info, err := os.Lstat(p)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if info.Mode()&os.ModeSymlink == 0 {
+		return nil
+	}
+
+	resolved, err := filepath.EvalSymlinks(p)
+	if err != nil || !helpers.Within(s.targetTree, resolved) {
+		s.session.logger.Info("path-outside-target", lager.Data{"path": p})
+		return fmt.Errorf("%s: symbolic link leads outside of the target directory", filepath.Base(p))
+	}
+
+	return nil
+}
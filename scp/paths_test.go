@@ -0,0 +1,186 @@
+package scp_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/diego-ssh/scp"
+	"code.cloudfoundry.org/lager/lagertest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Target Paths", func() {
+	var (
+		logger    *lagertest.TestLogger
+		tempDir   string
+		targetDir string
+		outside   string
+
+		options *scp.Options
+		stdin   *bytes.Buffer
+		stdout  *bytes.Buffer
+	)
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test")
+
+		var err error
+		tempDir, err = ioutil.TempDir("", "scp-paths")
+		Expect(err).NotTo(HaveOccurred())
+
+		tempDir, err = filepath.EvalSymlinks(tempDir)
+		Expect(err).NotTo(HaveOccurred())
+
+		targetDir = filepath.Join(tempDir, "target")
+		Expect(os.Mkdir(targetDir, 0755)).To(Succeed())
+
+		outside = filepath.Join(tempDir, "outside")
+		Expect(os.Mkdir(outside, 0755)).To(Succeed())
+
+		options = &scp.Options{TargetMode: true, Target: targetDir}
+		stdin = &bytes.Buffer{}
+		stdout = &bytes.Buffer{}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tempDir)
+	})
+
+	receive := func() error {
+		return scp.New(options, stdin, stdout, &bytes.Buffer{}, logger).Copy()
+	}
+
+	Context("when the source sends a name with path elements", func() {
+		expectRefused := func(message string) {
+			stdin.WriteString(message)
+
+			err := receive()
+			Expect(err).To(MatchError(ContainSubstring("unexpected filename")))
+			Expect(stdout.String()).To(ContainSubstring("scp: unexpected filename"))
+
+			infos, err := ioutil.ReadDir(tempDir)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(infos).To(HaveLen(2))
+		}
+
+		It("refuses files named ..", func() {
+			expectRefused("C0644 5 ..\nhello")
+		})
+
+		It("refuses files with a separator", func() {
+			expectRefused("C0644 5 ../escape.txt\nhello")
+		})
+
+		It("refuses files without a name", func() {
+			expectRefused("C0644 5 \nhello")
+		})
+
+		It("refuses directories named ..", func() {
+			expectRefused("D0755 0 ..\nE\n")
+		})
+
+		It("refuses directories with a separator", func() {
+			expectRefused("D0755 0 ../escape\nE\n")
+		})
+	})
+
+	Context("when a file in the target is a symbolic link that leads outside of it", func() {
+		BeforeEach(func() {
+			Expect(ioutil.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644)).To(Succeed())
+			Expect(os.Symlink(filepath.Join(outside, "secret"), filepath.Join(targetDir, "link"))).To(Succeed())
+		})
+
+		It("refuses to write through the link", func() {
+			stdin.WriteString("C0644 5 link\nhello")
+
+			err := receive()
+			Expect(err).To(MatchError(ContainSubstring("outside of the target directory")))
+			Expect(ioutil.ReadFile(filepath.Join(outside, "secret"))).To(BeEquivalentTo("secret"))
+		})
+	})
+
+	Context("when a directory in the target is a symbolic link that leads outside of it", func() {
+		BeforeEach(func() {
+			Expect(os.Symlink(outside, filepath.Join(targetDir, "link"))).To(Succeed())
+		})
+
+		It("refuses to receive into the link", func() {
+			stdin.WriteString("D0755 0 link\nC0644 5 hello.txt\nhello")
+
+			err := receive()
+			Expect(err).To(MatchError(ContainSubstring("outside of the target directory")))
+
+			_, err = os.Stat(filepath.Join(outside, "hello.txt"))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+	})
+
+	Context("when a symbolic link in the target stays inside of it", func() {
+		BeforeEach(func() {
+			Expect(os.Mkdir(filepath.Join(targetDir, "real"), 0755)).To(Succeed())
+			Expect(os.Symlink("real", filepath.Join(targetDir, "link"))).To(Succeed())
+		})
+
+		It("receives into the link", func() {
+			stdin.WriteString("D0755 0 link\nC0644 5 hello.txt\nhello")
+			stdin.WriteByte(0)
+			stdin.WriteString("E\n")
+
+			Expect(receive()).To(Succeed())
+			Expect(ioutil.ReadFile(filepath.Join(targetDir, "real", "hello.txt"))).To(BeEquivalentTo("hello"))
+		})
+	})
+
+	Context("when an scp root is configured", func() {
+		BeforeEach(func() {
+			Expect(os.Mkdir(filepath.Join(targetDir, "uploads"), 0755)).To(Succeed())
+			options.Root = targetDir
+		})
+
+		It("resolves the target below the root", func() {
+			options.Target = "/uploads"
+			stdin.WriteString("C0644 5 hello.txt\nhello")
+			stdin.WriteByte(0)
+
+			Expect(receive()).To(Succeed())
+			Expect(ioutil.ReadFile(filepath.Join(targetDir, "uploads", "hello.txt"))).To(BeEquivalentTo("hello"))
+		})
+
+		It("does not let the target lead outside of the root", func() {
+			options.Target = "../../outside"
+			stdin.WriteString("C0644 5 hello.txt\nhello")
+			stdin.WriteByte(0)
+
+			Expect(receive()).To(Succeed())
+			Expect(ioutil.ReadFile(filepath.Join(targetDir, "outside"))).To(BeEquivalentTo("hello"))
+
+			_, err := os.Stat(filepath.Join(outside, "hello.txt"))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+
+		It("does not let '..' after a missing element skip symbolic links", func() {
+			Expect(os.Symlink("../outside", filepath.Join(targetDir, "out"))).To(Succeed())
+			options.Target = "nope/../out"
+			stdin.WriteString("C0644 5 hello.txt\nhello")
+			stdin.WriteByte(0)
+
+			Expect(receive()).NotTo(Succeed())
+
+			_, err := os.Stat(filepath.Join(outside, "hello.txt"))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+
+		It("resolves symbolic links in the target as if the root was /", func() {
+			Expect(os.Symlink("/uploads", filepath.Join(targetDir, "link"))).To(Succeed())
+			options.Target = "/link"
+			stdin.WriteString("C0644 5 hello.txt\nhello")
+			stdin.WriteByte(0)
+
+			Expect(receive()).To(Succeed())
+			Expect(ioutil.ReadFile(filepath.Join(targetDir, "uploads", "hello.txt"))).To(BeEquivalentTo("hello"))
+		})
+	})
+})
@@ -17,6 +17,17 @@ type SecureCopier interface {
 type secureCopy struct {
 	options *Options
 	session *Session
+
+	// targetTree is the directory that files received in target mode are
+	// confined to.
+	targetTree string
+
+	// directories holds the directories that are being sent in source mode,
+	// from the outermost to the innermost one.
+	directories []os.FileInfo
+
+	// sourceErr is the last warning that the source sent in target mode.
+	sourceErr error
 }
 
 func New(options *Options, stdin io.Reader, stdout io.Writer, stderr io.Writer, logger lager.Logger) SecureCopier {
@@ -104,8 +115,15 @@ func (s *secureCopy) Copy() error {
 		logger.Info("started")
 		defer logger.Info("finished")
 
+		target, err := s.resolveTarget()
+		if err != nil {
+			logger.Error("failed-resolving-target", err)
+			s.session.sendError(err.Error())
+			return err
+		}
+
 		targetIsDir := false
-		targetInfo, err := os.Stat(s.options.Target)
+		targetInfo, err := os.Stat(target)
 		if err == nil {
 			targetIsDir = targetInfo.IsDir()
 		}
@@ -130,7 +148,16 @@ func (s *secureCopy) Copy() error {
 			var err error
 			messageType, err := s.session.peekByte()
 			if err == io.EOF {
-				return nil
+				return s.sourceErr
+			}
+
+			if messageType == 1 || messageType == 2 {
+				err = s.receiveError()
+				if err != nil {
+					logger.Error("source-failed", err)
+					return err
+				}
+				continue
 			}
 
 			if messageType == 'T' {
@@ -144,15 +171,15 @@ func (s *secureCopy) Copy() error {
 
 				messageType, err = s.session.peekByte()
 				if err == io.EOF {
-					return nil
+					return s.sourceErr
 				}
 			}
 
 			if messageType == 'C' {
 				s.session.logger.Info("receiving-file", lager.Data{"Message Type": messageType})
-				err = s.ReceiveFile(s.options.Target, targetIsDir, timeMessage)
+				err = s.ReceiveFile(target, targetIsDir, timeMessage)
 			} else if messageType == 'D' {
-				err = s.ReceiveDirectory(s.options.Target, timeMessage)
+				err = s.ReceiveDirectory(target, timeMessage)
 			} else {
 				err = fmt.Errorf("unexpected message type: %c", messageType)
 				logger.Error("unexpected-message", err)
@@ -180,13 +207,37 @@ func (s *secureCopy) send(source string) error {
 		}
 	}()
 
+	fileInfo, err := os.Lstat(source)
+	if err != nil {
+		return err
+	}
+
+	if fileInfo.Mode()&os.ModeSymlink != 0 {
+		if s.options.Symlinks == SymlinkPolicySkip {
+			s.session.logger.Info("skipped-symlink", lager.Data{"Source": source})
+			return nil
+		}
+
+		fileInfo, err = os.Stat(source)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Opening a FIFO or a device could block or never end
+	if !fileInfo.IsDir() && !fileInfo.Mode().IsRegular() {
+		s.session.logger.Info("skipped-special-file", lager.Data{"Source": source, "Mode": fileInfo.Mode().String()})
+		err = fmt.Errorf("%s: not a regular file", fileInfo.Name())
+		return err
+	}
+
 	file, err := os.Open(source)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
-	fileInfo, err := file.Stat()
+	fileInfo, err = file.Stat()
 	if err != nil {
 		return err
 	}
@@ -203,3 +254,26 @@ func (s *secureCopy) send(source string) error {
 
 	return err
 }
+
+// receiveError reads an error that the source sent in place of a message.
+// Fatal errors are returned. Warnings are written to stderr and make the copy
+// fail once all messages have been received.
+func (s *secureCopy) receiveError() error {
+	errorType, err := s.session.readByte()
+	if err != nil {
+		return err
+	}
+
+	message, err := s.session.readString(NEWLINE)
+	if err != nil {
+		return err
+	}
+
+	if errorType == 2 {
+		return errors.New(message)
+	}
+
+	fmt.Fprintln(s.session.stderr, message)
+	s.sourceErr = errors.New(message)
+	return nil
+}
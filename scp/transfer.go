@@ -0,0 +1,148 @@
+package scp
+
+import (
+	"io"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+)
+
+const progressInterval = time.Second
+
+// ProgressFunc is called while the contents of a file are transferred, with
+// the number of bytes transferred so far and the size of the file.
+type ProgressFunc func(name string, transferred, size int64)
+
+// transferWriter wraps the writer that the contents of a file are copied to
+// with the bandwidth limit and progress reporting. The returned function has
+// to be called once the copy has finished.
+func (s *secureCopy) transferWriter(w io.Writer, name string, size int64) (io.Writer, func()) {
+	w = newThrottledWriter(w, s.options.BandwidthLimit)
+	if s.options.Progress != nil {
+		w = &callbackWriter{w: w, progress: s.options.Progress, name: name, size: size}
+	}
+
+	if !s.options.Verbose {
+		return w, func() {}
+	}
+
+	progress := &progressWriter{
+		w:      w,
+		logger: s.session.logger.Session("transfer", lager.Data{"File": name, "Size": size}),
+		start:  time.Now(),
+	}
+	progress.lastReport = progress.start
+
+	return progress, progress.finish
+}
+
+// throttledWriter delays writes so that the average rate stays below a limit
+// given in Kbit/s, as the -l option of OpenSSH scp does.
+type throttledWriter struct {
+	w              io.Writer
+	bytesPerSecond int64
+	chunkSize      int
+	start          time.Time
+	written        int64
+}
+
+func newThrottledWriter(w io.Writer, limit int) io.Writer {
+	if limit <= 0 {
+		return w
+	}
+
+	bytesPerSecond := int64(limit) * 1024 / 8
+
+	// Writes are split up so that the delays stay short and the rate even
+	chunkSize := int(bytesPerSecond / 10)
+	if chunkSize < 1 {
+		chunkSize = 1
+	}
+
+	return &throttledWriter{
+		w:              w,
+		bytesPerSecond: bytesPerSecond,
+		chunkSize:      chunkSize,
+		start:          time.Now(),
+	}
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	total := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > t.chunkSize {
+			chunk = chunk[:t.chunkSize]
+		}
+
+		n, err := t.w.Write(chunk)
+		total += n
+		t.written += int64(n)
+		if err != nil {
+			return total, err
+		}
+		p = p[n:]
+
+		expected := time.Duration(float64(t.written) / float64(t.bytesPerSecond) * float64(time.Second))
+		if elapsed := time.Since(t.start); expected > elapsed {
+			time.Sleep(expected - elapsed)
+		}
+	}
+
+	return total, nil
+}
+
+// progressWriter logs the bytes written and the throughput of a file
+// transfer.
+type progressWriter struct {
+	w      io.Writer
+	logger lager.Logger
+
+	start      time.Time
+	lastReport time.Time
+	written    int64
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.written += int64(n)
+
+	now := time.Now()
+	if now.Sub(p.lastReport) >= progressInterval {
+		p.lastReport = now
+		p.logger.Info("progress", p.data(now))
+	}
+
+	return n, err
+}
+
+func (p *progressWriter) finish() {
+	data := p.data(time.Now())
+	data["Duration"] = time.Since(p.start).String()
+	p.logger.Info("finished", data)
+}
+
+func (p *progressWriter) data(now time.Time) lager.Data {
+	var bytesPerSecond int64
+	if elapsed := now.Sub(p.start).Seconds(); elapsed > 0 {
+		bytesPerSecond = int64(float64(p.written) / elapsed)
+	}
+
+	return lager.Data{"Bytes": p.written, "Bytes Per Second": bytesPerSecond}
+}
+
+type callbackWriter struct {
+	w        io.Writer
+	progress ProgressFunc
+
+	name        string
+	size        int64
+	transferred int64
+}
+
+func (c *callbackWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.transferred += int64(n)
+	c.progress(c.name, c.transferred, c.size)
+	return n, err
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	proxyHeaderTimeout = 5 * time.Second
+
+	// maxProxyHeaderLength is the longest PROXY protocol v1 header, including
+	// the trailing CRLF.
+	maxProxyHeaderLength = 107
+)
+
+var errInvalidProxyHeader = errors.New("invalid PROXY protocol header")
+
+// proxiedConn is a connection that was forwarded by a load balancer. Its
+// remote address is the address of the client that the load balancer
+// reported.
+type proxiedConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// readProxyHeader reads a PROXY protocol v1 header from conn and returns a
+// connection that reports the client address from the header. The header is
+// read byte by byte so that none of the data that follows it is consumed.
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	err := conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, maxProxyHeaderLength)
+	b := make([]byte, 1)
+	for !strings.HasSuffix(string(header), "\r\n") {
+		if len(header) == maxProxyHeaderLength {
+			return nil, errInvalidProxyHeader
+		}
+
+		_, err := conn.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		header = append(header, b[0])
+	}
+
+	err = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+
+	remoteAddr, err := parseProxyHeader(strings.TrimSuffix(string(header), "\r\n"))
+	if err != nil {
+		return nil, err
+	}
+
+	if remoteAddr == nil {
+		return conn, nil
+	}
+
+	return &proxiedConn{Conn: conn, remoteAddr: remoteAddr}, nil
+}
+
+// parseProxyHeader returns the source address of a PROXY protocol v1 header.
+// It returns nil for UNKNOWN connections, such as health checks of the load
+// balancer.
+func parseProxyHeader(header string) (net.Addr, error) {
+	fields := strings.Split(header, " ")
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, errInvalidProxyHeader
+	}
+
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, fmt.Errorf("unsupported PROXY protocol family: %s", fields[1])
+	}
+
+	if len(fields) != 6 {
+		return nil, errInvalidProxyHeader
+	}
+
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, errInvalidProxyHeader
+	}
+
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, errInvalidProxyHeader
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
@@ -2,6 +2,7 @@ package server
 
 import (
 	"errors"
+	"math/rand"
 	"net"
 	"os"
 	"sync"
@@ -15,6 +16,18 @@ type ConnectionHandler interface {
 	HandleConnection(net.Conn)
 }
 
+type connectionHandlerFunc func(net.Conn)
+
+func (f connectionHandlerFunc) HandleConnection(conn net.Conn) {
+	f(conn)
+}
+
+// A ConnectionFilter decides whether a new connection is served. Rejected
+// connections are closed right away.
+type ConnectionFilter interface {
+	AdmitConnection(logger lager.Logger, addr net.Addr) error
+}
+
 type Server struct {
 	logger            lager.Logger
 	listenAddress     string
@@ -24,6 +37,14 @@ type Server struct {
 	state             serverState
 	idleConnTimeout   time.Duration
 	store             connHandler
+
+	connectionFilter ConnectionFilter
+	proxyProtocol    bool
+
+	maxStartups     MaxStartups
+	loginGraceTime  time.Duration
+	unauthenticated int32
+	random          func() float64
 }
 
 func NewServer(
@@ -38,6 +59,7 @@ func NewServer(
 		connectionHandler: connectionHandler,
 		mutex:             &sync.Mutex{},
 		idleConnTimeout:   idleConnTimeout,
+		random:            rand.Float64,
 	}
 }
 
@@ -84,6 +106,19 @@ func (s *Server) SetListener(listener net.Listener) error {
 	return nil
 }
 
+// SetConnectionFilter sets the filter that new connections have to pass. It
+// has to be called before the server is started.
+func (s *Server) SetConnectionFilter(filter ConnectionFilter) {
+	s.connectionFilter = filter
+}
+
+// EnableProxyProtocol makes the server expect a PROXY protocol v1 header on
+// every connection and use the client address from it. It has to be called
+// before the server is started.
+func (s *Server) EnableProxyProtocol() {
+	s.proxyProtocol = true
+}
+
 func (s *Server) ListenAddr() (net.Addr, error) {
 	if s.listener == nil {
 		return nil, errors.New("No listener")
@@ -117,9 +152,6 @@ func (s *Server) Serve() {
 
 	for {
 		netConn, err := s.listener.Accept()
-		if s.idleConnTimeout > 0 {
-			netConn = &idleTimeoutConn{s.idleConnTimeout, netConn}
-		}
 		if err != nil {
 			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
 				logger.Error("accept-temporary-error", netErr)
@@ -134,6 +166,44 @@ func (s *Server) Serve() {
 			logger.Error("accept-failed", err)
 			return
 		}
-		s.store.Handle(s.connectionHandler, netConn)
+
+		st := s.admitStartup(logger, netConn)
+		if st == nil {
+			netConn.Close()
+			continue
+		}
+
+		s.store.Handle(connectionHandlerFunc(func(conn net.Conn) {
+			defer st.complete()
+			s.handleConnection(conn, st)
+		}), netConn)
+	}
+}
+
+func (s *Server) handleConnection(netConn net.Conn, st *startup) {
+	logger := s.logger.Session("handle-connection")
+
+	if s.proxyProtocol {
+		proxiedConn, err := readProxyHeader(netConn)
+		if err != nil {
+			logger.Error("failed-to-read-proxy-header", err, lager.Data{"remote": remoteAddress(netConn)})
+			netConn.Close()
+			return
+		}
+		netConn = proxiedConn
 	}
+
+	if s.connectionFilter != nil {
+		err := s.connectionFilter.AdmitConnection(logger, netConn.RemoteAddr())
+		if err != nil {
+			netConn.Close()
+			return
+		}
+	}
+
+	if s.idleConnTimeout > 0 {
+		netConn = &idleTimeoutConn{s.idleConnTimeout, netConn}
+	}
+
+	s.connectionHandler.HandleConnection(&startupConn{Conn: netConn, startup: st})
 }
@@ -3,6 +3,7 @@ package server_test
 import (
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"time"
@@ -106,12 +107,16 @@ var _ = Describe("Server", func() {
 		var fakeListener *fake_net.FakeListener
 		var fakeConn *fake_net.FakeConn
 
-		BeforeEach(func() {
-			fakeListener = &fake_net.FakeListener{}
-			fakeConn = &fake_net.FakeConn{}
+		var connectionFilter server.ConnectionFilter
+		var proxyProtocol bool
+		var maxStartups server.MaxStartups
+		var loginGraceTime time.Duration
 
-			connectionCh := make(chan net.Conn, 1)
-			connectionCh <- fakeConn
+		acceptOnce := func(netConns ...net.Conn) {
+			connectionCh := make(chan net.Conn, len(netConns))
+			for _, netConn := range netConns {
+				connectionCh <- netConn
+			}
 
 			fakeListener.AcceptStub = func() (net.Conn, error) {
 				cx := connectionCh
@@ -122,11 +127,30 @@ var _ = Describe("Server", func() {
 					return nil, errors.New("fail")
 				}
 			}
+		}
+
+		BeforeEach(func() {
+			fakeListener = &fake_net.FakeListener{}
+			fakeConn = &fake_net.FakeConn{}
+			connectionFilter = nil
+			proxyProtocol = false
+			maxStartups = server.MaxStartups{}
+			loginGraceTime = 0
+
+			acceptOnce(fakeConn)
 		})
 
 		JustBeforeEach(func() {
 			srv = server.NewServer(logger, address, handler, 500*time.Millisecond)
 			srv.SetListener(fakeListener)
+			if connectionFilter != nil {
+				srv.SetConnectionFilter(connectionFilter)
+			}
+			if proxyProtocol {
+				srv.EnableProxyProtocol()
+			}
+			srv.SetMaxStartups(maxStartups)
+			srv.SetLoginGraceTime(loginGraceTime)
 			srv.Serve()
 		})
 
@@ -150,6 +174,189 @@ var _ = Describe("Server", func() {
 			Expect(t.Sub(time.Now())).To(BeNumerically("<=", 500*time.Millisecond))
 		})
 
+		Context("when a connection filter is set", func() {
+			var admitErr error
+			var filteredAddrs chan net.Addr
+
+			BeforeEach(func() {
+				admitErr = nil
+				filteredAddrs = make(chan net.Addr, 1)
+
+				fakeConn.RemoteAddrReturns(&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 50000})
+				connectionFilter = connectionFilterFunc(func(logger lager.Logger, addr net.Addr) error {
+					filteredAddrs <- addr
+					return admitErr
+				})
+			})
+
+			It("passes admitted connections to the connection handler", func() {
+				Eventually(handler.HandleConnectionCallCount).Should(Equal(1))
+				Expect(filteredAddrs).To(Receive(Equal(&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 50000})))
+			})
+
+			Context("when the filter rejects the connection", func() {
+				BeforeEach(func() {
+					admitErr = errors.New("go away")
+				})
+
+				It("closes the connection without handling it", func() {
+					Eventually(fakeConn.CloseCallCount).Should(Equal(1))
+					Consistently(handler.HandleConnectionCallCount).Should(Equal(0))
+				})
+			})
+		})
+
+		Context("when the PROXY protocol is enabled", func() {
+			var clientConn net.Conn
+			var header string
+
+			BeforeEach(func() {
+				proxyProtocol = true
+				header = "PROXY TCP4 203.0.113.7 10.0.0.5 40000 2222\r\n"
+
+				var serverConn net.Conn
+				serverConn, clientConn = net.Pipe()
+				acceptOnce(serverConn)
+			})
+
+			JustBeforeEach(func() {
+				go func() {
+					clientConn.Write([]byte(header + "SSH-2.0-client\r\n"))
+				}()
+			})
+
+			AfterEach(func() {
+				clientConn.Close()
+			})
+
+			It("uses the client address from the header", func() {
+				Eventually(handler.HandleConnectionCallCount).Should(Equal(1))
+				conn := handler.HandleConnectionArgsForCall(0)
+				Expect(conn.RemoteAddr()).To(Equal(&net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 40000}))
+
+				data := make([]byte, len("SSH-2.0-client\r\n"))
+				_, err := io.ReadFull(conn, data)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(data)).To(Equal("SSH-2.0-client\r\n"))
+			})
+
+			Context("when the header reports an unknown connection", func() {
+				BeforeEach(func() {
+					header = "PROXY UNKNOWN\r\n"
+				})
+
+				It("keeps the address of the connection", func() {
+					Eventually(handler.HandleConnectionCallCount).Should(Equal(1))
+					conn := handler.HandleConnectionArgsForCall(0)
+					Expect(conn.RemoteAddr().Network()).To(Equal("pipe"))
+				})
+			})
+
+			Context("when the header is invalid", func() {
+				BeforeEach(func() {
+					header = "GET / HTTP/1.1\r\n"
+				})
+
+				It("closes the connection without handling it", func() {
+					Eventually(logger).Should(gbytes.Say("failed-to-read-proxy-header"))
+					Consistently(handler.HandleConnectionCallCount).Should(Equal(0))
+				})
+			})
+		})
+
+		Context("when unauthenticated connections are limited", func() {
+			var otherConn *fake_net.FakeConn
+			var release chan struct{}
+
+			BeforeEach(func() {
+				maxStartups = server.MaxStartups{Start: 1, Rate: 100, Full: 1}
+				otherConn = &fake_net.FakeConn{}
+				acceptOnce(fakeConn, otherConn)
+
+				release = make(chan struct{})
+				handler.HandleConnectionStub = func(net.Conn) {
+					<-release
+				}
+			})
+
+			AfterEach(func() {
+				close(release)
+			})
+
+			It("drops new connections while others are authenticating", func() {
+				Eventually(handler.HandleConnectionCallCount).Should(Equal(1))
+				Expect(otherConn.CloseCallCount()).To(Equal(1))
+				Expect(fakeConn.CloseCallCount()).To(Equal(0))
+				Expect(logger).To(gbytes.Say("dropped-unauthenticated-connection"))
+			})
+
+			Context("when the first connection finishes authenticating", func() {
+				BeforeEach(func() {
+					authenticated := make(chan struct{})
+					handler.HandleConnectionStub = func(conn net.Conn) {
+						server.HandshakeComplete(conn)
+						close(authenticated)
+						<-release
+					}
+
+					accepted := 0
+					fakeListener.AcceptStub = func() (net.Conn, error) {
+						accepted++
+						switch accepted {
+						case 1:
+							return fakeConn, nil
+						case 2:
+							<-authenticated
+							return otherConn, nil
+						default:
+							return nil, errors.New("fail")
+						}
+					}
+				})
+
+				It("accepts new connections again", func() {
+					Eventually(handler.HandleConnectionCallCount).Should(Equal(2))
+					Expect(otherConn.CloseCallCount()).To(Equal(0))
+				})
+			})
+		})
+
+		Context("when a login grace time is set", func() {
+			var release chan struct{}
+
+			BeforeEach(func() {
+				loginGraceTime = 100 * time.Millisecond
+
+				release = make(chan struct{})
+				handler.HandleConnectionStub = func(net.Conn) {
+					<-release
+				}
+			})
+
+			AfterEach(func() {
+				close(release)
+			})
+
+			It("closes connections that do not authenticate in time", func() {
+				Eventually(fakeConn.CloseCallCount).Should(Equal(1))
+				Expect(logger).To(gbytes.Say("login-grace-time-exceeded"))
+			})
+
+			Context("when the connection authenticates in time", func() {
+				BeforeEach(func() {
+					handler.HandleConnectionStub = func(conn net.Conn) {
+						server.HandshakeComplete(conn)
+						<-release
+					}
+				})
+
+				It("keeps the connection open", func() {
+					Eventually(handler.HandleConnectionCallCount).Should(Equal(1))
+					Consistently(fakeConn.CloseCallCount, 300*time.Millisecond).Should(Equal(0))
+				})
+			})
+		})
+
 		Context("when accept returns a permanent error", func() {
 			BeforeEach(func() {
 				fakeListener.AcceptReturns(nil, errors.New("oops"))
@@ -225,6 +432,23 @@ var _ = Describe("Server", func() {
 		})
 	})
 
+	Describe("ParseMaxStartups", func() {
+		It("parses a single limit", func() {
+			Expect(server.ParseMaxStartups("10")).To(Equal(server.MaxStartups{Start: 10, Rate: 100, Full: 10}))
+		})
+
+		It("parses start, rate and full", func() {
+			Expect(server.ParseMaxStartups("10:30:100")).To(Equal(server.MaxStartups{Start: 10, Rate: 30, Full: 100}))
+		})
+
+		It("rejects malformed limits", func() {
+			for _, value := range []string{"", "ten", "10:30", "-1", "20:30:10", "10:101:100"} {
+				_, err := server.ParseMaxStartups(value)
+				Expect(err).To(HaveOccurred(), value)
+			}
+		})
+	})
+
 	Describe("ListenAddr", func() {
 		var listener net.Listener
 		BeforeEach(func() {
@@ -255,3 +479,9 @@ var _ = Describe("Server", func() {
 		})
 	})
 })
+
+type connectionFilterFunc func(lager.Logger, net.Addr) error
+
+func (f connectionFilterFunc) AdmitConnection(logger lager.Logger, addr net.Addr) error {
+	return f(logger, addr)
+}
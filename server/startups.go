@@ -0,0 +1,166 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+)
+
+// MaxStartups limits the connections that have not finished authenticating,
+// like the MaxStartups option of OpenSSH. Once Start connections are
+// unauthenticated, new connections are dropped with a probability of Rate
+// percent that rises linearly to 100 percent at Full connections. A zero Full
+// disables the limit.
+type MaxStartups struct {
+	Start int
+	Rate  int
+	Full  int
+}
+
+// ParseMaxStartups parses a limit in the OpenSSH format, either "full" or
+// "start:rate:full".
+func ParseMaxStartups(value string) (MaxStartups, error) {
+	fields := strings.Split(value, ":")
+
+	numbers := make([]int, len(fields))
+	for i, field := range fields {
+		number, err := strconv.Atoi(field)
+		if err != nil || number < 0 {
+			return MaxStartups{}, fmt.Errorf("invalid max startups: %q", value)
+		}
+		numbers[i] = number
+	}
+
+	var maxStartups MaxStartups
+	switch len(numbers) {
+	case 1:
+		maxStartups = MaxStartups{Start: numbers[0], Rate: 100, Full: numbers[0]}
+	case 3:
+		maxStartups = MaxStartups{Start: numbers[0], Rate: numbers[1], Full: numbers[2]}
+	default:
+		return MaxStartups{}, fmt.Errorf("invalid max startups: %q", value)
+	}
+
+	if maxStartups.Start > maxStartups.Full || maxStartups.Rate > 100 {
+		return MaxStartups{}, fmt.Errorf("invalid max startups: %q", value)
+	}
+
+	return maxStartups, nil
+}
+
+// dropProbability returns the probability that a new connection is dropped
+// while unauthenticated connections are open.
+func (m MaxStartups) dropProbability(unauthenticated int) float64 {
+	if m.Full <= 0 || unauthenticated < m.Start {
+		return 0
+	}
+
+	if unauthenticated >= m.Full {
+		return 1
+	}
+
+	rate := float64(m.Rate) / 100
+	return rate + (1-rate)*float64(unauthenticated-m.Start)/float64(m.Full-m.Start)
+}
+
+// startup tracks a connection until it has finished authenticating.
+type startup struct {
+	lock    sync.Mutex
+	done    bool
+	timer   *time.Timer
+	release func()
+}
+
+// complete ends the startup of the connection. It reports whether the
+// startup was still in progress.
+func (s *startup) complete() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.done {
+		return false
+	}
+	s.done = true
+
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.release()
+
+	return true
+}
+
+type startupConn struct {
+	net.Conn
+	startup *startup
+}
+
+// HandshakeComplete tells the server that conn, as it was passed to the
+// ConnectionHandler, has finished authenticating. It stops the login grace
+// timer of the connection and no longer counts it towards MaxStartups.
+func HandshakeComplete(conn net.Conn) {
+	if conn, ok := conn.(*startupConn); ok {
+		conn.startup.complete()
+	}
+}
+
+// SetMaxStartups sets the limit of unauthenticated connections. It has to be
+// called before the server is started.
+func (s *Server) SetMaxStartups(maxStartups MaxStartups) {
+	s.maxStartups = maxStartups
+}
+
+// SetLoginGraceTime sets how long a client has to authenticate before its
+// connection is closed. Zero disables the timeout. It has to be called before
+// the server is started.
+func (s *Server) SetLoginGraceTime(loginGraceTime time.Duration) {
+	s.loginGraceTime = loginGraceTime
+}
+
+// admitStartup decides whether a new connection is served and starts to
+// track it until it has finished authenticating. It returns nil when the
+// connection has to be dropped.
+func (s *Server) admitStartup(logger lager.Logger, netConn net.Conn) *startup {
+	unauthenticated := int(atomic.LoadInt32(&s.unauthenticated))
+
+	probability := s.maxStartups.dropProbability(unauthenticated)
+	if probability > 0 && s.random() < probability {
+		logger.Info("dropped-unauthenticated-connection", lager.Data{
+			"remote":          remoteAddress(netConn),
+			"unauthenticated": unauthenticated,
+		})
+		return nil
+	}
+
+	atomic.AddInt32(&s.unauthenticated, 1)
+
+	st := &startup{
+		release: func() { atomic.AddInt32(&s.unauthenticated, -1) },
+	}
+
+	if s.loginGraceTime > 0 {
+		st.lock.Lock()
+		st.timer = time.AfterFunc(s.loginGraceTime, func() {
+			if st.complete() {
+				logger.Info("login-grace-time-exceeded", lager.Data{"remote": remoteAddress(netConn)})
+				netConn.Close()
+			}
+		})
+		st.lock.Unlock()
+	}
+
+	return st
+}
+
+func remoteAddress(conn net.Conn) string {
+	if addr := conn.RemoteAddr(); addr != nil {
+		return addr.String()
+	}
+	return ""
+}
@@ -0,0 +1,269 @@
+package sftpserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"code.cloudfoundry.org/lager"
+	"golang.org/x/crypto/ssh"
+)
+
+// SummaryRequest is the channel request that carries the transfer summary
+// of an SFTP session from the daemon to the proxy.
+const SummaryRequest = "sftp-summary@cloudfoundry.org"
+
+// MaxSummarySize is the size of the largest summary payload. Sessions that
+// transferred more files than fit list the first ones and count the rest as
+// omitted.
+const MaxSummarySize = 16 * 1024
+
+// Summary lists the files that were transferred during an SFTP session.
+type Summary struct {
+	Uploaded   []Transfer `json:"uploaded,omitempty"`
+	Downloaded []Transfer `json:"downloaded,omitempty"`
+	Omitted    int        `json:"omitted,omitempty"`
+}
+
+type Transfer struct {
+	Path  string `json:"path"`
+	Bytes int64  `json:"bytes"`
+}
+
+func (s Summary) Empty() bool {
+	return len(s.Uploaded) == 0 && len(s.Downloaded) == 0 && s.Omitted == 0
+}
+
+// Payload encodes the summary as the payload of a SummaryRequest. Transfers
+// are dropped from the end until the payload fits in MaxSummarySize.
+func (s Summary) Payload() []byte {
+	for {
+		encoded, _ := json.Marshal(s)
+		payload := ssh.Marshal(struct{ Summary string }{string(encoded)})
+		if len(payload) <= MaxSummarySize {
+			return payload
+		}
+
+		if len(s.Downloaded) > 0 {
+			s.Downloaded = s.Downloaded[:len(s.Downloaded)-1]
+		} else if len(s.Uploaded) > 0 {
+			s.Uploaded = s.Uploaded[:len(s.Uploaded)-1]
+		} else {
+			return ssh.Marshal(struct{ Summary string }{"{}"})
+		}
+		s.Omitted++
+	}
+}
+
+// ParseSummary decodes the payload of a SummaryRequest. The payload comes
+// from the container, so anything but a well-formed summary of at most
+// MaxSummarySize bytes is rejected.
+func ParseSummary(payload []byte) (Summary, error) {
+	if len(payload) > MaxSummarySize {
+		return Summary{}, fmt.Errorf("summary of %d bytes exceeds %d bytes", len(payload), MaxSummarySize)
+	}
+
+	var msg struct{ Summary string }
+	err := ssh.Unmarshal(payload, &msg)
+	if err != nil {
+		return Summary{}, err
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(msg.Summary))
+	decoder.DisallowUnknownFields()
+
+	var summary Summary
+	err = decoder.Decode(&summary)
+	if err != nil {
+		return Summary{}, err
+	}
+
+	if decoder.More() {
+		return Summary{}, errors.New("unexpected data after summary")
+	}
+
+	if summary.Omitted < 0 {
+		return Summary{}, errors.New("negative omitted count")
+	}
+
+	for _, transfers := range [][]Transfer{summary.Uploaded, summary.Downloaded} {
+		for _, transfer := range transfers {
+			err := checkTransfer(transfer)
+			if err != nil {
+				return Summary{}, err
+			}
+		}
+	}
+
+	return summary, nil
+}
+
+func checkTransfer(transfer Transfer) error {
+	if transfer.Path == "" || !utf8.ValidString(transfer.Path) {
+		return fmt.Errorf("invalid transfer path %q", transfer.Path)
+	}
+
+	if transfer.Bytes < 0 {
+		return fmt.Errorf("negative byte count for %q", transfer.Path)
+	}
+
+	return nil
+}
+
+func (h *requestHandler) audit(operation string, start time.Time, err error, data lager.Data) {
+	data["operation"] = operation
+	data["duration"] = time.Since(start).String()
+	data["result"] = "ok"
+	if err != nil {
+		data["result"] = err.Error()
+	}
+
+	h.logger.Info("audit", data)
+}
+
+// transferLog adds up the bytes transferred per file in the order the files
+// were first used.
+type transferLog struct {
+	sync.Mutex
+	uploaded   []Transfer
+	downloaded []Transfer
+}
+
+func newTransferLog() *transferLog {
+	return &transferLog{}
+}
+
+func (l *transferLog) upload(path string, bytes int64) {
+	l.Lock()
+	l.uploaded = addTransfer(l.uploaded, path, bytes)
+	l.Unlock()
+}
+
+func (l *transferLog) download(path string, bytes int64) {
+	l.Lock()
+	l.downloaded = addTransfer(l.downloaded, path, bytes)
+	l.Unlock()
+}
+
+func addTransfer(transfers []Transfer, path string, bytes int64) []Transfer {
+	for i := range transfers {
+		if transfers[i].Path == path {
+			transfers[i].Bytes += bytes
+			return transfers
+		}
+	}
+	return append(transfers, Transfer{Path: path, Bytes: bytes})
+}
+
+func (l *transferLog) summary() Summary {
+	l.Lock()
+	defer l.Unlock()
+
+	return Summary{
+		Uploaded:   append([]Transfer(nil), l.uploaded...),
+		Downloaded: append([]Transfer(nil), l.downloaded...),
+	}
+}
+
+// transferRange records the bytes moved through a file handle in one
+// direction and the range of offsets they covered.
+type transferRange struct {
+	used  bool
+	bytes int64
+	first int64
+	last  int64
+	err   error
+}
+
+func (t *transferRange) add(offset int64, n int, err error) {
+	if !t.used || offset < t.first {
+		t.first = offset
+	}
+	if end := offset + int64(n); !t.used || end > t.last {
+		t.last = end
+	}
+	t.used = true
+	t.bytes += int64(n)
+
+	if err != nil && err != io.EOF && t.err == nil {
+		t.err = err
+	}
+}
+
+type auditedFile struct {
+	File
+
+	handler *requestHandler
+	path    string
+	opened  time.Time
+
+	lock    sync.Mutex
+	read    transferRange
+	written transferRange
+}
+
+func (h *requestHandler) newAuditedFile(file File, path string) *auditedFile {
+	return &auditedFile{
+		File:    file,
+		handler: h,
+		path:    path,
+		opened:  time.Now(),
+	}
+}
+
+func (f *auditedFile) ReadAt(p []byte, offset int64) (int, error) {
+	n, err := f.File.ReadAt(p, offset)
+
+	f.lock.Lock()
+	f.read.add(offset, n, err)
+	f.lock.Unlock()
+
+	return n, err
+}
+
+func (f *auditedFile) WriteAt(p []byte, offset int64) (int, error) {
+	n, err := f.File.WriteAt(p, offset)
+
+	f.lock.Lock()
+	f.written.add(offset, n, err)
+	f.lock.Unlock()
+
+	return n, err
+}
+
+func (f *auditedFile) Close() error {
+	err := f.File.Close()
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.read.used {
+		f.auditTransfer("read", f.read)
+		f.handler.transfer.download(f.path, f.read.bytes)
+	}
+
+	if f.written.used {
+		written := f.written
+		if written.err == nil {
+			written.err = err
+		}
+		f.auditTransfer("write", written)
+		f.handler.transfer.upload(f.path, f.written.bytes)
+	}
+
+	return err
+}
+
+func (f *auditedFile) auditTransfer(operation string, t transferRange) {
+	f.handler.audit(operation, f.opened, t.err, lager.Data{
+		"path":         f.path,
+		"size":         t.bytes,
+		"offset-start": t.first,
+		"offset-end":   t.last,
+	})
+}
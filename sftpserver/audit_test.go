@@ -0,0 +1,217 @@
+package sftpserver_test
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"code.cloudfoundry.org/diego-ssh/sftpserver"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/lager/lagertest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+var _ = Describe("Auditing", func() {
+	var (
+		logger *lagertest.TestLogger
+		root   string
+
+		server     *sftpserver.Server
+		client     *sftp.Client
+		serverDone chan error
+	)
+
+	auditLogs := func() []lager.LogFormat {
+		var audits []lager.LogFormat
+		for _, log := range logger.Logs() {
+			if log.Message == "test.sftp-server.audit" {
+				audits = append(audits, log)
+			}
+		}
+		return audits
+	}
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test")
+
+		var err error
+		root, err = ioutil.TempDir("", "sftp-audit")
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(ioutil.WriteFile(filepath.Join(root, "download"), []byte("0123456789"), 0644)).To(Succeed())
+
+		fs, err := sftpserver.NewOSFileSystem(logger, root)
+		Expect(err).NotTo(HaveOccurred())
+
+		serverReader, clientWriter := io.Pipe()
+		clientReader, serverWriter := io.Pipe()
+
+		server, err = sftpserver.New(logger, pipeConn{serverReader, serverWriter}, sftpserver.Options{FileSystem: fs})
+		Expect(err).NotTo(HaveOccurred())
+
+		serverDone = make(chan error, 1)
+		go func() {
+			serverDone <- server.Serve()
+			serverWriter.Close()
+		}()
+
+		client, err = sftp.NewClientPipe(clientReader, clientWriter)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		client.Close()
+		Eventually(serverDone).Should(Receive())
+		os.RemoveAll(root)
+	})
+
+	It("records the byte range that was written", func() {
+		file, err := client.Create("/upload")
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = file.Write([]byte("hello world"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(file.Close()).To(Succeed())
+
+		audits := auditLogs()
+		Expect(audits).To(HaveLen(2))
+
+		Expect(audits[0].Data).To(HaveKeyWithValue("operation", "open"))
+		Expect(audits[0].Data).To(HaveKeyWithValue("mode", "read-write"))
+		Expect(audits[0].Data).To(HaveKeyWithValue("path", "/upload"))
+		Expect(audits[0].Data).To(HaveKeyWithValue("result", "ok"))
+
+		Expect(audits[1].Data).To(HaveKeyWithValue("operation", "write"))
+		Expect(audits[1].Data).To(HaveKeyWithValue("path", "/upload"))
+		Expect(audits[1].Data).To(HaveKeyWithValue("size", float64(11)))
+		Expect(audits[1].Data).To(HaveKeyWithValue("offset-start", float64(0)))
+		Expect(audits[1].Data).To(HaveKeyWithValue("offset-end", float64(11)))
+		Expect(audits[1].Data).To(HaveKeyWithValue("result", "ok"))
+		Expect(audits[1].Data).To(HaveKey("duration"))
+	})
+
+	It("records the byte range that was read", func() {
+		file, err := client.Open("/download")
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = file.Seek(2, io.SeekStart)
+		Expect(err).NotTo(HaveOccurred())
+
+		buffer := make([]byte, 5)
+		_, err = io.ReadFull(file, buffer)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(file.Close()).To(Succeed())
+
+		audits := auditLogs()
+		Expect(audits).To(HaveLen(2))
+		Expect(audits[1].Data).To(HaveKeyWithValue("operation", "read"))
+		Expect(audits[1].Data).To(HaveKeyWithValue("offset-start", float64(2)))
+		Expect(audits[1].Data["offset-end"]).To(BeNumerically(">=", 7))
+	})
+
+	It("records file commands and their results", func() {
+		Expect(client.Mkdir("/dir")).To(Succeed())
+		Expect(client.Rename("/download", "/dir/renamed")).To(Succeed())
+		Expect(client.Chmod("/dir/renamed", 0600)).To(Succeed())
+		Expect(client.Remove("/missing")).NotTo(Succeed())
+
+		audits := auditLogs()
+		Expect(audits).To(HaveLen(4))
+
+		Expect(audits[0].Data).To(HaveKeyWithValue("operation", "mkdir"))
+		Expect(audits[0].Data).To(HaveKeyWithValue("path", "/dir"))
+
+		Expect(audits[1].Data).To(HaveKeyWithValue("operation", "rename"))
+		Expect(audits[1].Data).To(HaveKeyWithValue("path", "/download"))
+		Expect(audits[1].Data).To(HaveKeyWithValue("target", "/dir/renamed"))
+
+		Expect(audits[2].Data).To(HaveKeyWithValue("operation", "setstat"))
+		Expect(audits[2].Data).To(HaveKeyWithValue("result", "ok"))
+
+		Expect(audits[3].Data).To(HaveKeyWithValue("operation", "remove"))
+		Expect(audits[3].Data["result"]).To(ContainSubstring("no such file"))
+	})
+
+	It("summarizes the files that were transferred", func() {
+		for i := 0; i < 2; i++ {
+			file, err := client.Create("/upload")
+			Expect(err).NotTo(HaveOccurred())
+			_, err = file.Write([]byte("hello"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(file.Close()).To(Succeed())
+		}
+
+		file, err := client.Open("/download")
+		Expect(err).NotTo(HaveOccurred())
+		_, err = ioutil.ReadAll(file)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(file.Close()).To(Succeed())
+
+		Expect(server.Summary()).To(Equal(sftpserver.Summary{
+			Uploaded:   []sftpserver.Transfer{{Path: "/upload", Bytes: 10}},
+			Downloaded: []sftpserver.Transfer{{Path: "/download", Bytes: 10}},
+		}))
+	})
+
+	It("logs the summary when the client goes away", func() {
+		Expect(client.Close()).To(Succeed())
+		Eventually(logger).Should(gbytes.Say("transfer-summary"))
+	})
+
+	Describe("Summary", func() {
+		It("round trips through a request payload", func() {
+			summary := sftpserver.Summary{
+				Uploaded: []sftpserver.Transfer{{Path: "/upload", Bytes: 10}},
+			}
+
+			parsed, err := sftpserver.ParseSummary(summary.Payload())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(parsed).To(Equal(summary))
+			Expect(parsed.Empty()).To(BeFalse())
+			Expect(sftpserver.Summary{}.Empty()).To(BeTrue())
+		})
+
+		It("drops transfers that do not fit and counts them", func() {
+			summary := sftpserver.Summary{}
+			for i := 0; i < 1000; i++ {
+				summary.Uploaded = append(summary.Uploaded, sftpserver.Transfer{Path: fmt.Sprintf("/upload/%04d", i), Bytes: 1})
+			}
+
+			payload := summary.Payload()
+			Expect(len(payload)).To(BeNumerically("<=", sftpserver.MaxSummarySize))
+
+			parsed, err := sftpserver.ParseSummary(payload)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(parsed.Uploaded).To(Equal(summary.Uploaded[:len(parsed.Uploaded)]))
+			Expect(len(parsed.Uploaded) + parsed.Omitted).To(Equal(1000))
+		})
+
+		It("rejects payloads that are too large or not well formed", func() {
+			payload := func(summary string) []byte {
+				return ssh.Marshal(struct{ Summary string }{summary})
+			}
+
+			_, err := sftpserver.ParseSummary(payload(`{"uploaded": [{"path": "/upload", "bytes": 10}], "extra": true}`))
+			Expect(err).To(HaveOccurred())
+
+			_, err = sftpserver.ParseSummary(payload(`{"uploaded": [{"path": "", "bytes": 10}]}`))
+			Expect(err).To(HaveOccurred())
+
+			_, err = sftpserver.ParseSummary(payload(`{"downloaded": [{"path": "/download", "bytes": -1}]}`))
+			Expect(err).To(HaveOccurred())
+
+			_, err = sftpserver.ParseSummary(payload(`{} {}`))
+			Expect(err).To(HaveOccurred())
+
+			_, err = sftpserver.ParseSummary(payload(`{"omitted": 1, "uploaded": [{"path": "/` + strings.Repeat("a", sftpserver.MaxSummarySize) + `", "bytes": 1}]}`))
+			Expect(err).To(MatchError(ContainSubstring("exceeds")))
+		})
+	})
+})
@@ -0,0 +1,37 @@
+package sftpserver
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+// FileSystem is what the SFTP server serves to clients. Paths are the
+// cleaned, absolute, slash separated paths sent by the client, so an
+// implementation decides what they map to.
+type FileSystem interface {
+	Open(path string) (File, error)
+	OpenFile(path string, flag int, perm os.FileMode) (File, error)
+
+	Stat(path string) (os.FileInfo, error)
+	Lstat(path string) (os.FileInfo, error)
+	ReadDir(path string) ([]os.FileInfo, error)
+	Readlink(path string) (string, error)
+
+	Mkdir(path string, perm os.FileMode) error
+	Remove(path string) error
+	Rename(oldpath, newpath string) error
+	Symlink(target, link string) error
+	Link(oldpath, newpath string) error
+
+	Chmod(path string, mode os.FileMode) error
+	Chtimes(path string, atime, mtime time.Time) error
+	Chown(path string, uid, gid int) error
+	Truncate(path string, size int64) error
+}
+
+type File interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+}
@@ -0,0 +1,67 @@
+package sftpserver
+
+import (
+	"fmt"
+
+	"code.cloudfoundry.org/diego-ssh/quota"
+)
+
+// Operation names an SFTP request that changes the filesystem and can be
+// denied on its own.
+type Operation string
+
+const (
+	OperationRemove  Operation = "remove"
+	OperationRename  Operation = "rename"
+	OperationSetstat Operation = "setstat"
+	OperationSymlink Operation = "symlink"
+)
+
+var operations = []Operation{
+	OperationRemove,
+	OperationRename,
+	OperationSetstat,
+	OperationSymlink,
+}
+
+func ParseOperation(name string) (Operation, error) {
+	for _, op := range operations {
+		if string(op) == name {
+			return op, nil
+		}
+	}
+
+	return "", fmt.Errorf("unknown sftp operation %q", name)
+}
+
+// Options restrict what an SFTP client can see and change.
+type Options struct {
+	// FileSystem is served to the client. The whole file system of the
+	// container is served when nil.
+	FileSystem FileSystem
+
+	// StartDirectory is the directory that relative paths start at. A
+	// relative start directory is resolved against the default one, which
+	// is / of the file system or the working directory of the daemon when
+	// the whole file system is served.
+	StartDirectory string
+
+	// ReadOnly denies every request that writes to the filesystem.
+	ReadOnly bool
+
+	// Deny lists operations that are refused even when writes are allowed.
+	Deny []Operation
+
+	// Quota limits the files that are written in a session.
+	Quota quota.Limits
+}
+
+func (o Options) denies(op Operation) bool {
+	for _, denied := range o.Deny {
+		if denied == op {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,237 @@
+package sftpserver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.cloudfoundry.org/diego-ssh/helpers"
+	"code.cloudfoundry.org/diego-ssh/quota"
+	"code.cloudfoundry.org/lager"
+	"github.com/pkg/sftp"
+)
+
+type osFileSystem struct {
+	logger lager.Logger
+	root   string
+}
+
+// NewOSFileSystem serves the directory root as "/". Clients cannot leave it,
+// not even through symbolic links.
+func NewOSFileSystem(logger lager.Logger, root string) (FileSystem, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err = filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		return nil, &os.PathError{Op: "sftp-root", Path: root, Err: os.ErrInvalid}
+	}
+
+	return &osFileSystem{
+		logger: logger.Session("os-filesystem", lager.Data{"root": root}),
+		root:   root,
+	}, nil
+}
+
+func (fs *osFileSystem) Open(path string) (File, error) {
+	resolved, err := fs.resolve(path, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.Open(resolved)
+}
+
+func (fs *osFileSystem) OpenFile(path string, flag int, perm os.FileMode) (File, error) {
+	resolved, err := fs.resolve(path, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.OpenFile(resolved, flag, perm)
+}
+
+func (fs *osFileSystem) Stat(path string) (os.FileInfo, error) {
+	resolved, err := fs.resolve(path, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.Stat(resolved)
+}
+
+func (fs *osFileSystem) Lstat(path string) (os.FileInfo, error) {
+	resolved, err := fs.resolve(path, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.Lstat(resolved)
+}
+
+func (fs *osFileSystem) ReadDir(path string) ([]os.FileInfo, error) {
+	resolved, err := fs.resolve(path, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadDir(resolved)
+}
+
+// Readlink reports absolute targets below the root as client paths.
+func (fs *osFileSystem) Readlink(path string) (string, error) {
+	resolved, err := fs.resolve(path, false)
+	if err != nil {
+		return "", err
+	}
+
+	target, err := os.Readlink(resolved)
+	if err != nil {
+		return "", err
+	}
+
+	if filepath.IsAbs(target) {
+		if !helpers.Within(fs.root, target) {
+			return "", sftp.ErrSSHFxPermissionDenied
+		}
+		target = clientPath(fs.root, target)
+	}
+
+	return target, nil
+}
+
+func (fs *osFileSystem) Mkdir(path string, perm os.FileMode) error {
+	resolved, err := fs.resolve(path, false)
+	if err != nil {
+		return err
+	}
+
+	return os.Mkdir(resolved, perm)
+}
+
+func (fs *osFileSystem) Remove(path string) error {
+	resolved, err := fs.resolve(path, false)
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(resolved)
+}
+
+func (fs *osFileSystem) Rename(oldpath, newpath string) error {
+	source, err := fs.resolve(oldpath, false)
+	if err != nil {
+		return err
+	}
+
+	target, err := fs.resolve(newpath, false)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(source, target)
+}
+
+// Symlink stores absolute targets relative to the root.
+func (fs *osFileSystem) Symlink(target, link string) error {
+	resolved, err := fs.resolve(link, false)
+	if err != nil {
+		return err
+	}
+
+	if filepath.IsAbs(filepath.FromSlash(target)) {
+		target = filepath.Join(fs.root, filepath.FromSlash(target))
+	}
+
+	return os.Symlink(target, resolved)
+}
+
+func (fs *osFileSystem) Link(oldpath, newpath string) error {
+	source, err := fs.resolve(oldpath, true)
+	if err != nil {
+		return err
+	}
+
+	target, err := fs.resolve(newpath, false)
+	if err != nil {
+		return err
+	}
+
+	return os.Link(source, target)
+}
+
+func (fs *osFileSystem) Chmod(path string, mode os.FileMode) error {
+	resolved, err := fs.resolve(path, true)
+	if err != nil {
+		return err
+	}
+
+	return os.Chmod(resolved, mode)
+}
+
+func (fs *osFileSystem) Chtimes(path string, atime, mtime time.Time) error {
+	resolved, err := fs.resolve(path, true)
+	if err != nil {
+		return err
+	}
+
+	return os.Chtimes(resolved, atime, mtime)
+}
+
+func (fs *osFileSystem) Chown(path string, uid, gid int) error {
+	resolved, err := fs.resolve(path, true)
+	if err != nil {
+		return err
+	}
+
+	return os.Chown(resolved, uid, gid)
+}
+
+func (fs *osFileSystem) Truncate(path string, size int64) error {
+	resolved, err := fs.resolve(path, true)
+	if err != nil {
+		return err
+	}
+
+	return os.Truncate(resolved, size)
+}
+
+func (fs *osFileSystem) FreeSpace(path string) (uint64, error) {
+	resolved, err := fs.resolve(path, true)
+	if err != nil {
+		return 0, err
+	}
+
+	return quota.FreeSpace(resolved)
+}
+
+func (fs *osFileSystem) resolve(path string, followLast bool) (string, error) {
+	resolved, err := helpers.ResolveWithin(fs.root, path, followLast)
+	if err == helpers.ErrOutsideRoot {
+		fs.logger.Info("path-outside-root", lager.Data{"path": path})
+		return "", sftp.ErrSSHFxPermissionDenied
+	}
+	return resolved, err
+}
+
+// clientPath maps a path below root back to the path seen by the client.
+func clientPath(root, p string) string {
+	rel, err := filepath.Rel(root, p)
+	if err != nil || rel == "." {
+		return "/"
+	}
+
+	return "/" + filepath.ToSlash(rel)
+}
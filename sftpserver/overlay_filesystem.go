@@ -0,0 +1,312 @@
+package sftpserver
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+type mount struct {
+	path string
+	fs   FileSystem
+}
+
+type overlayFileSystem struct {
+	mounts []mount
+}
+
+// NewOverlayFileSystem serves each file system at its mount point, so that a
+// client only sees the directories it was given, for example /logs and /app.
+// The directories above the mount points are read-only and contain nothing
+// else.
+func NewOverlayFileSystem(mounts map[string]FileSystem) (FileSystem, error) {
+	overlay := &overlayFileSystem{}
+
+	for mountPoint, fs := range mounts {
+		cleaned := path.Clean("/" + mountPoint)
+		if cleaned == "/" {
+			return nil, fmt.Errorf("invalid mount point %q", mountPoint)
+		}
+		overlay.mounts = append(overlay.mounts, mount{path: cleaned, fs: fs})
+	}
+
+	// longest first, so that nested mount points win
+	sort.Slice(overlay.mounts, func(i, j int) bool {
+		return len(overlay.mounts[i].path) > len(overlay.mounts[j].path)
+	})
+
+	return overlay, nil
+}
+
+// lookup returns the file system that p is mounted on and the path within it.
+func (o *overlayFileSystem) lookup(p string) (FileSystem, string, bool) {
+	p = path.Clean("/" + p)
+	for _, m := range o.mounts {
+		if p == m.path {
+			return m.fs, "/", true
+		}
+		if strings.HasPrefix(p, m.path+"/") {
+			return m.fs, strings.TrimPrefix(p, m.path), true
+		}
+	}
+	return nil, "", false
+}
+
+// children returns the names of the entries of a directory above the mount
+// points, or false when p is not such a directory.
+func (o *overlayFileSystem) children(p string) ([]string, bool) {
+	p = path.Clean("/" + p)
+
+	prefix := p + "/"
+	if p == "/" {
+		prefix = "/"
+	}
+
+	seen := map[string]bool{}
+	var names []string
+	for _, m := range o.mounts {
+		if !strings.HasPrefix(m.path, prefix) {
+			continue
+		}
+		name := strings.SplitN(strings.TrimPrefix(m.path, prefix), "/", 2)[0]
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+
+	if len(names) == 0 && p != "/" {
+		return nil, false
+	}
+
+	sort.Strings(names)
+	return names, true
+}
+
+func (o *overlayFileSystem) Open(p string) (File, error) {
+	if fs, inner, ok := o.lookup(p); ok {
+		return fs.Open(inner)
+	}
+	return nil, o.notMounted(p)
+}
+
+func (o *overlayFileSystem) OpenFile(p string, flag int, perm os.FileMode) (File, error) {
+	if fs, inner, ok := o.lookup(p); ok {
+		return fs.OpenFile(inner, flag, perm)
+	}
+	return nil, o.notMounted(p)
+}
+
+func (o *overlayFileSystem) Stat(p string) (os.FileInfo, error) {
+	if fs, inner, ok := o.lookup(p); ok {
+		return o.rename(fs.Stat(inner))(p)
+	}
+	if _, ok := o.children(p); ok {
+		return virtualDir(path.Base(path.Clean("/" + p))), nil
+	}
+	return nil, os.ErrNotExist
+}
+
+func (o *overlayFileSystem) Lstat(p string) (os.FileInfo, error) {
+	if fs, inner, ok := o.lookup(p); ok {
+		return o.rename(fs.Lstat(inner))(p)
+	}
+	return o.Stat(p)
+}
+
+func (o *overlayFileSystem) ReadDir(p string) ([]os.FileInfo, error) {
+	if fs, inner, ok := o.lookup(p); ok {
+		return fs.ReadDir(inner)
+	}
+
+	names, ok := o.children(p)
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+
+	infos := make([]os.FileInfo, len(names))
+	for i, name := range names {
+		infos[i] = virtualDir(name)
+	}
+	return infos, nil
+}
+
+// Readlink reports absolute targets as paths of the overlay.
+func (o *overlayFileSystem) Readlink(p string) (string, error) {
+	fs, inner, ok := o.lookup(p)
+	if !ok {
+		return "", o.notMounted(p)
+	}
+
+	target, err := fs.Readlink(inner)
+	if err != nil {
+		return "", err
+	}
+
+	if path.IsAbs(target) {
+		target = path.Join(o.mountPoint(p), target)
+	}
+	return target, nil
+}
+
+func (o *overlayFileSystem) Mkdir(p string, perm os.FileMode) error {
+	if fs, inner, ok := o.lookup(p); ok {
+		return fs.Mkdir(inner, perm)
+	}
+	return o.notMounted(p)
+}
+
+func (o *overlayFileSystem) Remove(p string) error {
+	if fs, inner, ok := o.lookup(p); ok && inner != "/" {
+		return fs.Remove(inner)
+	}
+	return sftp.ErrSSHFxPermissionDenied
+}
+
+func (o *overlayFileSystem) Rename(oldpath, newpath string) error {
+	fs, oldInner, newInner, err := o.lookupPair(oldpath, newpath)
+	if err != nil {
+		return err
+	}
+	return fs.Rename(oldInner, newInner)
+}
+
+// Symlink only links within one mounted file system.
+func (o *overlayFileSystem) Symlink(target, link string) error {
+	fs, inner, ok := o.lookup(link)
+	if !ok {
+		return o.notMounted(link)
+	}
+
+	if path.IsAbs(target) {
+		targetFS, targetInner, ok := o.lookup(target)
+		if !ok || targetFS != fs {
+			return sftp.ErrSSHFxPermissionDenied
+		}
+		target = targetInner
+	}
+
+	return fs.Symlink(target, inner)
+}
+
+func (o *overlayFileSystem) Link(oldpath, newpath string) error {
+	fs, oldInner, newInner, err := o.lookupPair(oldpath, newpath)
+	if err != nil {
+		return err
+	}
+	return fs.Link(oldInner, newInner)
+}
+
+func (o *overlayFileSystem) Chmod(p string, mode os.FileMode) error {
+	if fs, inner, ok := o.lookup(p); ok {
+		return fs.Chmod(inner, mode)
+	}
+	return o.notMounted(p)
+}
+
+func (o *overlayFileSystem) Chtimes(p string, atime, mtime time.Time) error {
+	if fs, inner, ok := o.lookup(p); ok {
+		return fs.Chtimes(inner, atime, mtime)
+	}
+	return o.notMounted(p)
+}
+
+func (o *overlayFileSystem) Chown(p string, uid, gid int) error {
+	if fs, inner, ok := o.lookup(p); ok {
+		return fs.Chown(inner, uid, gid)
+	}
+	return o.notMounted(p)
+}
+
+func (o *overlayFileSystem) Truncate(p string, size int64) error {
+	if fs, inner, ok := o.lookup(p); ok {
+		return fs.Truncate(inner, size)
+	}
+	return o.notMounted(p)
+}
+
+// FreeSpace fails for file systems that cannot report their free space, so
+// that a free space floor is not silently ignored.
+func (o *overlayFileSystem) FreeSpace(p string) (uint64, error) {
+	fs, inner, ok := o.lookup(p)
+	if !ok {
+		return 0, o.notMounted(p)
+	}
+
+	spacer, ok := fs.(FreeSpacer)
+	if !ok {
+		return 0, sftp.ErrSSHFxOpUnsupported
+	}
+	return spacer.FreeSpace(inner)
+}
+
+// lookupPair resolves two paths that have to be on the same file system.
+func (o *overlayFileSystem) lookupPair(oldpath, newpath string) (FileSystem, string, string, error) {
+	oldFS, oldInner, ok := o.lookup(oldpath)
+	if !ok || oldInner == "/" {
+		return nil, "", "", sftp.ErrSSHFxPermissionDenied
+	}
+
+	newFS, newInner, ok := o.lookup(newpath)
+	if !ok || newInner == "/" || newFS != oldFS {
+		return nil, "", "", sftp.ErrSSHFxPermissionDenied
+	}
+
+	return oldFS, oldInner, newInner, nil
+}
+
+func (o *overlayFileSystem) mountPoint(p string) string {
+	p = path.Clean("/" + p)
+	for _, m := range o.mounts {
+		if p == m.path || strings.HasPrefix(p, m.path+"/") {
+			return m.path
+		}
+	}
+	return "/"
+}
+
+// notMounted is the error for changes outside of the mount points. The
+// directories above them exist but cannot be changed.
+func (o *overlayFileSystem) notMounted(p string) error {
+	if _, ok := o.children(p); ok {
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	if _, ok := o.children(path.Dir(path.Clean("/" + p))); ok {
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	return os.ErrNotExist
+}
+
+// rename gives the root of a mounted file system the name of its mount point.
+func (o *overlayFileSystem) rename(info os.FileInfo, err error) func(string) (os.FileInfo, error) {
+	return func(p string) (os.FileInfo, error) {
+		if err != nil {
+			return nil, err
+		}
+		if path.Clean("/"+p) == o.mountPoint(p) {
+			return namedFileInfo{FileInfo: info, name: path.Base(o.mountPoint(p))}, nil
+		}
+		return info, nil
+	}
+}
+
+type namedFileInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (i namedFileInfo) Name() string { return i.name }
+
+type virtualDir string
+
+func (d virtualDir) Name() string       { return string(d) }
+func (d virtualDir) Size() int64        { return 0 }
+func (d virtualDir) Mode() os.FileMode  { return os.ModeDir | 0555 }
+func (d virtualDir) ModTime() time.Time { return time.Time{} }
+func (d virtualDir) IsDir() bool        { return true }
+func (d virtualDir) Sys() interface{}   { return nil }
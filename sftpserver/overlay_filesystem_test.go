@@ -0,0 +1,149 @@
+package sftpserver_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/diego-ssh/sftpserver"
+	"code.cloudfoundry.org/lager/lagertest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/sftp"
+)
+
+var _ = Describe("OverlayFileSystem", func() {
+	var (
+		logger  *lagertest.TestLogger
+		tempDir string
+		logsDir string
+		appDir  string
+
+		overlay sftpserver.FileSystem
+	)
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test")
+
+		var err error
+		tempDir, err = ioutil.TempDir("", "sftp-overlay")
+		Expect(err).NotTo(HaveOccurred())
+
+		tempDir, err = filepath.EvalSymlinks(tempDir)
+		Expect(err).NotTo(HaveOccurred())
+
+		logsDir = filepath.Join(tempDir, "logs")
+		appDir = filepath.Join(tempDir, "app")
+		Expect(os.MkdirAll(logsDir, 0755)).To(Succeed())
+		Expect(os.MkdirAll(filepath.Join(appDir, "bin"), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(logsDir, "app.log"), []byte("log data"), 0644)).To(Succeed())
+
+		logsFS, err := sftpserver.NewOSFileSystem(logger, logsDir)
+		Expect(err).NotTo(HaveOccurred())
+
+		appFS, err := sftpserver.NewOSFileSystem(logger, appDir)
+		Expect(err).NotTo(HaveOccurred())
+
+		overlay, err = sftpserver.NewOverlayFileSystem(map[string]sftpserver.FileSystem{
+			"/logs":      logsFS,
+			"/home/vcap": appFS,
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tempDir)
+	})
+
+	names := func(infos []os.FileInfo) []string {
+		var result []string
+		for _, info := range infos {
+			result = append(result, info.Name())
+		}
+		return result
+	}
+
+	It("lists the mount points in the directories above them", func() {
+		infos, err := overlay.ReadDir("/")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(names(infos)).To(Equal([]string{"home", "logs"}))
+
+		infos, err = overlay.ReadDir("/home")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(names(infos)).To(Equal([]string{"vcap"}))
+
+		info, err := overlay.Stat("/home")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.IsDir()).To(BeTrue())
+	})
+
+	It("serves files from the mounted file systems", func() {
+		file, err := overlay.Open("/logs/app.log")
+		Expect(err).NotTo(HaveOccurred())
+		defer file.Close()
+
+		contents := make([]byte, 8)
+		_, err = file.ReadAt(contents, 0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(contents)).To(Equal("log data"))
+
+		infos, err := overlay.ReadDir("/home/vcap")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(names(infos)).To(Equal([]string{"bin"}))
+	})
+
+	It("names the mount points after their path", func() {
+		info, err := overlay.Stat("/home/vcap")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.Name()).To(Equal("vcap"))
+	})
+
+	It("reports paths that are not mounted as missing", func() {
+		_, err := overlay.Stat("/etc/passwd")
+		Expect(os.IsNotExist(err)).To(BeTrue())
+
+		_, err = overlay.Open("/etc/passwd")
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("refuses to change the directories above the mount points", func() {
+		Expect(overlay.Mkdir("/tmp", 0755)).To(Equal(sftp.ErrSSHFxPermissionDenied))
+		Expect(overlay.Remove("/logs")).To(Equal(sftp.ErrSSHFxPermissionDenied))
+		Expect(overlay.Rename("/logs", "/old-logs")).To(Equal(sftp.ErrSSHFxPermissionDenied))
+	})
+
+	It("refuses to rename or link across mount points", func() {
+		Expect(overlay.Rename("/logs/app.log", "/home/vcap/app.log")).To(Equal(sftp.ErrSSHFxPermissionDenied))
+		Expect(overlay.Link("/logs/app.log", "/home/vcap/app.log")).To(Equal(sftp.ErrSSHFxPermissionDenied))
+		Expect(overlay.Symlink("/logs/app.log", "/home/vcap/app.log")).To(Equal(sftp.ErrSSHFxPermissionDenied))
+
+		_, err := os.Stat(filepath.Join(logsDir, "app.log"))
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("renames within a mount point", func() {
+		Expect(overlay.Rename("/logs/app.log", "/logs/old.log")).To(Succeed())
+
+		_, err := os.Stat(filepath.Join(logsDir, "old.log"))
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("translates absolute symbolic link targets", func() {
+		Expect(overlay.Symlink("/logs/app.log", "/logs/current")).To(Succeed())
+
+		target, err := os.Readlink(filepath.Join(logsDir, "current"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(target).To(Equal(filepath.Join(logsDir, "app.log")))
+
+		link, err := overlay.Readlink("/logs/current")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(link).To(Equal("/logs/app.log"))
+	})
+
+	Context("when a mount point is the root", func() {
+		It("returns an error", func() {
+			_, err := sftpserver.NewOverlayFileSystem(map[string]sftpserver.FileSystem{"/": nil})
+			Expect(err).To(MatchError(`invalid mount point "/"`))
+		})
+	})
+})
@@ -0,0 +1 @@
+package sftpserver // import "code.cloudfoundry.org/diego-ssh/sftpserver"
@@ -0,0 +1,54 @@
+package sftpserver
+
+import (
+	"path"
+
+	"code.cloudfoundry.org/diego-ssh/quota"
+	"code.cloudfoundry.org/lager"
+)
+
+// FreeSpacer is implemented by file systems that can report the free space
+// of the filesystem that a path is on. The free space floor of the upload
+// limits is only enforced for them.
+type FreeSpacer interface {
+	FreeSpace(path string) (uint64, error)
+}
+
+type quotaFile struct {
+	File
+
+	handler   *requestHandler
+	path      string
+	freeSpace quota.FreeSpaceFunc
+}
+
+func (h *requestHandler) newQuotaFile(file File, p string) File {
+	if h.quota == nil {
+		return file
+	}
+
+	var freeSpace quota.FreeSpaceFunc
+	if spacer, ok := h.fs.(FreeSpacer); ok {
+		dir := path.Dir(p)
+		freeSpace = func() (uint64, error) {
+			return spacer.FreeSpace(dir)
+		}
+	}
+
+	return &quotaFile{
+		File:      file,
+		handler:   h,
+		path:      p,
+		freeSpace: freeSpace,
+	}
+}
+
+func (f *quotaFile) WriteAt(p []byte, offset int64) (int, error) {
+	err := f.handler.quota.Write(int64(len(p)), offset+int64(len(p)), f.freeSpace)
+	if err != nil {
+		f.handler.logger.Info("upload-refused", lager.Data{"path": f.path, "offset": offset, "reason": err.Error()})
+		return 0, err
+	}
+
+	return f.File.WriteAt(p, offset)
+}
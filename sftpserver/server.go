@@ -0,0 +1,349 @@
+package sftpserver
+
+import (
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/diego-ssh/quota"
+	"code.cloudfoundry.org/lager"
+	"github.com/pkg/sftp"
+)
+
+// Server is an SFTP server that audits every operation and keeps track of
+// the files that were transferred.
+type Server struct {
+	*sftp.RequestServer
+
+	handler *requestHandler
+}
+
+// New returns an SFTP server on rwc that applies options to every request.
+// When no file system is provided, the whole file system of the container is
+// served and relative paths start at the working directory of the daemon.
+func New(logger lager.Logger, rwc io.ReadWriteCloser, options Options) (*Server, error) {
+	logger = logger.Session("sftp-server")
+
+	fs := options.FileSystem
+	startDirectory := "/"
+	if fs == nil {
+		var err error
+		fs, err = NewOSFileSystem(logger, string(filepath.Separator))
+		if err != nil {
+			return nil, err
+		}
+
+		if wd, err := os.Getwd(); err == nil {
+			startDirectory = filepath.ToSlash(wd)
+		}
+	}
+
+	if options.StartDirectory != "" {
+		dir := filepath.ToSlash(options.StartDirectory)
+		if path.IsAbs(dir) {
+			startDirectory = path.Clean(dir)
+		} else {
+			startDirectory = path.Join(startDirectory, dir)
+		}
+	}
+
+	handler := &requestHandler{
+		logger:   logger,
+		fs:       fs,
+		options:  options,
+		quota:    quota.New(options.Quota),
+		transfer: newTransferLog(),
+	}
+
+	handlers := sftp.Handlers{
+		FileGet:  handler,
+		FilePut:  handler,
+		FileCmd:  handler,
+		FileList: handler,
+	}
+
+	return &Server{
+		RequestServer: sftp.NewRequestServer(rwc, handlers, sftp.WithStartDirectory(startDirectory)),
+		handler:       handler,
+	}, nil
+}
+
+// Serve handles requests until the client goes away and then logs the files
+// that were transferred.
+func (s *Server) Serve() error {
+	err := s.RequestServer.Serve()
+
+	summary := s.Summary()
+	s.handler.logger.Info("transfer-summary", lager.Data{
+		"uploaded":   summary.Uploaded,
+		"downloaded": summary.Downloaded,
+	})
+
+	return err
+}
+
+// Summary returns the files that were uploaded and downloaded so far.
+func (s *Server) Summary() Summary {
+	return s.handler.transfer.summary()
+}
+
+// requestHandler serves SFTP requests from a FileSystem. It enforces the
+// options and audits every operation.
+type requestHandler struct {
+	logger   lager.Logger
+	fs       FileSystem
+	options  Options
+	quota    *quota.Quota
+	transfer *transferLog
+}
+
+func (h *requestHandler) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	start := time.Now()
+
+	file, err := h.fs.Open(r.Filepath)
+	h.audit("open", start, err, lager.Data{"path": r.Filepath, "mode": "read"})
+	if err != nil {
+		return nil, err
+	}
+
+	return h.newAuditedFile(file, r.Filepath), nil
+}
+
+func (h *requestHandler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	file, err := h.openFile(r, os.O_WRONLY)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (h *requestHandler) OpenFile(r *sftp.Request) (sftp.WriterAtReaderAt, error) {
+	file, err := h.openFile(r, os.O_RDWR)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (h *requestHandler) openFile(r *sftp.Request, flags int) (*auditedFile, error) {
+	start := time.Now()
+
+	mode := "write"
+	if flags&os.O_RDWR != 0 {
+		mode = "read-write"
+	}
+
+	file, err := h.openWrite(r, flags)
+	h.audit("open", start, err, lager.Data{"path": r.Filepath, "mode": mode})
+	if err != nil {
+		return nil, err
+	}
+
+	return h.newAuditedFile(h.newQuotaFile(file, r.Filepath), r.Filepath), nil
+}
+
+func (h *requestHandler) openWrite(r *sftp.Request, flags int) (File, error) {
+	if err := h.allow(r, ""); err != nil {
+		return nil, err
+	}
+
+	pflags := r.Pflags()
+	if pflags.Append {
+		flags |= os.O_APPEND
+	}
+	if pflags.Creat {
+		flags |= os.O_CREATE
+	}
+	if pflags.Trunc {
+		flags |= os.O_TRUNC
+	}
+	if pflags.Excl {
+		flags |= os.O_EXCL
+	}
+
+	return h.fs.OpenFile(r.Filepath, flags, 0644)
+}
+
+func (h *requestHandler) Filecmd(r *sftp.Request) error {
+	start := time.Now()
+	err := h.filecmd(r)
+
+	data := lager.Data{"path": r.Filepath}
+	if r.Target != "" {
+		data["target"] = r.Target
+	}
+	h.audit(operationName(r.Method), start, err, data)
+
+	return err
+}
+
+func (h *requestHandler) filecmd(r *sftp.Request) error {
+	switch r.Method {
+	case "Setstat":
+		return h.setstat(r)
+	case "Rename", "PosixRename":
+		if err := h.allow(r, OperationRename); err != nil {
+			return err
+		}
+		return h.fs.Rename(r.Filepath, r.Target)
+	case "Remove", "Rmdir":
+		return h.remove(r)
+	case "Mkdir":
+		if err := h.allow(r, ""); err != nil {
+			return err
+		}
+		return h.fs.Mkdir(r.Filepath, 0755)
+	case "Symlink":
+		if err := h.allow(r, OperationSymlink); err != nil {
+			return err
+		}
+		return h.fs.Symlink(r.Filepath, r.Target)
+	case "Link":
+		if err := h.allow(r, OperationSymlink); err != nil {
+			return err
+		}
+		return h.fs.Link(r.Filepath, r.Target)
+	}
+
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+func (h *requestHandler) PosixRename(r *sftp.Request) error {
+	return h.Filecmd(r)
+}
+
+func (h *requestHandler) setstat(r *sftp.Request) error {
+	if err := h.allow(r, OperationSetstat); err != nil {
+		return err
+	}
+
+	flags := r.AttrFlags()
+	attrs := r.Attributes()
+
+	if flags.Size {
+		if err := h.fs.Truncate(r.Filepath, int64(attrs.Size)); err != nil {
+			return err
+		}
+	}
+	if flags.Permissions {
+		if err := h.fs.Chmod(r.Filepath, attrs.FileMode()); err != nil {
+			return err
+		}
+	}
+	if flags.Acmodtime {
+		if err := h.fs.Chtimes(r.Filepath, time.Unix(int64(attrs.Atime), 0), time.Unix(int64(attrs.Mtime), 0)); err != nil {
+			return err
+		}
+	}
+	if flags.UidGid {
+		if err := h.fs.Chown(r.Filepath, int(attrs.UID), int(attrs.GID)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (h *requestHandler) remove(r *sftp.Request) error {
+	if err := h.allow(r, OperationRemove); err != nil {
+		return err
+	}
+
+	info, err := h.fs.Lstat(r.Filepath)
+	if err != nil {
+		return err
+	}
+
+	if (r.Method == "Rmdir") != info.IsDir() {
+		return sftp.ErrSSHFxFailure
+	}
+
+	return h.fs.Remove(r.Filepath)
+}
+
+func (h *requestHandler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	switch r.Method {
+	case "List":
+		infos, err := h.fs.ReadDir(r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		return listerAt(infos), nil
+
+	case "Stat":
+		info, err := h.fs.Stat(r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		return listerAt{info}, nil
+
+	case "Readlink":
+		target, err := h.fs.Readlink(r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		return listerAt{linkTarget(target)}, nil
+	}
+
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+func (h *requestHandler) Lstat(r *sftp.Request) (sftp.ListerAt, error) {
+	info, err := h.fs.Lstat(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	return listerAt{info}, nil
+}
+
+// allow refuses writes in read-only mode and operations that are denied.
+// Plain writes pass an empty op.
+func (h *requestHandler) allow(r *sftp.Request, op Operation) error {
+	if h.options.ReadOnly || (op != "" && h.options.denies(op)) {
+		h.logger.Info("operation-denied", lager.Data{"method": r.Method, "path": r.Filepath})
+		return sftp.ErrSSHFxPermissionDenied
+	}
+
+	return nil
+}
+
+type listerAt []os.FileInfo
+
+func (l listerAt) ListAt(infos []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+
+	n := copy(infos, l[offset:])
+	if n < len(infos) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// linkTarget carries the target of a symbolic link as its name, which is how
+// the request server expects readlink results.
+type linkTarget string
+
+func (t linkTarget) Name() string       { return string(t) }
+func (t linkTarget) Size() int64        { return 0 }
+func (t linkTarget) Mode() os.FileMode  { return os.ModeSymlink }
+func (t linkTarget) ModTime() time.Time { return time.Time{} }
+func (t linkTarget) IsDir() bool        { return false }
+func (t linkTarget) Sys() interface{}   { return nil }
+
+func operationName(method string) string {
+	switch method {
+	case "Rename", "PosixRename":
+		return string(OperationRename)
+	case "Remove", "Rmdir":
+		return string(OperationRemove)
+	case "Symlink", "Link":
+		return string(OperationSymlink)
+	}
+
+	return strings.ToLower(method)
+}
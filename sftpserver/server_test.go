@@ -0,0 +1,334 @@
+package sftpserver_test
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/diego-ssh/quota"
+	"code.cloudfoundry.org/diego-ssh/sftpserver"
+	"code.cloudfoundry.org/lager/lagertest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"github.com/pkg/sftp"
+)
+
+type pipeConn struct {
+	io.Reader
+	io.WriteCloser
+}
+
+var _ = Describe("Server", func() {
+	var (
+		logger  *lagertest.TestLogger
+		tempDir string
+		root    string
+		options sftpserver.Options
+
+		client     *sftp.Client
+		serverDone chan error
+	)
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test")
+
+		var err error
+		tempDir, err = ioutil.TempDir("", "sftp-server")
+		Expect(err).NotTo(HaveOccurred())
+
+		tempDir, err = filepath.EvalSymlinks(tempDir)
+		Expect(err).NotTo(HaveOccurred())
+
+		root = filepath.Join(tempDir, "root")
+		Expect(os.MkdirAll(filepath.Join(root, "logs"), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(root, "logs", "app.log"), []byte("log data"), 0644)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(tempDir, "secret"), []byte("secret data"), 0644)).To(Succeed())
+
+		fs, err := sftpserver.NewOSFileSystem(logger, root)
+		Expect(err).NotTo(HaveOccurred())
+
+		options = sftpserver.Options{FileSystem: fs}
+	})
+
+	JustBeforeEach(func() {
+		serverReader, clientWriter := io.Pipe()
+		clientReader, serverWriter := io.Pipe()
+
+		server, err := sftpserver.New(logger, pipeConn{serverReader, serverWriter}, options)
+		Expect(err).NotTo(HaveOccurred())
+
+		serverDone = make(chan error, 1)
+		go func() {
+			serverDone <- server.Serve()
+			serverWriter.Close()
+		}()
+
+		client, err = sftp.NewClientPipe(clientReader, clientWriter)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		client.Close()
+		Eventually(serverDone).Should(Receive())
+		os.RemoveAll(tempDir)
+	})
+
+	readFile := func(path string) (string, error) {
+		file, err := client.Open(path)
+		if err != nil {
+			return "", err
+		}
+		defer file.Close()
+
+		contents, err := ioutil.ReadAll(file)
+		return string(contents), err
+	}
+
+	writeFile := func(path, contents string) error {
+		file, err := client.Create(path)
+		if err != nil {
+			return err
+		}
+
+		_, err = file.Write([]byte(contents))
+		if err != nil {
+			file.Close()
+			return err
+		}
+		return file.Close()
+	}
+
+	Context("when a root directory is configured", func() {
+		It("serves the root directory as /", func() {
+			contents, err := readFile("/logs/app.log")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(contents).To(Equal("log data"))
+
+			infos, err := client.ReadDir("/")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(infos).To(HaveLen(1))
+			Expect(infos[0].Name()).To(Equal("logs"))
+		})
+
+		It("resolves relative paths against the root", func() {
+			contents, err := readFile("logs/app.log")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(contents).To(Equal("log data"))
+
+			wd, err := client.Getwd()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(wd).To(Equal("/"))
+		})
+
+		Context("when a start directory is configured", func() {
+			BeforeEach(func() {
+				options.StartDirectory = "logs"
+			})
+
+			It("resolves relative paths against the start directory", func() {
+				contents, err := readFile("app.log")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(contents).To(Equal("log data"))
+
+				wd, err := client.Getwd()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(wd).To(Equal("/logs"))
+			})
+		})
+
+		It("does not let .. leave the root", func() {
+			_, err := readFile("/../secret")
+			Expect(err).To(HaveOccurred())
+
+			contents, err := readFile("/../logs/app.log")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(contents).To(Equal("log data"))
+		})
+
+		It("writes files below the root", func() {
+			Expect(writeFile("/logs/new.log", "new data")).To(Succeed())
+
+			contents, err := ioutil.ReadFile(filepath.Join(root, "logs", "new.log"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(contents)).To(Equal("new data"))
+		})
+
+		Context("when a symbolic link points outside of the root", func() {
+			BeforeEach(func() {
+				Expect(os.Symlink(filepath.Join(tempDir, "secret"), filepath.Join(root, "absolute"))).To(Succeed())
+				Expect(os.Symlink("../../secret", filepath.Join(root, "logs", "relative"))).To(Succeed())
+				Expect(os.Symlink(tempDir, filepath.Join(root, "outside"))).To(Succeed())
+			})
+
+			It("refuses to follow absolute links", func() {
+				_, err := readFile("/absolute")
+				Expect(err).To(MatchError(ContainSubstring("permission denied")))
+				Expect(logger).To(gbytes.Say("path-outside-root"))
+			})
+
+			It("resolves relative links within the root", func() {
+				_, err := readFile("/logs/relative")
+				Expect(err).To(HaveOccurred())
+				Expect(err).NotTo(MatchError(ContainSubstring("secret data")))
+			})
+
+			It("refuses to create files through the link", func() {
+				err := writeFile("/outside/created", "data")
+				Expect(err).To(HaveOccurred())
+
+				_, err = os.Stat(filepath.Join(tempDir, "created"))
+				Expect(os.IsNotExist(err)).To(BeTrue())
+			})
+
+			It("refuses to list through the link", func() {
+				_, err := client.ReadDir("/outside")
+				Expect(err).To(HaveOccurred())
+			})
+
+			It("still reports the link itself", func() {
+				info, err := client.Lstat("/absolute")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(info.Mode() & os.ModeSymlink).NotTo(BeZero())
+			})
+		})
+
+		Context("when a dangling link points outside of the root", func() {
+			BeforeEach(func() {
+				Expect(os.Symlink(filepath.Join(tempDir, "created"), filepath.Join(root, "dangling"))).To(Succeed())
+			})
+
+			It("refuses to create its target", func() {
+				err := writeFile("/dangling", "data")
+				Expect(err).To(HaveOccurred())
+
+				_, err = os.Stat(filepath.Join(tempDir, "created"))
+				Expect(os.IsNotExist(err)).To(BeTrue())
+			})
+		})
+
+		Context("when a symbolic link points inside of the root", func() {
+			BeforeEach(func() {
+				Expect(os.Symlink(filepath.Join(root, "logs"), filepath.Join(root, "current"))).To(Succeed())
+			})
+
+			It("follows it", func() {
+				contents, err := readFile("/current/app.log")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(contents).To(Equal("log data"))
+			})
+
+			It("reports the target as a client path", func() {
+				target, err := client.ReadLink("/current")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(target).To(Equal("/logs"))
+			})
+		})
+
+		It("creates symbolic links relative to the root", func() {
+			Expect(client.Symlink("/logs/app.log", "/link")).To(Succeed())
+
+			contents, err := readFile("/link")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(contents).To(Equal("log data"))
+
+			target, err := os.Readlink(filepath.Join(root, "link"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(target).To(Equal(filepath.Join(root, "logs", "app.log")))
+		})
+	})
+
+	Context("when the root directory does not exist", func() {
+		It("fails to create the file system", func() {
+			_, err := sftpserver.NewOSFileSystem(logger, filepath.Join(tempDir, "missing"))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("when the server is read-only", func() {
+		BeforeEach(func() {
+			options.ReadOnly = true
+		})
+
+		It("serves files", func() {
+			contents, err := readFile("/logs/app.log")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(contents).To(Equal("log data"))
+
+			_, err = client.Stat("/logs")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("refuses every write", func() {
+			Expect(writeFile("/logs/new.log", "data")).To(MatchError(ContainSubstring("permission denied")))
+			Expect(client.Mkdir("/new")).NotTo(Succeed())
+			Expect(client.Remove("/logs/app.log")).NotTo(Succeed())
+			Expect(client.Rename("/logs/app.log", "/logs/old.log")).NotTo(Succeed())
+			Expect(client.Chmod("/logs/app.log", 0600)).NotTo(Succeed())
+			Expect(client.Symlink("/logs/app.log", "/link")).NotTo(Succeed())
+
+			Expect(logger).To(gbytes.Say("operation-denied"))
+
+			_, err := os.Stat(filepath.Join(root, "logs", "app.log"))
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+
+	Context("when operations are denied", func() {
+		BeforeEach(func() {
+			options.Deny = []sftpserver.Operation{sftpserver.OperationRemove, sftpserver.OperationSetstat}
+		})
+
+		It("refuses the denied operations", func() {
+			Expect(client.Remove("/logs/app.log")).To(MatchError(ContainSubstring("permission denied")))
+			Expect(client.Chmod("/logs/app.log", 0600)).To(MatchError(ContainSubstring("permission denied")))
+		})
+
+		It("allows the others", func() {
+			Expect(writeFile("/logs/new.log", "data")).To(Succeed())
+			Expect(client.Rename("/logs/new.log", "/logs/renamed.log")).To(Succeed())
+			Expect(client.Mkdir("/new")).To(Succeed())
+
+			_, err := os.Stat(filepath.Join(root, "logs", "renamed.log"))
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+
+	Context("when upload limits are configured", func() {
+		BeforeEach(func() {
+			options.Quota = quota.Limits{MaxFileSize: 8, MaxSessionSize: 12}
+		})
+
+		It("writes files within the limits", func() {
+			Expect(writeFile("/logs/new.log", "data")).To(Succeed())
+
+			contents, err := ioutil.ReadFile(filepath.Join(root, "logs", "new.log"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(contents)).To(Equal("data"))
+		})
+
+		It("refuses a file that is too large", func() {
+			Expect(writeFile("/logs/new.log", "too much data")).To(MatchError(ContainSubstring("upload size limit")))
+			Expect(logger).To(gbytes.Say("upload-refused"))
+		})
+
+		It("refuses writes once the session quota is used up", func() {
+			Expect(writeFile("/logs/one.log", "12345678")).To(Succeed())
+			Expect(writeFile("/logs/two.log", "12345678")).To(MatchError(ContainSubstring("upload quota")))
+		})
+	})
+
+	Describe("ParseOperation", func() {
+		It("parses known operations", func() {
+			op, err := sftpserver.ParseOperation("rename")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(op).To(Equal(sftpserver.OperationRename))
+		})
+
+		It("rejects unknown operations", func() {
+			_, err := sftpserver.ParseOperation("chown")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,13 @@
+package sftpserver_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestSftpserver(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "SFTP Server Suite")
+}
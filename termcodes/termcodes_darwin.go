@@ -5,6 +5,7 @@ package termcodes
 import (
 	"os"
 	"syscall"
+	"time"
 	"unsafe"
 )
 
@@ -43,3 +44,25 @@ func GetAttr(tty *os.File) (*syscall.Termios, error) {
 
 	return termios, nil
 }
+
+// SendBreak asserts a break condition on the terminal for the given
+// duration. A zero duration sends a break of the default length.
+func SendBreak(tty *os.File, duration time.Duration) error {
+	if duration == 0 {
+		duration = 400 * time.Millisecond
+	}
+
+	r, _, e := syscall.Syscall(syscall.SYS_IOCTL, tty.Fd(), syscall.TIOCSBRK, 0)
+	if r != 0 {
+		return os.NewSyscallError("SYS_IOCTL", e)
+	}
+
+	time.Sleep(duration)
+
+	r, _, e = syscall.Syscall(syscall.SYS_IOCTL, tty.Fd(), syscall.TIOCCBRK, 0)
+	if r != 0 {
+		return os.NewSyscallError("SYS_IOCTL", e)
+	}
+
+	return nil
+}
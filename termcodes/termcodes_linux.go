@@ -5,7 +5,10 @@ package termcodes
 import (
 	"os"
 	"syscall"
+	"time"
 	"unsafe"
+
+	"golang.org/x/sys/unix"
 )
 
 type iflagSetter struct {
@@ -43,3 +46,17 @@ func GetAttr(tty *os.File) (*syscall.Termios, error) {
 
 	return termios, nil
 }
+
+// SendBreak asserts a break condition on the terminal for roughly the given
+// duration, rounded to tenths of a second. A zero duration sends a break of
+// the default length.
+func SendBreak(tty *os.File, duration time.Duration) error {
+	deciseconds := uintptr(duration / (100 * time.Millisecond))
+
+	r, _, e := syscall.Syscall(syscall.SYS_IOCTL, tty.Fd(), unix.TCSBRKP, deciseconds)
+	if r != 0 {
+		return os.NewSyscallError("SYS_IOCTL", e)
+	}
+
+	return nil
+}